@@ -0,0 +1,307 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"art/pkg/db"
+	"art/pkg/diff"
+	"art/pkg/overlay"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	diffFormat  string
+	diffUnified bool
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "Show what the agent changed versus the host workspace",
+	Long: `Compares the workspace as the agent sees it (host files overlaid with
+the database) against the host workspace directory, and lists added (A),
+modified (M), deleted (D) and mode-changed (m) paths.
+
+Formats:
+  text   one line per change; --unified adds unified diffs of text files
+  json   an array of changes; --unified adds a "diff" field
+  patch  a git-style patch that can be applied with 'git apply' inside
+         the workspace directory (directories and special files such as
+         FIFOs and devices are not included)`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if dbPath == "" {
+			fmt.Println("Error: --db flag is required")
+			os.Exit(1)
+		}
+		switch diffFormat {
+		case "text", "json", "patch":
+		default:
+			fmt.Printf("Error: invalid format %q (want text, json or patch)\n", diffFormat)
+			os.Exit(1)
+		}
+		if err := runDiff(os.Stdout, dbPath, mountDir, diffFormat, diffUnified); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	diffCmd.Flags().StringVar(&diffFormat, "format", "text", "Output format: text, json or patch")
+	diffCmd.Flags().BoolVarP(&diffUnified, "unified", "u", false, "Include unified diffs of text files (text and json formats)")
+	RootCmd.AddCommand(diffCmd)
+}
+
+func runDiff(w io.Writer, dbPath, workspaceDir, format string, unified bool) error {
+	absWorkspaceDir, err := filepath.Abs(workspaceDir)
+	if err != nil {
+		return fmt.Errorf("cannot resolve workspace directory: %w", err)
+	}
+	workspaceName := filepath.Base(absWorkspaceDir)
+
+	store, err := db.Open(db.DefaultConfig(dbPath))
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer store.Close()
+
+	hostfs, err := overlay.NewHostFS(absWorkspaceDir)
+	if err != nil {
+		return fmt.Errorf("failed to create host filesystem: %w", err)
+	}
+	agentfs, err := overlay.NewAgentFS(store)
+	if err != nil {
+		return fmt.Errorf("failed to create agent filesystem: %w", err)
+	}
+	overlayfs, err := overlay.NewOverlayFS(hostfs, agentfs, overlay.WithWorkspaceName(workspaceName))
+	if err != nil {
+		return fmt.Errorf("failed to create overlay filesystem: %w", err)
+	}
+
+	ctx := context.Background()
+	changes, err := overlayfs.Diff(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to compute diff: %w", err)
+	}
+
+	d := &differ{ctx: ctx, host: hostfs, overlay: overlayfs, workspace: "/" + workspaceName, warn: os.Stderr}
+	switch format {
+	case "json":
+		type jsonChange struct {
+			overlay.Change
+			Diff string `json:"diff,omitempty"`
+		}
+		out := make([]jsonChange, 0, len(changes))
+		for _, c := range changes {
+			jc := jsonChange{Change: c}
+			if unified {
+				var buf bytes.Buffer
+				if err := d.writeContentDiff(&buf, c); err != nil {
+					return err
+				}
+				jc.Diff = buf.String()
+			}
+			out = append(out, jc)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+
+	case "patch":
+		for _, c := range changes {
+			if err := d.writePatch(w, c); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		for _, c := range changes {
+			writeChangeLine(w, c)
+			if unified {
+				if err := d.writeContentDiff(w, c); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// writeChangeLine writes the one-line text summary of a change
+func writeChangeLine(w io.Writer, c overlay.Change) {
+	path := c.Path
+	if c.IsDir() {
+		path += "/"
+	}
+	switch c.Kind {
+	case overlay.ChangeAdded:
+		fmt.Fprintf(w, "A %s\n", path)
+	case overlay.ChangeDeleted:
+		fmt.Fprintf(w, "D %s\n", path)
+	case overlay.ChangeModified:
+		if c.OldMode&0o7777 != c.NewMode&0o7777 {
+			fmt.Fprintf(w, "M %s (%04o -> %04o)\n", path, c.OldMode&0o7777, c.NewMode&0o7777)
+		} else {
+			fmt.Fprintf(w, "M %s\n", path)
+		}
+	case overlay.ChangeMode:
+		fmt.Fprintf(w, "m %s (%04o -> %04o)\n", path, c.OldMode&0o7777, c.NewMode&0o7777)
+	}
+}
+
+// differ renders file contents of changes from the host and overlay views
+type differ struct {
+	ctx       context.Context
+	host      overlay.FileSystem
+	overlay   overlay.FileSystem
+	workspace string    // Workspace path in the overlay
+	warn      io.Writer // Where to report changes left out of patches
+}
+
+// contents returns the old and new contents of a changed file; symlinks
+// are represented by their target, as git does
+func (d *differ) contents(c overlay.Change) (old, new []byte, err error) {
+	read := func(fs overlay.FileSystem, path string, mode uint32) ([]byte, error) {
+		switch mode & overlay.S_IFMT {
+		case overlay.S_IFREG:
+			return overlay.ReadFile(d.ctx, fs, path)
+		case overlay.S_IFLNK:
+			target, err := fs.Readlink(d.ctx, path)
+			return []byte(target), err
+		}
+		return nil, nil
+	}
+	if c.OldMode != 0 {
+		if old, err = read(d.host, "/"+c.Path, c.OldMode); err != nil {
+			return nil, nil, err
+		}
+	}
+	if c.NewMode != 0 {
+		if new, err = read(d.overlay, d.workspace+"/"+c.Path, c.NewMode); err != nil {
+			return nil, nil, err
+		}
+	}
+	return old, new, nil
+}
+
+// hasContent returns true for changes that carry file contents
+func hasContent(c overlay.Change) bool {
+	return c.Kind != overlay.ChangeMode && !c.IsDir()
+}
+
+// writeContentDiff writes a unified diff of a changed file's contents
+func (d *differ) writeContentDiff(w io.Writer, c overlay.Change) error {
+	if !hasContent(c) {
+		return nil
+	}
+	old, new, err := d.contents(c)
+	if err != nil {
+		return err
+	}
+	oldName, newName := "a/"+c.Path, "b/"+c.Path
+	if c.Kind == overlay.ChangeAdded {
+		oldName = "/dev/null"
+	}
+	if c.Kind == overlay.ChangeDeleted {
+		newName = "/dev/null"
+	}
+	writeHunks(w, oldName, newName, old, new)
+	return nil
+}
+
+// writePatch writes a change as a git-style patch. Directories are skipped
+// since git doesn't track them, and special files since git can't.
+func (d *differ) writePatch(w io.Writer, c overlay.Change) error {
+	if c.IsDir() {
+		return nil
+	}
+	oldMode, newMode := gitMode(c.OldMode), gitMode(c.NewMode)
+	if (c.OldMode != 0 && oldMode == 0) || (c.NewMode != 0 && newMode == 0) {
+		fmt.Fprintf(d.warn, "Warning: leaving %s out of the patch: git can't represent special files\n", c.Path)
+		return nil
+	}
+	if c.Kind == overlay.ChangeMode && oldMode == newMode {
+		return nil // Not representable in git
+	}
+
+	fmt.Fprintf(w, "diff --git a/%s b/%s\n", c.Path, c.Path)
+	oldName, newName := "a/"+c.Path, "b/"+c.Path
+	switch c.Kind {
+	case overlay.ChangeAdded:
+		fmt.Fprintf(w, "new file mode %06o\n", newMode)
+		oldName = "/dev/null"
+	case overlay.ChangeDeleted:
+		fmt.Fprintf(w, "deleted file mode %06o\n", oldMode)
+		newName = "/dev/null"
+	default:
+		if oldMode != newMode {
+			fmt.Fprintf(w, "old mode %06o\nnew mode %06o\n", oldMode, newMode)
+		}
+	}
+	if !hasContent(c) {
+		return nil
+	}
+
+	old, new, err := d.contents(c)
+	if err != nil {
+		return err
+	}
+	if (isBinary(old) || isBinary(new)) && !bytes.Equal(old, new) {
+		// git apply only takes binary patches with full object names
+		oldHash, newHash := diff.BlobHash(old), diff.BlobHash(new)
+		if c.Kind == overlay.ChangeAdded {
+			oldHash = diff.ZeroHash
+		}
+		if c.Kind == overlay.ChangeDeleted {
+			newHash = diff.ZeroHash
+		}
+		fmt.Fprintf(w, "index %s..%s\n", oldHash, newHash)
+		io.WriteString(w, diff.Binary(old, new))
+		return nil
+	}
+	writeHunks(w, oldName, newName, old, new)
+	return nil
+}
+
+// writeHunks writes the ---/+++ headers and hunks of a content diff
+func writeHunks(w io.Writer, oldName, newName string, old, new []byte) {
+	if bytes.Equal(old, new) {
+		return
+	}
+	if isBinary(old) || isBinary(new) {
+		fmt.Fprintf(w, "Binary files %s and %s differ\n", oldName, newName)
+		return
+	}
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", oldName, newName)
+	io.WriteString(w, diff.Unified(string(old), string(new), 3))
+}
+
+// gitMode maps a file mode to one of the modes git records, or 0 for
+// files git can't record
+func gitMode(mode uint32) uint32 {
+	switch mode & overlay.S_IFMT {
+	case overlay.S_IFLNK:
+		return 0o120000
+	case overlay.S_IFREG:
+		if mode&0o111 != 0 {
+			return 0o100755
+		}
+		return 0o100644
+	}
+	return 0
+}
+
+// isBinary uses git's heuristic: a NUL byte in the first 8000 bytes
+func isBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
@@ -0,0 +1,207 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"art/pkg/db"
+	artfs "art/pkg/fs"
+	"art/pkg/overlay"
+	"art/pkg/supervisor"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	mountReadOnly bool
+	mountSnapshot string
+)
+
+var mountCmd = &cobra.Command{
+	Use:   "mount <mountpoint>",
+	Short: "Mount the database on the host",
+	Long: `Serves the database as a filesystem at the mount point, in the foreground
+until interrupted (Ctrl-C), so an agent's home can be inspected with normal
+host tools without starting a sandbox.
+
+Without -m, the mount shows the database alone, which is refused if
+files in it still read part of their contents from the host workspace.
+With -m, it shows the overlay the agent sees: the host workspace directory at /<workspace-name>/
+with the database on top, as in a sandbox session. Changes made through
+the mount are stored in the database unless --read-only is given.
+
+With --snapshot, the named snapshot is copied to a temporary database and
+mounted read-only instead of the live tree. Do not mount the database
+while a sandbox session is using it.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if dbPath == "" {
+			fmt.Println("Error: --db flag is required")
+			os.Exit(1)
+		}
+		if dbPath == supervisor.MemoryDB {
+			fmt.Printf("Error: --db %s has nothing to mount\n", supervisor.MemoryDB)
+			os.Exit(1)
+		}
+
+		opts := mountOptions{readOnly: mountReadOnly, snapshot: mountSnapshot}
+		if cmd.Flags().Changed("mount") {
+			opts.workspace = mountDir
+		}
+		if err := runMount(dbPath, args[0], opts); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	mountCmd.Flags().BoolVar(&mountReadOnly, "read-only", false, "Refuse all changes through the mount")
+	mountCmd.Flags().StringVar(&mountSnapshot, "snapshot", "", "Mount this snapshot (read-only) instead of the live tree")
+	RootCmd.AddCommand(mountCmd)
+}
+
+// mountOptions controls what runMount serves
+type mountOptions struct {
+	workspace string // Host workspace to overlay, or "" for the database alone
+	readOnly  bool   // Refuse changes
+	snapshot  string // Snapshot to serve instead of the live tree
+}
+
+// mounter is a mounted filesystem, of the database or the overlay
+type mounter interface {
+	Unmount() error
+	Wait()
+}
+
+func runMount(dbPath, mountPoint string, opts mountOptions) error {
+	absMountPoint, err := filepath.Abs(mountPoint)
+	if err != nil {
+		return fmt.Errorf("cannot resolve mount point: %w", err)
+	}
+	if info, err := os.Stat(absMountPoint); err != nil || !info.IsDir() {
+		return fmt.Errorf("mount point %s is not a directory", absMountPoint)
+	}
+	// db.Open would create a missing database
+	if _, err := os.Stat(dbPath); err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+
+	ctx := context.Background()
+	store, err := db.Open(db.DefaultConfig(dbPath))
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+
+	if opts.snapshot != "" {
+		// Snapshots are only readable as a live tree, so serve a copy
+		tmpDir, err := os.MkdirTemp("", "art-snapshot-*")
+		if err != nil {
+			store.Close()
+			return fmt.Errorf("failed to create temp directory: %w", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		forkPath := filepath.Join(tmpDir, "snapshot.db")
+		err = store.ForkSnapshot(ctx, opts.snapshot, forkPath)
+		store.Close()
+		if err != nil {
+			return fmt.Errorf("failed to copy snapshot %q: %w", opts.snapshot, err)
+		}
+		store, err = db.Open(db.DefaultConfig(forkPath))
+		if err != nil {
+			return fmt.Errorf("failed to open snapshot copy: %w", err)
+		}
+		opts.readOnly = true
+	}
+	defer store.Close()
+
+	if opts.workspace == "" {
+		// Files copied up lazily or for their metadata read the rest of
+		// their contents from the host workspace, which only the overlay has
+		lowers, err := store.ListLowers(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list partial copy-ups: %w", err)
+		}
+		if len(lowers) > 0 {
+			return fmt.Errorf("%d files in the database read part of their contents from the host workspace (e.g. %s); mount it with -m <workspace-dir>",
+				len(lowers), lowers[0].Path)
+		}
+	}
+
+	if !opts.readOnly {
+		// Lets `art pull` tell host edits made meanwhile apart
+		if err := store.BeginSession(ctx); err != nil {
+			return fmt.Errorf("failed to record session start: %w", err)
+		}
+	}
+
+	var m mounter
+	if opts.workspace == "" {
+		m, err = artfs.Mount(absMountPoint, store, opts.readOnly)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Mounted %s at %s\n", dbPath, absMountPoint)
+	} else {
+		absWorkspaceDir, err := filepath.Abs(opts.workspace)
+		if err != nil {
+			return fmt.Errorf("cannot resolve workspace directory: %w", err)
+		}
+		workspaceName := filepath.Base(absWorkspaceDir)
+
+		hostfs, err := overlay.NewHostFS(absWorkspaceDir)
+		if err != nil {
+			return fmt.Errorf("failed to create host filesystem: %w", err)
+		}
+		agentfs, err := overlay.NewAgentFS(store)
+		if err != nil {
+			return fmt.Errorf("failed to create agent filesystem: %w", err)
+		}
+		overlayfs, err := overlay.NewOverlayFS(hostfs, agentfs,
+			overlay.WithWorkspaceName(workspaceName),
+			overlay.WithMountPoint(supervisor.GuestHome))
+		if err != nil {
+			return fmt.Errorf("failed to create overlay filesystem: %w", err)
+		}
+
+		var mountOpts []artfs.OverlayMountOption
+		if opts.readOnly {
+			mountOpts = append(mountOpts, artfs.WithReadOnly())
+		}
+		m, err = artfs.MountOverlay(absMountPoint, overlayfs, mountOpts...)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Mounted %s over %s at %s\n", dbPath, absWorkspaceDir, absMountPoint)
+		fmt.Printf("Host workspace: %s -> %s\n", absWorkspaceDir, filepath.Join(absMountPoint, workspaceName))
+	}
+	if opts.snapshot != "" {
+		fmt.Printf("Snapshot: %s\n", opts.snapshot)
+	}
+	if opts.readOnly {
+		fmt.Println("Read-only")
+	}
+	fmt.Println("Press Ctrl-C to unmount")
+
+	// Unmounting fails while the mount is in use; stay mounted and let the
+	// user try again
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		for range sigs {
+			if err := m.Unmount(); err != nil {
+				fmt.Printf("failed to unmount %s: %v\n", absMountPoint, err)
+			}
+		}
+	}()
+
+	m.Wait()
+	fmt.Println("Unmounted")
+	return nil
+}
@@ -3,26 +3,42 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
 
 	"art/pkg/db"
+	"art/pkg/overlay"
 
 	"github.com/spf13/cobra"
 )
 
+var (
+	pullDryRun bool
+	pullPrune  bool
+	pullForce  bool
+)
+
 var pullCmd = &cobra.Command{
 	Use:   "pull",
 	Short: "Pull files from SQLite database to workspace",
 	Long: `Pulls files from the SQLite database to the workspace directory.
 Only exports the workspace subdirectory (/<workspace-name>/) contents to the host.
-The workspace name is derived from the mount directory basename.`,
+The workspace name is derived from the mount directory basename.
+
+Directories the agent renamed are moved on the host first. Then paths the
+agent deleted or renamed away (whiteouts) are deleted on the host. Host files
+modified since the sandbox session started are not deleted unless --force is
+given; the pull is refused before anything is changed.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if dbPath == "" {
 			fmt.Println("Error: --db flag is required")
 			os.Exit(1)
 		}
-		if err := runPull(dbPath, mountDir); err != nil {
+		if err := runPull(dbPath, mountDir, pullOptions{dryRun: pullDryRun, prune: pullPrune, force: pullForce}); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
@@ -30,10 +46,20 @@ The workspace name is derived from the mount directory basename.`,
 }
 
 func init() {
+	pullCmd.Flags().BoolVarP(&pullDryRun, "dry-run", "n", false, "Show what would be written and deleted without changing anything")
+	pullCmd.Flags().BoolVar(&pullPrune, "prune", false, "Remove applied whiteouts from the database after deleting the host paths")
+	pullCmd.Flags().BoolVar(&pullForce, "force", false, "Delete host paths even if they were modified since the session started")
 	RootCmd.AddCommand(pullCmd)
 }
 
-func runPull(dbPath, outputDir string) error {
+// pullOptions controls how runPull applies the database to the host
+type pullOptions struct {
+	dryRun bool // Only report changes
+	prune  bool // Drop applied whiteouts from the database
+	force  bool // Delete host paths modified during the session
+}
+
+func runPull(dbPath, outputDir string, opts pullOptions) error {
 	// Resolve output directory
 	absOutputDir, err := filepath.Abs(outputDir)
 	if err != nil {
@@ -44,6 +70,9 @@ func runPull(dbPath, outputDir string) error {
 	workspaceName := filepath.Base(absOutputDir)
 	fmt.Printf("Workspace name: %s\n", workspaceName)
 	fmt.Printf("Exporting from: /%s/\n", workspaceName)
+	if opts.dryRun {
+		fmt.Println("Dry run: no changes will be made")
+	}
 
 	// Open database
 	store, err := db.Open(db.DefaultConfig(dbPath))
@@ -52,30 +81,439 @@ func runPull(dbPath, outputDir string) error {
 	}
 	defer store.Close()
 
-	// Create output directory
-	if err := os.MkdirAll(absOutputDir, 0755); err != nil {
-		return fmt.Errorf("failed to create output directory: %w", err)
-	}
-
 	ctx := context.Background()
 
 	// Find the workspace directory in the DB
 	workspaceIno, err := store.Lookup(ctx, 1, workspaceName)
+	if err != nil && err != db.ErrNotFound {
+		return fmt.Errorf("failed to find workspace directory: %w", err)
+	}
+
+	// Renamed and recreated directories replace their host paths
+	var metas []pullDirMeta
+	if err == nil {
+		if err := findDirMeta(ctx, store, workspaceIno, "", "/"+workspaceName, &metas); err != nil {
+			return err
+		}
+	}
+	moves := planMoves(metas, absOutputDir)
+
+	// Plan deletions first so that a conflict aborts before anything changes
+	deletions, err := planDeletions(ctx, store, workspaceName, absOutputDir, metas)
 	if err != nil {
-		if err == db.ErrNotFound {
-			fmt.Printf("Workspace directory /%s/ not found in database\n", workspaceName)
-			return nil
+		return err
+	}
+	replaced, err := planReplaced(ctx, store, absOutputDir, metas)
+	if err != nil {
+		return err
+	}
+	var conflicts int
+	for _, d := range append(replaced, deletions...) {
+		if d.modified != "" {
+			conflicts++
+			if d.modified == d.hostPath {
+				fmt.Printf("CONFLICT %s (modified on host since the session started)\n", d.hostPath)
+			} else {
+				fmt.Printf("CONFLICT %s (%s modified on host since the session started)\n", d.hostPath, d.modified)
+			}
+		}
+	}
+	if conflicts > 0 && !opts.force {
+		return fmt.Errorf("refusing to delete %d host path(s) modified since the session started; use --force to delete anyway", conflicts)
+	}
+
+	// Create output directory
+	if !opts.dryRun {
+		if err := os.MkdirAll(absOutputDir, 0755); err != nil {
+			return fmt.Errorf("failed to create output directory: %w", err)
+		}
+
+		// Large files the agent edited may still read unchanged chunks from
+		// the host files this pull overwrites, so store those chunks first
+		hostfs, err := overlay.NewHostFS(absOutputDir)
+		if err != nil {
+			return fmt.Errorf("failed to open workspace: %w", err)
+		}
+		layers := overlay.NewLayerFS(overlay.Layer{FS: hostfs, Prefix: "/" + workspaceName})
+		if err := overlay.CompleteCopyUps(ctx, store, layers); err != nil {
+			return err
+		}
+	}
+
+	// Move renamed directories before deleting, as whiteouts name paths
+	// after the moves
+	if err := applyMoves(metas, moves, replaced, absOutputDir, opts.dryRun); err != nil {
+		return err
+	}
+
+	// Apply deletions before writing, so a path that changed type is
+	// replaced rather than merged
+	for _, d := range deletions {
+		if !d.exists {
+			continue
+		}
+		fmt.Printf("DEL  %s\n", d.hostPath)
+		if opts.dryRun {
+			continue
+		}
+		if err := os.RemoveAll(d.hostPath); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", d.hostPath, err)
+		}
+	}
+
+	if workspaceIno == 0 {
+		fmt.Printf("Workspace directory /%s/ not found in database\n", workspaceName)
+	} else {
+		fmt.Printf("Workspace directory inode: %d\n", workspaceIno)
+
+		// Export starting from workspace directory
+		if err := pullDir(ctx, store, workspaceIno, absOutputDir, opts.dryRun); err != nil {
+			return err
+		}
+	}
+
+	if opts.dryRun {
+		return nil
+	}
+	if opts.prune {
+		for _, d := range deletions {
+			if err := store.DeleteWhiteout(ctx, d.whiteout); err != nil {
+				return fmt.Errorf("failed to prune whiteout %s: %w", d.whiteout, err)
+			}
+		}
+		fmt.Printf("Pruned %d whiteout(s)\n", len(deletions))
+	}
+
+	// The host now has the directories where the agent sees them
+	for _, m := range metas {
+		for _, name := range []string{overlay.XattrRedirect, overlay.XattrOpaque} {
+			if err := store.RemoveXattr(ctx, m.ino, name); err != nil && err != db.ErrNotFound {
+				return fmt.Errorf("failed to clear %s on /%s/%s: %w", name, workspaceName, m.rel, err)
+			}
 		}
-		return fmt.Errorf("failed to find workspace directory: %w", err)
 	}
 
-	fmt.Printf("Workspace directory inode: %d\n", workspaceIno)
+	// The host now reflects the session; later host edits belong to the next one
+	if err := store.EndSession(ctx); err != nil {
+		return fmt.Errorf("failed to end session: %w", err)
+	}
+	return nil
+}
 
-	// Export starting from workspace directory
-	return pullDir(ctx, store, workspaceIno, absOutputDir)
+// pullDeletion is a whiteout to be applied to the host
+type pullDeletion struct {
+	whiteout string // Whiteout path in the database
+	hostPath string
+	exists   bool   // The host path still exists
+	modified string // Host path modified since the session started, if any
 }
 
-func pullDir(ctx context.Context, store *db.Store, ino uint64, path string) error {
+// planDeletions maps the whiteouts under the workspace to host paths.
+// Whiteouts below an already deleted directory are folded into it, and those
+// of directories moved elsewhere are left to the move.
+func planDeletions(ctx context.Context, store *db.Store, workspaceName, hostRoot string, metas []pullDirMeta) ([]pullDeletion, error) {
+	prefix := "/" + workspaceName
+	whiteouts, err := store.ListWhiteoutsUnder(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list whiteouts: %w", err)
+	}
+	sessionStart, err := store.SessionStart(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session start: %w", err)
+	}
+
+	sources := make(map[string]bool)
+	for _, m := range metas {
+		if m.redirect != "" {
+			sources[m.redirect] = true
+		}
+	}
+
+	var deletions []pullDeletion
+	deleted := make(map[string]bool)
+	for _, w := range whiteouts {
+		// LIKE is case-insensitive, so recheck the prefix
+		if !strings.HasPrefix(w.Path, prefix+"/") {
+			continue
+		}
+		rel := strings.TrimPrefix(w.Path, prefix+"/")
+		d := pullDeletion{whiteout: w.Path, hostPath: filepath.Join(hostRoot, filepath.FromSlash(rel))}
+
+		// Check the host path before the moves, where it is now
+		origin, ok := hostOrigin(metas, rel, false)
+		if ok && !sources[origin] && !hasDeletedAncestor(deleted, rel) {
+			originPath := filepath.Join(hostRoot, filepath.FromSlash(origin))
+			if _, err := os.Lstat(originPath); err == nil {
+				d.exists = true
+				deleted[rel] = true
+
+				// Without a recorded session, the deletion time is the best bound
+				since := sessionStart
+				if since == 0 {
+					since = w.CreatedAt
+				}
+				if d.modified, err = modifiedSince(originPath, since); err != nil {
+					return nil, err
+				}
+			} else if !os.IsNotExist(err) {
+				return nil, fmt.Errorf("failed to stat %s: %w", originPath, err)
+			}
+		}
+		deletions = append(deletions, d)
+	}
+	return deletions, nil
+}
+
+// pullDirMeta is a workspace directory that replaces its host path: it
+// shows the host contents of another path (redirect), or none (opaque)
+type pullDirMeta struct {
+	ino      uint64
+	rel      string // Path relative to the workspace
+	redirect string // Host path it was renamed from, relative to the workspace
+	opaque   bool
+}
+
+// findDirMeta collects the directories below ino that carry overlay merge
+// metadata, parents before children
+func findDirMeta(ctx context.Context, store *db.Store, ino uint64, rel, prefix string, metas *[]pullDirMeta) error {
+	entries, err := store.ListDir(ctx, ino)
+	if err != nil {
+		return fmt.Errorf("failed to list directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		inode, err := store.GetInode(ctx, entry.Ino)
+		if err != nil || !inode.IsDir() {
+			continue
+		}
+		childRel := entry.Name
+		if rel != "" {
+			childRel = rel + "/" + entry.Name
+		}
+
+		m := pullDirMeta{ino: entry.Ino, rel: childRel}
+		if value, err := store.GetXattr(ctx, entry.Ino, overlay.XattrRedirect); err == nil {
+			// A redirect out of the workspace has no host contents to move
+			if redirect := string(value); strings.HasPrefix(redirect, prefix+"/") {
+				m.redirect = strings.TrimPrefix(redirect, prefix+"/")
+			} else {
+				m.opaque = true
+			}
+		} else if err != db.ErrNotFound {
+			return fmt.Errorf("failed to read redirect of %s: %w", childRel, err)
+		}
+		if value, err := store.GetXattr(ctx, entry.Ino, overlay.XattrOpaque); err == nil {
+			m.opaque = m.opaque || string(value) == "y"
+		} else if err != db.ErrNotFound {
+			return fmt.Errorf("failed to read opaque flag of %s: %w", childRel, err)
+		}
+		if m.redirect != "" || m.opaque {
+			*metas = append(*metas, m)
+		}
+
+		if err := findDirMeta(ctx, store, entry.Ino, childRel, prefix, metas); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hostOrigin returns where the host contents shown at rel are before the
+// moves, or false if none are. With self set, the metadata of rel itself
+// applies too, as for its entries.
+func hostOrigin(metas []pullDirMeta, rel string, self bool) (string, bool) {
+	byRel := make(map[string]pullDirMeta, len(metas))
+	for _, m := range metas {
+		byRel[m.rel] = m
+	}
+
+	parts := strings.Split(rel, "/")
+	var origin []string
+	hidden := false
+	for i, part := range parts {
+		if !hidden {
+			origin = append(origin, part)
+		}
+		if i == len(parts)-1 && !self {
+			continue
+		}
+		m, ok := byRel[strings.Join(parts[:i+1], "/")]
+		if !ok {
+			continue
+		}
+		if m.redirect != "" {
+			origin = append(origin[:0], strings.Split(m.redirect, "/")...)
+			hidden = false
+		}
+		if m.opaque {
+			hidden = true
+		}
+	}
+	if hidden {
+		return "", false
+	}
+	return strings.Join(origin, "/"), true
+}
+
+// pullMove is a renamed directory to be moved on the host
+type pullMove struct {
+	from, to string // Host paths
+	staged   string // Temporary location while moves are applied
+}
+
+// planMoves maps the renamed directories to host moves
+func planMoves(metas []pullDirMeta, hostRoot string) map[string]*pullMove {
+	moves := make(map[string]*pullMove)
+	for _, m := range metas {
+		if m.redirect != "" {
+			moves[m.rel] = &pullMove{
+				from: filepath.Join(hostRoot, filepath.FromSlash(m.redirect)),
+				to:   filepath.Join(hostRoot, filepath.FromSlash(m.rel)),
+			}
+		}
+	}
+	return moves
+}
+
+// planReplaced finds the host directories that renamed or recreated
+// directories replace, except those moved away themselves
+func planReplaced(ctx context.Context, store *db.Store, hostRoot string, metas []pullDirMeta) ([]pullDeletion, error) {
+	sessionStart, err := store.SessionStart(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session start: %w", err)
+	}
+
+	sources := make(map[string]bool)
+	for _, m := range metas {
+		if m.redirect != "" {
+			sources[m.redirect] = true
+		}
+	}
+
+	var replaced []pullDeletion
+	for _, m := range metas {
+		d := pullDeletion{hostPath: filepath.Join(hostRoot, filepath.FromSlash(m.rel))}
+		origin, ok := hostOrigin(metas, m.rel, false)
+		if ok && !sources[origin] {
+			originPath := filepath.Join(hostRoot, filepath.FromSlash(origin))
+			if _, err := os.Lstat(originPath); err == nil {
+				d.exists = true
+				if sessionStart != 0 {
+					if d.modified, err = modifiedSince(originPath, sessionStart); err != nil {
+						return nil, err
+					}
+				}
+			} else if !os.IsNotExist(err) {
+				return nil, fmt.Errorf("failed to stat %s: %w", originPath, err)
+			}
+		}
+		replaced = append(replaced, d)
+	}
+	return replaced, nil
+}
+
+// applyMoves moves renamed directories to their new host paths, replacing
+// what is there. Sources are staged out of the way first, so that exchanged
+// and nested directories land in the right place.
+func applyMoves(metas []pullDirMeta, moves map[string]*pullMove, replaced []pullDeletion, hostRoot string, dryRun bool) error {
+	if len(metas) == 0 {
+		return nil
+	}
+
+	var stage string
+	if !dryRun && len(moves) > 0 {
+		var err error
+		if stage, err = os.MkdirTemp(hostRoot, ".art-pull-"); err != nil {
+			return fmt.Errorf("failed to create staging directory: %w", err)
+		}
+		defer os.Remove(stage)
+
+		// Deepest first, so a source inside another one is staged on its own
+		sorted := make([]*pullMove, 0, len(moves))
+		for _, mv := range moves {
+			sorted = append(sorted, mv)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			return strings.Count(sorted[i].from, "/") > strings.Count(sorted[j].from, "/")
+		})
+		for i, mv := range sorted {
+			staged := filepath.Join(stage, fmt.Sprint(i))
+			if err := os.Rename(mv.from, staged); err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return fmt.Errorf("failed to move %s: %w", mv.from, err)
+			}
+			mv.staged = staged
+		}
+	}
+
+	// Parents before children, so each lands inside its new parent
+	for i, m := range metas {
+		if replaced[i].exists {
+			fmt.Printf("DEL  %s\n", replaced[i].hostPath)
+		}
+		mv := moves[m.rel]
+		if mv != nil {
+			fmt.Printf("MOVE %s -> %s\n", mv.from, mv.to)
+		}
+		if dryRun {
+			continue
+		}
+
+		if err := os.RemoveAll(replaced[i].hostPath); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", replaced[i].hostPath, err)
+		}
+		if mv == nil || mv.staged == "" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(mv.to), 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", filepath.Dir(mv.to), err)
+		}
+		if err := os.Rename(mv.staged, mv.to); err != nil {
+			return fmt.Errorf("failed to move %s to %s: %w", mv.from, mv.to, err)
+		}
+	}
+	return nil
+}
+
+// hasDeletedAncestor checks if a parent directory of rel is being deleted
+func hasDeletedAncestor(deleted map[string]bool, rel string) bool {
+	for dir := filepath.Dir(rel); dir != "."; dir = filepath.Dir(dir) {
+		if deleted[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// modifiedSince returns the first path in the tree at root whose mtime or
+// ctime is after the given Unix time, or "" if there is none
+func modifiedSince(root string, since int64) (string, error) {
+	var modified string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().Unix() > since || ctimeUnix(info) > since {
+			modified = path
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to check %s for changes: %w", root, err)
+	}
+	return modified, nil
+}
+
+// pullDir writes the directory tree at ino to path; with dryRun it only
+// reports what would be written
+func pullDir(ctx context.Context, store *db.Store, ino uint64, path string, dryRun bool) error {
 	entries, err := store.ListDir(ctx, ino)
 	if err != nil {
 		return err
@@ -92,11 +530,13 @@ func pullDir(ctx context.Context, store *db.Store, ino uint64, path string) erro
 
 		if inode.IsDir() {
 			// Create directory and recurse
-			if err := os.MkdirAll(entryPath, os.FileMode(inode.Mode&0777)); err != nil {
-				return fmt.Errorf("failed to create directory %s: %w", entryPath, err)
+			if !dryRun {
+				if err := os.MkdirAll(entryPath, os.FileMode(inode.Mode&0777)); err != nil {
+					return fmt.Errorf("failed to create directory %s: %w", entryPath, err)
+				}
 			}
 			fmt.Printf("DIR  %s\n", entryPath)
-			if err := pullDir(ctx, store, entry.Ino, entryPath); err != nil {
+			if err := pullDir(ctx, store, entry.Ino, entryPath, dryRun); err != nil {
 				return err
 			}
 		} else if inode.IsSymlink() {
@@ -106,6 +546,10 @@ func pullDir(ctx context.Context, store *db.Store, ino uint64, path string) erro
 				fmt.Printf("Warning: could not read symlink %s: %v\n", entryPath, err)
 				continue
 			}
+			if dryRun {
+				fmt.Printf("LINK %s -> %s\n", entryPath, target)
+				continue
+			}
 			// Remove existing symlink if any
 			os.Remove(entryPath)
 			if err := os.Symlink(target, entryPath); err != nil {
@@ -114,6 +558,14 @@ func pullDir(ctx context.Context, store *db.Store, ino uint64, path string) erro
 			fmt.Printf("LINK %s -> %s\n", entryPath, target)
 		} else if inode.IsRegular() {
 			// Export file
+			if dryRun {
+				fmt.Printf("FILE %s (%d bytes)\n", entryPath, inode.Size)
+				continue
+			}
+			// Files copied up from another layer read it for unchanged chunks
+			if lower, err := store.GetLower(ctx, entry.Ino); err == nil {
+				return fmt.Errorf("file %s still reads from layer path %s, which pull cannot see", entryPath, lower.Path)
+			}
 			data, err := store.ReadData(ctx, entry.Ino, 0, int64(inode.Size))
 			if err != nil {
 				return fmt.Errorf("failed to read file %s: %w", entryPath, err)
@@ -127,3 +579,11 @@ func pullDir(ctx context.Context, store *db.Store, ino uint64, path string) erro
 
 	return nil
 }
+
+// ctimeUnix returns the status change time of a file, or 0 if unknown
+func ctimeUnix(info fs.FileInfo) int64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Ctim.Sec
+	}
+	return 0
+}
@@ -2,22 +2,37 @@ package cmd
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"syscall"
 
 	"art/pkg/db"
+	"art/pkg/ignore"
 
 	"github.com/spf13/cobra"
 )
 
+var (
+	pushCompression string
+	pushChecksum    bool
+)
+
 var pushCmd = &cobra.Command{
 	Use:   "push",
 	Short: "Push workspace files into SQLite database",
 	Long: `Pushes all files from workspace directory into the SQLite database.
 Files are stored under /<workspace-name>/ in the virtual filesystem,
-where <workspace-name> is the basename of the mount directory.`,
+where <workspace-name> is the basename of the mount directory.
+
+Pushing again updates the database incrementally: files whose size or
+modification time changed are rewritten in place, and entries deleted on
+the host are removed. Paths matched by .artignore (or .gitignore if there
+is no .artignore) are neither imported nor removed. The push runs in one
+transaction, so a failed push leaves the database untouched.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if dbPath == "" {
 			fmt.Println("Error: --db flag is required")
@@ -27,7 +42,17 @@ where <workspace-name> is the basename of the mount directory.`,
 			fmt.Println("Error: --mount flag is required")
 			os.Exit(1)
 		}
-		if err := runPush(dbPath, mountDir); err != nil {
+		// Empty keeps the database's current setting
+		var compression db.Compression
+		if pushCompression != "" {
+			c, err := db.ParseCompression(pushCompression)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			compression = c
+		}
+		if err := runPush(dbPath, mountDir, compression, pushChecksum); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
@@ -35,10 +60,12 @@ where <workspace-name> is the basename of the mount directory.`,
 }
 
 func init() {
+	pushCmd.Flags().StringVar(&pushCompression, "compression", "", "Chunk compression: none or deflate (saved in the database; default: keep current setting)")
+	pushCmd.Flags().BoolVar(&pushChecksum, "checksum", false, "Also compare file contents, not just size and modification time")
 	RootCmd.AddCommand(pushCmd)
 }
 
-func runPush(dbPath, inputDir string) error {
+func runPush(dbPath, inputDir string, compression db.Compression, checksum bool) error {
 	// Check input directory exists
 	absInputDir, err := filepath.Abs(inputDir)
 	if err != nil {
@@ -58,136 +85,389 @@ func runPush(dbPath, inputDir string) error {
 	fmt.Printf("Workspace name: %s\n", workspaceName)
 	fmt.Printf("Files will be stored under: /%s/\n", workspaceName)
 
+	ignored, ignoreFile, err := ignore.Load(absInputDir, ".artignore", ".gitignore")
+	if err != nil {
+		return fmt.Errorf("failed to read ignore file: %w", err)
+	}
+	if ignoreFile != "" {
+		fmt.Printf("Ignoring paths matched by: %s\n", ignoreFile)
+	}
+
 	// Open database
-	store, err := db.Open(db.DefaultConfig(dbPath))
+	cfg := db.DefaultConfig(dbPath)
+	cfg.Compression = compression
+	store, err := db.Open(cfg)
 	if err != nil {
 		return fmt.Errorf("failed to open database: %w", err)
 	}
 	defer store.Close()
 
 	ctx := context.Background()
-
-	// First, ensure the workspace directory exists in the DB
-	workspaceIno, err := ensureWorkspaceDir(ctx, store, workspaceName)
-	if err != nil {
-		return fmt.Errorf("failed to create workspace directory: %w", err)
+	p := &pusher{
+		ctx:      ctx,
+		store:    store,
+		root:     absInputDir,
+		virtual:  "/" + workspaceName,
+		ignored:  ignored,
+		checksum: checksum,
+		dirs:     make(map[string]uint64),
+		seen:     make(map[string]bool),
 	}
-	fmt.Printf("Workspace directory inode: %d\n", workspaceIno)
 
-	// Walk the input directory and import everything
-	return filepath.WalkDir(absInputDir, func(path string, d fs.DirEntry, err error) error {
+	err = store.WithTx(ctx, func(tx *sql.Tx) error {
+		p.tx = tx
+
+		// First, ensure the workspace directory exists in the DB
+		workspaceIno, err := ensureWorkspaceDir(ctx, store, tx, workspaceName)
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to create workspace directory: %w", err)
 		}
+		fmt.Printf("Workspace directory inode: %d\n", workspaceIno)
+		p.dirs["."] = workspaceIno
 
-		// Get relative path from input directory
-		relPath, err := filepath.Rel(absInputDir, path)
-		if err != nil {
+		// Walk the input directory and import everything
+		if err := filepath.WalkDir(absInputDir, p.visit); err != nil {
 			return err
 		}
+		return p.removeDeleted()
+	})
+	if err != nil {
+		return err
+	}
 
-		// Skip the root directory itself (it's the workspace dir)
-		if relPath == "." {
-			return nil
+	fmt.Printf("Pushed: %d added, %d updated, %d deleted, %d unchanged\n",
+		p.added, p.updated, p.deleted, p.unchanged)
+	return nil
+}
+
+// pusher mirrors a host directory into the database within one transaction
+type pusher struct {
+	ctx      context.Context
+	store    *db.Store
+	tx       *sql.Tx
+	root     string // Host directory
+	virtual  string // Its path in the database
+	ignored  *ignore.Matcher
+	checksum bool
+
+	dirs map[string]uint64 // Inodes of host directories by relative path
+	seen map[string]bool   // Relative paths present on the host
+
+	added, updated, deleted, unchanged int
+}
+
+// visit imports one host path
+func (p *pusher) visit(path string, d fs.DirEntry, err error) error {
+	if err != nil {
+		return err
+	}
+
+	// Get relative path from input directory
+	relPath, err := filepath.Rel(p.root, path)
+	if err != nil {
+		return err
+	}
+
+	// Skip the root directory itself (it's the workspace dir)
+	if relPath == "." {
+		return nil
+	}
+	relPath = filepath.ToSlash(relPath)
+
+	if p.ignored.Match(relPath, d.IsDir()) {
+		if d.IsDir() {
+			return filepath.SkipDir
 		}
+		return nil
+	}
 
-		// Virtual path is /<workspace>/<relPath>
-		virtualPath := "/" + workspaceName + "/" + filepath.ToSlash(relPath)
+	// Virtual path is /<workspace>/<relPath>
+	virtualPath := p.virtual + "/" + relPath
+	parentIno := p.dirs[filepath.ToSlash(filepath.Dir(relPath))]
+	name := d.Name()
 
-		// Get parent path and name
-		parentPath := filepath.Dir(relPath)
-		name := filepath.Base(relPath)
+	info, err := d.Info()
+	if err != nil {
+		return err
+	}
+	var fileType uint32
+	switch {
+	case d.IsDir():
+		fileType = db.S_IFDIR
+	case d.Type()&fs.ModeSymlink != 0:
+		fileType = db.S_IFLNK
+	case d.Type().IsRegular():
+		fileType = db.S_IFREG
+	default:
+		return nil // Devices, sockets and FIFOs are not stored
+	}
+	p.seen[relPath] = true
 
-		// Resolve parent inode (relative to workspace)
-		var parentIno uint64
-		if parentPath == "." {
-			parentIno = workspaceIno
-		} else {
-			parentIno, err = resolvePath(ctx, store, "/"+workspaceName+"/"+filepath.ToSlash(parentPath))
-			if err != nil {
-				return fmt.Errorf("cannot resolve parent %s: %w", parentPath, err)
+	// Check if entry already exists
+	ino, err := p.store.LookupTx(p.ctx, p.tx, parentIno, name)
+	if err != nil && err != db.ErrNotFound {
+		return fmt.Errorf("failed to look up %s: %w", virtualPath, err)
+	}
+	if err == nil {
+		inode, err := p.store.GetInodeTx(p.ctx, p.tx, ino)
+		if err != nil {
+			return fmt.Errorf("failed to get inode of %s: %w", virtualPath, err)
+		}
+		if inode.Mode&db.S_IFMT == fileType {
+			if fileType == db.S_IFDIR {
+				p.dirs[relPath] = ino
 			}
+			return p.update(path, virtualPath, info, inode)
+		}
+
+		// The file type changed: replace the entry
+		if err := p.remove(parentIno, name, ino); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", virtualPath, err)
+		}
+		fmt.Printf("DEL  %s\n", virtualPath)
+	}
+
+	ino, err = p.create(path, virtualPath, parentIno, name, info, fileType)
+	if err != nil {
+		return err
+	}
+	if fileType == db.S_IFDIR {
+		p.dirs[relPath] = ino
+	}
+	return nil
+}
+
+// create imports a host path that is not in the database yet
+func (p *pusher) create(path, virtualPath string, parentIno uint64, name string, info fs.FileInfo, fileType uint32) (uint64, error) {
+	mode := uint32(info.Mode().Perm())
+	if fileType == db.S_IFLNK {
+		mode = 0777
+	}
+	// Keep the host owner, which matters with --enforce-permissions
+	var uid, gid uint32
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		uid, gid = st.Uid, st.Gid
+	}
+	ino, err := p.store.CreateInodeTx(p.ctx, p.tx, fileType|mode, uid, gid)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create inode for %s: %w", virtualPath, err)
+	}
+	if err := p.store.CreateDentryTx(p.ctx, p.tx, parentIno, name, ino); err != nil {
+		return 0, fmt.Errorf("failed to create dentry for %s: %w", virtualPath, err)
+	}
+
+	var size uint64
+	switch fileType {
+	case db.S_IFDIR:
+		fmt.Printf("DIR  %s (ino %d)\n", virtualPath, ino)
+
+	case db.S_IFLNK:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read symlink: %w", err)
+		}
+		if err := p.store.CreateSymlinkTx(p.ctx, p.tx, ino, target); err != nil {
+			return 0, fmt.Errorf("failed to store symlink target: %w", err)
 		}
+		size = uint64(len(target))
+		fmt.Printf("LINK %s -> %s (ino %d)\n", virtualPath, target, ino)
 
-		// Check if entry already exists
-		existingIno, err := store.Lookup(ctx, parentIno, name)
-		if err == nil {
-			fmt.Printf("SKIP %s (exists as ino %d)\n", virtualPath, existingIno)
+	case db.S_IFREG:
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read file: %w", err)
+		}
+		if err := p.store.WriteDataTx(p.ctx, p.tx, ino, 0, data); err != nil {
+			return 0, fmt.Errorf("failed to write file data: %w", err)
+		}
+		size = uint64(len(data))
+		fmt.Printf("FILE %s (%d bytes, ino %d)\n", virtualPath, len(data), ino)
+	}
+
+	p.added++
+	return ino, p.setAttrs(ino, fileType|mode, size, info)
+}
+
+// update refreshes an existing entry of the same file type if the host
+// copy changed
+func (p *pusher) update(path, virtualPath string, info fs.FileInfo, inode *db.Inode) error {
+	mode := inode.Mode&db.S_IFMT | uint32(info.Mode().Perm())
+	size := inode.Size
+
+	switch inode.Mode & db.S_IFMT {
+	case db.S_IFDIR:
+		if inode.Mode == mode {
+			p.unchanged++
 			return nil
 		}
+		fmt.Printf("DIR  %s (mode %04o)\n", virtualPath, mode&0o7777)
 
-		info, err := d.Info()
+	case db.S_IFLNK:
+		target, err := os.Readlink(path)
 		if err != nil {
+			return fmt.Errorf("failed to read symlink: %w", err)
+		}
+		current, err := p.store.ReadSymlinkTx(p.ctx, p.tx, inode.Ino)
+		if err != nil {
+			return fmt.Errorf("failed to read symlink %s: %w", virtualPath, err)
+		}
+		if current == target {
+			p.unchanged++
+			return nil
+		}
+		if err := p.store.DeleteSymlinkTx(p.ctx, p.tx, inode.Ino); err != nil {
 			return err
 		}
+		if err := p.store.CreateSymlinkTx(p.ctx, p.tx, inode.Ino, target); err != nil {
+			return fmt.Errorf("failed to store symlink target: %w", err)
+		}
+		mode, size = inode.Mode, uint64(len(target))
+		fmt.Printf("LINK %s -> %s (updated)\n", virtualPath, target)
 
-		mode := uint32(info.Mode().Perm())
-
-		if d.IsDir() {
-			// Create directory
-			ino, err := store.CreateInode(ctx, db.S_IFDIR|mode, 0, 0)
-			if err != nil {
-				return fmt.Errorf("failed to create directory inode: %w", err)
-			}
-			if err := store.CreateDentry(ctx, parentIno, name, ino); err != nil {
-				return fmt.Errorf("failed to create directory dentry: %w", err)
+	case db.S_IFREG:
+		sameStat := inode.Size == uint64(info.Size()) && inode.Mtime == info.ModTime().Unix()
+		if sameStat && !p.checksum {
+			if inode.Mode == mode {
+				p.unchanged++
+				return nil
 			}
-			fmt.Printf("DIR  %s (ino %d)\n", virtualPath, ino)
+			fmt.Printf("FILE %s (mode %04o)\n", virtualPath, mode&0o7777)
+			break
+		}
 
-		} else if d.Type()&fs.ModeSymlink != 0 {
-			// Create symlink
-			target, err := os.Readlink(path)
-			if err != nil {
-				return fmt.Errorf("failed to read symlink: %w", err)
-			}
-			ino, err := store.CreateInode(ctx, db.S_IFLNK|0777, 0, 0)
-			if err != nil {
-				return fmt.Errorf("failed to create symlink inode: %w", err)
-			}
-			if err := store.CreateSymlink(ctx, ino, target); err != nil {
-				return fmt.Errorf("failed to store symlink target: %w", err)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+		same, err := p.store.SameContentsTx(p.ctx, p.tx, inode.Ino, data)
+		if err != nil {
+			return fmt.Errorf("failed to compare %s: %w", virtualPath, err)
+		}
+		if same && inode.Mode == mode && inode.Mtime == info.ModTime().Unix() {
+			p.unchanged++
+			return nil
+		}
+		if !same {
+			// Overwrite in place, then cut off any old tail
+			if err := p.store.WriteDataTx(p.ctx, p.tx, inode.Ino, 0, data); err != nil {
+				return fmt.Errorf("failed to write file data: %w", err)
 			}
-			if err := store.CreateDentry(ctx, parentIno, name, ino); err != nil {
-				return fmt.Errorf("failed to create symlink dentry: %w", err)
+			if err := p.store.TruncateTx(p.ctx, p.tx, inode.Ino, uint64(len(data))); err != nil {
+				return fmt.Errorf("failed to truncate file data: %w", err)
 			}
-			if err := store.UpdateSize(ctx, ino, uint64(len(target))); err != nil {
-				return fmt.Errorf("failed to update symlink size: %w", err)
+			// Every chunk was written, so nothing is read from the host any more
+			if err := p.store.DeleteLowerTx(p.ctx, p.tx, inode.Ino); err != nil {
+				return fmt.Errorf("failed to complete copy-up: %w", err)
 			}
-			fmt.Printf("LINK %s -> %s (ino %d)\n", virtualPath, target, ino)
+		}
+		size = uint64(len(data))
+		fmt.Printf("FILE %s (%d bytes, updated)\n", virtualPath, len(data))
+	}
 
-		} else if d.Type().IsRegular() {
-			// Create regular file
-			data, err := os.ReadFile(path)
-			if err != nil {
-				return fmt.Errorf("failed to read file: %w", err)
+	p.updated++
+	return p.setAttrs(inode.Ino, mode, size, info)
+}
+
+// setAttrs stores the mode, size and host modification time of an inode
+func (p *pusher) setAttrs(ino uint64, mode uint32, size uint64, info fs.FileInfo) error {
+	inode, err := p.store.GetInodeTx(p.ctx, p.tx, ino)
+	if err != nil {
+		return err
+	}
+	inode.Mode = mode
+	inode.Size = size
+	inode.Mtime = info.ModTime().Unix()
+	inode.Ctime = max(inode.Ctime, inode.Mtime)
+	return p.store.UpdateInodeTx(p.ctx, p.tx, inode)
+}
+
+// removeDeleted removes database entries under the workspace whose host
+// paths no longer exist, leaving ignored paths alone
+func (p *pusher) removeDeleted() error {
+	dirs := make([]string, 0, len(p.dirs))
+	for rel := range p.dirs {
+		dirs = append(dirs, rel)
+	}
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		entries, err := p.store.ListDirTx(p.ctx, p.tx, p.dirs[dir])
+		if err != nil {
+			return fmt.Errorf("failed to list %s: %w", dir, err)
+		}
+		for _, entry := range entries {
+			rel := entry.Name
+			if dir != "." {
+				rel = dir + "/" + entry.Name
+			}
+			if p.seen[rel] {
+				continue
 			}
-			ino, err := store.CreateInode(ctx, db.S_IFREG|mode, 0, 0)
+			inode, err := p.store.GetInodeTx(p.ctx, p.tx, entry.Ino)
 			if err != nil {
-				return fmt.Errorf("failed to create file inode: %w", err)
+				return err
 			}
-			if len(data) > 0 {
-				if err := store.WriteData(ctx, ino, 0, data); err != nil {
-					return fmt.Errorf("failed to write file data: %w", err)
-				}
+			if p.ignored.Match(rel, inode.IsDir()) {
+				continue
 			}
-			if err := store.UpdateSize(ctx, ino, uint64(len(data))); err != nil {
-				return fmt.Errorf("failed to update file size: %w", err)
+			if err := p.remove(p.dirs[dir], entry.Name, entry.Ino); err != nil {
+				return fmt.Errorf("failed to remove %s: %w", rel, err)
 			}
-			if err := store.CreateDentry(ctx, parentIno, name, ino); err != nil {
-				return fmt.Errorf("failed to create file dentry: %w", err)
+			fmt.Printf("DEL  %s/%s\n", p.virtual, rel)
+		}
+	}
+	return nil
+}
+
+// remove unlinks an entry, and everything below it for directories
+func (p *pusher) remove(parentIno uint64, name string, ino uint64) error {
+	inode, err := p.store.GetInodeTx(p.ctx, p.tx, ino)
+	if err != nil {
+		return err
+	}
+	if inode.IsDir() {
+		entries, err := p.store.ListDirTx(p.ctx, p.tx, ino)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := p.remove(ino, entry.Name, entry.Ino); err != nil {
+				return err
 			}
-			fmt.Printf("FILE %s (%d bytes, ino %d)\n", virtualPath, len(data), ino)
 		}
+	}
 
-		return nil
-	})
+	if err := p.store.DeleteDentryTx(p.ctx, p.tx, parentIno, name); err != nil {
+		return err
+	}
+	remaining, err := p.store.DecrNlinkTx(p.ctx, p.tx, ino)
+	if err != nil {
+		return err
+	}
+	if remaining == 0 || inode.IsDir() {
+		if inode.IsSymlink() {
+			if err := p.store.DeleteSymlinkTx(p.ctx, p.tx, ino); err != nil {
+				return err
+			}
+		} else if err := p.store.DeleteDataTx(p.ctx, p.tx, ino); err != nil {
+			return err
+		}
+		if err := p.store.DeleteOriginTx(p.ctx, p.tx, ino); err != nil {
+			return err
+		}
+		if err := p.store.DeleteInodeTx(p.ctx, p.tx, ino); err != nil {
+			return err
+		}
+	}
+	p.deleted++
+	return nil
 }
 
 // ensureWorkspaceDir ensures the workspace directory exists in the database
 // and returns its inode number
-func ensureWorkspaceDir(ctx context.Context, store *db.Store, workspaceName string) (uint64, error) {
+func ensureWorkspaceDir(ctx context.Context, store *db.Store, tx *sql.Tx, workspaceName string) (uint64, error) {
 	// Try to look up existing workspace directory
-	ino, err := store.Lookup(ctx, 1, workspaceName)
+	ino, err := store.LookupTx(ctx, tx, 1, workspaceName)
 	if err == nil {
 		return ino, nil
 	}
@@ -196,58 +476,13 @@ func ensureWorkspaceDir(ctx context.Context, store *db.Store, workspaceName stri
 	}
 
 	// Create workspace directory under root
-	ino, err = store.CreateInode(ctx, db.S_IFDIR|0755, 0, 0)
+	ino, err = store.CreateInodeTx(ctx, tx, db.S_IFDIR|0755, 0, 0)
 	if err != nil {
 		return 0, err
 	}
-	if err := store.CreateDentry(ctx, 1, workspaceName, ino); err != nil {
+	if err := store.CreateDentryTx(ctx, tx, 1, workspaceName, ino); err != nil {
 		return 0, err
 	}
 
 	return ino, nil
 }
-
-// resolvePath resolves a path to an inode number
-func resolvePath(ctx context.Context, store *db.Store, path string) (uint64, error) {
-	parts := filepath.SplitList(path)
-	if len(parts) == 0 {
-		parts = []string{path}
-	}
-	// Split by separator
-	parts = splitPath(path)
-
-	ino := uint64(1) // start at root
-	for _, part := range parts {
-		if part == "" || part == "." {
-			continue
-		}
-		childIno, err := store.Lookup(ctx, ino, part)
-		if err != nil {
-			return 0, err
-		}
-		ino = childIno
-	}
-	return ino, nil
-}
-
-func splitPath(path string) []string {
-	var parts []string
-	for _, p := range filepath.SplitList(path) {
-		parts = append(parts, p)
-	}
-	if len(parts) == 0 || (len(parts) == 1 && parts[0] == path) {
-		// filepath.SplitList didn't work, split manually
-		parts = nil
-		for path != "" {
-			dir, file := filepath.Split(path)
-			if file != "" {
-				parts = append([]string{file}, parts...)
-			}
-			if dir == "" || dir == path {
-				break
-			}
-			path = filepath.Clean(dir)
-		}
-	}
-	return parts
-}
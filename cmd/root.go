@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -17,6 +18,18 @@ var (
 	enableTrace   bool
 	traceLogPath  string
 	traceSyscalls string
+	networkMode   string
+	memoryMax     string
+	cpuQuota      float64
+	pidsMax       int64
+	ioWeight      uint64
+	quiet         bool
+	permissions   bool
+	allowDevices  bool
+	layerSpecs    []string
+	deltaMaxSize  string
+	dumpPath      string
+	cacheMode     string
 )
 
 var RootCmd = &cobra.Command{
@@ -34,17 +47,91 @@ var RootCmd = &cobra.Command{
 			}
 		}
 
+		var network supervisor.NetworkMode
+		if networkMode != "" {
+			mode, err := supervisor.ParseNetworkMode(networkMode)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			network = mode
+		}
+
+		memMax, err := supervisor.ParseSize(memoryMax)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if ioWeight > 10000 {
+			fmt.Fprintln(os.Stderr, "Error: --io-weight must be between 1 and 10000")
+			os.Exit(1)
+		}
+
+		var layers []supervisor.Layer
+		for _, spec := range layerSpecs {
+			layer, err := supervisor.ParseLayer(spec)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			layers = append(layers, layer)
+		}
+		if len(layers) > 0 && dbPath == "" {
+			fmt.Fprintln(os.Stderr, "Error: --layer requires --db (overlay mode)")
+			os.Exit(1)
+		}
+
+		deltaMax, err := supervisor.ParseSize(deltaMaxSize)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if (deltaMax > 0 || dumpPath != "") && dbPath != supervisor.MemoryDB {
+			fmt.Fprintf(os.Stderr, "Error: --delta-max-size and --dump require --db %s\n", supervisor.MemoryDB)
+			os.Exit(1)
+		}
+
+		cache, err := supervisor.ParseCacheMode(cacheMode)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if cacheMode != "" && dbPath == "" {
+			fmt.Fprintln(os.Stderr, "Error: --cache requires --db (overlay mode)")
+			os.Exit(1)
+		}
+
 		cfg := supervisor.Config{
 			MountDir:      mountDir,
 			Interactive:   interactive,
 			DBPath:        dbPath,
+			DeltaMaxSize:  deltaMax,
+			DumpPath:      dumpPath,
+			Layers:        layers,
 			EnableTracer:  enableTrace,
 			TraceLogPath:  traceLogPath,
 			TraceSyscalls: syscalls,
-			Command:       args,
+			Network:       network,
+			Resources: supervisor.ResourceLimits{
+				MemoryMax: memMax,
+				CPUQuota:  cpuQuota,
+				PidsMax:   pidsMax,
+				IOWeight:  ioWeight,
+			},
+			Command:     args,
+			Quiet:       quiet,
+			Permissions: permissions,
+			Devices:     allowDevices,
+			Cache:       cache,
 		}
 		if err := supervisor.Run(cfg); err != nil {
-			fmt.Println(err)
+			// Exit with the sandboxed command's own status so callers can tell
+			// pass from fail
+			var exitErr *supervisor.ExitError
+			if errors.As(err, &exitErr) {
+				os.Exit(exitErr.ExitCode())
+			}
+			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
 	},
@@ -52,7 +139,7 @@ var RootCmd = &cobra.Command{
 
 func Execute() {
 	if err := RootCmd.Execute(); err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
@@ -60,8 +147,20 @@ func Execute() {
 func init() {
 	RootCmd.PersistentFlags().StringVarP(&mountDir, "mount", "m", ".", "Host directory to mount as the agent's workspace (read-only base for overlay)")
 	RootCmd.PersistentFlags().BoolVarP(&interactive, "interactive", "i", true, "Run in interactive mode with full PTY support (use -i=false to disable)")
-	RootCmd.PersistentFlags().StringVarP(&dbPath, "db", "d", "", "Path to SQLite database for persistent FUSE filesystem")
+	RootCmd.PersistentFlags().StringVarP(&dbPath, "db", "d", "", "Path to SQLite database for persistent FUSE filesystem (:memory: for an ephemeral one)")
 	RootCmd.PersistentFlags().BoolVar(&enableTrace, "trace", false, "Enable ptrace-based syscall tracing")
 	RootCmd.PersistentFlags().StringVar(&traceLogPath, "trace-log", "", "Path to log file for ptrace syscalls (default: stderr)")
+	RootCmd.Flags().StringVar(&networkMode, "network", "", "Network mode: host, none or loopback-only (default: binds.json setting, else host)")
+	RootCmd.Flags().StringVar(&memoryMax, "memory-max", "", "Memory limit for the session, e.g. 2G (default: unlimited)")
+	RootCmd.Flags().Float64Var(&cpuQuota, "cpu-quota", 0, "CPU limit in number of CPUs, e.g. 1.5 (default: unlimited)")
+	RootCmd.Flags().Int64Var(&pidsMax, "pids-max", 0, "Maximum number of processes and threads (default: unlimited)")
+	RootCmd.Flags().Uint64Var(&ioWeight, "io-weight", 0, "Relative IO weight, 1-10000 (default: kernel default)")
+	RootCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "Suppress supervisor messages (they are written to stderr by default)")
+	RootCmd.Flags().BoolVar(&permissions, "enforce-permissions", false, "Enforce file permission bits in the overlay against the agent's uid and gid")
+	RootCmd.Flags().StringArrayVar(&layerSpecs, "layer", nil, "Stack a read-only host directory below the workspace as DIR[:PATH], PATH under /home/agent (repeatable; earlier layers take precedence)")
+	RootCmd.Flags().StringVar(&deltaMaxSize, "delta-max-size", "", "Size cap of the in-memory filesystem with --db :memory:, e.g. 512M (default: unlimited)")
+	RootCmd.Flags().StringVar(&dumpPath, "dump", "", "Write the in-memory filesystem to this new SQLite database when the session ends")
+	RootCmd.Flags().StringVar(&cacheMode, "cache", "", "Kernel caching of the overlay mount: default, none or full")
+	RootCmd.Flags().BoolVar(&allowDevices, "allow-devices", false, "Allow creating character and block device nodes in the overlay")
 	RootCmd.PersistentFlags().StringVar(&traceSyscalls, "trace-syscalls", "", "Comma-separated list of syscalls to log (default: all)")
 }
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"art/pkg/db"
+	"art/pkg/supervisor"
+
+	"github.com/spf13/cobra"
+)
+
+var snapshotBranch string
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Manage workspace snapshots in the SQLite database",
+	Long: `Snapshots freeze the whole delta layer (files, whiteouts and origins)
+under a name, so an agent's work can be checkpointed before a risky step
+and rolled back afterwards. Snapshots share file contents with the live
+tree, so creating one is cheap. Do not modify snapshots while a sandbox
+session is using the database.`,
+}
+
+var snapshotCreateCmd = &cobra.Command{
+	Use:   "create <name>",
+	Short: "Snapshot the current state of the database",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runSnapshotCmd(func(ctx context.Context, store *db.Store) error {
+			snap, err := store.CreateSnapshot(ctx, args[0])
+			if err != nil {
+				return fmt.Errorf("failed to create snapshot %q: %w", args[0], err)
+			}
+			fmt.Printf("Created snapshot %s (%d inodes, %s)\n",
+				snap.Name, snap.Inodes, supervisor.FormatSize(int64(snap.Size)))
+			return nil
+		})
+	},
+}
+
+var snapshotListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List snapshots",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		runSnapshotCmd(func(ctx context.Context, store *db.Store) error {
+			snaps, err := store.ListSnapshots(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to list snapshots: %w", err)
+			}
+			if len(snaps) == 0 {
+				fmt.Println("No snapshots")
+				return nil
+			}
+			fmt.Printf("%-24s %-20s %8s %10s\n", "NAME", "CREATED", "INODES", "SIZE")
+			for _, snap := range snaps {
+				created := time.Unix(snap.CreatedAt, 0).Format("2006-01-02 15:04:05")
+				fmt.Printf("%-24s %-20s %8d %10s\n",
+					snap.Name, created, snap.Inodes, supervisor.FormatSize(int64(snap.Size)))
+			}
+			return nil
+		})
+	},
+}
+
+var snapshotRestoreCmd = &cobra.Command{
+	Use:   "restore <name>",
+	Short: "Roll the database back to a snapshot, or fork a branch from it",
+	Long: `Replaces the live tree with the contents of the snapshot. Changes made
+since the snapshot are discarded unless they were snapshotted themselves.
+
+With --branch, the database is left untouched and a new database is created
+at the given path with the snapshot as its live tree.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runSnapshotCmd(func(ctx context.Context, store *db.Store) error {
+			if snapshotBranch != "" {
+				if err := store.ForkSnapshot(ctx, args[0], snapshotBranch); err != nil {
+					return fmt.Errorf("failed to fork snapshot %q: %w", args[0], err)
+				}
+				fmt.Printf("Forked snapshot %s into %s\n", args[0], snapshotBranch)
+				return nil
+			}
+
+			if err := store.RestoreSnapshot(ctx, args[0]); err != nil {
+				return fmt.Errorf("failed to restore snapshot %q: %w", args[0], err)
+			}
+			fmt.Printf("Restored snapshot %s\n", args[0])
+			return nil
+		})
+	},
+}
+
+var snapshotDeleteCmd = &cobra.Command{
+	Use:   "delete <name>",
+	Short: "Delete a snapshot",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runSnapshotCmd(func(ctx context.Context, store *db.Store) error {
+			if err := store.DeleteSnapshot(ctx, args[0]); err != nil {
+				return fmt.Errorf("failed to delete snapshot %q: %w", args[0], err)
+			}
+			fmt.Printf("Deleted snapshot %s\n", args[0])
+			return nil
+		})
+	},
+}
+
+func init() {
+	snapshotRestoreCmd.Flags().StringVar(&snapshotBranch, "branch", "", "Create a new database at this path instead of restoring in place")
+
+	snapshotCmd.AddCommand(snapshotCreateCmd, snapshotListCmd, snapshotRestoreCmd, snapshotDeleteCmd)
+	RootCmd.AddCommand(snapshotCmd)
+}
+
+// runSnapshotCmd opens the database given by --db and runs fn against it,
+// exiting on error
+func runSnapshotCmd(fn func(ctx context.Context, store *db.Store) error) {
+	if dbPath == "" {
+		fmt.Println("Error: --db flag is required")
+		os.Exit(1)
+	}
+
+	store, err := db.Open(db.DefaultConfig(dbPath))
+	if err != nil {
+		fmt.Printf("failed to open database: %v\n", err)
+		os.Exit(1)
+	}
+
+	err = fn(context.Background(), store)
+	store.Close()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
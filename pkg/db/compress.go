@@ -0,0 +1,94 @@
+package db
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Compression names a chunk compression algorithm
+type Compression string
+
+const (
+	CompressionNone    Compression = "none"    // Store chunks as-is
+	CompressionDeflate Compression = "deflate" // DEFLATE (compress/flate)
+)
+
+// Chunk codecs, recorded per chunk in fs_chunk.codec so that databases
+// written with different settings remain readable
+const (
+	codecNone    = 0
+	codecDeflate = 1
+)
+
+// ParseCompression validates a compression name.
+// An empty string selects no compression.
+func ParseCompression(s string) (Compression, error) {
+	switch Compression(s) {
+	case "":
+		return CompressionNone, nil
+	case CompressionNone, CompressionDeflate:
+		return Compression(s), nil
+	default:
+		return "", fmt.Errorf("invalid compression %q (want none or deflate)", s)
+	}
+}
+
+// codec returns the chunk codec used to store new chunks
+func (c Compression) codec() int {
+	if c == CompressionDeflate {
+		return codecDeflate
+	}
+	return codecNone
+}
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+// encodeChunk compresses data with the given codec. It returns the codec
+// actually used: chunks that don't shrink are stored uncompressed.
+func encodeChunk(codec int, data []byte) (int, []byte, error) {
+	if codec != codecDeflate || len(data) == 0 {
+		return codecNone, data, nil
+	}
+
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(data); err != nil {
+		return 0, nil, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, nil, err
+	}
+
+	if buf.Len() >= len(data) {
+		return codecNone, data, nil
+	}
+	return codecDeflate, buf.Bytes(), nil
+}
+
+// decodeChunk returns the uncompressed contents of a stored chunk
+func decodeChunk(codec int, data []byte) ([]byte, error) {
+	switch codec {
+	case codecNone:
+		return data, nil
+	case codecDeflate:
+		r := flate.NewReader(bytes.NewReader(data))
+		defer r.Close()
+		out, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress chunk: %w", err)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unknown chunk codec %d", codec)
+	}
+}
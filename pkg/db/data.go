@@ -1,64 +1,95 @@
 package db
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 )
 
-// ReadData reads file data at the given offset
+// ReadData reads file data at the given offset, up to the end of the file.
+// Chunks that were never written (holes) read as zeros.
 func (s *Store) ReadData(ctx context.Context, ino uint64, offset, length int64) ([]byte, error) {
 	if length <= 0 {
 		return nil, nil
 	}
 
+	var size int64
+	err := s.db.QueryRowContext(ctx, `SELECT size FROM fs_inode WHERE ino = ?`, ino).Scan(&size)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if offset >= size {
+		return nil, nil
+	}
+	length = min(length, size-offset)
+
 	chunkSize := s.chunkSize
-	startChunk := offset / chunkSize
-	endChunk := (offset + length - 1) / chunkSize
+	chunks, err := s.ReadChunks(ctx, ino, offset/chunkSize, (offset+length-1)/chunkSize)
+	if err != nil {
+		return nil, err
+	}
 
+	result := make([]byte, length)
+	for chunkIdx, data := range chunks {
+		// Copy the part of the chunk that falls in the requested range
+		chunkStart := chunkIdx * chunkSize
+		lo, hi := max(chunkStart, offset), min(chunkStart+int64(len(data)), offset+length)
+		if hi > lo {
+			copy(result[lo-offset:hi-offset], data[lo-chunkStart:hi-chunkStart])
+		}
+	}
+	return result, nil
+}
+
+// ReadChunks returns the stored chunks of an inode between two chunk
+// indexes (inclusive), by index. Chunks that were never written are missing.
+func (s *Store) ReadChunks(ctx context.Context, ino uint64, first, last int64) (map[int64][]byte, error) {
 	rows, err := s.db.QueryContext(ctx,
-		`SELECT chunk_index, data FROM fs_data
-		 WHERE ino = ? AND chunk_index >= ? AND chunk_index <= ?
-		 ORDER BY chunk_index`,
-		ino, startChunk, endChunk)
+		`SELECT d.chunk_index, c.codec, c.data FROM fs_data d
+		 JOIN fs_chunk c ON c.hash = d.hash
+		 WHERE d.ino = ? AND d.chunk_index >= ? AND d.chunk_index <= ?`,
+		ino, first, last)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	result := make([]byte, 0, length)
-	bytesRead := int64(0)
-
-	for rows.Next() && bytesRead < length {
+	chunks := make(map[int64][]byte)
+	for rows.Next() {
 		var chunkIdx int64
+		var codec int
 		var data []byte
-		if err := rows.Scan(&chunkIdx, &data); err != nil {
+		if err := rows.Scan(&chunkIdx, &codec, &data); err != nil {
 			return nil, err
 		}
-
-		chunkStart := chunkIdx * chunkSize
-
-		// Calculate the portion of this chunk we need
-		readStart := int64(0)
-		if offset > chunkStart {
-			readStart = offset - chunkStart
+		if chunks[chunkIdx], err = decodeChunk(codec, data); err != nil {
+			return nil, err
 		}
+	}
+	return chunks, rows.Err()
+}
 
-		readEnd := int64(len(data))
-		remaining := length - bytesRead
-		if readEnd-readStart > remaining {
-			readEnd = readStart + remaining
-		}
+// ListChunkIndexes returns the indexes of the stored chunks of an inode, in order
+func (s *Store) ListChunkIndexes(ctx context.Context, ino uint64) ([]int64, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT chunk_index FROM fs_data WHERE ino = ? ORDER BY chunk_index`, ino)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-		if readStart < int64(len(data)) && readEnd > readStart {
-			if readEnd > int64(len(data)) {
-				readEnd = int64(len(data))
-			}
-			result = append(result, data[readStart:readEnd]...)
-			bytesRead += readEnd - readStart
+	var indexes []int64
+	for rows.Next() {
+		var chunkIdx int64
+		if err := rows.Scan(&chunkIdx); err != nil {
+			return nil, err
 		}
+		indexes = append(indexes, chunkIdx)
 	}
-
-	return result, rows.Err()
+	return indexes, rows.Err()
 }
 
 // WriteData writes data at the given offset
@@ -107,10 +138,7 @@ func (s *Store) writeDataTx(ctx context.Context, tx *sql.Tx, ino uint64, offset
 		// Read existing chunk if we're doing a partial write
 		var existingData []byte
 		if writeStart > 0 || writeLen < chunkSize {
-			row := tx.QueryRowContext(ctx,
-				`SELECT data FROM fs_data WHERE ino = ? AND chunk_index = ?`,
-				ino, chunkIdx)
-			row.Scan(&existingData)
+			existingData, _ = s.readChunkTx(ctx, tx, ino, chunkIdx)
 		}
 
 		// Build new chunk data
@@ -134,10 +162,7 @@ func (s *Store) writeDataTx(ctx context.Context, tx *sql.Tx, ino uint64, offset
 		copy(newChunk[writeStart:], data[dataOffset:dataOffset+writeLen])
 
 		// Store the chunk
-		_, err := tx.ExecContext(ctx,
-			`INSERT OR REPLACE INTO fs_data (ino, chunk_index, data) VALUES (?, ?, ?)`,
-			ino, chunkIdx, newChunk)
-		if err != nil {
+		if err := s.storeChunkTx(ctx, tx, ino, chunkIdx, newChunk); err != nil {
 			return err
 		}
 
@@ -162,6 +187,11 @@ func (s *Store) TruncateTx(ctx context.Context, tx *sql.Tx, ino uint64, size uin
 func (s *Store) truncateTx(ctx context.Context, tx *sql.Tx, ino uint64, size uint64) error {
 	chunkSize := s.chunkSize
 
+	// Cut-off base contents don't come back when the file grows again
+	if err := s.shrinkLowerTx(ctx, tx, ino, size); err != nil {
+		return err
+	}
+
 	if size == 0 {
 		// Delete all chunks
 		_, err := tx.ExecContext(ctx, `DELETE FROM fs_data WHERE ino = ?`, ino)
@@ -182,11 +212,7 @@ func (s *Store) truncateTx(ctx context.Context, tx *sql.Tx, ino uint64, size uin
 	// Truncate the last chunk if needed
 	offsetInLastChunk := int64(size) - lastChunk*chunkSize
 
-	var existingData []byte
-	err = tx.QueryRowContext(ctx,
-		`SELECT data FROM fs_data WHERE ino = ? AND chunk_index = ?`,
-		ino, lastChunk).Scan(&existingData)
-
+	existingData, err := s.readChunkTx(ctx, tx, ino, lastChunk)
 	if err == sql.ErrNoRows {
 		// No data at this chunk yet, nothing to truncate
 		return nil
@@ -197,15 +223,60 @@ func (s *Store) truncateTx(ctx context.Context, tx *sql.Tx, ino uint64, size uin
 
 	if int64(len(existingData)) > offsetInLastChunk {
 		// Truncate the chunk
-		_, err = tx.ExecContext(ctx,
-			`UPDATE fs_data SET data = ? WHERE ino = ? AND chunk_index = ?`,
-			existingData[:offsetInLastChunk], ino, lastChunk)
-		return err
+		return s.storeChunkTx(ctx, tx, ino, lastChunk, existingData[:offsetInLastChunk])
 	}
 
 	return nil
 }
 
+// readChunkTx reads the uncompressed contents of a single chunk.
+// Returns sql.ErrNoRows if the chunk does not exist.
+func (s *Store) readChunkTx(ctx context.Context, tx *sql.Tx, ino uint64, chunkIdx int64) ([]byte, error) {
+	var codec int
+	var data []byte
+	err := tx.QueryRowContext(ctx,
+		`SELECT c.codec, c.data FROM fs_data d JOIN fs_chunk c ON c.hash = d.hash
+		 WHERE d.ino = ? AND d.chunk_index = ?`,
+		ino, chunkIdx).Scan(&codec, &data)
+	if err != nil {
+		return nil, err
+	}
+	return decodeChunk(codec, data)
+}
+
+// storeChunkTx points a chunk of an inode at the given contents. Chunks are
+// content-addressed and shared, so identical contents are stored only once
+// and never modified in place; the fs_data triggers keep reference counts
+// and free contents once nothing refers to them. The hash covers the
+// uncompressed data, so existing chunks are reused whatever their codec.
+func (s *Store) storeChunkTx(ctx context.Context, tx *sql.Tx, ino uint64, chunkIdx int64, data []byte) error {
+	hash := chunkHash(data)
+
+	var exists int
+	err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM fs_chunk WHERE hash = ?`, hash).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		codec, stored, err := encodeChunk(s.compression.codec(), data)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO fs_chunk (hash, codec, data) VALUES (?, ?, ?)`,
+			hash, codec, stored)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO fs_data (ino, chunk_index, hash) VALUES (?, ?, ?)
+		 ON CONFLICT (ino, chunk_index) DO UPDATE SET hash = excluded.hash`,
+		ino, chunkIdx, hash)
+	return err
+}
+
 // DeleteData deletes all data chunks for an inode
 func (s *Store) DeleteData(ctx context.Context, ino uint64) error {
 	_, err := s.db.ExecContext(ctx, `DELETE FROM fs_data WHERE ino = ?`, ino)
@@ -217,3 +288,197 @@ func (s *Store) DeleteDataTx(ctx context.Context, tx *sql.Tx, ino uint64) error
 	_, err := tx.ExecContext(ctx, `DELETE FROM fs_data WHERE ino = ?`, ino)
 	return err
 }
+
+// SameContentsTx checks if the stored contents of an inode equal data by
+// comparing chunk hashes, without reading or decompressing the chunks
+func (s *Store) SameContentsTx(ctx context.Context, tx *sql.Tx, ino uint64, data []byte) (bool, error) {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT chunk_index, hash FROM fs_data WHERE ino = ? ORDER BY chunk_index`, ino)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var next int64
+	for rows.Next() {
+		var chunkIdx int64
+		var hash []byte
+		if err := rows.Scan(&chunkIdx, &hash); err != nil {
+			return false, err
+		}
+		start := chunkIdx * s.chunkSize
+		if chunkIdx != next || start >= int64(len(data)) {
+			return false, nil // Hole or chunk past the end
+		}
+		end := min(start+s.chunkSize, int64(len(data)))
+		if !bytes.Equal(hash, chunkHash(data[start:end])) {
+			return false, nil
+		}
+		next++
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	return next*s.chunkSize >= int64(len(data)), nil
+}
+
+// readRangeTx reads length bytes at offset within a transaction, with
+// holes and bytes past the stored chunks read as zeros
+func (s *Store) readRangeTx(ctx context.Context, tx *sql.Tx, ino uint64, offset, length int64) ([]byte, error) {
+	result := make([]byte, length)
+	chunkSize := s.chunkSize
+	for chunkIdx := offset / chunkSize; chunkIdx*chunkSize < offset+length; chunkIdx++ {
+		data, err := s.readChunkTx(ctx, tx, ino, chunkIdx)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		chunkStart := chunkIdx * chunkSize
+		lo, hi := max(chunkStart, offset), min(chunkStart+int64(len(data)), offset+length)
+		if hi > lo {
+			copy(result[lo-offset:hi-offset], data[lo-chunkStart:hi-chunkStart])
+		}
+	}
+	return result, nil
+}
+
+// PunchHole zeroes length bytes at offset without changing the file size.
+// Chunks that lie wholly in the range are deleted and read as holes.
+func (s *Store) PunchHole(ctx context.Context, ino uint64, offset, length int64) error {
+	return s.WithTx(ctx, func(tx *sql.Tx) error {
+		return s.PunchHoleTx(ctx, tx, ino, offset, length)
+	})
+}
+
+// PunchHoleTx punches a hole within a transaction
+func (s *Store) PunchHoleTx(ctx context.Context, tx *sql.Tx, ino uint64, offset, length int64) error {
+	if length <= 0 {
+		return nil
+	}
+	chunkSize := s.chunkSize
+	end := offset + length
+
+	// Whole chunks go; the ones the range starts or ends in are zeroed
+	first := (offset + chunkSize - 1) / chunkSize
+	last := end / chunkSize // Exclusive
+	if first < last {
+		_, err := tx.ExecContext(ctx,
+			`DELETE FROM fs_data WHERE ino = ? AND chunk_index >= ? AND chunk_index < ?`,
+			ino, first, last)
+		if err != nil {
+			return err
+		}
+	}
+
+	var partial []int64
+	if head := offset / chunkSize; head < first || head >= last {
+		partial = append(partial, head)
+	}
+	if tail := (end - 1) / chunkSize; tail >= last && tail != offset/chunkSize {
+		partial = append(partial, tail)
+	}
+	for _, chunkIdx := range partial {
+		data, err := s.readChunkTx(ctx, tx, ino, chunkIdx)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		chunkStart := chunkIdx * chunkSize
+		lo, hi := max(chunkStart, offset), min(chunkStart+int64(len(data)), end)
+		if hi <= lo {
+			continue
+		}
+		clear(data[lo-chunkStart : hi-chunkStart])
+		if err := s.storeChunkTx(ctx, tx, ino, chunkIdx, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CopyRange copies length bytes at srcOff in src to dstOff in dst, up to
+// the end of src, and returns how many were copied. Whole chunks are
+// shared rather than copied, and holes stay holes, so srcOff and dstOff
+// must lie at the same offset within a chunk. Overlapping ranges of the
+// same file fail with ErrInvalid, as with copy_file_range. The size and
+// mtime of dst are updated as by a write.
+func (s *Store) CopyRange(ctx context.Context, src uint64, srcOff int64, dst uint64, dstOff, length int64) (int64, error) {
+	chunkSize := s.chunkSize
+	if srcOff%chunkSize != dstOff%chunkSize {
+		return 0, ErrInvalid
+	}
+
+	var copied int64
+	err := s.WithTx(ctx, func(tx *sql.Tx) error {
+		srcInode, err := s.GetInodeTx(ctx, tx, src)
+		if err != nil {
+			return err
+		}
+		length = min(length, int64(srcInode.Size)-srcOff)
+		if length <= 0 {
+			return nil
+		}
+		// Destination chunks are replaced before the source is read
+		if src == dst && srcOff < dstOff+length && dstOff < srcOff+length {
+			return ErrInvalid
+		}
+
+		// Bytes up to the first chunk boundary and after the last are
+		// copied, the chunks between them shared
+		head := min(length, (chunkSize-srcOff%chunkSize)%chunkSize)
+		chunks := (length - head) / chunkSize
+		tail := length - head - chunks*chunkSize
+
+		copyBytes := func(off, n int64) error {
+			if n == 0 {
+				return nil
+			}
+			data, err := s.readRangeTx(ctx, tx, src, srcOff+off, n)
+			if err != nil {
+				return err
+			}
+			return s.writeDataTx(ctx, tx, dst, dstOff+off, data)
+		}
+		if err := copyBytes(0, head); err != nil {
+			return err
+		}
+		if chunks > 0 {
+			srcFirst, dstFirst := (srcOff+head)/chunkSize, (dstOff+head)/chunkSize
+			_, err := tx.ExecContext(ctx,
+				`DELETE FROM fs_data WHERE ino = ? AND chunk_index >= ? AND chunk_index < ?`,
+				dst, dstFirst, dstFirst+chunks)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx,
+				`INSERT INTO fs_data (ino, chunk_index, hash)
+				 SELECT ?, chunk_index - ? + ?, hash FROM fs_data
+				 WHERE ino = ? AND chunk_index >= ? AND chunk_index < ?`,
+				dst, srcFirst, dstFirst, src, srcFirst, srcFirst+chunks)
+			if err != nil {
+				return err
+			}
+		}
+		if err := copyBytes(length-tail, tail); err != nil {
+			return err
+		}
+
+		dstInode, err := s.GetInodeTx(ctx, tx, dst)
+		if err != nil {
+			return err
+		}
+		dstInode.Size = max(dstInode.Size, uint64(dstOff+length))
+		dstInode.Mtime = nowUnix()
+		dstInode.Ctime = dstInode.Mtime
+		if err := s.UpdateInodeTx(ctx, tx, dstInode); err != nil {
+			return err
+		}
+		copied = length
+		return nil
+	})
+	return copied, err
+}
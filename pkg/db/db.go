@@ -15,12 +15,16 @@ var (
 	ErrNotFound = errors.New("not found")
 	ErrExists   = errors.New("already exists")
 	ErrNotEmpty = errors.New("directory not empty")
+	ErrNotDir   = errors.New("not a directory")
+	ErrIsDir    = errors.New("is a directory")
+	ErrInvalid  = errors.New("invalid argument")
 )
 
 // Store provides all database operations for the filesystem
 type Store struct {
-	db        *sql.DB
-	chunkSize int64
+	db          *sql.DB
+	chunkSize   int64
+	compression Compression
 }
 
 // Config holds database configuration
@@ -28,6 +32,7 @@ type Config struct {
 	Path        string
 	ChunkSize   int64
 	BusyTimeout time.Duration
+	Compression Compression // Codec for new chunks (empty = keep the database's setting)
 }
 
 // DefaultConfig returns a config with sensible defaults
@@ -79,6 +84,13 @@ func Open(cfg Config) (*Store, error) {
 		fmt.Sscanf(chunkSizeStr, "%d", &store.chunkSize)
 	}
 
+	// Compression applies to newly written chunks only, so it can be changed
+	// at any time; an explicit setting is persisted for later sessions
+	if err := store.initCompression(cfg.Compression); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return store, nil
 }
 
@@ -92,6 +104,34 @@ func (s *Store) ChunkSize() int64 {
 	return s.chunkSize
 }
 
+// Compression returns the codec used for newly written chunks
+func (s *Store) Compression() Compression {
+	return s.compression
+}
+
+// initCompression resolves the compression setting, persisting it if given
+func (s *Store) initCompression(c Compression) error {
+	if c != "" {
+		if _, err := ParseCompression(string(c)); err != nil {
+			return err
+		}
+		_, err := s.db.Exec(`INSERT OR REPLACE INTO fs_config (key, value) VALUES ('compression', ?)`, string(c))
+		if err != nil {
+			return fmt.Errorf("failed to save compression setting: %w", err)
+		}
+		s.compression = c
+		return nil
+	}
+
+	var value string
+	err := s.db.QueryRow("SELECT value FROM fs_config WHERE key = 'compression'").Scan(&value)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	s.compression, err = ParseCompression(value)
+	return err
+}
+
 // WithTx executes a function within a transaction
 func (s *Store) WithTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
 	tx, err := s.db.BeginTx(ctx, nil)
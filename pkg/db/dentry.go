@@ -36,6 +36,21 @@ func (s *Store) Lookup(ctx context.Context, parentIno uint64, name string) (uint
 	return ino, nil
 }
 
+// LookupTx finds a child inode by name within a transaction
+func (s *Store) LookupTx(ctx context.Context, tx *sql.Tx, parentIno uint64, name string) (uint64, error) {
+	var ino uint64
+	err := tx.QueryRowContext(ctx,
+		`SELECT ino FROM fs_dentry WHERE parent_ino = ? AND name = ?`,
+		parentIno, name).Scan(&ino)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return ino, nil
+}
+
 // ListDir lists all entries in a directory
 func (s *Store) ListDir(ctx context.Context, parentIno uint64) ([]Dentry, error) {
 	rows, err := s.db.QueryContext(ctx,
@@ -44,6 +59,22 @@ func (s *Store) ListDir(ctx context.Context, parentIno uint64) ([]Dentry, error)
 	if err != nil {
 		return nil, err
 	}
+	return scanDentries(rows, parentIno)
+}
+
+// ListDirTx lists all entries in a directory within a transaction
+func (s *Store) ListDirTx(ctx context.Context, tx *sql.Tx, parentIno uint64) ([]Dentry, error) {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT name, ino FROM fs_dentry WHERE parent_ino = ? ORDER BY name`,
+		parentIno)
+	if err != nil {
+		return nil, err
+	}
+	return scanDentries(rows, parentIno)
+}
+
+// scanDentries reads the (name, ino) rows of a directory listing
+func scanDentries(rows *sql.Rows, parentIno uint64) ([]Dentry, error) {
 	defer rows.Close()
 
 	var entries []Dentry
@@ -116,72 +147,193 @@ func (s *Store) DeleteDentryTx(ctx context.Context, tx *sql.Tx, parentIno uint64
 	return nil
 }
 
+// Rename flags (matching renameat2)
+const (
+	RENAME_NOREPLACE = 1 << 0 // Fail if the target exists
+	RENAME_EXCHANGE  = 1 << 1 // Atomically swap source and target
+	RENAME_WHITEOUT  = 1 << 2 // Leave a whiteout (char device 0/0) at the source
+)
+
 // Rename moves/renames a directory entry
-func (s *Store) Rename(ctx context.Context, oldParentIno, newParentIno uint64, oldName, newName string) error {
+func (s *Store) Rename(ctx context.Context, oldParentIno, newParentIno uint64, oldName, newName string, flags uint32) error {
 	return s.WithTx(ctx, func(tx *sql.Tx) error {
-		// Get the inode being moved
-		var ino uint64
-		err := tx.QueryRowContext(ctx,
-			`SELECT ino FROM fs_dentry WHERE parent_ino = ? AND name = ?`,
-			oldParentIno, oldName).Scan(&ino)
-		if err == sql.ErrNoRows {
+		return s.RenameTx(ctx, tx, oldParentIno, newParentIno, oldName, newName, flags)
+	})
+}
+
+// RenameTx moves/renames a directory entry within a transaction. A
+// replaced target is unlinked like by unlink/rmdir; with RENAME_EXCHANGE
+// the two entries swap inodes instead.
+func (s *Store) RenameTx(ctx context.Context, tx *sql.Tx, oldParentIno, newParentIno uint64, oldName, newName string, flags uint32) error {
+	if flags&^(RENAME_NOREPLACE|RENAME_EXCHANGE|RENAME_WHITEOUT) != 0 {
+		return ErrInvalid
+	}
+	if flags&RENAME_EXCHANGE != 0 && flags&(RENAME_NOREPLACE|RENAME_WHITEOUT) != 0 {
+		return ErrInvalid
+	}
+
+	ino, err := s.LookupTx(ctx, tx, oldParentIno, oldName)
+	if err != nil {
+		return err
+	}
+	inode, err := s.GetInodeTx(ctx, tx, ino)
+	if err != nil {
+		return err
+	}
+
+	targetIno, err := s.LookupTx(ctx, tx, newParentIno, newName)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	targetExists := err == nil
+
+	if flags&RENAME_EXCHANGE != 0 {
+		if !targetExists {
 			return ErrNotFound
 		}
-		if err != nil {
+		return s.exchangeTx(ctx, tx, oldParentIno, newParentIno, oldName, newName, inode, targetIno)
+	}
+
+	if targetExists {
+		if flags&RENAME_NOREPLACE != 0 {
+			return ErrExists
+		}
+		// Renaming a link onto another link of the same inode does nothing
+		if targetIno == ino {
+			return nil
+		}
+		if err := s.unlinkTargetTx(ctx, tx, newParentIno, newName, inode, targetIno); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE fs_dentry SET parent_ino = ?, name = ? WHERE parent_ino = ? AND name = ?`,
+		newParentIno, newName, oldParentIno, oldName)
+	if err != nil {
+		return err
+	}
+
+	// A directory's ".." moves to its new parent
+	if inode.IsDir() && oldParentIno != newParentIno {
+		if _, err := s.DecrNlinkTx(ctx, tx, oldParentIno); err != nil {
 			return err
 		}
+		if err := s.IncrNlinkTx(ctx, tx, newParentIno); err != nil {
+			return err
+		}
+	}
 
-		// Check if target exists and delete if so
-		var targetIno uint64
-		err = tx.QueryRowContext(ctx,
-			`SELECT ino FROM fs_dentry WHERE parent_ino = ? AND name = ?`,
-			newParentIno, newName).Scan(&targetIno)
-		if err == nil {
-			// Target exists, check if it's a directory
-			var targetMode uint32
-			tx.QueryRowContext(ctx, `SELECT mode FROM fs_inode WHERE ino = ?`, targetIno).Scan(&targetMode)
-
-			if targetMode&S_IFMT == S_IFDIR {
-				// Check if directory is empty
-				var count int
-				tx.QueryRowContext(ctx,
-					`SELECT COUNT(*) FROM fs_dentry WHERE parent_ino = ?`,
-					targetIno).Scan(&count)
-				if count > 0 {
-					return ErrNotEmpty
-				}
-			}
-
-			// Delete target dentry
-			tx.ExecContext(ctx,
-				`DELETE FROM fs_dentry WHERE parent_ino = ? AND name = ?`,
-				newParentIno, newName)
-
-			// Decrement target's link count
-			tx.ExecContext(ctx,
-				`UPDATE fs_inode SET nlink = nlink - 1 WHERE ino = ?`, targetIno)
-
-			// Delete target inode if nlink = 0
-			tx.ExecContext(ctx,
-				`DELETE FROM fs_inode WHERE ino = ? AND nlink = 0`, targetIno)
-		} else if err != sql.ErrNoRows {
+	if flags&RENAME_WHITEOUT != 0 {
+		whiteoutIno, err := s.CreateNodeTx(ctx, tx, S_IFCHR, inode.UID, inode.GID, 0)
+		if err != nil {
 			return err
 		}
+		return s.CreateDentryTx(ctx, tx, oldParentIno, oldName, whiteoutIno)
+	}
+	return nil
+}
 
-		// Delete old entry
-		_, err = tx.ExecContext(ctx,
-			`DELETE FROM fs_dentry WHERE parent_ino = ? AND name = ?`,
-			oldParentIno, oldName)
+// unlinkTargetTx removes the entry a rename replaces, freeing its inode
+// when this was the last link
+func (s *Store) unlinkTargetTx(ctx context.Context, tx *sql.Tx, parentIno uint64, name string, source *Inode, targetIno uint64) error {
+	target, err := s.GetInodeTx(ctx, tx, targetIno)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case source.IsDir() && !target.IsDir():
+		return ErrNotDir
+	case !source.IsDir() && target.IsDir():
+		return ErrIsDir
+	}
+
+	if target.IsDir() {
+		var count int
+		err := tx.QueryRowContext(ctx,
+			`SELECT COUNT(*) FROM fs_dentry WHERE parent_ino = ?`,
+			targetIno).Scan(&count)
 		if err != nil {
 			return err
 		}
+		if count > 0 {
+			return ErrNotEmpty
+		}
+	}
 
-		// Create new entry
-		_, err = tx.ExecContext(ctx,
-			`INSERT INTO fs_dentry (parent_ino, name, ino) VALUES (?, ?, ?)`,
-			newParentIno, newName, ino)
+	if err := s.DeleteDentryTx(ctx, tx, parentIno, name); err != nil {
 		return err
-	})
+	}
+
+	if target.IsDir() {
+		if err := s.DeleteOriginTx(ctx, tx, targetIno); err != nil {
+			return err
+		}
+		if err := s.DeleteInodeTx(ctx, tx, targetIno); err != nil {
+			return err
+		}
+		// The replaced directory's ".." is gone
+		_, err = s.DecrNlinkTx(ctx, tx, parentIno)
+		return err
+	}
+
+	remaining, err := s.DecrNlinkTx(ctx, tx, targetIno)
+	if err != nil {
+		return err
+	}
+	if remaining > 0 {
+		return nil
+	}
+	if target.IsSymlink() {
+		err = s.DeleteSymlinkTx(ctx, tx, targetIno)
+	} else {
+		err = s.DeleteDataTx(ctx, tx, targetIno)
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.DeleteOriginTx(ctx, tx, targetIno); err != nil {
+		return err
+	}
+	return s.DeleteInodeTx(ctx, tx, targetIno)
+}
+
+// exchangeTx swaps the inodes of two directory entries
+func (s *Store) exchangeTx(ctx context.Context, tx *sql.Tx, oldParentIno, newParentIno uint64, oldName, newName string, source *Inode, targetIno uint64) error {
+	if targetIno == source.Ino {
+		return nil
+	}
+	target, err := s.GetInodeTx(ctx, tx, targetIno)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE fs_dentry SET ino = ? WHERE parent_ino = ? AND name = ?`,
+		targetIno, oldParentIno, oldName)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		`UPDATE fs_dentry SET ino = ? WHERE parent_ino = ? AND name = ?`,
+		source.Ino, newParentIno, newName)
+	if err != nil {
+		return err
+	}
+
+	// Swapping a directory with a non-directory across parents moves a ".."
+	if oldParentIno == newParentIno || source.IsDir() == target.IsDir() {
+		return nil
+	}
+	from, to := oldParentIno, newParentIno
+	if target.IsDir() {
+		from, to = newParentIno, oldParentIno
+	}
+	if _, err := s.DecrNlinkTx(ctx, tx, from); err != nil {
+		return err
+	}
+	return s.IncrNlinkTx(ctx, tx, to)
 }
 
 // HasChildren returns true if the directory has any entries
@@ -12,6 +12,10 @@ const (
 	S_IFDIR  = 0o040000 // Directory
 	S_IFREG  = 0o100000 // Regular file
 	S_IFLNK  = 0o120000 // Symbolic link
+	S_IFBLK  = 0o060000 // Block device
+	S_IFCHR  = 0o020000 // Character device
+	S_IFIFO  = 0o010000 // FIFO
+	S_IFSOCK = 0o140000 // Socket
 )
 
 // Inode represents file/directory metadata
@@ -25,6 +29,7 @@ type Inode struct {
 	Atime int64 // Unix timestamp (seconds)
 	Mtime int64
 	Ctime int64
+	Rdev  uint32 // Device number of character and block devices
 }
 
 // IsDir returns true if the inode is a directory
@@ -83,15 +88,62 @@ func (s *Store) CreateInodeTx(ctx context.Context, tx *sql.Tx, mode, uid, gid ui
 	return uint64(ino), nil
 }
 
+// CreateNode creates an inode for a special file (FIFO, socket or device)
+// and returns its number
+func (s *Store) CreateNode(ctx context.Context, mode, uid, gid, rdev uint32) (uint64, error) {
+	now := nowUnix()
+	result, err := s.db.ExecContext(ctx,
+		`INSERT INTO fs_inode (mode, nlink, uid, gid, size, atime, mtime, ctime, rdev)
+		 VALUES (?, 1, ?, ?, 0, ?, ?, ?, ?)`,
+		mode, uid, gid, now, now, now, rdev)
+	if err != nil {
+		return 0, err
+	}
+
+	ino, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(ino), nil
+}
+
+// CreateNodeTx creates an inode for a special file within a transaction
+func (s *Store) CreateNodeTx(ctx context.Context, tx *sql.Tx, mode, uid, gid, rdev uint32) (uint64, error) {
+	now := nowUnix()
+	result, err := tx.ExecContext(ctx,
+		`INSERT INTO fs_inode (mode, nlink, uid, gid, size, atime, mtime, ctime, rdev)
+		 VALUES (?, 1, ?, ?, 0, ?, ?, ?, ?)`,
+		mode, uid, gid, now, now, now, rdev)
+	if err != nil {
+		return 0, err
+	}
+
+	ino, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(ino), nil
+}
+
 // GetInode retrieves an inode by number
 func (s *Store) GetInode(ctx context.Context, ino uint64) (*Inode, error) {
-	row := s.db.QueryRowContext(ctx,
-		`SELECT ino, mode, nlink, uid, gid, size, atime, mtime, ctime
-		 FROM fs_inode WHERE ino = ?`, ino)
+	return scanInode(s.db.QueryRowContext(ctx,
+		`SELECT ino, mode, nlink, uid, gid, size, atime, mtime, ctime, rdev
+		 FROM fs_inode WHERE ino = ?`, ino))
+}
+
+// GetInodeTx retrieves an inode by number within a transaction
+func (s *Store) GetInodeTx(ctx context.Context, tx *sql.Tx, ino uint64) (*Inode, error) {
+	return scanInode(tx.QueryRowContext(ctx,
+		`SELECT ino, mode, nlink, uid, gid, size, atime, mtime, ctime, rdev
+		 FROM fs_inode WHERE ino = ?`, ino))
+}
 
+// scanInode reads a single inode row
+func scanInode(row *sql.Row) (*Inode, error) {
 	inode := &Inode{}
 	err := row.Scan(&inode.Ino, &inode.Mode, &inode.Nlink, &inode.UID, &inode.GID,
-		&inode.Size, &inode.Atime, &inode.Mtime, &inode.Ctime)
+		&inode.Size, &inode.Atime, &inode.Mtime, &inode.Ctime, &inode.Rdev)
 	if err == sql.ErrNoRows {
 		return nil, ErrNotFound
 	}
@@ -154,14 +206,21 @@ func (s *Store) UpdateTimes(ctx context.Context, ino uint64, atime, mtime *int64
 	return err
 }
 
-// DeleteInode deletes an inode (should only be called when nlink=0)
+// DeleteInode deletes an inode and its xattrs (should only be called when nlink=0)
 func (s *Store) DeleteInode(ctx context.Context, ino uint64) error {
-	_, err := s.db.ExecContext(ctx, `DELETE FROM fs_inode WHERE ino=?`, ino)
-	return err
+	return s.WithTx(ctx, func(tx *sql.Tx) error {
+		return s.DeleteInodeTx(ctx, tx, ino)
+	})
 }
 
-// DeleteInodeTx deletes an inode within a transaction
+// DeleteInodeTx deletes an inode and its xattrs within a transaction
 func (s *Store) DeleteInodeTx(ctx context.Context, tx *sql.Tx, ino uint64) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM fs_xattr WHERE ino=?`, ino); err != nil {
+		return err
+	}
+	if err := s.DeleteLowerTx(ctx, tx, ino); err != nil {
+		return err
+	}
 	_, err := tx.ExecContext(ctx, `DELETE FROM fs_inode WHERE ino=?`, ino)
 	return err
 }
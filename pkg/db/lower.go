@@ -0,0 +1,85 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Lower is the base file behind a partially copied-up inode. Chunks of the
+// inode without fs_data rows are read from it, up to Size, for as long as
+// it still has the inode number, size and mtime it had at copy-up.
+type Lower struct {
+	Ino       uint64
+	Path      string // Path in the base layer
+	Size      int64  // Bytes of the inode that may come from the base file
+	BaseIno   uint64
+	BaseSize  int64
+	BaseMtime int64
+}
+
+// SetLowerTx records the base file behind an inode within a transaction
+func (s *Store) SetLowerTx(ctx context.Context, tx *sql.Tx, l *Lower) error {
+	_, err := tx.ExecContext(ctx,
+		`INSERT OR REPLACE INTO fs_lower (ino, path, size, base_ino, base_size, base_mtime)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		l.Ino, l.Path, l.Size, l.BaseIno, l.BaseSize, l.BaseMtime)
+	return err
+}
+
+// GetLower returns the base file behind an inode, or ErrNotFound if the
+// inode is fully stored
+func (s *Store) GetLower(ctx context.Context, ino uint64) (*Lower, error) {
+	l := &Lower{Ino: ino}
+	err := s.db.QueryRowContext(ctx,
+		`SELECT path, size, base_ino, base_size, base_mtime FROM fs_lower WHERE ino = ?`,
+		ino).Scan(&l.Path, &l.Size, &l.BaseIno, &l.BaseSize, &l.BaseMtime)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// ListLowers returns the base files behind all partially copied-up inodes
+func (s *Store) ListLowers(ctx context.Context) ([]Lower, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT ino, path, size, base_ino, base_size, base_mtime FROM fs_lower ORDER BY ino`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lowers []Lower
+	for rows.Next() {
+		var l Lower
+		if err := rows.Scan(&l.Ino, &l.Path, &l.Size, &l.BaseIno, &l.BaseSize, &l.BaseMtime); err != nil {
+			return nil, err
+		}
+		lowers = append(lowers, l)
+	}
+	return lowers, rows.Err()
+}
+
+// DeleteLower forgets the base file behind an inode
+func (s *Store) DeleteLower(ctx context.Context, ino uint64) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM fs_lower WHERE ino = ?`, ino)
+	return err
+}
+
+// DeleteLowerTx forgets the base file behind an inode within a transaction
+func (s *Store) DeleteLowerTx(ctx context.Context, tx *sql.Tx, ino uint64) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM fs_lower WHERE ino = ?`, ino)
+	return err
+}
+
+// shrinkLowerTx stops reading base contents past size, for a truncated inode
+func (s *Store) shrinkLowerTx(ctx context.Context, tx *sql.Tx, ino uint64, size uint64) error {
+	if size == 0 {
+		return s.DeleteLowerTx(ctx, tx, ino)
+	}
+	_, err := tx.ExecContext(ctx,
+		`UPDATE fs_lower SET size = ? WHERE ino = ? AND size > ?`, size, ino, size)
+	return err
+}
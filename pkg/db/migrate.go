@@ -0,0 +1,141 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+)
+
+// migrations upgrade an existing database from version i to version i+1
+var migrations = []func(ctx context.Context, tx *sql.Tx) error{
+	migrateChunks,
+}
+
+// migrate brings an existing database up to schemaVersion. Fresh databases
+// are left alone; initSchema creates them at the current version.
+func (s *Store) migrate() error {
+	var tables int
+	err := s.db.QueryRow(
+		`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'fs_config'`).Scan(&tables)
+	if err != nil {
+		return err
+	}
+	if tables == 0 {
+		return nil
+	}
+
+	version := 0
+	var versionStr string
+	err = s.db.QueryRow(`SELECT value FROM fs_config WHERE key = 'schema_version'`).Scan(&versionStr)
+	if err == nil {
+		fmt.Sscanf(versionStr, "%d", &version)
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+	if version > schemaVersion {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", version, schemaVersion)
+	}
+
+	ctx := context.Background()
+	for ; version < schemaVersion; version++ {
+		err := s.WithTx(ctx, func(tx *sql.Tx) error {
+			if err := migrations[version](ctx, tx); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO fs_config (key, value) VALUES ('schema_version', ?)`,
+				fmt.Sprintf("%d", version+1))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to migrate schema to version %d: %w", version+1, err)
+		}
+	}
+	return nil
+}
+
+// migrateChunks (v0 -> v1) moves chunk contents out of fs_data into the
+// content-addressed fs_chunk table, deduplicating identical chunks, and
+// adds device numbers to inodes. Tables that are new since v0 are created
+// with the rest of the schema.
+func migrateChunks(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+		ALTER TABLE fs_inode ADD COLUMN rdev INTEGER NOT NULL DEFAULT 0;
+
+		CREATE TABLE fs_chunk (
+			hash BLOB PRIMARY KEY,
+			refs INTEGER NOT NULL DEFAULT 0,
+			codec INTEGER NOT NULL DEFAULT 0,
+			data BLOB NOT NULL
+		);
+		ALTER TABLE fs_data RENAME TO fs_data_v0;
+		CREATE TABLE fs_data (
+			ino INTEGER NOT NULL,
+			chunk_index INTEGER NOT NULL,
+			hash BLOB NOT NULL,
+			PRIMARY KEY (ino, chunk_index),
+			FOREIGN KEY (ino) REFERENCES fs_inode(ino) ON DELETE CASCADE,
+			FOREIGN KEY (hash) REFERENCES fs_chunk(hash)
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Hash chunks in batches; contents may not fit in memory all at once.
+	// The reference counting triggers don't exist yet, so count here.
+	var lastID int64
+	for {
+		rows, err := tx.QueryContext(ctx,
+			`SELECT rowid, ino, chunk_index, data FROM fs_data_v0 WHERE rowid > ? ORDER BY rowid LIMIT 256`, lastID)
+		if err != nil {
+			return err
+		}
+
+		type chunk struct {
+			id    int64
+			ino   int64
+			index int64
+			data  []byte
+		}
+		var batch []chunk
+		for rows.Next() {
+			var c chunk
+			if err := rows.Scan(&c.id, &c.ino, &c.index, &c.data); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, c := range batch {
+			hash := chunkHash(c.data)
+			if _, err := tx.ExecContext(ctx, `
+				INSERT INTO fs_chunk (hash, refs, data) VALUES (?, 1, ?)
+				ON CONFLICT (hash) DO UPDATE SET refs = refs + 1`, hash, c.data); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx,
+				`INSERT INTO fs_data (ino, chunk_index, hash) VALUES (?, ?, ?)`, c.ino, c.index, hash); err != nil {
+				return err
+			}
+			lastID = c.id
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `DROP TABLE fs_data_v0`)
+	return err
+}
+
+// chunkHash returns the content address of a chunk
+func chunkHash(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
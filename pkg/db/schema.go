@@ -4,6 +4,9 @@ import (
 	"fmt"
 )
 
+// schemaVersion is the current on-disk layout version, stored in fs_config
+const schemaVersion = 1
+
 const schema = `
 -- Filesystem configuration
 CREATE TABLE IF NOT EXISTS fs_config (
@@ -21,7 +24,8 @@ CREATE TABLE IF NOT EXISTS fs_inode (
 	size INTEGER NOT NULL DEFAULT 0,
 	atime INTEGER NOT NULL,
 	mtime INTEGER NOT NULL,
-	ctime INTEGER NOT NULL
+	ctime INTEGER NOT NULL,
+	rdev INTEGER NOT NULL DEFAULT 0
 );
 
 -- Directory entries (maps names to inodes)
@@ -38,13 +42,24 @@ CREATE TABLE IF NOT EXISTS fs_dentry (
 CREATE INDEX IF NOT EXISTS idx_fs_dentry_parent ON fs_dentry(parent_ino, name);
 CREATE INDEX IF NOT EXISTS idx_fs_dentry_ino ON fs_dentry(ino);
 
--- File content in chunks
+-- Content-addressed chunk contents (keyed by SHA-256 of the uncompressed
+-- data), shared between files and snapshots. refs counts fs_data and
+-- fs_snapshot_data rows; codec records how data is compressed.
+CREATE TABLE IF NOT EXISTS fs_chunk (
+	hash BLOB PRIMARY KEY,
+	refs INTEGER NOT NULL DEFAULT 0,
+	codec INTEGER NOT NULL DEFAULT 0,
+	data BLOB NOT NULL
+);
+
+-- File content in chunks (maps each chunk of an inode to its contents)
 CREATE TABLE IF NOT EXISTS fs_data (
 	ino INTEGER NOT NULL,
 	chunk_index INTEGER NOT NULL,
-	data BLOB NOT NULL,
+	hash BLOB NOT NULL,
 	PRIMARY KEY (ino, chunk_index),
-	FOREIGN KEY (ino) REFERENCES fs_inode(ino) ON DELETE CASCADE
+	FOREIGN KEY (ino) REFERENCES fs_inode(ino) ON DELETE CASCADE,
+	FOREIGN KEY (hash) REFERENCES fs_chunk(hash)
 );
 
 -- Symbolic link targets
@@ -69,10 +84,147 @@ CREATE TABLE IF NOT EXISTS fs_origin (
 	base_ino INTEGER NOT NULL,
 	FOREIGN KEY (delta_ino) REFERENCES fs_inode(ino) ON DELETE CASCADE
 );
+
+-- Base files behind partially copied-up inodes (see Lower): chunks
+-- without fs_data rows below size are read from path in the base layer
+CREATE TABLE IF NOT EXISTS fs_lower (
+	ino INTEGER PRIMARY KEY,
+	path TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	base_ino INTEGER NOT NULL,
+	base_size INTEGER NOT NULL,
+	base_mtime INTEGER NOT NULL,
+	FOREIGN KEY (ino) REFERENCES fs_inode(ino) ON DELETE CASCADE
+);
+
+-- Extended attributes
+CREATE TABLE IF NOT EXISTS fs_xattr (
+	ino INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	value BLOB NOT NULL,
+	PRIMARY KEY (ino, name),
+	FOREIGN KEY (ino) REFERENCES fs_inode(ino) ON DELETE CASCADE
+);
+
+-- Named snapshots of the tree
+CREATE TABLE IF NOT EXISTS fs_snapshot (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	created_at INTEGER NOT NULL
+);
+
+-- Frozen copies of the tree tables, keyed by snapshot
+CREATE TABLE IF NOT EXISTS fs_snapshot_inode (
+	snapshot_id INTEGER NOT NULL,
+	ino INTEGER NOT NULL,
+	mode INTEGER NOT NULL,
+	nlink INTEGER NOT NULL,
+	uid INTEGER NOT NULL,
+	gid INTEGER NOT NULL,
+	size INTEGER NOT NULL,
+	atime INTEGER NOT NULL,
+	mtime INTEGER NOT NULL,
+	ctime INTEGER NOT NULL,
+	rdev INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (snapshot_id, ino)
+);
+
+CREATE TABLE IF NOT EXISTS fs_snapshot_dentry (
+	snapshot_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	parent_ino INTEGER NOT NULL,
+	ino INTEGER NOT NULL,
+	PRIMARY KEY (snapshot_id, parent_ino, name)
+);
+
+CREATE TABLE IF NOT EXISTS fs_snapshot_data (
+	snapshot_id INTEGER NOT NULL,
+	ino INTEGER NOT NULL,
+	chunk_index INTEGER NOT NULL,
+	hash BLOB NOT NULL,
+	PRIMARY KEY (snapshot_id, ino, chunk_index)
+);
+
+CREATE TABLE IF NOT EXISTS fs_snapshot_symlink (
+	snapshot_id INTEGER NOT NULL,
+	ino INTEGER NOT NULL,
+	target TEXT NOT NULL,
+	PRIMARY KEY (snapshot_id, ino)
+);
+
+CREATE TABLE IF NOT EXISTS fs_snapshot_whiteout (
+	snapshot_id INTEGER NOT NULL,
+	path TEXT NOT NULL,
+	parent_path TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	PRIMARY KEY (snapshot_id, path)
+);
+
+CREATE TABLE IF NOT EXISTS fs_snapshot_origin (
+	snapshot_id INTEGER NOT NULL,
+	delta_ino INTEGER NOT NULL,
+	base_ino INTEGER NOT NULL,
+	PRIMARY KEY (snapshot_id, delta_ino)
+);
+
+CREATE TABLE IF NOT EXISTS fs_snapshot_lower (
+	snapshot_id INTEGER NOT NULL,
+	ino INTEGER NOT NULL,
+	path TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	base_ino INTEGER NOT NULL,
+	base_size INTEGER NOT NULL,
+	base_mtime INTEGER NOT NULL,
+	PRIMARY KEY (snapshot_id, ino)
+);
+
+CREATE TABLE IF NOT EXISTS fs_snapshot_xattr (
+	snapshot_id INTEGER NOT NULL,
+	ino INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	value BLOB NOT NULL,
+	PRIMARY KEY (snapshot_id, ino, name)
+);
+
+-- Chunk reference counting; chunks are freed when the last reference goes
+CREATE TRIGGER IF NOT EXISTS fs_data_ref AFTER INSERT ON fs_data
+BEGIN
+	UPDATE fs_chunk SET refs = refs + 1 WHERE hash = NEW.hash;
+END;
+
+CREATE TRIGGER IF NOT EXISTS fs_data_unref AFTER DELETE ON fs_data
+BEGIN
+	UPDATE fs_chunk SET refs = refs - 1 WHERE hash = OLD.hash;
+	DELETE FROM fs_chunk WHERE hash = OLD.hash AND refs <= 0;
+END;
+
+CREATE TRIGGER IF NOT EXISTS fs_data_reref AFTER UPDATE OF hash ON fs_data
+WHEN OLD.hash != NEW.hash
+BEGIN
+	UPDATE fs_chunk SET refs = refs + 1 WHERE hash = NEW.hash;
+	UPDATE fs_chunk SET refs = refs - 1 WHERE hash = OLD.hash;
+	DELETE FROM fs_chunk WHERE hash = OLD.hash AND refs <= 0;
+END;
+
+CREATE TRIGGER IF NOT EXISTS fs_snapshot_data_ref AFTER INSERT ON fs_snapshot_data
+BEGIN
+	UPDATE fs_chunk SET refs = refs + 1 WHERE hash = NEW.hash;
+END;
+
+CREATE TRIGGER IF NOT EXISTS fs_snapshot_data_unref AFTER DELETE ON fs_snapshot_data
+BEGIN
+	UPDATE fs_chunk SET refs = refs - 1 WHERE hash = OLD.hash;
+	DELETE FROM fs_chunk WHERE hash = OLD.hash AND refs <= 0;
+END;
 `
 
 // initSchema initializes the database schema
 func (s *Store) initSchema() error {
+	// Upgrade databases created by older versions
+	if err := s.migrate(); err != nil {
+		return err
+	}
+
 	// Create tables
 	if _, err := s.db.Exec(schema); err != nil {
 		return fmt.Errorf("failed to create schema: %w", err)
@@ -84,6 +236,11 @@ func (s *Store) initSchema() error {
 	if err != nil {
 		return fmt.Errorf("failed to initialize config: %w", err)
 	}
+	_, err = s.db.Exec(`INSERT OR IGNORE INTO fs_config (key, value) VALUES ('schema_version', ?)`,
+		fmt.Sprintf("%d", schemaVersion))
+	if err != nil {
+		return fmt.Errorf("failed to initialize config: %w", err)
+	}
 
 	// Create root inode if not exists (ino=1, mode=S_IFDIR|0755 = 16877)
 	// S_IFDIR = 0o040000 = 16384, 0755 = 493, total = 16877
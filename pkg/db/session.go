@@ -0,0 +1,46 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// BeginSession records the time the agent started working on the database,
+// unless a session is already open. The session stays open until EndSession
+// so that several sandbox runs between two pulls count as one session.
+func (s *Store) BeginSession(ctx context.Context) error {
+	return s.BeginSessionAt(ctx, nowUnix())
+}
+
+// BeginSessionAt records a session that started at the given Unix time,
+// unless a session is already open
+func (s *Store) BeginSessionAt(ctx context.Context, start int64) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT OR IGNORE INTO fs_config (key, value) VALUES ('session_start', ?)`,
+		fmt.Sprintf("%d", start))
+	return err
+}
+
+// SessionStart returns the Unix time the open session started, or 0 if no
+// session is open
+func (s *Store) SessionStart(ctx context.Context) (int64, error) {
+	var value string
+	err := s.db.QueryRowContext(ctx,
+		`SELECT value FROM fs_config WHERE key = 'session_start'`).Scan(&value)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var start int64
+	fmt.Sscanf(value, "%d", &start)
+	return start, nil
+}
+
+// EndSession closes the open session, if any
+func (s *Store) EndSession(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM fs_config WHERE key = 'session_start'`)
+	return err
+}
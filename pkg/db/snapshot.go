@@ -0,0 +1,213 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+)
+
+// Snapshot describes a named, frozen copy of the filesystem tree
+type Snapshot struct {
+	ID        int64
+	Name      string
+	CreatedAt int64  // Unix timestamp (seconds)
+	Inodes    int64  // Number of inodes captured
+	Size      uint64 // Total size of regular files
+}
+
+// snapshotTable pairs a live tree table with its snapshot copy
+type snapshotTable struct {
+	live    string
+	columns string
+}
+
+// snapshotTables lists every table that makes up the tree, in insert order.
+// Each has a fs_snapshot_<name> copy with a leading snapshot_id column.
+var snapshotTables = []snapshotTable{
+	{"fs_inode", "ino, mode, nlink, uid, gid, size, atime, mtime, ctime, rdev"},
+	{"fs_dentry", "name, parent_ino, ino"},
+	{"fs_data", "ino, chunk_index, hash"},
+	{"fs_symlink", "ino, target"},
+	{"fs_whiteout", "path, parent_path, created_at"},
+	{"fs_origin", "delta_ino, base_ino"},
+	{"fs_lower", "ino, path, size, base_ino, base_size, base_mtime"},
+	{"fs_xattr", "ino, name, value"},
+}
+
+// snapshot returns the name of the table holding snapshot copies of t
+func (t snapshotTable) snapshot() string {
+	return "fs_snapshot_" + t.live[len("fs_"):]
+}
+
+// CreateSnapshot freezes the current tree (including whiteouts and origins)
+// under the given name. File contents are not copied: the snapshot only
+// takes references on the content-addressed chunks of the live tree.
+func (s *Store) CreateSnapshot(ctx context.Context, name string) (*Snapshot, error) {
+	if name == "" {
+		return nil, fmt.Errorf("snapshot name must not be empty")
+	}
+
+	var id int64
+	err := s.WithTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx,
+			`INSERT INTO fs_snapshot (name, created_at) VALUES (?, ?)`,
+			name, nowUnix())
+		if err != nil {
+			if isUniqueConstraintError(err) {
+				return ErrExists
+			}
+			return err
+		}
+		id, err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		for _, t := range snapshotTables {
+			_, err := tx.ExecContext(ctx, fmt.Sprintf(
+				`INSERT INTO %s (snapshot_id, %s) SELECT ?, %s FROM %s`,
+				t.snapshot(), t.columns, t.columns, t.live), id)
+			if err != nil {
+				return fmt.Errorf("failed to copy %s: %w", t.live, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetSnapshot(ctx, name)
+}
+
+// GetSnapshot retrieves a snapshot by name
+func (s *Store) GetSnapshot(ctx context.Context, name string) (*Snapshot, error) {
+	row := s.db.QueryRowContext(ctx, snapshotQuery+` WHERE s.name = ?`, name)
+	snap, err := scanSnapshot(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// ListSnapshots returns all snapshots, oldest first
+func (s *Store) ListSnapshots(ctx context.Context) ([]Snapshot, error) {
+	rows, err := s.db.QueryContext(ctx, snapshotQuery+` ORDER BY s.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var snaps []Snapshot
+	for rows.Next() {
+		snap, err := scanSnapshot(rows)
+		if err != nil {
+			return nil, err
+		}
+		snaps = append(snaps, *snap)
+	}
+	return snaps, rows.Err()
+}
+
+// snapshotQuery selects snapshots along with their inode count and the
+// total size of regular files (S_IFMT = 61440, S_IFREG = 32768)
+const snapshotQuery = `
+	SELECT s.id, s.name, s.created_at,
+		(SELECT COUNT(*) FROM fs_snapshot_inode i WHERE i.snapshot_id = s.id),
+		(SELECT COALESCE(SUM(i.size), 0) FROM fs_snapshot_inode i
+		 WHERE i.snapshot_id = s.id AND (i.mode & 61440) = 32768)
+	FROM fs_snapshot s`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanSnapshot scans a row produced by snapshotQuery
+func scanSnapshot(row rowScanner) (*Snapshot, error) {
+	snap := &Snapshot{}
+	err := row.Scan(&snap.ID, &snap.Name, &snap.CreatedAt, &snap.Inodes, &snap.Size)
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// RestoreSnapshot replaces the live tree with the contents of a snapshot.
+// Changes made since the snapshot are discarded, and the snapshot itself is
+// kept. It must not be called while the store is mounted.
+func (s *Store) RestoreSnapshot(ctx context.Context, name string) error {
+	snap, err := s.GetSnapshot(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	return s.WithTx(ctx, func(tx *sql.Tx) error {
+		// Clear the live tree, children first
+		for i := len(snapshotTables) - 1; i >= 0; i-- {
+			t := snapshotTables[i]
+			if _, err := tx.ExecContext(ctx, `DELETE FROM `+t.live); err != nil {
+				return fmt.Errorf("failed to clear %s: %w", t.live, err)
+			}
+		}
+
+		for _, t := range snapshotTables {
+			_, err := tx.ExecContext(ctx, fmt.Sprintf(
+				`INSERT INTO %s (%s) SELECT %s FROM %s WHERE snapshot_id = ?`,
+				t.live, t.columns, t.columns, t.snapshot()), snap.ID)
+			if err != nil {
+				return fmt.Errorf("failed to restore %s: %w", t.live, err)
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteSnapshot removes a snapshot. Chunks that are no longer referenced
+// by the live tree or another snapshot are freed.
+func (s *Store) DeleteSnapshot(ctx context.Context, name string) error {
+	snap, err := s.GetSnapshot(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	return s.WithTx(ctx, func(tx *sql.Tx) error {
+		for _, t := range snapshotTables {
+			_, err := tx.ExecContext(ctx,
+				`DELETE FROM `+t.snapshot()+` WHERE snapshot_id = ?`, snap.ID)
+			if err != nil {
+				return fmt.Errorf("failed to delete from %s: %w", t.snapshot(), err)
+			}
+		}
+		_, err := tx.ExecContext(ctx, `DELETE FROM fs_snapshot WHERE id = ?`, snap.ID)
+		return err
+	})
+}
+
+// ForkSnapshot creates a new database at path whose live tree is the given
+// snapshot. All snapshots are carried over, so the fork is an independent
+// branch sharing history with this store up to that point.
+func (s *Store) ForkSnapshot(ctx context.Context, name, path string) error {
+	if _, err := s.GetSnapshot(ctx, name); err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s: %w", path, ErrExists)
+	}
+
+	if _, err := s.db.ExecContext(ctx, `VACUUM INTO ?`, path); err != nil {
+		return fmt.Errorf("failed to copy database: %w", err)
+	}
+
+	fork, err := Open(Config{Path: path, ChunkSize: s.chunkSize})
+	if err != nil {
+		return err
+	}
+	defer fork.Close()
+
+	return fork.RestoreSnapshot(ctx, name)
+}
@@ -35,6 +35,20 @@ func (s *Store) ReadSymlink(ctx context.Context, ino uint64) (string, error) {
 	return target, nil
 }
 
+// ReadSymlinkTx retrieves a symlink target within a transaction
+func (s *Store) ReadSymlinkTx(ctx context.Context, tx *sql.Tx, ino uint64) (string, error) {
+	var target string
+	err := tx.QueryRowContext(ctx,
+		`SELECT target FROM fs_symlink WHERE ino = ?`, ino).Scan(&target)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
 // DeleteSymlink removes a symlink target
 func (s *Store) DeleteSymlink(ctx context.Context, ino uint64) error {
 	_, err := s.db.ExecContext(ctx, `DELETE FROM fs_symlink WHERE ino = ?`, ino)
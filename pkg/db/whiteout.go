@@ -72,6 +72,88 @@ func (s *Store) DeleteWhiteoutsUnderTx(ctx context.Context, tx *sql.Tx, path str
 	return err
 }
 
+// MoveWhiteoutsUnder moves the whiteouts below oldPath (not oldPath itself)
+// to below newPath, replacing any that were there, for a directory that
+// was renamed
+func (s *Store) MoveWhiteoutsUnder(ctx context.Context, oldPath, newPath string) error {
+	return s.WithTx(ctx, func(tx *sql.Tx) error {
+		return s.MoveWhiteoutsUnderTx(ctx, tx, oldPath, newPath)
+	})
+}
+
+// MoveWhiteoutsUnderTx moves the whiteouts below oldPath within a
+// transaction
+func (s *Store) MoveWhiteoutsUnderTx(ctx context.Context, tx *sql.Tx, oldPath, newPath string) error {
+	oldPath = normalizePath(oldPath)
+	newPath = normalizePath(newPath)
+	_, err := tx.ExecContext(ctx,
+		`DELETE FROM fs_whiteout WHERE substr(path, 1, length(?)) = ?`,
+		newPath+"/", newPath+"/")
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		`UPDATE fs_whiteout SET path = ? || substr(path, length(?) + 1),
+		 parent_path = ? || substr(parent_path, length(?) + 1)
+		 WHERE substr(path, 1, length(?)) = ?`,
+		newPath, oldPath, newPath, oldPath, oldPath+"/", oldPath+"/")
+	return err
+}
+
+// SwapWhiteoutsUnder exchanges the whiteouts below two paths, for
+// directories that were exchanged
+func (s *Store) SwapWhiteoutsUnder(ctx context.Context, path1, path2 string) error {
+	return s.WithTx(ctx, func(tx *sql.Tx) error {
+		return s.SwapWhiteoutsUnderTx(ctx, tx, path1, path2)
+	})
+}
+
+// SwapWhiteoutsUnderTx exchanges the whiteouts below two paths within a
+// transaction
+func (s *Store) SwapWhiteoutsUnderTx(ctx context.Context, tx *sql.Tx, path1, path2 string) error {
+	path1 = normalizePath(path1)
+	path2 = normalizePath(path2)
+	var moved []Whiteout
+	for _, p := range [][2]string{{path1, path2}, {path2, path1}} {
+		rows, err := tx.QueryContext(ctx,
+			`SELECT path, created_at FROM fs_whiteout WHERE substr(path, 1, length(?)) = ?`,
+			p[0]+"/", p[0]+"/")
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var w Whiteout
+			if err := rows.Scan(&w.Path, &w.CreatedAt); err != nil {
+				rows.Close()
+				return err
+			}
+			w.Path = p[1] + strings.TrimPrefix(w.Path, p[0])
+			moved = append(moved, w)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx,
+			`DELETE FROM fs_whiteout WHERE substr(path, 1, length(?)) = ?`,
+			p[0]+"/", p[0]+"/")
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, w := range moved {
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO fs_whiteout (path, parent_path, created_at) VALUES (?, ?, ?)`,
+			w.Path, filepath.Dir(w.Path), w.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // HasWhiteout checks if a whiteout exists for the exact path
 func (s *Store) HasWhiteout(ctx context.Context, path string) (bool, error) {
 	path = normalizePath(path)
@@ -104,6 +186,35 @@ func (s *Store) ListWhiteouts(ctx context.Context) ([]string, error) {
 	return paths, rows.Err()
 }
 
+// Whiteout is a path deleted from the base layer
+type Whiteout struct {
+	Path      string
+	CreatedAt int64
+}
+
+// ListWhiteoutsUnder returns the whiteouts under the given path (including
+// the path itself), sorted by path
+func (s *Store) ListWhiteoutsUnder(ctx context.Context, path string) ([]Whiteout, error) {
+	path = normalizePath(path)
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT path, created_at FROM fs_whiteout WHERE path = ? OR path LIKE ? ORDER BY path`,
+		path, path+"/%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var whiteouts []Whiteout
+	for rows.Next() {
+		var w Whiteout
+		if err := rows.Scan(&w.Path, &w.CreatedAt); err != nil {
+			return nil, err
+		}
+		whiteouts = append(whiteouts, w)
+	}
+	return whiteouts, rows.Err()
+}
+
 // GetChildWhiteouts returns all direct child whiteout names under the given directory path
 func (s *Store) GetChildWhiteouts(ctx context.Context, parentPath string) ([]string, error) {
 	parentPath = normalizePath(parentPath)
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Setxattr flags (matching Linux)
+const (
+	XattrCreate  = 1 // Fail if the attribute exists
+	XattrReplace = 2 // Fail if the attribute does not exist
+)
+
+// GetXattr retrieves the value of an extended attribute
+func (s *Store) GetXattr(ctx context.Context, ino uint64, name string) ([]byte, error) {
+	var value []byte
+	err := s.db.QueryRowContext(ctx,
+		`SELECT value FROM fs_xattr WHERE ino = ? AND name = ?`, ino, name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	return value, nil
+}
+
+// ListXattrs returns the names of an inode's extended attributes
+func (s *Store) ListXattrs(ctx context.Context, ino uint64) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT name FROM fs_xattr WHERE ino = ? ORDER BY name`, ino)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// SetXattr sets an extended attribute. flags may be XattrCreate or
+// XattrReplace, which fail with ErrExists and ErrNotFound respectively.
+func (s *Store) SetXattr(ctx context.Context, ino uint64, name string, value []byte, flags int) error {
+	return s.WithTx(ctx, func(tx *sql.Tx) error {
+		return s.SetXattrTx(ctx, tx, ino, name, value, flags)
+	})
+}
+
+// SetXattrTx sets an extended attribute within a transaction
+func (s *Store) SetXattrTx(ctx context.Context, tx *sql.Tx, ino uint64, name string, value []byte, flags int) error {
+	if value == nil {
+		value = []byte{} // value is NOT NULL
+	}
+
+	switch {
+	case flags&XattrCreate != 0:
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO fs_xattr (ino, name, value) VALUES (?, ?, ?)`, ino, name, value)
+		if isUniqueConstraintError(err) {
+			return ErrExists
+		}
+		return err
+
+	case flags&XattrReplace != 0:
+		result, err := tx.ExecContext(ctx,
+			`UPDATE fs_xattr SET value = ? WHERE ino = ? AND name = ?`, value, ino, name)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return ErrNotFound
+		}
+		return nil
+
+	default:
+		_, err := tx.ExecContext(ctx,
+			`INSERT OR REPLACE INTO fs_xattr (ino, name, value) VALUES (?, ?, ?)`, ino, name, value)
+		return err
+	}
+}
+
+// RemoveXattr removes an extended attribute
+func (s *Store) RemoveXattr(ctx context.Context, ino uint64, name string) error {
+	return s.WithTx(ctx, func(tx *sql.Tx) error {
+		return s.RemoveXattrTx(ctx, tx, ino, name)
+	})
+}
+
+// RemoveXattrTx removes an extended attribute within a transaction
+func (s *Store) RemoveXattrTx(ctx context.Context, tx *sql.Tx, ino uint64, name string) error {
+	result, err := tx.ExecContext(ctx,
+		`DELETE FROM fs_xattr WHERE ino = ? AND name = ?`, ino, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
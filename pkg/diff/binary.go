@@ -0,0 +1,85 @@
+package diff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// ZeroHash is the object name git uses for a missing side of a change
+const ZeroHash = "0000000000000000000000000000000000000000"
+
+// base85 is git's base85 alphabet
+const base85 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz!#$%&()*+-;<=>?@^_`{|}~"
+
+// binaryLineLen is the most compressed bytes git encodes on one line
+const binaryLineLen = 52
+
+// BlobHash returns the git object name of a blob with the given contents,
+// as used in the index line of a patch
+func BlobHash(data []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(data))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Binary returns a git binary patch turning a into b, starting with the
+// "GIT binary patch" line. Both directions are included as literals, so
+// that the patch can also be applied in reverse.
+func Binary(a, b []byte) string {
+	var out strings.Builder
+	out.WriteString("GIT binary patch\n")
+	writeLiteral(&out, b)
+	writeLiteral(&out, a)
+	return out.String()
+}
+
+// writeLiteral writes a literal hunk: the deflated data in base85, one
+// line per 52 bytes, each prefixed with its length
+func writeLiteral(out *strings.Builder, data []byte) {
+	var deflated bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	zw.Write(data)
+	zw.Close()
+
+	fmt.Fprintf(out, "literal %d\n", len(data))
+	z := deflated.Bytes()
+	for len(z) > 0 {
+		n := min(len(z), binaryLineLen)
+		if n <= 26 {
+			out.WriteByte(byte('A' + n - 1))
+		} else {
+			out.WriteByte(byte('a' + n - 27))
+		}
+		encode85(out, z[:n])
+		out.WriteByte('\n')
+		z = z[n:]
+	}
+	out.WriteByte('\n')
+}
+
+// encode85 writes data in base85, five characters per four bytes, with
+// the last group padded with zeros
+func encode85(out *strings.Builder, data []byte) {
+	for len(data) > 0 {
+		var acc uint32
+		for i := range 4 {
+			acc <<= 8
+			if i < len(data) {
+				acc |= uint32(data[i])
+			}
+		}
+		data = data[min(len(data), 4):]
+
+		var group [5]byte
+		for i := 4; i >= 0; i-- {
+			group[i] = base85[acc%85]
+			acc /= 85
+		}
+		out.Write(group[:])
+	}
+}
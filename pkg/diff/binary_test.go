@@ -0,0 +1,108 @@
+package diff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBlobHash(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"", "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"},
+		{"hello\n", "ce013625030ba8dba906f756967f9e9ca394464a"},
+	}
+	for _, tt := range tests {
+		if got := BlobHash([]byte(tt.data)); got != tt.want {
+			t.Errorf("BlobHash(%q) = %s, want %s", tt.data, got, tt.want)
+		}
+	}
+}
+
+// decodeLiteral reads one literal hunk of a binary patch, checking its
+// line lengths, and returns the inflated data and the rest of the patch
+func decodeLiteral(t *testing.T, patch string) ([]byte, string) {
+	t.Helper()
+	header, patch, _ := strings.Cut(patch, "\n")
+	size, err := strconv.Atoi(strings.TrimPrefix(header, "literal "))
+	if err != nil {
+		t.Fatalf("bad literal header %q", header)
+	}
+
+	var deflated []byte
+	for {
+		var line string
+		line, patch, _ = strings.Cut(patch, "\n")
+		if line == "" {
+			break
+		}
+		n := int(line[0]-'A') + 1
+		if line[0] >= 'a' {
+			n = int(line[0]-'a') + 27
+		}
+		enc := line[1:]
+		if len(enc) != (n+3)/4*5 {
+			t.Fatalf("line %q: %d characters for %d bytes", line, len(enc), n)
+		}
+		var chunk []byte
+		for len(enc) > 0 {
+			var acc uint32
+			for _, c := range []byte(enc[:5]) {
+				acc = acc*85 + uint32(strings.IndexByte(base85, c))
+			}
+			chunk = append(chunk, byte(acc>>24), byte(acc>>16), byte(acc>>8), byte(acc))
+			enc = enc[5:]
+		}
+		deflated = append(deflated, chunk[:n]...)
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(deflated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != size {
+		t.Fatalf("literal of %d bytes holds %d", size, len(data))
+	}
+	return data, patch
+}
+
+func TestBinary(t *testing.T) {
+	large := make([]byte, 10000)
+	for i := range large {
+		large[i] = byte(i * 7919 >> 3)
+	}
+	tests := []struct {
+		name string
+		a, b []byte
+	}{
+		{"added", nil, []byte{0, 1, 2, 3}},
+		{"deleted", []byte{0, 1, 2, 3}, nil},
+		{"changed", []byte("a\x00b"), []byte("a\x00c")},
+		{"many lines", []byte{0}, large},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch, ok := strings.CutPrefix(Binary(tt.a, tt.b), "GIT binary patch\n")
+			if !ok {
+				t.Fatal("missing GIT binary patch line")
+			}
+			b, patch := decodeLiteral(t, patch)
+			a, patch := decodeLiteral(t, patch)
+			if !bytes.Equal(a, tt.a) || !bytes.Equal(b, tt.b) {
+				t.Errorf("literals = %q, %q", a, b)
+			}
+			if patch != "" {
+				t.Errorf("trailing %q", patch)
+			}
+		})
+	}
+}
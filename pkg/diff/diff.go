@@ -0,0 +1,219 @@
+// Package diff produces line-based unified diffs and git binary patches.
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxEditCost bounds the Myers search; beyond it the texts are treated as
+// entirely replaced, which keeps memory use bounded for unrelated files
+const maxEditCost = 4096
+
+// opKind is the type of an edit operation
+type opKind int
+
+const (
+	opEqual opKind = iota
+	opDelete
+	opInsert
+)
+
+// op is a single line of an edit script. a and b are the line positions
+// in the old and new text at which the operation applies.
+type op struct {
+	kind opKind
+	a, b int
+}
+
+// Unified returns the hunks of a unified diff between a and b with the
+// given number of context lines, without file headers. It returns an
+// empty string if the texts are equal.
+func Unified(a, b string, context int) string {
+	al, bl := splitLines(a), splitLines(b)
+	ops := myers(al, bl)
+
+	var out strings.Builder
+	i := 0
+	for i < len(ops) {
+		// Find the next change
+		for i < len(ops) && ops[i].kind == opEqual {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+
+		// Extend the hunk over changes separated by little context
+		end := i
+		for {
+			for end < len(ops) && ops[end].kind != opEqual {
+				end++
+			}
+			next := end
+			for next < len(ops) && ops[next].kind == opEqual {
+				next++
+			}
+			if next < len(ops) && next-end <= 2*context {
+				end = next
+				continue
+			}
+			break
+		}
+		stop := end + context
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		writeHunk(&out, ops[start:stop], al, bl)
+		i = stop
+	}
+	return out.String()
+}
+
+// writeHunk writes a single hunk, including its header
+func writeHunk(out *strings.Builder, ops []op, a, b []string) {
+	var aLen, bLen int
+	for _, o := range ops {
+		if o.kind != opInsert {
+			aLen++
+		}
+		if o.kind != opDelete {
+			bLen++
+		}
+	}
+	aStart, bStart := ops[0].a, ops[0].b
+	if aLen > 0 {
+		aStart++
+	}
+	if bLen > 0 {
+		bStart++
+	}
+	fmt.Fprintf(out, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+
+	for _, o := range ops {
+		switch o.kind {
+		case opEqual:
+			writeLine(out, ' ', a[o.a])
+		case opDelete:
+			writeLine(out, '-', a[o.a])
+		case opInsert:
+			writeLine(out, '+', b[o.b])
+		}
+	}
+}
+
+// writeLine writes a prefixed line, marking a missing final newline
+func writeLine(out *strings.Builder, prefix byte, line string) {
+	out.WriteByte(prefix)
+	out.WriteString(line)
+	if !strings.HasSuffix(line, "\n") {
+		out.WriteString("\n\\ No newline at end of file\n")
+	}
+}
+
+// splitLines splits text into lines, keeping line terminators
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// myers returns a shortest edit script turning a into b, using the
+// algorithm from "An O(ND) Difference Algorithm and Its Variations"
+func myers(a, b []string) []op {
+	n, m := len(a), len(b)
+
+	// v[k] is the furthest x reached on diagonal k; trace[d] holds v for
+	// diagonals -d-1..d+1 as it was before step d
+	v := make([]int, 2*(n+m)+3)
+	offset := n + m + 1
+	var trace [][]int
+
+	for d := 0; d <= n+m; d++ {
+		if d > maxEditCost {
+			return replaceAll(n, m)
+		}
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(trace, n, m)
+			}
+		}
+	}
+	return replaceAll(n, m)
+}
+
+// backtrack walks the saved Myers trace back from (n, m) to recover the
+// edit script
+func backtrack(trace [][]int, n, m int) []op {
+	var ops []op
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		at := func(k int) int { return v[k+d+1] }
+
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, op{opEqual, x, y})
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, op{opInsert, prevX, prevY})
+			} else {
+				ops = append(ops, op{opDelete, prevX, prevY})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// replaceAll returns an edit script deleting all of a and inserting all of b
+func replaceAll(n, m int) []op {
+	ops := make([]op, 0, n+m)
+	for i := 0; i < n; i++ {
+		ops = append(ops, op{opDelete, i, 0})
+	}
+	for j := 0; j < m; j++ {
+		ops = append(ops, op{opInsert, n, j})
+	}
+	return ops
+}
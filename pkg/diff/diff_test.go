@@ -0,0 +1,66 @@
+package diff
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    string
+		context int
+		want    string
+	}{
+		{"equal", "a\nb\n", "a\nb\n", 3, ""},
+		{"both empty", "", "", 3, ""},
+		{"added file", "", "a\nb\n", 3,
+			"@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"deleted file", "a\nb\n", "", 3,
+			"@@ -1,2 +0,0 @@\n-a\n-b\n"},
+		{"changed line", "1\n2\n3\n4\n5\n", "1\n2\nx\n4\n5\n", 1,
+			"@@ -2,3 +2,3 @@\n 2\n-3\n+x\n 4\n"},
+		{"context clipped at start", "1\n2\n3\n", "x\n2\n3\n", 3,
+			"@@ -1,3 +1,3 @@\n-1\n+x\n 2\n 3\n"},
+		{"insert without context", "a\n", "a\nb\n", 0,
+			"@@ -1,0 +2,1 @@\n+b\n"},
+		{"delete without context", "a\nb\n", "a\n", 0,
+			"@@ -2,1 +1,0 @@\n-b\n"},
+		{"changes far apart", "1\n2\n3\n4\n5\n6\n7\n8\n9\n", "1\nx\n3\n4\n5\n6\n7\ny\n9\n", 1,
+			"@@ -1,3 +1,3 @@\n 1\n-2\n+x\n 3\n@@ -7,3 +7,3 @@\n 7\n-8\n+y\n 9\n"},
+		{"changes close together", "1\n2\n3\n4\n5\n", "1\nx\n3\ny\n5\n", 1,
+			"@@ -1,5 +1,5 @@\n 1\n-2\n+x\n 3\n-4\n+y\n 5\n"},
+		{"newline removed", "a\n", "a", 3,
+			"@@ -1,1 +1,1 @@\n-a\n+a\n\\ No newline at end of file\n"},
+		{"newline added", "a", "a\n", 3,
+			"@@ -1,1 +1,1 @@\n-a\n\\ No newline at end of file\n+a\n"},
+		{"append to unterminated line", "a\nb", "a\nb\nc\n", 3,
+			"@@ -1,2 +1,3 @@\n a\n-b\n\\ No newline at end of file\n+b\n+c\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Unified(tt.a, tt.b, tt.context); got != tt.want {
+				t.Errorf("Unified(%q, %q, %d) =\n%s\nwant\n%s", tt.a, tt.b, tt.context, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnifiedReplaceAll(t *testing.T) {
+	// Past maxEditCost the texts are replaced as a whole
+	var a, b strings.Builder
+	for i := range maxEditCost + 1 {
+		a.WriteString("a" + strconv.Itoa(i) + "\n")
+		b.WriteString("b" + strconv.Itoa(i) + "\n")
+	}
+	got := Unified(a.String(), b.String(), 3)
+	n := maxEditCost + 1
+	header := "@@ -1," + strconv.Itoa(n) + " +1," + strconv.Itoa(n) + " @@\n"
+	if !strings.HasPrefix(got, header) {
+		t.Fatalf("hunk header = %q, want %q", got[:strings.IndexByte(got, '\n')+1], header)
+	}
+	if c := strings.Count(got, "\n-"); c != n {
+		t.Errorf("%d deleted lines, want %d", c, n)
+	}
+}
@@ -230,7 +230,7 @@ func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedd
 		return syscall.EIO
 	}
 
-	err := n.store.Rename(ctx, n.ino, newParentNode.ino, name, newName)
+	err := n.store.Rename(ctx, n.ino, newParentNode.ino, name, newName, flags)
 	return toErrno(err)
 }
 
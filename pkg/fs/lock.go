@@ -0,0 +1,293 @@
+package fs
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// posixLock is an fcntl lock on the bytes from start to end, inclusive
+type posixLock struct {
+	owner uint64 // Lock owner, one per process (file table)
+	start uint64
+	end   uint64
+	typ   uint32 // F_RDLCK or F_WRLCK
+	pid   uint32 // Process that took the lock, reported by F_GETLK
+}
+
+// overlaps reports whether l covers any byte from start to end
+func (l *posixLock) overlaps(start, end uint64) bool {
+	return l.start <= end && start <= l.end
+}
+
+// nodeLocks holds the locks on one file. fcntl and flock locks don't
+// conflict with each other, as on Linux.
+type nodeLocks struct {
+	posix   []posixLock
+	flock   map[uint64]uint32 // Lock type by owner (open file)
+	changed chan struct{}     // Closed when a lock is released or downgraded
+}
+
+// lockManager keeps the fcntl and flock locks of a mount, by kernel node,
+// so that they hold across all open files and hard links of a file
+type lockManager struct {
+	nodes map[uint64]*nodeLocks
+	mu    sync.Mutex
+}
+
+// newLockManager creates a lock manager without locks
+func newLockManager() *lockManager {
+	return &lockManager{nodes: make(map[uint64]*nodeLocks)}
+}
+
+// nodeLocked returns the locks on a node, creating them if needed
+func (m *lockManager) nodeLocked(node uint64) *nodeLocks {
+	nl, ok := m.nodes[node]
+	if !ok {
+		nl = &nodeLocks{
+			flock:   make(map[uint64]uint32),
+			changed: make(chan struct{}),
+		}
+		m.nodes[node] = nl
+	}
+	return nl
+}
+
+// releasedLocked wakes the waiters on a node and forgets it once it has no
+// locks left
+func (m *lockManager) releasedLocked(node uint64, nl *nodeLocks) {
+	close(nl.changed)
+	nl.changed = make(chan struct{})
+	if len(nl.posix) == 0 && len(nl.flock) == 0 {
+		delete(m.nodes, node)
+	}
+}
+
+// conflict returns a lock of another owner that keeps lk from being taken
+func (nl *nodeLocks) conflict(owner uint64, lk *fuse.FileLock) *posixLock {
+	for i := range nl.posix {
+		l := &nl.posix[i]
+		if l.owner != owner && l.overlaps(lk.Start, lk.End) &&
+			(l.typ == syscall.F_WRLCK || lk.Typ == syscall.F_WRLCK) {
+			return l
+		}
+	}
+	return nil
+}
+
+// flockConflict reports whether another open file's flock lock keeps lk
+// from being taken
+func (nl *nodeLocks) flockConflict(owner uint64, typ uint32) bool {
+	for o, t := range nl.flock {
+		if o != owner && (t == syscall.F_WRLCK || typ == syscall.F_WRLCK) {
+			return true
+		}
+	}
+	return false
+}
+
+// unlock removes the locks of owner from start to end, splitting locks
+// that stick out of the range. It reports whether any lock changed.
+func (nl *nodeLocks) unlock(owner, start, end uint64) bool {
+	kept := nl.posix[:0:0]
+	changed := false
+	for _, l := range nl.posix {
+		if l.owner != owner || !l.overlaps(start, end) {
+			kept = append(kept, l)
+			continue
+		}
+		changed = true
+		if l.start < start {
+			left := l
+			left.end = start - 1
+			kept = append(kept, left)
+		}
+		if l.end > end {
+			right := l
+			right.start = end + 1
+			kept = append(kept, right)
+		}
+	}
+	nl.posix = kept
+	return changed
+}
+
+// getlk finds a lock that conflicts with lk, or sets out to F_UNLCK
+func (m *lockManager) getlk(node, owner uint64, lk *fuse.FileLock, out *fuse.FileLock) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	*out = fuse.FileLock{Typ: syscall.F_UNLCK}
+	nl, ok := m.nodes[node]
+	if !ok {
+		return
+	}
+	if l := nl.conflict(owner, lk); l != nil {
+		*out = fuse.FileLock{Start: l.start, End: l.end, Typ: l.typ, Pid: l.pid}
+	}
+}
+
+// setlk takes, changes or releases a lock. A conflicting lock fails it
+// with EAGAIN, or makes it wait until the lock is released or cancel is
+// closed by an interrupt.
+func (m *lockManager) setlk(cancel <-chan struct{}, node, owner uint64, lk *fuse.FileLock, flags uint32, wait bool) syscall.Errno {
+	if lk.Typ != syscall.F_RDLCK && lk.Typ != syscall.F_WRLCK && lk.Typ != syscall.F_UNLCK {
+		return syscall.EINVAL
+	}
+	if lk.Start > lk.End {
+		return syscall.EINVAL
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		nl := m.nodeLocked(node)
+		if lk.Typ == syscall.F_UNLCK {
+			if flags&fuse.FUSE_LK_FLOCK != 0 {
+				delete(nl.flock, owner)
+			} else {
+				nl.unlock(owner, lk.Start, lk.End)
+			}
+			m.releasedLocked(node, nl)
+			return 0
+		}
+
+		var blocked bool
+		if flags&fuse.FUSE_LK_FLOCK != 0 {
+			blocked = nl.flockConflict(owner, lk.Typ)
+		} else {
+			blocked = nl.conflict(owner, lk) != nil
+		}
+		if !blocked {
+			break
+		}
+		if !wait {
+			return syscall.EAGAIN
+		}
+
+		changed := nl.changed
+		m.mu.Unlock()
+		select {
+		case <-changed:
+			m.mu.Lock()
+		case <-cancel:
+			m.mu.Lock()
+			return syscall.EINTR
+		}
+	}
+
+	nl := m.nodeLocked(node)
+	if flags&fuse.FUSE_LK_FLOCK != 0 {
+		downgrade := nl.flock[owner] == syscall.F_WRLCK && lk.Typ == syscall.F_RDLCK
+		nl.flock[owner] = lk.Typ
+		if downgrade {
+			m.releasedLocked(node, nl)
+		}
+		return 0
+	}
+
+	// The new lock replaces whatever the owner held in its range, which
+	// wakes waiters if it was a write lock turning into a read lock. The
+	// waiters are woken after adding it, so that the node isn't forgotten.
+	replaced := nl.unlock(owner, lk.Start, lk.End)
+	nl.add(posixLock{
+		owner: owner,
+		start: lk.Start,
+		end:   lk.End,
+		typ:   lk.Typ,
+		pid:   lk.Pid,
+	})
+	if replaced {
+		m.releasedLocked(node, nl)
+	}
+	return 0
+}
+
+// add inserts a lock, merging it with adjacent locks of the same owner and
+// type, as Linux does
+func (nl *nodeLocks) add(lk posixLock) {
+	kept := nl.posix[:0:0]
+	for _, l := range nl.posix {
+		adjacent := (l.end != ^uint64(0) && l.end+1 == lk.start) ||
+			(lk.end != ^uint64(0) && lk.end+1 == l.start)
+		if l.owner != lk.owner || l.typ != lk.typ || !adjacent {
+			kept = append(kept, l)
+			continue
+		}
+		lk.start = min(lk.start, l.start)
+		lk.end = max(lk.end, l.end)
+	}
+	nl.posix = append(kept, lk)
+}
+
+// releasePosix drops the fcntl locks of owner on a node. The kernel asks
+// for this with every close of a descriptor, including at process exit.
+func (m *lockManager) releasePosix(node, owner uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if nl, ok := m.nodes[node]; ok && nl.unlock(owner, 0, ^uint64(0)) {
+		m.releasedLocked(node, nl)
+	}
+}
+
+// releaseFlock drops the flock lock of an open file once it is released
+func (m *lockManager) releaseFlock(node, owner uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if nl, ok := m.nodes[node]; ok {
+		if _, held := nl.flock[owner]; held {
+			delete(nl.flock, owner)
+			m.releasedLocked(node, nl)
+		}
+	}
+}
+
+// lockingFS serves file locks in front of a node filesystem. go-fuse
+// doesn't pass the lock owner to Flush and Release, which is where the
+// locks of closed files and exited processes are dropped, so locks are
+// handled here by kernel node rather than by the file handles.
+type lockingFS struct {
+	fuse.RawFileSystem
+	locks *lockManager
+}
+
+// newLockingFS wraps a raw filesystem with a lock manager
+func newLockingFS(fsys fuse.RawFileSystem) *lockingFS {
+	return &lockingFS{
+		RawFileSystem: fsys,
+		locks:         newLockManager(),
+	}
+}
+
+// GetLk reports a lock that would conflict with the given one
+func (l *lockingFS) GetLk(cancel <-chan struct{}, in *fuse.LkIn, out *fuse.LkOut) fuse.Status {
+	l.locks.getlk(in.NodeId, in.Owner, &in.Lk, &out.Lk)
+	return fuse.OK
+}
+
+// SetLk takes or releases a lock, failing if it conflicts
+func (l *lockingFS) SetLk(cancel <-chan struct{}, in *fuse.LkIn) fuse.Status {
+	return fuse.Status(l.locks.setlk(cancel, in.NodeId, in.Owner, &in.Lk, in.LkFlags, false))
+}
+
+// SetLkw takes or releases a lock, waiting for conflicting locks
+func (l *lockingFS) SetLkw(cancel <-chan struct{}, in *fuse.LkIn) fuse.Status {
+	return fuse.Status(l.locks.setlk(cancel, in.NodeId, in.Owner, &in.Lk, in.LkFlags, true))
+}
+
+// Flush drops the fcntl locks of the closing process before flushing
+func (l *lockingFS) Flush(cancel <-chan struct{}, in *fuse.FlushIn) fuse.Status {
+	l.locks.releasePosix(in.NodeId, in.LockOwner)
+	return l.RawFileSystem.Flush(cancel, in)
+}
+
+// Release drops the flock lock of the released file
+func (l *lockingFS) Release(cancel <-chan struct{}, in *fuse.ReleaseIn) {
+	if in.ReleaseFlags&fuse.FUSE_RELEASE_FLOCK_UNLOCK != 0 {
+		l.locks.releaseFlock(in.NodeId, in.LockOwner)
+	}
+	l.RawFileSystem.Release(cancel, in)
+}
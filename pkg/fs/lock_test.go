@@ -0,0 +1,323 @@
+package fs
+
+import (
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+const maxOffset = ^uint64(0)
+
+// lockOp is one fcntl lock request by owner
+type lockOp struct {
+	owner      uint64
+	typ        uint32
+	start, end uint64
+}
+
+func (op lockOp) lock() *fuse.FileLock {
+	return &fuse.FileLock{Start: op.start, End: op.end, Typ: op.typ, Pid: uint32(op.owner)}
+}
+
+// heldLocks returns the fcntl locks on a node, ordered by owner and start
+func heldLocks(m *lockManager, node uint64) []lockOp {
+	nl, ok := m.nodes[node]
+	if !ok {
+		return nil
+	}
+	var held []lockOp
+	for _, l := range nl.posix {
+		held = append(held, lockOp{l.owner, l.typ, l.start, l.end})
+	}
+	slices.SortFunc(held, func(a, b lockOp) int {
+		if a.owner != b.owner {
+			return int(a.owner) - int(b.owner)
+		}
+		if a.start < b.start {
+			return -1
+		}
+		return 1
+	})
+	return held
+}
+
+func TestSetlkRanges(t *testing.T) {
+	const r, w, u = syscall.F_RDLCK, syscall.F_WRLCK, syscall.F_UNLCK
+	tests := []struct {
+		name string
+		ops  []lockOp
+		want []lockOp
+	}{
+		{"split by unlock",
+			[]lockOp{{1, w, 0, 99}, {1, u, 10, 19}},
+			[]lockOp{{1, w, 0, 9}, {1, w, 20, 99}}},
+		{"unlock head",
+			[]lockOp{{1, w, 0, 99}, {1, u, 0, 9}},
+			[]lockOp{{1, w, 10, 99}}},
+		{"unlock to end of file",
+			[]lockOp{{1, w, 0, maxOffset}, {1, u, 10, maxOffset}},
+			[]lockOp{{1, w, 0, 9}}},
+		{"unlock everything",
+			[]lockOp{{1, w, 0, 9}, {1, r, 20, 29}, {1, u, 0, maxOffset}},
+			nil},
+		{"unlock of another owner",
+			[]lockOp{{1, w, 0, 9}, {2, u, 0, maxOffset}},
+			[]lockOp{{1, w, 0, 9}}},
+		{"read lock inside write lock",
+			[]lockOp{{1, w, 0, 99}, {1, r, 10, 19}},
+			[]lockOp{{1, w, 0, 9}, {1, r, 10, 19}, {1, w, 20, 99}}},
+		{"upgrade",
+			[]lockOp{{1, r, 0, 9}, {1, w, 0, 9}},
+			[]lockOp{{1, w, 0, 9}}},
+		{"merge adjacent",
+			[]lockOp{{1, w, 0, 9}, {1, w, 10, 19}},
+			[]lockOp{{1, w, 0, 19}}},
+		{"merge overlapping",
+			[]lockOp{{1, r, 0, 9}, {1, r, 5, 19}},
+			[]lockOp{{1, r, 0, 19}}},
+		{"merge both sides",
+			[]lockOp{{1, w, 0, 9}, {1, w, 20, 29}, {1, w, 10, 19}},
+			[]lockOp{{1, w, 0, 29}}},
+		{"merge up to end of file",
+			[]lockOp{{1, w, 10, maxOffset}, {1, w, 0, 9}},
+			[]lockOp{{1, w, 0, maxOffset}}},
+		{"no merge across types",
+			[]lockOp{{1, r, 0, 9}, {1, w, 10, 19}},
+			[]lockOp{{1, r, 0, 9}, {1, w, 10, 19}}},
+		{"no merge across owners",
+			[]lockOp{{1, r, 0, 9}, {2, r, 10, 19}},
+			[]lockOp{{1, r, 0, 9}, {2, r, 10, 19}}},
+		{"no merge with a gap",
+			[]lockOp{{1, w, 0, 9}, {1, w, 11, 19}},
+			[]lockOp{{1, w, 0, 9}, {1, w, 11, 19}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newLockManager()
+			for _, op := range tt.ops {
+				if errno := m.setlk(nil, 1, op.owner, op.lock(), 0, false); errno != 0 {
+					t.Fatalf("setlk(%+v) = %v", op, errno)
+				}
+			}
+			if got := heldLocks(m, 1); !slices.Equal(got, tt.want) {
+				t.Errorf("locks = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetlkConflict(t *testing.T) {
+	const r, w = syscall.F_RDLCK, syscall.F_WRLCK
+	tests := []struct {
+		name     string
+		held     lockOp
+		req      lockOp
+		conflict bool
+	}{
+		{"read and read", lockOp{1, r, 0, 9}, lockOp{2, r, 0, 9}, false},
+		{"read and write", lockOp{1, r, 0, 9}, lockOp{2, w, 5, 5}, true},
+		{"write and read", lockOp{1, w, 0, 9}, lockOp{2, r, 5, 5}, true},
+		{"write and write", lockOp{1, w, 0, 9}, lockOp{2, w, 0, 9}, true},
+		{"touching last byte", lockOp{1, w, 0, 9}, lockOp{2, w, 9, 20}, true},
+		{"disjoint", lockOp{1, w, 0, 9}, lockOp{2, w, 10, 20}, false},
+		{"same owner", lockOp{1, w, 0, 9}, lockOp{1, w, 0, 9}, false},
+		{"same owner read over write", lockOp{1, w, 0, 9}, lockOp{1, r, 0, 9}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newLockManager()
+			if errno := m.setlk(nil, 1, tt.held.owner, tt.held.lock(), 0, false); errno != 0 {
+				t.Fatalf("setlk(%+v) = %v", tt.held, errno)
+			}
+
+			var out fuse.FileLock
+			m.getlk(1, tt.req.owner, tt.req.lock(), &out)
+			want := fuse.FileLock{Typ: syscall.F_UNLCK}
+			if tt.conflict {
+				want = *tt.held.lock()
+			}
+			if out != want {
+				t.Errorf("getlk = %+v, want %+v", out, want)
+			}
+
+			wantErrno := syscall.Errno(0)
+			if tt.conflict {
+				wantErrno = syscall.EAGAIN
+			}
+			if errno := m.setlk(nil, 1, tt.req.owner, tt.req.lock(), 0, false); errno != wantErrno {
+				t.Errorf("setlk = %v, want %v", errno, wantErrno)
+			}
+		})
+	}
+}
+
+func TestSetlkInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		lk   fuse.FileLock
+	}{
+		{"unknown type", fuse.FileLock{Typ: 99, End: 9}},
+		{"start after end", fuse.FileLock{Typ: syscall.F_WRLCK, Start: 10, End: 9}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newLockManager()
+			if errno := m.setlk(nil, 1, 1, &tt.lk, 0, false); errno != syscall.EINVAL {
+				t.Errorf("setlk = %v, want EINVAL", errno)
+			}
+		})
+	}
+}
+
+func TestFlockConflict(t *testing.T) {
+	const r, w = syscall.F_RDLCK, syscall.F_WRLCK
+	tests := []struct {
+		name      string
+		held, req uint32
+		owner     uint64
+		want      syscall.Errno
+	}{
+		{"shared and shared", r, r, 2, 0},
+		{"shared and exclusive", r, w, 2, syscall.EAGAIN},
+		{"exclusive and shared", w, r, 2, syscall.EAGAIN},
+		{"exclusive and exclusive", w, w, 2, syscall.EAGAIN},
+		{"same file", w, w, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newLockManager()
+			lk := &fuse.FileLock{Typ: tt.held, End: maxOffset}
+			if errno := m.setlk(nil, 1, 1, lk, fuse.FUSE_LK_FLOCK, false); errno != 0 {
+				t.Fatalf("setlk = %v", errno)
+			}
+			lk = &fuse.FileLock{Typ: tt.req, End: maxOffset}
+			if errno := m.setlk(nil, 1, tt.owner, lk, fuse.FUSE_LK_FLOCK, false); errno != tt.want {
+				t.Errorf("setlk = %v, want %v", errno, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlockIgnoresPosix(t *testing.T) {
+	m := newLockManager()
+	lk := &fuse.FileLock{Typ: syscall.F_WRLCK, End: maxOffset}
+	if errno := m.setlk(nil, 1, 1, lk, 0, false); errno != 0 {
+		t.Fatalf("setlk = %v", errno)
+	}
+	if errno := m.setlk(nil, 1, 2, lk, fuse.FUSE_LK_FLOCK, false); errno != 0 {
+		t.Errorf("flock over an fcntl lock = %v, want success", errno)
+	}
+}
+
+// setlkw runs a waiting setlk in the background and returns its result
+func setlkw(m *lockManager, cancel <-chan struct{}, owner uint64, typ, flags uint32) <-chan syscall.Errno {
+	done := make(chan syscall.Errno, 1)
+	go func() {
+		lk := &fuse.FileLock{Typ: typ, End: maxOffset}
+		done <- m.setlk(cancel, 1, owner, lk, flags, true)
+	}()
+	return done
+}
+
+// expectBlocked fails if a waiting setlk has returned
+func expectBlocked(t *testing.T, done <-chan syscall.Errno) {
+	t.Helper()
+	select {
+	case errno := <-done:
+		t.Fatalf("setlkw returned %v while the lock was held", errno)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// expectDone waits for a waiting setlk to return
+func expectDone(t *testing.T, done <-chan syscall.Errno, want syscall.Errno) {
+	t.Helper()
+	select {
+	case errno := <-done:
+		if errno != want {
+			t.Errorf("setlkw = %v, want %v", errno, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("setlkw still waiting")
+	}
+}
+
+func TestSetlkwWakeups(t *testing.T) {
+	const r, w, u = syscall.F_RDLCK, syscall.F_WRLCK, syscall.F_UNLCK
+	tests := []struct {
+		name    string
+		flags   uint32
+		wait    uint32 // Lock the waiter asks for
+		release func(m *lockManager)
+	}{
+		{"fcntl unlock", 0, w, func(m *lockManager) {
+			m.setlk(nil, 1, 1, &fuse.FileLock{Typ: u, End: maxOffset}, 0, false)
+		}},
+		{"fcntl downgrade", 0, r, func(m *lockManager) {
+			m.setlk(nil, 1, 1, &fuse.FileLock{Typ: r, End: maxOffset}, 0, false)
+		}},
+		{"fcntl close", 0, w, func(m *lockManager) {
+			m.releasePosix(1, 1)
+		}},
+		{"flock unlock", fuse.FUSE_LK_FLOCK, w, func(m *lockManager) {
+			m.setlk(nil, 1, 1, &fuse.FileLock{Typ: u}, fuse.FUSE_LK_FLOCK, false)
+		}},
+		{"flock downgrade", fuse.FUSE_LK_FLOCK, r, func(m *lockManager) {
+			m.setlk(nil, 1, 1, &fuse.FileLock{Typ: r, End: maxOffset}, fuse.FUSE_LK_FLOCK, false)
+		}},
+		{"flock release", fuse.FUSE_LK_FLOCK, w, func(m *lockManager) {
+			m.releaseFlock(1, 1)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newLockManager()
+			lk := &fuse.FileLock{Typ: w, End: maxOffset}
+			if errno := m.setlk(nil, 1, 1, lk, tt.flags, false); errno != 0 {
+				t.Fatalf("setlk = %v", errno)
+			}
+
+			done := setlkw(m, nil, 2, tt.wait, tt.flags)
+			expectBlocked(t, done)
+			tt.release(m)
+			expectDone(t, done, 0)
+		})
+	}
+}
+
+func TestSetlkwCancel(t *testing.T) {
+	m := newLockManager()
+	held := lockOp{1, syscall.F_WRLCK, 0, maxOffset}
+	if errno := m.setlk(nil, 1, held.owner, held.lock(), 0, false); errno != 0 {
+		t.Fatalf("setlk = %v", errno)
+	}
+
+	cancel := make(chan struct{})
+	done := setlkw(m, cancel, 2, syscall.F_WRLCK, 0)
+	expectBlocked(t, done)
+	close(cancel)
+	expectDone(t, done, syscall.EINTR)
+
+	if got := heldLocks(m, 1); !slices.Equal(got, []lockOp{held}) {
+		t.Errorf("locks after cancel = %+v, want %+v", got, []lockOp{held})
+	}
+}
+
+func TestReleaseForgetsNode(t *testing.T) {
+	m := newLockManager()
+	lk := &fuse.FileLock{Typ: syscall.F_RDLCK, End: 9}
+	m.setlk(nil, 1, 1, lk, 0, false)
+	m.setlk(nil, 1, 2, lk, fuse.FUSE_LK_FLOCK, false)
+
+	m.releasePosix(1, 1)
+	if _, ok := m.nodes[1]; !ok {
+		t.Fatal("node forgotten while a flock lock is held")
+	}
+	m.releaseFlock(1, 2)
+	if _, ok := m.nodes[1]; ok {
+		t.Error("node kept without locks")
+	}
+}
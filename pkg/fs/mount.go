@@ -1,7 +1,10 @@
 package fs
 
 import (
+	"context"
 	"fmt"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
@@ -18,8 +21,9 @@ type Mounter struct {
 	path   string
 }
 
-// Mount creates and mounts the FUSE filesystem
-func Mount(path string, store *db.Store) (*Mounter, error) {
+// Mount creates and mounts the FUSE filesystem. A read-only mount has
+// the kernel refuse all changes with EROFS.
+func Mount(path string, store *db.Store, readOnly bool) (*Mounter, error) {
 	// Create root node (inode 1)
 	root := &Node{
 		ino:   1,
@@ -40,6 +44,9 @@ func Mount(path string, store *db.Store) (*Mounter, error) {
 		UID:          uint32(0),
 		GID:          uint32(0),
 	}
+	if readOnly {
+		opts.MountOptions.Options = append(opts.MountOptions.Options, "ro")
+	}
 
 	server, err := fs.Mount(path, root, opts)
 	if err != nil {
@@ -76,41 +83,163 @@ func (m *Mounter) Serve() {
 // OverlayMounter manages the overlay FUSE filesystem lifecycle
 type OverlayMounter struct {
 	server *fuse.Server
+	root   *OverlayNode
 	path   string
 }
 
+// CacheOptions sets what the kernel caches of an overlay mount. The kernel
+// writeback cache is not among them: go-fuse v2.7.2 masks
+// CAP_WRITEBACK_CACHE out of its INIT reply, so it takes a go-fuse upgrade
+// to offer. Until then writes reach the overlay one request of at most
+// MaxWrite bytes at a time.
+type CacheOptions struct {
+	AttrTimeout  time.Duration // How long file attributes are cached
+	EntryTimeout time.Duration // How long name lookups are cached
+	KeepCache    bool          // Keep file contents cached when a file is opened again
+	ReadDirPlus  bool          // Look up entries along with reading a directory
+	MaxWrite     int           // Largest read or write request in bytes (0 = 128 KiB)
+}
+
+// DefaultCacheOptions returns the caching of a mount without WithCache
+func DefaultCacheOptions() CacheOptions {
+	return CacheOptions{
+		AttrTimeout:  time.Second,
+		EntryTimeout: time.Second,
+		ReadDirPlus:  true,
+	}
+}
+
+// OverlayMountOption configures an overlay mount
+type OverlayMountOption func(*OverlayNode)
+
+// WithPermissions makes the mount check permission bits against the uid
+// and gid of the calling process for access, lookup, open, create, unlink
+// and rename, and record them as the owner of new files. Without it, all
+// requests are allowed and new files are owned by root.
+func WithPermissions() OverlayMountOption {
+	return func(n *OverlayNode) {
+		n.perms = true
+	}
+}
+
+// WithCache sets what the kernel caches. Changes made to an OverlayFS
+// other than through the mount are pushed to the kernel as invalidations,
+// so long timeouts and KeepCache don't show stale data.
+func WithCache(cache CacheOptions) OverlayMountOption {
+	return func(n *OverlayNode) {
+		n.cache = cache
+	}
+}
+
+// WithReadOnly has the kernel refuse all changes to the mount with EROFS
+func WithReadOnly() OverlayMountOption {
+	return func(n *OverlayNode) {
+		n.ro = true
+	}
+}
+
 // MountOverlay creates and mounts an overlay FUSE filesystem
-func MountOverlay(mountPath string, fsys overlay.FileSystem) (*OverlayMounter, error) {
+func MountOverlay(mountPath string, fsys overlay.FileSystem, mountOpts ...OverlayMountOption) (*OverlayMounter, error) {
 	// Create root node for overlay
 	root := &OverlayNode{
-		path: "/",
-		fsys: fsys,
+		fsys:  fsys,
+		cache: DefaultCacheOptions(),
+	}
+	for _, opt := range mountOpts {
+		opt(root)
 	}
 
 	// Mount options
-	timeout := time.Second
 	opts := &fs.Options{
 		MountOptions: fuse.MountOptions{
-			AllowOther: false,
-			Debug:      false,
-			FsName:     "artfs-overlay",
-			Name:       "artfs",
+			AllowOther:         false,
+			Debug:              false,
+			FsName:             "artfs-overlay",
+			Name:               "artfs",
+			MaxWrite:           root.cache.MaxWrite,
+			DisableReadDirPlus: !root.cache.ReadDirPlus,
+			EnableLocks:        true,
 		},
-		AttrTimeout:  &timeout,
-		EntryTimeout: &timeout,
-		UID:          uint32(0),
-		GID:          uint32(0),
+		AttrTimeout:  &root.cache.AttrTimeout,
+		EntryTimeout: &root.cache.EntryTimeout,
+		// Report modes as stored, so files chmodded to 000 and whiteout
+		// devices don't show up as 0644
+		NullPermissions: true,
+		UID:             uint32(0),
+		GID:             uint32(0),
+	}
+	if root.ro {
+		opts.MountOptions.Options = append(opts.MountOptions.Options, "ro")
 	}
 
-	server, err := fs.Mount(mountPath, root, opts)
+	// As fs.Mount does, with fcntl and flock locks served by the mount
+	rawFS := newLockingFS(fs.NewNodeFS(root, opts))
+	server, err := fuse.NewServer(rawFS, mountPath, &opts.MountOptions)
 	if err != nil {
 		return nil, fmt.Errorf("failed to mount overlay FUSE: %w", err)
 	}
+	go server.Serve()
+	if err := server.WaitMount(); err != nil {
+		return nil, fmt.Errorf("failed to mount overlay FUSE: %w", err)
+	}
 
-	return &OverlayMounter{
+	m := &OverlayMounter{
 		server: server,
+		root:   root,
 		path:   mountPath,
-	}, nil
+	}
+	if ofs, ok := fsys.(*overlay.OverlayFS); ok {
+		ofs.SetNotifier(m)
+	}
+	return m, nil
+}
+
+// ContentChanged implements overlay.Notifier by dropping the kernel's
+// cached data and attributes of the file at path
+func (m *OverlayMounter) ContentChanged(ctx context.Context, path string) {
+	if _, ok := fuse.FromContext(ctx); ok {
+		// Made through the mount, so the kernel knows, and notifying from
+		// within a request can deadlock
+		return
+	}
+	if node := m.cachedNode(path); node != nil {
+		node.NotifyContent(0, 0)
+	}
+}
+
+// EntryChanged implements overlay.Notifier by dropping the kernel's cached
+// lookup of path and the attributes of its parent and of the inode it
+// named
+func (m *OverlayMounter) EntryChanged(ctx context.Context, path string) {
+	if _, ok := fuse.FromContext(ctx); ok {
+		return
+	}
+	dir, name := filepath.Split(path)
+	parent := m.cachedNode(dir)
+	if parent == nil || name == "" {
+		return
+	}
+	// A negative offset only drops attributes
+	if child := parent.GetChild(name); child != nil {
+		child.NotifyContent(-1, 0)
+	}
+	parent.NotifyEntry(name)
+	parent.NotifyContent(-1, 0)
+}
+
+// cachedNode returns the inode at path if the kernel knows it, without
+// looking anything up
+func (m *OverlayMounter) cachedNode(path string) *fs.Inode {
+	node := m.root.EmbeddedInode()
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		if node = node.GetChild(name); node == nil {
+			return nil
+		}
+	}
+	return node
 }
 
 // Unmount cleanly unmounts the overlay filesystem
@@ -123,6 +123,7 @@ func fillAttr(inode *db.Inode, attr *fuse.Attr) {
 	attr.Atime = uint64(inode.Atime)
 	attr.Mtime = uint64(inode.Mtime)
 	attr.Ctime = uint64(inode.Ctime)
+	attr.Rdev = inode.Rdev
 }
 
 // toErrno converts db errors to syscall.Errno
@@ -137,6 +138,12 @@ func toErrno(err error) syscall.Errno {
 		return syscall.EEXIST
 	case db.ErrNotEmpty:
 		return syscall.ENOTEMPTY
+	case db.ErrNotDir:
+		return syscall.ENOTDIR
+	case db.ErrIsDir:
+		return syscall.EISDIR
+	case db.ErrInvalid:
+		return syscall.EINVAL
 	default:
 		return syscall.EIO
 	}
@@ -2,9 +2,10 @@ package fs
 
 import (
 	"context"
+	"io"
+	"math"
 	"path/filepath"
 	"syscall"
-	"time"
 
 	"art/pkg/overlay"
 
@@ -12,17 +13,13 @@ import (
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
-// Timeout constants for overlay FUSE
-var (
-	attrTimeout  = time.Second
-	entryTimeout = time.Second
-)
-
 // OverlayNode is a FUSE node backed by an overlay.FileSystem
 type OverlayNode struct {
 	fs.Inode
-	path string              // Path relative to root
-	fsys overlay.FileSystem  // The underlying filesystem
+	fsys  overlay.FileSystem  // The underlying filesystem
+	perms bool                // Check permissions against the FUSE caller
+	cache CacheOptions        // What the kernel caches
+	ro    bool                // Mounted read-only
 }
 
 // Ensure interface compliance
@@ -35,6 +32,7 @@ var (
 	_ fs.NodeMkdirer   = (*OverlayNode)(nil)
 	_ fs.NodeRmdirer   = (*OverlayNode)(nil)
 	_ fs.NodeCreater   = (*OverlayNode)(nil)
+	_ fs.NodeMknoder   = (*OverlayNode)(nil)
 	_ fs.NodeUnlinker  = (*OverlayNode)(nil)
 	_ fs.NodeRenamer   = (*OverlayNode)(nil)
 	_ fs.NodeLinker    = (*OverlayNode)(nil)
@@ -43,18 +41,53 @@ var (
 	_ fs.NodeOpener    = (*OverlayNode)(nil)
 	_ fs.NodeStatfser  = (*OverlayNode)(nil)
 	_ fs.NodeAccesser  = (*OverlayNode)(nil)
+	_ fs.NodeCopyFileRanger = (*OverlayNode)(nil)
 )
 
+// path returns the node's current path, taken from the inode tree so it
+// follows renames of the node and its ancestors
+func (n *OverlayNode) path() string {
+	return cleanPath(n.Path(n.Root()))
+}
+
 // childPath returns the path for a child with the given name
 func (n *OverlayNode) childPath(name string) string {
-	if n.path == "/" {
+	path := n.path()
+	if path == "/" {
 		return "/" + name
 	}
-	return n.path + "/" + name
+	return path + "/" + name
+}
+
+// newChild returns a node for a child that inherits n's settings
+func (n *OverlayNode) newChild() *OverlayNode {
+	return &OverlayNode{
+		fsys:  n.fsys,
+		perms: n.perms,
+		cache: n.cache,
+	}
+}
+
+// withCaller attaches the FUSE caller to ctx if permissions are checked,
+// which makes the filesystem enforce them and record new files' owners
+func (n *OverlayNode) withCaller(ctx context.Context) context.Context {
+	if !n.perms {
+		return ctx
+	}
+	caller, ok := fuse.FromContext(ctx)
+	if !ok {
+		return ctx
+	}
+	return overlay.WithCaller(ctx, overlay.Caller{Uid: caller.Uid, Gid: caller.Gid})
 }
 
 // Lookup finds a child by name
 func (n *OverlayNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	ctx = n.withCaller(ctx)
+	if err := overlay.CheckPath(ctx, n.fsys, n.path(), overlay.X_OK); err != nil {
+		return nil, overlay.ToErrno(err)
+	}
+
 	childPath := n.childPath(name)
 
 	stats, err := n.fsys.Lstat(ctx, childPath)
@@ -63,13 +96,10 @@ func (n *OverlayNode) Lookup(ctx context.Context, name string, out *fuse.EntryOu
 	}
 
 	fillOverlayAttr(stats, &out.Attr)
-	out.SetAttrTimeout(attrTimeout)
-	out.SetEntryTimeout(entryTimeout)
+	out.SetAttrTimeout(n.cache.AttrTimeout)
+	out.SetEntryTimeout(n.cache.EntryTimeout)
 
-	child := &OverlayNode{
-		path: childPath,
-		fsys: n.fsys,
-	}
+	child := n.newChild()
 
 	return n.NewInode(ctx, child, fs.StableAttr{
 		Mode: stats.Mode,
@@ -79,28 +109,30 @@ func (n *OverlayNode) Lookup(ctx context.Context, name string, out *fuse.EntryOu
 
 // Getattr returns file attributes
 func (n *OverlayNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
-	stats, err := n.fsys.Lstat(ctx, n.path)
+	stats, err := n.fsys.Lstat(ctx, n.path())
 	if err != nil {
 		return overlay.ToErrno(err)
 	}
 
 	fillOverlayAttr(stats, &out.Attr)
-	out.SetTimeout(attrTimeout)
+	out.SetTimeout(n.cache.AttrTimeout)
 	return 0
 }
 
 // Setattr sets file attributes
 func (n *OverlayNode) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	path := n.path()
+
 	// Handle truncate
 	if sz, ok := in.GetSize(); ok {
-		if err := n.fsys.Truncate(ctx, n.path, int64(sz)); err != nil {
+		if err := n.fsys.Truncate(ctx, path, int64(sz)); err != nil {
 			return overlay.ToErrno(err)
 		}
 	}
 
 	// Handle chmod
 	if mode, ok := in.GetMode(); ok {
-		if err := n.fsys.Chmod(ctx, n.path, mode); err != nil {
+		if err := n.fsys.Chmod(ctx, path, mode); err != nil {
 			return overlay.ToErrno(err)
 		}
 	}
@@ -111,7 +143,7 @@ func (n *OverlayNode) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.Se
 		if g, ok := in.GetGID(); ok {
 			gid = g
 		}
-		if err := n.fsys.Chown(ctx, n.path, uid, gid); err != nil {
+		if err := n.fsys.Chown(ctx, path, uid, gid); err != nil {
 			return overlay.ToErrno(err)
 		}
 	}
@@ -124,12 +156,12 @@ func (n *OverlayNode) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.Se
 			m := mtime.Unix()
 			mt = &m
 		}
-		if err := n.fsys.Utimens(ctx, n.path, &at, mt); err != nil {
+		if err := n.fsys.Utimens(ctx, path, &at, mt); err != nil {
 			return overlay.ToErrno(err)
 		}
 	} else if mtime, ok := in.GetMTime(); ok {
 		m := mtime.Unix()
-		if err := n.fsys.Utimens(ctx, n.path, nil, &m); err != nil {
+		if err := n.fsys.Utimens(ctx, path, nil, &m); err != nil {
 			return overlay.ToErrno(err)
 		}
 	}
@@ -140,7 +172,12 @@ func (n *OverlayNode) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.Se
 
 // Readdir returns directory entries
 func (n *OverlayNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
-	entries, err := n.fsys.Readdir(ctx, n.path)
+	ctx = n.withCaller(ctx)
+	if err := overlay.CheckPath(ctx, n.fsys, n.path(), overlay.R_OK); err != nil {
+		return nil, overlay.ToErrno(err)
+	}
+
+	entries, err := n.fsys.Readdir(ctx, n.path())
 	if err != nil {
 		return nil, overlay.ToErrno(err)
 	}
@@ -159,6 +196,11 @@ func (n *OverlayNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno)
 
 // Mkdir creates a directory
 func (n *OverlayNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	ctx = n.withCaller(ctx)
+	if err := overlay.CheckPath(ctx, n.fsys, n.path(), overlay.W_OK|overlay.X_OK); err != nil {
+		return nil, overlay.ToErrno(err)
+	}
+
 	childPath := n.childPath(name)
 
 	if err := n.fsys.Mkdir(ctx, childPath, mode); err != nil {
@@ -171,13 +213,10 @@ func (n *OverlayNode) Mkdir(ctx context.Context, name string, mode uint32, out *
 	}
 
 	fillOverlayAttr(stats, &out.Attr)
-	out.SetAttrTimeout(attrTimeout)
-	out.SetEntryTimeout(entryTimeout)
+	out.SetAttrTimeout(n.cache.AttrTimeout)
+	out.SetEntryTimeout(n.cache.EntryTimeout)
 
-	child := &OverlayNode{
-		path: childPath,
-		fsys: n.fsys,
-	}
+	child := n.newChild()
 
 	return n.NewInode(ctx, child, fs.StableAttr{
 		Mode: stats.Mode,
@@ -187,12 +226,22 @@ func (n *OverlayNode) Mkdir(ctx context.Context, name string, mode uint32, out *
 
 // Rmdir removes a directory
 func (n *OverlayNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	ctx = n.withCaller(ctx)
 	childPath := n.childPath(name)
+	if err := overlay.CheckRemove(ctx, n.fsys, childPath); err != nil {
+		return overlay.ToErrno(err)
+	}
+
 	return overlay.ToErrno(n.fsys.Rmdir(ctx, childPath))
 }
 
 // Create creates a new file
 func (n *OverlayNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	ctx = n.withCaller(ctx)
+	if err := overlay.CheckPath(ctx, n.fsys, n.path(), overlay.W_OK|overlay.X_OK); err != nil {
+		return nil, nil, 0, overlay.ToErrno(err)
+	}
+
 	childPath := n.childPath(name)
 
 	file, stats, err := n.fsys.Create(ctx, childPath, mode)
@@ -201,13 +250,10 @@ func (n *OverlayNode) Create(ctx context.Context, name string, flags uint32, mod
 	}
 
 	fillOverlayAttr(stats, &out.Attr)
-	out.SetAttrTimeout(attrTimeout)
-	out.SetEntryTimeout(entryTimeout)
+	out.SetAttrTimeout(n.cache.AttrTimeout)
+	out.SetEntryTimeout(n.cache.EntryTimeout)
 
-	child := &OverlayNode{
-		path: childPath,
-		fsys: n.fsys,
-	}
+	child := n.newChild()
 
 	handle := &OverlayFileHandle{
 		path: childPath,
@@ -218,12 +264,47 @@ func (n *OverlayNode) Create(ctx context.Context, name string, flags uint32, mod
 	return n.NewInode(ctx, child, fs.StableAttr{
 		Mode: stats.Mode,
 		Ino:  stats.Ino,
-	}), handle, 0, 0
+	}), handle, n.openFlags(), 0
+}
+
+// Mknod creates a FIFO, socket or device node
+func (n *OverlayNode) Mknod(ctx context.Context, name string, mode uint32, dev uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	ctx = n.withCaller(ctx)
+	if err := overlay.CheckPath(ctx, n.fsys, n.path(), overlay.W_OK|overlay.X_OK); err != nil {
+		return nil, overlay.ToErrno(err)
+	}
+
+	childPath := n.childPath(name)
+
+	if err := n.fsys.Mknod(ctx, childPath, mode, dev); err != nil {
+		return nil, overlay.ToErrno(err)
+	}
+
+	stats, err := n.fsys.Lstat(ctx, childPath)
+	if err != nil {
+		return nil, overlay.ToErrno(err)
+	}
+
+	fillOverlayAttr(stats, &out.Attr)
+	out.SetAttrTimeout(n.cache.AttrTimeout)
+	out.SetEntryTimeout(n.cache.EntryTimeout)
+
+	child := n.newChild()
+
+	return n.NewInode(ctx, child, fs.StableAttr{
+		Mode: stats.Mode,
+		Ino:  stats.Ino,
+	}), 0
 }
 
 // Unlink removes a file
 func (n *OverlayNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	ctx = n.withCaller(ctx)
 	childPath := n.childPath(name)
+	if err := overlay.CheckRemove(ctx, n.fsys, childPath); err != nil {
+		return overlay.ToErrno(err)
+	}
+
 	return overlay.ToErrno(n.fsys.Remove(ctx, childPath))
 }
 
@@ -238,11 +319,31 @@ func (n *OverlayNode) Rename(ctx context.Context, name string, newParent fs.Inod
 	}
 	newPath := newParentNode.childPath(newName)
 
-	return overlay.ToErrno(n.fsys.Rename(ctx, oldPath, newPath))
+	// Moving an entry needs the same permissions as removing it, and
+	// replacing one as removing that too
+	ctx = n.withCaller(ctx)
+	if err := overlay.CheckRemove(ctx, n.fsys, oldPath); err != nil {
+		return overlay.ToErrno(err)
+	}
+	if err := overlay.CheckRemove(ctx, n.fsys, newPath); err == overlay.ErrNotFound {
+		err = overlay.CheckPath(ctx, n.fsys, newParentNode.path(), overlay.W_OK|overlay.X_OK)
+		if err != nil {
+			return overlay.ToErrno(err)
+		}
+	} else if err != nil {
+		return overlay.ToErrno(err)
+	}
+
+	return overlay.ToErrno(n.fsys.Rename(ctx, oldPath, newPath, flags))
 }
 
 // Link creates a hard link
 func (n *OverlayNode) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	ctx = n.withCaller(ctx)
+	if err := overlay.CheckPath(ctx, n.fsys, n.path(), overlay.W_OK|overlay.X_OK); err != nil {
+		return nil, overlay.ToErrno(err)
+	}
+
 	targetNode, ok := target.(*OverlayNode)
 	if !ok {
 		return nil, syscall.EINVAL
@@ -250,7 +351,7 @@ func (n *OverlayNode) Link(ctx context.Context, target fs.InodeEmbedder, name st
 
 	newPath := n.childPath(name)
 
-	if err := n.fsys.Link(ctx, targetNode.path, newPath); err != nil {
+	if err := n.fsys.Link(ctx, targetNode.path(), newPath); err != nil {
 		return nil, overlay.ToErrno(err)
 	}
 
@@ -260,13 +361,10 @@ func (n *OverlayNode) Link(ctx context.Context, target fs.InodeEmbedder, name st
 	}
 
 	fillOverlayAttr(stats, &out.Attr)
-	out.SetAttrTimeout(attrTimeout)
-	out.SetEntryTimeout(entryTimeout)
+	out.SetAttrTimeout(n.cache.AttrTimeout)
+	out.SetEntryTimeout(n.cache.EntryTimeout)
 
-	child := &OverlayNode{
-		path: newPath,
-		fsys: n.fsys,
-	}
+	child := n.newChild()
 
 	return n.NewInode(ctx, child, fs.StableAttr{
 		Mode: stats.Mode,
@@ -276,6 +374,11 @@ func (n *OverlayNode) Link(ctx context.Context, target fs.InodeEmbedder, name st
 
 // Symlink creates a symbolic link
 func (n *OverlayNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	ctx = n.withCaller(ctx)
+	if err := overlay.CheckPath(ctx, n.fsys, n.path(), overlay.W_OK|overlay.X_OK); err != nil {
+		return nil, overlay.ToErrno(err)
+	}
+
 	linkPath := n.childPath(name)
 
 	if err := n.fsys.Symlink(ctx, target, linkPath); err != nil {
@@ -288,13 +391,10 @@ func (n *OverlayNode) Symlink(ctx context.Context, target, name string, out *fus
 	}
 
 	fillOverlayAttr(stats, &out.Attr)
-	out.SetAttrTimeout(attrTimeout)
-	out.SetEntryTimeout(entryTimeout)
+	out.SetAttrTimeout(n.cache.AttrTimeout)
+	out.SetEntryTimeout(n.cache.EntryTimeout)
 
-	child := &OverlayNode{
-		path: linkPath,
-		fsys: n.fsys,
-	}
+	child := n.newChild()
 
 	return n.NewInode(ctx, child, fs.StableAttr{
 		Mode: stats.Mode,
@@ -304,7 +404,7 @@ func (n *OverlayNode) Symlink(ctx context.Context, target, name string, out *fus
 
 // Readlink reads a symbolic link
 func (n *OverlayNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
-	target, err := n.fsys.Readlink(ctx, n.path)
+	target, err := n.fsys.Readlink(ctx, n.path())
 	if err != nil {
 		return nil, overlay.ToErrno(err)
 	}
@@ -313,25 +413,61 @@ func (n *OverlayNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
 
 // Open opens a file
 func (n *OverlayNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	ctx = n.withCaller(ctx)
+	path := n.path()
+
 	// Verify it's not a directory
-	stats, err := n.fsys.Lstat(ctx, n.path)
+	stats, err := n.fsys.Lstat(ctx, path)
 	if err != nil {
 		return nil, 0, overlay.ToErrno(err)
 	}
 	if stats.IsDir() {
 		return nil, 0, syscall.EISDIR
 	}
+	if err := overlay.CheckAccess(ctx, stats, overlay.OpenMask(int(flags))); err != nil {
+		return nil, 0, overlay.ToErrno(err)
+	}
 
-	file, err := n.fsys.Open(ctx, n.path, int(flags))
+	file, err := n.fsys.Open(ctx, path, int(flags))
 	if err != nil {
 		return nil, 0, overlay.ToErrno(err)
 	}
 
 	return &OverlayFileHandle{
-		path: n.path,
+		path: path,
 		file: file,
 		fsys: n.fsys,
-	}, 0, 0
+	}, n.openFlags(), 0
+}
+
+// openFlags returns the FUSE flags for files opened on the node
+func (n *OverlayNode) openFlags() uint32 {
+	if n.cache.KeepCache {
+		return fuse.FOPEN_KEEP_CACHE
+	}
+	return 0
+}
+
+// CopyFileRange copies data from another file of the mount into this one.
+// Copies between files in an AgentFS delta share chunks instead of
+// duplicating them.
+func (n *OverlayNode) CopyFileRange(ctx context.Context, fhIn fs.FileHandle, offIn uint64, out *fs.Inode, fhOut fs.FileHandle, offOut uint64, length uint64, flags uint64) (uint32, syscall.Errno) {
+	if flags != 0 {
+		return 0, syscall.EINVAL
+	}
+	in, ok1 := fhIn.(*OverlayFileHandle)
+	dst, ok2 := fhOut.(*OverlayFileHandle)
+	if !ok1 || !ok2 {
+		return 0, syscall.EBADF
+	}
+
+	// The reply only has room for 32 bits; callers loop over short copies
+	length = min(length, math.MaxUint32)
+	copied, err := overlay.CopyRange(ctx, dst.file, in.file, int64(offIn), int64(offOut), int64(length))
+	if err != nil && copied == 0 {
+		return 0, overlay.ToErrno(err)
+	}
+	return uint32(copied), 0
 }
 
 // Statfs returns filesystem statistics
@@ -355,7 +491,8 @@ func (n *OverlayNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.E
 
 // Access checks if the file is accessible
 func (n *OverlayNode) Access(ctx context.Context, mask uint32) syscall.Errno {
-	return overlay.ToErrno(n.fsys.Access(ctx, n.path, mask))
+	ctx = n.withCaller(ctx)
+	return overlay.ToErrno(n.fsys.Access(ctx, n.path(), mask))
 }
 
 // fillOverlayAttr fills fuse.Attr from overlay.Stats
@@ -369,6 +506,7 @@ func fillOverlayAttr(stats *overlay.Stats, attr *fuse.Attr) {
 	attr.Atime = uint64(stats.Atime)
 	attr.Mtime = uint64(stats.Mtime)
 	attr.Ctime = uint64(stats.Ctime)
+	attr.Rdev = stats.Rdev
 	attr.Blksize = 4096
 	attr.Blocks = (uint64(stats.Size) + 511) / 512
 }
@@ -388,12 +526,14 @@ var (
 	_ fs.FileFlusher   = (*OverlayFileHandle)(nil)
 	_ fs.FileFsyncer   = (*OverlayFileHandle)(nil)
 	_ fs.FileGetattrer = (*OverlayFileHandle)(nil)
+	_ fs.FileAllocater = (*OverlayFileHandle)(nil)
+	_ fs.FileLseeker   = (*OverlayFileHandle)(nil)
 )
 
 // Read reads data from the file
 func (fh *OverlayFileHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
 	n, err := fh.file.Read(ctx, dest, off)
-	if err != nil {
+	if err != nil && err != io.EOF { // Short reads at the end of base files
 		return nil, overlay.ToErrno(err)
 	}
 	return fuse.ReadResultData(dest[:n]), 0
@@ -408,8 +548,12 @@ func (fh *OverlayFileHandle) Write(ctx context.Context, data []byte, off int64)
 	return uint32(n), 0
 }
 
-// Flush is called on close
+// Flush is called on close, and stores buffered writes so that errors
+// storing them are returned by close
 func (fh *OverlayFileHandle) Flush(ctx context.Context) syscall.Errno {
+	if flusher, ok := fh.file.(overlay.Flusher); ok {
+		return overlay.ToErrno(flusher.Flush(ctx))
+	}
 	return 0
 }
 
@@ -418,6 +562,22 @@ func (fh *OverlayFileHandle) Fsync(ctx context.Context, flags uint32) syscall.Er
 	return overlay.ToErrno(fh.file.Sync(ctx))
 }
 
+// Allocate implements fallocate. Space can't be reserved ahead of writes,
+// so plain allocations only grow the file.
+func (fh *OverlayFileHandle) Allocate(ctx context.Context, off uint64, size uint64, mode uint32) syscall.Errno {
+	return overlay.ToErrno(overlay.Allocate(ctx, fh.file, int64(off), int64(size), mode))
+}
+
+// Lseek finds data and holes for SEEK_DATA and SEEK_HOLE; the kernel
+// handles the other whence values itself
+func (fh *OverlayFileHandle) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, syscall.Errno) {
+	pos, err := overlay.SeekHole(ctx, fh.file, int64(off), int(whence))
+	if err != nil {
+		return 0, overlay.ToErrno(err)
+	}
+	return uint64(pos), 0
+}
+
 // Getattr returns file attributes
 func (fh *OverlayFileHandle) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
 	stats, err := fh.file.Stat(ctx)
@@ -0,0 +1,110 @@
+package fs
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"art/pkg/db"
+	"art/pkg/overlay"
+)
+
+// Ensure interface compliance
+var (
+	_ fs.NodeGetxattrer    = (*OverlayNode)(nil)
+	_ fs.NodeSetxattrer    = (*OverlayNode)(nil)
+	_ fs.NodeListxattrer   = (*OverlayNode)(nil)
+	_ fs.NodeRemovexattrer = (*OverlayNode)(nil)
+
+	_ fs.NodeGetxattrer    = (*Node)(nil)
+	_ fs.NodeSetxattrer    = (*Node)(nil)
+	_ fs.NodeListxattrer   = (*Node)(nil)
+	_ fs.NodeRemovexattrer = (*Node)(nil)
+)
+
+// Getxattr reads an extended attribute
+func (n *OverlayNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	value, err := n.fsys.Getxattr(ctx, n.path(), attr)
+	if err != nil {
+		return 0, overlay.ToErrno(err)
+	}
+	return copyXattr(dest, value)
+}
+
+// Setxattr sets an extended attribute
+func (n *OverlayNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return overlay.ToErrno(n.fsys.Setxattr(ctx, n.path(), attr, data, int(flags)))
+}
+
+// Listxattr lists extended attribute names
+func (n *OverlayNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	names, err := n.fsys.Listxattr(ctx, n.path())
+	if err != nil {
+		return 0, overlay.ToErrno(err)
+	}
+	return copyXattr(dest, xattrNames(names))
+}
+
+// Removexattr removes an extended attribute
+func (n *OverlayNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	return overlay.ToErrno(n.fsys.Removexattr(ctx, n.path(), attr))
+}
+
+// Getxattr reads an extended attribute
+func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	value, err := n.store.GetXattr(ctx, n.ino, attr)
+	if err == db.ErrNotFound {
+		return 0, syscall.ENODATA
+	}
+	if err != nil {
+		return 0, toErrno(err)
+	}
+	return copyXattr(dest, value)
+}
+
+// Setxattr sets an extended attribute
+func (n *Node) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	err := n.store.SetXattr(ctx, n.ino, attr, data, int(flags))
+	if err == db.ErrNotFound {
+		return syscall.ENODATA
+	}
+	return toErrno(err)
+}
+
+// Listxattr lists extended attribute names
+func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	names, err := n.store.ListXattrs(ctx, n.ino)
+	if err != nil {
+		return 0, toErrno(err)
+	}
+	return copyXattr(dest, xattrNames(names))
+}
+
+// Removexattr removes an extended attribute
+func (n *Node) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	err := n.store.RemoveXattr(ctx, n.ino, attr)
+	if err == db.ErrNotFound {
+		return syscall.ENODATA
+	}
+	return toErrno(err)
+}
+
+// copyXattr copies value into dest, returning ERANGE and the needed size
+// if dest is too small (go-fuse turns that into a size reply for probes)
+func copyXattr(dest, value []byte) (uint32, syscall.Errno) {
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), 0
+}
+
+// xattrNames encodes attribute names as a NUL-terminated list
+func xattrNames(names []string) []byte {
+	var buf []byte
+	for _, name := range names {
+		buf = append(buf, name...)
+		buf = append(buf, 0)
+	}
+	return buf
+}
@@ -0,0 +1,142 @@
+// Package ignore matches workspace paths against gitignore-style patterns.
+package ignore
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// pattern is a single line of an ignore file
+type pattern struct {
+	glob     string // Slash-separated glob, without leading or trailing slash
+	negate   bool   // "!pattern" re-includes matching paths
+	dirOnly  bool   // "pattern/" only matches directories
+	anchored bool   // Contains a slash, so matches relative to the root
+}
+
+// Matcher decides whether paths are ignored. The zero value ignores nothing.
+type Matcher struct {
+	patterns []pattern
+}
+
+// Load reads the first of the named ignore files that exists in dir and
+// returns its matcher and name. If none exists, the matcher ignores nothing
+// and the name is empty.
+func Load(dir string, names ...string) (*Matcher, string, error) {
+	for _, name := range names {
+		f, err := os.Open(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		defer f.Close()
+		m, err := Parse(f)
+		return m, name, err
+	}
+	return &Matcher{}, "", nil
+}
+
+// Parse reads patterns in gitignore syntax: blank lines and "#" comments
+// are skipped, "!" negates, a trailing "/" matches directories only, a
+// slash elsewhere anchors the pattern to the root, and "**" matches any
+// number of directories.
+func Parse(r io.Reader) (*Matcher, error) {
+	m := &Matcher{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var p pattern
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:] // Escaped leading "#" or "!"
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			p.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		p.glob = line
+		m.patterns = append(m.patterns, p)
+	}
+	return m, scanner.Err()
+}
+
+// Match reports whether the slash-separated path rel, relative to the
+// root, is ignored. As in git, a path under an ignored directory is
+// ignored even if a later pattern would re-include it.
+func (m *Matcher) Match(rel string, isDir bool) bool {
+	if len(m.patterns) == 0 {
+		return false
+	}
+	for i := 0; i < len(rel); i++ {
+		if rel[i] == '/' && m.match(rel[:i], true) {
+			return true
+		}
+	}
+	return m.match(rel, isDir)
+}
+
+// match applies the patterns to a single path; the last match wins
+func (m *Matcher) match(rel string, isDir bool) bool {
+	ignored := false
+	for _, p := range m.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		var ok bool
+		if p.anchored {
+			ok = matchSegments(strings.Split(p.glob, "/"), strings.Split(rel, "/"))
+		} else {
+			ok, _ = path.Match(p.glob, path.Base(rel))
+		}
+		if ok {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+// matchSegments matches path segments against glob segments, where a "**"
+// segment matches zero or more path segments, or one or more at the end
+// ("dir/**" matches what is inside dir, not dir itself)
+func matchSegments(globs, parts []string) bool {
+	for len(globs) > 0 {
+		if globs[0] == "**" {
+			if len(globs) == 1 {
+				return len(parts) > 0
+			}
+			for i := 0; i <= len(parts); i++ {
+				if matchSegments(globs[1:], parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(globs[0], parts[0]); !ok {
+			return false
+		}
+		globs, parts = globs[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
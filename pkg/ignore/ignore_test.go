@@ -0,0 +1,67 @@
+package ignore
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns string
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		{"no patterns", "", "a.txt", false, false},
+		{"comment", "# a.txt", "a.txt", false, false},
+		{"escaped hash", `\#a.txt`, "#a.txt", false, true},
+		{"basename glob", "*.log", "a.log", false, true},
+		{"basename glob at depth", "*.log", "x/y/a.log", false, true},
+		{"basename glob mismatch", "*.log", "a.txt", false, false},
+
+		{"dir only matches dir", "build/", "build", true, true},
+		{"dir only skips file", "build/", "build", false, false},
+		{"dir only matches dir at depth", "build/", "x/build", true, true},
+		{"under ignored dir", "build/", "build/out/a.o", false, true},
+
+		{"anchored at root", "/a.txt", "a.txt", false, true},
+		{"anchored not at depth", "/a.txt", "x/a.txt", false, false},
+		{"inner slash anchors", "doc/*.txt", "doc/a.txt", false, true},
+		{"inner slash anchors not at depth", "doc/*.txt", "x/doc/a.txt", false, false},
+		{"star stays in segment", "doc/*.txt", "doc/x/a.txt", false, false},
+
+		{"leading double star", "**/foo", "foo", false, true},
+		{"leading double star at depth", "**/foo", "a/b/foo", false, true},
+		{"trailing double star", "a/**", "a/b/c", false, true},
+		{"trailing double star not dir itself", "a/**", "a", true, false},
+		{"middle double star none", "a/**/b", "a/b", false, true},
+		{"middle double star many", "a/**/b", "a/x/y/b", false, true},
+		{"middle double star mismatch", "a/**/b", "a/x/c", false, false},
+
+		{"negation", "*.log\n!keep.log", "keep.log", false, false},
+		{"negation keeps others", "*.log\n!keep.log", "a.log", false, true},
+		{"last match wins", "!keep.log\n*.log", "keep.log", false, true},
+		{"negation under ignored dir", "build/\n!build/keep", "build/keep", false, true},
+		{"negation of dir contents", "build/*\n!build/keep", "build/keep", false, false},
+		{"escaped bang", `\!a`, "!a", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := Parse(strings.NewReader(tt.patterns))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.Match(tt.path, tt.isDir); got != tt.want {
+				t.Errorf("Match(%q, %v) with %q = %v, want %v", tt.path, tt.isDir, tt.patterns, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestZeroMatcher(t *testing.T) {
+	var m Matcher
+	if m.Match("a", false) {
+		t.Error("zero Matcher ignores a path")
+	}
+}
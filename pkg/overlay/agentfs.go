@@ -15,6 +15,9 @@ import (
 type AgentFS struct {
 	store *db.Store
 	cache *lru.Cache[dentryKey, uint64] // LRU cache for path resolution
+	types *lru.Cache[uint64, uint32]    // File types by inode, for symlink resolution
+	base  FileSystem                    // Base layer behind partially copied-up files
+	wb    *writeBack                    // Buffered writes (nil = written through)
 	mu    sync.RWMutex
 }
 
@@ -24,18 +27,40 @@ type dentryKey struct {
 	name      string
 }
 
+// AgentFSOption configures AgentFS behavior
+type AgentFSOption func(*AgentFS)
+
+// WithWriteBuffer buffers writes to files in memory, up to maxSize bytes
+// for all files, and stores those to a file in one transaction when it is
+// flushed, synced or closed, or when they are maxAge old. Without it,
+// every write is a transaction of its own.
+func WithWriteBuffer(maxSize int64, maxAge time.Duration) AgentFSOption {
+	return func(a *AgentFS) {
+		a.wb = newWriteBack(a.store, maxSize, maxAge)
+	}
+}
+
 // NewAgentFS creates a new AgentFS wrapping the given store
-func NewAgentFS(store *db.Store) (*AgentFS, error) {
+func NewAgentFS(store *db.Store, opts ...AgentFSOption) (*AgentFS, error) {
 	// Create LRU cache with 10000 entries
 	cache, err := lru.New[dentryKey, uint64](10000)
 	if err != nil {
 		return nil, err
 	}
+	types, err := lru.New[uint64, uint32](10000)
+	if err != nil {
+		return nil, err
+	}
 
-	return &AgentFS{
+	a := &AgentFS{
 		store: store,
 		cache: cache,
-	}, nil
+		types: types,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a, nil
 }
 
 // Store returns the underlying db.Store
@@ -43,8 +68,41 @@ func (a *AgentFS) Store() *db.Store {
 	return a.store
 }
 
-// resolvePath converts a virtual path to an inode number
+// Flush stores all buffered writes
+func (a *AgentFS) Flush(ctx context.Context) error {
+	if a.wb == nil {
+		return nil
+	}
+	return a.wb.flushAll(ctx)
+}
+
+// flushIno stores the buffered writes to an inode, before changes that
+// would conflict with them
+func (a *AgentFS) flushIno(ctx context.Context, ino uint64) error {
+	if a.wb == nil {
+		return nil
+	}
+	return a.wb.flush(ctx, ino)
+}
+
+// resolvePath converts a virtual path to an inode number, following
+// symlinks in all but the last component
 func (a *AgentFS) resolvePath(ctx context.Context, path string) (uint64, error) {
+	return a.resolve(ctx, path, false)
+}
+
+// resolve converts a virtual path to an inode number, following symlinks
+// in the last component too if followLast is set
+func (a *AgentFS) resolve(ctx context.Context, path string, followLast bool) (uint64, error) {
+	resolved, err := walkSymlinks(ctx, a, path, "", followLast)
+	if err != nil {
+		return 0, err
+	}
+	return a.lookupPath(ctx, resolved)
+}
+
+// lookupPath converts a path without symlinks to an inode number
+func (a *AgentFS) lookupPath(ctx context.Context, path string) (uint64, error) {
 	parts := splitPath(path)
 	if len(parts) == 0 {
 		return 1, nil // Root inode
@@ -52,31 +110,39 @@ func (a *AgentFS) resolvePath(ctx context.Context, path string) (uint64, error)
 
 	ino := uint64(1) // Start at root
 	for _, part := range parts {
-		key := dentryKey{parentIno: ino, name: part}
-
-		// Check cache first
-		if childIno, ok := a.cache.Get(key); ok {
-			ino = childIno
-			continue
-		}
-
-		// Cache miss - query database
-		childIno, err := a.store.Lookup(ctx, ino, part)
+		childIno, err := a.lookupChild(ctx, ino, part)
 		if err != nil {
-			if err == db.ErrNotFound {
-				return 0, ErrNotFound
-			}
 			return 0, err
 		}
-
-		// Cache the result
-		a.cache.Add(key, childIno)
 		ino = childIno
 	}
 
 	return ino, nil
 }
 
+// lookupChild returns the inode of an entry in a directory
+func (a *AgentFS) lookupChild(ctx context.Context, parentIno uint64, name string) (uint64, error) {
+	key := dentryKey{parentIno: parentIno, name: name}
+
+	// Check cache first
+	if ino, ok := a.cache.Get(key); ok {
+		return ino, nil
+	}
+
+	// Cache miss - query database
+	ino, err := a.store.Lookup(ctx, parentIno, name)
+	if err != nil {
+		if err == db.ErrNotFound {
+			return 0, ErrNotFound
+		}
+		return 0, err
+	}
+
+	// Cache the result
+	a.cache.Add(key, ino)
+	return ino, nil
+}
+
 // resolveParentAndName resolves the parent directory inode and returns the name component
 func (a *AgentFS) resolveParentAndName(ctx context.Context, path string) (parentIno uint64, name string, err error) {
 	parts := splitPath(path)
@@ -87,7 +153,7 @@ func (a *AgentFS) resolveParentAndName(ctx context.Context, path string) (parent
 	name = parts[len(parts)-1]
 	parentPath := joinPath(parts[:len(parts)-1])
 
-	parentIno, err = a.resolvePath(ctx, parentPath)
+	parentIno, err = a.resolve(ctx, parentPath, true)
 	if err != nil {
 		return 0, "", err
 	}
@@ -95,6 +161,50 @@ func (a *AgentFS) resolveParentAndName(ctx context.Context, path string) (parent
 	return parentIno, name, nil
 }
 
+// typeOf returns the file type of a path without symlinks before its last
+// component
+func (a *AgentFS) typeOf(ctx context.Context, path string) (uint32, error) {
+	ino, err := a.lookupPath(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	if mode, ok := a.types.Get(ino); ok {
+		return mode, nil
+	}
+
+	inode, err := a.store.GetInode(ctx, ino)
+	if err != nil {
+		if err == db.ErrNotFound {
+			return 0, ErrNotFound
+		}
+		return 0, err
+	}
+
+	// Inode numbers are never reused, so entries can't go stale
+	mode := inode.Mode & S_IFMT
+	a.types.Add(ino, mode)
+	return mode, nil
+}
+
+// readlink returns the target of a symlink at a path without symlinks
+// before its last component
+func (a *AgentFS) readlink(ctx context.Context, path string) (string, error) {
+	ino, err := a.lookupPath(ctx, path)
+	if err != nil {
+		return "", err
+	}
+
+	target, err := a.store.ReadSymlink(ctx, ino)
+	if err != nil {
+		if err == db.ErrNotFound {
+			return "", ErrNotFound
+		}
+		return "", err
+	}
+
+	return target, nil
+}
+
 // invalidateCache removes a dentry from the cache
 func (a *AgentFS) invalidateCache(parentIno uint64, name string) {
 	a.cache.Remove(dentryKey{parentIno: parentIno, name: name})
@@ -102,9 +212,11 @@ func (a *AgentFS) invalidateCache(parentIno uint64, name string) {
 
 // Stat implements FileSystem.Stat (follows symlinks)
 func (a *AgentFS) Stat(ctx context.Context, path string) (*Stats, error) {
-	// For now, Stat and Lstat behave the same (we don't follow symlinks in paths)
-	// A full implementation would resolve symlinks in the path
-	return a.Lstat(ctx, path)
+	ino, err := a.resolve(ctx, path, true)
+	if err != nil {
+		return nil, err
+	}
+	return a.statIno(ctx, ino)
 }
 
 // Lstat implements FileSystem.Lstat (does not follow symlinks)
@@ -113,7 +225,11 @@ func (a *AgentFS) Lstat(ctx context.Context, path string) (*Stats, error) {
 	if err != nil {
 		return nil, err
 	}
+	return a.statIno(ctx, ino)
+}
 
+// statIno returns the stats of an inode
+func (a *AgentFS) statIno(ctx context.Context, ino uint64) (*Stats, error) {
 	inode, err := a.store.GetInode(ctx, ino)
 	if err != nil {
 		if err == db.ErrNotFound {
@@ -122,25 +238,20 @@ func (a *AgentFS) Lstat(ctx context.Context, path string) (*Stats, error) {
 		return nil, err
 	}
 
-	return inodeToStats(inode), nil
+	stats := inodeToStats(inode)
+	if a.wb != nil {
+		a.wb.apply(stats)
+	}
+	return stats, nil
 }
 
 // Readlink implements FileSystem.Readlink
 func (a *AgentFS) Readlink(ctx context.Context, path string) (string, error) {
-	ino, err := a.resolvePath(ctx, path)
-	if err != nil {
-		return "", err
-	}
-
-	target, err := a.store.ReadSymlink(ctx, ino)
+	resolved, err := walkSymlinks(ctx, a, path, "", false)
 	if err != nil {
-		if err == db.ErrNotFound {
-			return "", ErrNotFound
-		}
 		return "", err
 	}
-
-	return target, nil
+	return a.readlink(ctx, resolved)
 }
 
 // Statfs implements FileSystem.Statfs
@@ -159,7 +270,7 @@ func (a *AgentFS) Statfs(ctx context.Context) (*FilesystemStats, error) {
 
 // Readdir implements FileSystem.Readdir
 func (a *AgentFS) Readdir(ctx context.Context, path string) ([]DirEntry, error) {
-	ino, err := a.resolvePath(ctx, path)
+	ino, err := a.resolve(ctx, path, true)
 	if err != nil {
 		return nil, err
 	}
@@ -194,7 +305,8 @@ func (a *AgentFS) Mkdir(ctx context.Context, path string, mode uint32) error {
 
 	return a.store.WithTx(ctx, func(tx *sql.Tx) error {
 		// Create directory inode
-		ino, err := a.store.CreateInodeTx(ctx, tx, db.S_IFDIR|mode, 0, 0)
+		uid, gid := owner(ctx)
+		ino, err := a.store.CreateInodeTx(ctx, tx, db.S_IFDIR|mode, uid, gid)
 		if err != nil {
 			return err
 		}
@@ -279,7 +391,8 @@ func (a *AgentFS) Create(ctx context.Context, path string, mode uint32) (File, *
 	err = a.store.WithTx(ctx, func(tx *sql.Tx) error {
 		// Create file inode
 		var err error
-		ino, err = a.store.CreateInodeTx(ctx, tx, db.S_IFREG|mode, 0, 0)
+		uid, gid := owner(ctx)
+		ino, err = a.store.CreateInodeTx(ctx, tx, db.S_IFREG|mode, uid, gid)
 		if err != nil {
 			return err
 		}
@@ -308,18 +421,54 @@ func (a *AgentFS) Create(ctx context.Context, path string, mode uint32) (File, *
 		store: a.store,
 		ino:   ino,
 		path:  path,
+		base:  a.base,
+		wb:    a.wb,
 	}, inodeToStats(inode), nil
 }
 
+// Mknod implements FileSystem.Mknod
+func (a *AgentFS) Mknod(ctx context.Context, path string, mode, rdev uint32) error {
+	switch mode & S_IFMT {
+	case S_IFIFO, S_IFSOCK, S_IFCHR, S_IFBLK:
+	default:
+		return ErrInvalid
+	}
+
+	parentIno, name, err := a.resolveParentAndName(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	return a.store.WithTx(ctx, func(tx *sql.Tx) error {
+		uid, gid := owner(ctx)
+		ino, err := a.store.CreateNodeTx(ctx, tx, mode, uid, gid, rdev)
+		if err != nil {
+			return err
+		}
+
+		if err := a.store.CreateDentryTx(ctx, tx, parentIno, name, ino); err != nil {
+			if err == db.ErrExists {
+				return ErrExists
+			}
+			return err
+		}
+
+		return nil
+	})
+}
+
 // Open implements FileSystem.Open
 func (a *AgentFS) Open(ctx context.Context, path string, flags int) (File, error) {
-	ino, err := a.resolvePath(ctx, path)
+	ino, err := a.resolve(ctx, path, true)
 	if err != nil {
 		return nil, err
 	}
 
 	// Handle truncation
 	if flags&O_TRUNC != 0 {
+		if err := a.flushIno(ctx, ino); err != nil {
+			return nil, err
+		}
 		if err := a.store.Truncate(ctx, ino, 0); err != nil {
 			return nil, err
 		}
@@ -332,6 +481,8 @@ func (a *AgentFS) Open(ctx context.Context, path string, flags int) (File, error
 		store: a.store,
 		ino:   ino,
 		path:  path,
+		base:  a.base,
+		wb:    a.wb,
 	}, nil
 }
 
@@ -398,7 +549,12 @@ func (a *AgentFS) Remove(ctx context.Context, path string) error {
 }
 
 // Rename implements FileSystem.Rename
-func (a *AgentFS) Rename(ctx context.Context, oldpath, newpath string) error {
+func (a *AgentFS) Rename(ctx context.Context, oldpath, newpath string, flags uint32) error {
+	return a.rename(ctx, oldpath, newpath, flags, nil)
+}
+
+// rename renames an entry and, unless nil, runs fn in the same transaction
+func (a *AgentFS) rename(ctx context.Context, oldpath, newpath string, flags uint32, fn func(tx *sql.Tx) error) error {
 	oldParentIno, oldName, err := a.resolveParentAndName(ctx, oldpath)
 	if err != nil {
 		return err
@@ -409,10 +565,31 @@ func (a *AgentFS) Rename(ctx context.Context, oldpath, newpath string) error {
 		return err
 	}
 
-	err = a.store.Rename(ctx, oldParentIno, newParentIno, oldName, newName)
-	if err == nil {
+	err = a.store.WithTx(ctx, func(tx *sql.Tx) error {
+		if err := a.store.RenameTx(ctx, tx, oldParentIno, newParentIno, oldName, newName, flags); err != nil {
+			return err
+		}
+		if fn != nil {
+			return fn(tx)
+		}
+		return nil
+	})
+	switch err {
+	case nil:
 		a.invalidateCache(oldParentIno, oldName)
 		a.invalidateCache(newParentIno, newName)
+	case db.ErrNotFound:
+		return ErrNotFound
+	case db.ErrExists:
+		return ErrExists
+	case db.ErrNotEmpty:
+		return ErrNotEmpty
+	case db.ErrNotDir:
+		return ErrNotDir
+	case db.ErrIsDir:
+		return ErrIsDir
+	case db.ErrInvalid:
+		return ErrInvalid
 	}
 	return err
 }
@@ -430,7 +607,7 @@ func (a *AgentFS) Chmod(ctx context.Context, path string, mode uint32) error {
 	}
 
 	// Keep file type, update permissions
-	newMode := (inode.Mode & S_IFMT) | (mode & 0o777)
+	newMode := (inode.Mode & S_IFMT) | (mode & 0o7777)
 	return a.store.SetAttr(ctx, ino, &newMode, nil, nil, nil, nil, nil)
 }
 
@@ -451,6 +628,9 @@ func (a *AgentFS) Truncate(ctx context.Context, path string, size int64) error {
 		return err
 	}
 
+	if err := a.flushIno(ctx, ino); err != nil {
+		return err
+	}
 	if err := a.store.Truncate(ctx, ino, uint64(size)); err != nil {
 		return err
 	}
@@ -463,6 +643,10 @@ func (a *AgentFS) Utimens(ctx context.Context, path string, atime, mtime *int64)
 	if err != nil {
 		return err
 	}
+	// Buffered writes would set the mtime again when flushed
+	if err := a.flushIno(ctx, ino); err != nil {
+		return err
+	}
 
 	return a.store.UpdateTimes(ctx, ino, atime, mtime)
 }
@@ -476,7 +660,8 @@ func (a *AgentFS) Symlink(ctx context.Context, target, linkpath string) error {
 
 	return a.store.WithTx(ctx, func(tx *sql.Tx) error {
 		// Create symlink inode
-		ino, err := a.store.CreateInodeTx(ctx, tx, db.S_IFLNK|0o777, 0, 0)
+		uid, gid := owner(ctx)
+		ino, err := a.store.CreateInodeTx(ctx, tx, db.S_IFLNK|0o777, uid, gid)
 		if err != nil {
 			return err
 		}
@@ -535,12 +720,65 @@ func (a *AgentFS) Link(ctx context.Context, oldpath, newpath string) error {
 
 // Access implements FileSystem.Access
 func (a *AgentFS) Access(ctx context.Context, path string, mode uint32) error {
-	_, err := a.resolvePath(ctx, path)
+	stats, err := a.Stat(ctx, path)
 	if err != nil {
 		return err
 	}
-	// Just check existence for now
-	return nil
+	return CheckAccess(ctx, stats, mode)
+}
+
+// Getxattr implements FileSystem.Getxattr
+func (a *AgentFS) Getxattr(ctx context.Context, path, name string) ([]byte, error) {
+	ino, err := a.resolvePath(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	value, err := a.store.GetXattr(ctx, ino, name)
+	if err == db.ErrNotFound {
+		return nil, ErrNoAttr
+	}
+	return value, err
+}
+
+// Setxattr implements FileSystem.Setxattr
+func (a *AgentFS) Setxattr(ctx context.Context, path, name string, value []byte, flags int) error {
+	ino, err := a.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return ErrInvalid
+	}
+	err = a.store.SetXattr(ctx, ino, name, value, flags)
+	switch err {
+	case db.ErrExists:
+		return ErrExists
+	case db.ErrNotFound:
+		return ErrNoAttr
+	}
+	return err
+}
+
+// Listxattr implements FileSystem.Listxattr
+func (a *AgentFS) Listxattr(ctx context.Context, path string) ([]string, error) {
+	ino, err := a.resolvePath(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return a.store.ListXattrs(ctx, ino)
+}
+
+// Removexattr implements FileSystem.Removexattr
+func (a *AgentFS) Removexattr(ctx context.Context, path, name string) error {
+	ino, err := a.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
+	err = a.store.RemoveXattr(ctx, ino, name)
+	if err == db.ErrNotFound {
+		return ErrNoAttr
+	}
+	return err
 }
 
 // GetIno returns the inode number for a path (used by OverlayFS)
@@ -556,10 +794,27 @@ type AgentFile struct {
 	store *db.Store
 	ino   uint64
 	path  string
+	base  FileSystem // Base layer, for partially copied-up files
+	wb    *writeBack // Buffered writes of the AgentFS (nil = written through)
+	mu    sync.Mutex
+	lower File // Open base file, once read
 }
 
 // Read implements File.Read
 func (f *AgentFile) Read(ctx context.Context, dest []byte, offset int64) (int, error) {
+	lower, err := f.lowerOf(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if lower != nil {
+		return f.readMerged(ctx, lower, dest, offset)
+	}
+	if f.wb != nil {
+		if n, ok, err := f.wb.read(ctx, f.ino, dest, offset); ok {
+			return n, err
+		}
+	}
+
 	data, err := f.store.ReadData(ctx, f.ino, offset, int64(len(dest)))
 	if err != nil {
 		return 0, err
@@ -569,6 +824,29 @@ func (f *AgentFile) Read(ctx context.Context, dest []byte, offset int64) (int, e
 
 // Write implements File.Write
 func (f *AgentFile) Write(ctx context.Context, data []byte, offset int64) (int, error) {
+	lower, err := f.lowerOf(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if lower != nil {
+		// Small files are copied whole on their first write
+		if lower.BaseSize < lazyCopyMin {
+			err = f.completeLower(ctx, lower)
+		} else {
+			err = f.fillFromLower(ctx, lower, offset, int64(len(data)))
+		}
+		if err != nil {
+			return 0, err
+		}
+	} else if f.wb != nil {
+		// Partially copied-up files are written through, as their
+		// reads merge the stored chunks with the base file
+		if err := f.wb.write(ctx, f.ino, data, offset); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+
 	if err := f.store.WriteData(ctx, f.ino, offset, data); err != nil {
 		return 0, err
 	}
@@ -595,14 +873,33 @@ func (f *AgentFile) Write(ctx context.Context, data []byte, offset int64) (int,
 	return len(data), nil
 }
 
-// Sync implements File.Sync
+// Sync implements File.Sync by storing buffered writes; SQLite handles
+// durability
 func (f *AgentFile) Sync(ctx context.Context) error {
-	return nil // SQLite handles durability
+	return f.Flush(ctx)
+}
+
+// Flush implements Flusher
+func (f *AgentFile) Flush(ctx context.Context) error {
+	if f.wb == nil {
+		return nil
+	}
+	return f.wb.flush(ctx, f.ino)
 }
 
 // Close implements File.Close
 func (f *AgentFile) Close() error {
-	return nil // Nothing to close
+	err := f.Flush(context.Background())
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.lower != nil {
+		if lowerErr := f.lower.Close(); err == nil {
+			err = lowerErr
+		}
+		f.lower = nil
+	}
+	return err
 }
 
 // Stat implements File.Stat
@@ -611,11 +908,18 @@ func (f *AgentFile) Stat(ctx context.Context) (*Stats, error) {
 	if err != nil {
 		return nil, err
 	}
-	return inodeToStats(inode), nil
+	stats := inodeToStats(inode)
+	if f.wb != nil {
+		f.wb.apply(stats)
+	}
+	return stats, nil
 }
 
 // Truncate implements File.Truncate
 func (f *AgentFile) Truncate(ctx context.Context, size int64) error {
+	if err := f.Flush(ctx); err != nil {
+		return err
+	}
 	if err := f.store.Truncate(ctx, f.ino, uint64(size)); err != nil {
 		return err
 	}
@@ -639,6 +943,7 @@ func inodeToStats(inode *db.Inode) *Stats {
 		Atime: inode.Atime,
 		Mtime: inode.Mtime,
 		Ctime: inode.Ctime,
+		Rdev:  inode.Rdev,
 	}
 }
 
@@ -688,7 +993,10 @@ func (a *AgentFS) WriteFile(ctx context.Context, path string, data []byte, mode
 		return err
 	}
 
-	// File exists - truncate and write
+	// File exists - truncate and write, after what is buffered for it
+	if err := a.flushIno(ctx, ino); err != nil {
+		return err
+	}
 	if err := a.store.Truncate(ctx, ino, 0); err != nil {
 		return err
 	}
@@ -702,17 +1010,7 @@ func (a *AgentFS) WriteFile(ctx context.Context, path string, data []byte, mode
 
 // ReadFile reads the entire content of a file
 func (a *AgentFS) ReadFile(ctx context.Context, path string) ([]byte, error) {
-	ino, err := a.resolvePath(ctx, path)
-	if err != nil {
-		return nil, err
-	}
-
-	inode, err := a.store.GetInode(ctx, ino)
-	if err != nil {
-		return nil, err
-	}
-
-	return a.store.ReadData(ctx, ino, 0, int64(inode.Size))
+	return ReadFile(ctx, a, path)
 }
 
 // CopyFromBase copies a file from the base filesystem to AgentFS
@@ -722,14 +1020,32 @@ func (a *AgentFS) CopyFromBase(ctx context.Context, path string, base FileSystem
 }
 
 // CopyFromBaseWithPath copies a file from the base filesystem to AgentFS
-// deltaPath is where the file will be created in AgentFS
-// basePath is where the file is read from in the base filesystem
+// deltaPath is where to create the file in AgentFS
+// basePath is where to read the file from in base filesystem
+// Extended attributes are copied along with the contents.
 func (a *AgentFS) CopyFromBaseWithPath(ctx context.Context, deltaPath, basePath string, base FileSystem) (uint64, error) {
+	return a.copyFromBase(ctx, deltaPath, basePath, base, false)
+}
+
+// CopyMetadataFromBase copies a file like CopyFromBaseWithPath, except that
+// the contents of a regular file stay in the base layer until written
+func (a *AgentFS) CopyMetadataFromBase(ctx context.Context, deltaPath, basePath string, base FileSystem) (uint64, error) {
+	return a.copyFromBase(ctx, deltaPath, basePath, base, true)
+}
+
+// copyFromBase copies a file from the base filesystem to AgentFS, leaving
+// the contents of regular files in the base layer if metadataOnly is set or
+// they are large
+func (a *AgentFS) copyFromBase(ctx context.Context, deltaPath, basePath string, base FileSystem, metadataOnly bool) (uint64, error) {
 	// Get stats from base
 	stats, err := base.Lstat(ctx, basePath)
 	if err != nil {
 		return 0, err
 	}
+	xattrs, err := readXattrs(ctx, base, basePath)
+	if err != nil {
+		return 0, err
+	}
 
 	// Ensure parent directories exist in delta
 	if err := a.EnsureParentDirs(ctx, deltaPath); err != nil {
@@ -742,15 +1058,39 @@ func (a *AgentFS) CopyFromBaseWithPath(ctx context.Context, deltaPath, basePath
 	}
 
 	var ino uint64
-	if stats.IsRegular() {
-		// Read content from base
-		f, err := base.Open(ctx, basePath, O_RDONLY)
+	if stats.IsRegular() && base == a.base && (metadataOnly || stats.Size >= lazyCopyMin) {
+		// Leave the contents in base until chunks are written
+		err = a.store.WithTx(ctx, func(tx *sql.Tx) error {
+			var err error
+			ino, err = a.store.CreateInodeTx(ctx, tx, stats.Mode, stats.Uid, stats.Gid)
+			if err != nil {
+				return err
+			}
+			if err := a.store.UpdateSizeTx(ctx, tx, ino, uint64(stats.Size)); err != nil {
+				return err
+			}
+			lower := &db.Lower{
+				Ino:       ino,
+				Path:      basePath,
+				Size:      stats.Size,
+				BaseIno:   stats.Ino,
+				BaseSize:  stats.Size,
+				BaseMtime: stats.Mtime,
+			}
+			if err := a.store.SetLowerTx(ctx, tx, lower); err != nil {
+				return err
+			}
+			if err := a.setXattrsTx(ctx, tx, ino, xattrs); err != nil {
+				return err
+			}
+			return a.store.CreateDentryTx(ctx, tx, parentIno, name, ino)
+		})
 		if err != nil {
 			return 0, err
 		}
-		data := make([]byte, stats.Size)
-		_, err = f.Read(ctx, data, 0)
-		f.Close()
+	} else if stats.IsRegular() {
+		// Read content from base
+		data, err := ReadFile(ctx, base, basePath)
 		if err != nil {
 			return 0, err
 		}
@@ -770,8 +1110,14 @@ func (a *AgentFS) CopyFromBaseWithPath(ctx context.Context, deltaPath, basePath
 			if err := a.store.UpdateSizeTx(ctx, tx, ino, uint64(len(data))); err != nil {
 				return err
 			}
+			if err := a.setXattrsTx(ctx, tx, ino, xattrs); err != nil {
+				return err
+			}
 			return a.store.CreateDentryTx(ctx, tx, parentIno, name, ino)
 		})
+		if err != nil {
+			return 0, err
+		}
 	} else if stats.IsSymlink() {
 		// Copy symlink
 		target, err := base.Readlink(ctx, basePath)
@@ -791,8 +1137,30 @@ func (a *AgentFS) CopyFromBaseWithPath(ctx context.Context, deltaPath, basePath
 			if err := a.store.UpdateSizeTx(ctx, tx, ino, uint64(len(target))); err != nil {
 				return err
 			}
+			if err := a.setXattrsTx(ctx, tx, ino, xattrs); err != nil {
+				return err
+			}
 			return a.store.CreateDentryTx(ctx, tx, parentIno, name, ino)
 		})
+		if err != nil {
+			return 0, err
+		}
+	} else if stats.IsSpecial() {
+		// Copy FIFO, socket or device node
+		err = a.store.WithTx(ctx, func(tx *sql.Tx) error {
+			var err error
+			ino, err = a.store.CreateNodeTx(ctx, tx, stats.Mode, stats.Uid, stats.Gid, stats.Rdev)
+			if err != nil {
+				return err
+			}
+			if err := a.setXattrsTx(ctx, tx, ino, xattrs); err != nil {
+				return err
+			}
+			return a.store.CreateDentryTx(ctx, tx, parentIno, name, ino)
+		})
+		if err != nil {
+			return 0, err
+		}
 	} else if stats.IsDir() {
 		// Create directory
 		err = a.store.WithTx(ctx, func(tx *sql.Tx) error {
@@ -801,6 +1169,9 @@ func (a *AgentFS) CopyFromBaseWithPath(ctx context.Context, deltaPath, basePath
 			if err != nil {
 				return err
 			}
+			if err := a.setXattrsTx(ctx, tx, ino, xattrs); err != nil {
+				return err
+			}
 			if err := a.store.CreateDentryTx(ctx, tx, parentIno, name, ino); err != nil {
 				return err
 			}
@@ -810,3 +1181,37 @@ func (a *AgentFS) CopyFromBaseWithPath(ctx context.Context, deltaPath, basePath
 
 	return ino, err
 }
+
+// setXattrsTx stores a set of extended attributes on an inode
+func (a *AgentFS) setXattrsTx(ctx context.Context, tx *sql.Tx, ino uint64, xattrs map[string][]byte) error {
+	for name, value := range xattrs {
+		if err := a.store.SetXattrTx(ctx, tx, ino, name, value, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readXattrs reads all extended attributes of a path, except the
+// overlay's private ones
+func readXattrs(ctx context.Context, fs FileSystem, path string) (map[string][]byte, error) {
+	names, err := fs.Listxattr(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	xattrs := make(map[string][]byte, len(names))
+	for _, name := range names {
+		if isPrivateXattr(name) {
+			continue // Never taken over from the base
+		}
+		value, err := fs.Getxattr(ctx, path, name)
+		if err == ErrNoAttr {
+			continue // Removed since listing
+		}
+		if err != nil {
+			return nil, err
+		}
+		xattrs[name] = value
+	}
+	return xattrs, nil
+}
@@ -0,0 +1,167 @@
+package overlay
+
+import (
+	"context"
+	"database/sql"
+
+	"art/pkg/db"
+)
+
+// Delta is the writable layer of an OverlayFS. Besides the files written
+// through the overlay, it keeps what the overlay records about the base:
+// whiteouts for deleted base paths and the base inodes of copied-up files.
+// AgentFS (SQLite) and MemFS (memory) implement it.
+type Delta interface {
+	FileSystem
+	linkResolver
+
+	// GetIno returns the inode number of a path
+	GetIno(ctx context.Context, path string) (uint64, error)
+
+	// CopyFromBaseWithPath copies a file from base into the delta
+	CopyFromBaseWithPath(ctx context.Context, deltaPath, basePath string, base FileSystem) (uint64, error)
+
+	// CopyMetadataFromBase copies a file from base into the delta, where
+	// the contents of a regular file may stay in base until written
+	CopyMetadataFromBase(ctx context.Context, deltaPath, basePath string, base FileSystem) (uint64, error)
+
+	setBase(base FileSystem)
+	lookupChild(ctx context.Context, parentIno uint64, name string) (uint64, error)
+
+	listWhiteouts(ctx context.Context) ([]string, error)
+	createWhiteout(ctx context.Context, path string) error
+	deleteWhiteout(ctx context.Context, path string) error
+	deleteWhiteoutsUnder(ctx context.Context, path string) error
+
+	origin(ctx context.Context, ino uint64) (uint64, error)
+	addOrigin(ctx context.Context, ino, baseIno uint64) error
+	deleteOrigin(ctx context.Context, ino uint64) error
+
+	// Extended attributes by inode, failing with ErrNoAttr if missing
+	inoXattr(ctx context.Context, ino uint64, name string) ([]byte, error)
+	setInoXattr(ctx context.Context, ino uint64, name string, value []byte) error
+	removeInoXattr(ctx context.Context, ino uint64, name string) error
+
+	// renameMerged applies a rename along with the overlay state that
+	// moves with it, all or nothing
+	renameMerged(ctx context.Context, r *mergedRename) error
+}
+
+// mergedRename is a rename in the delta together with the changes to
+// whiteouts and directory merge state that keep the merged view right
+type mergedRename struct {
+	oldpath, newpath string
+	flags            uint32
+	dirs             []movedDir // Merge state of the directories that moved
+	whiteouts        bool       // Move the whiteouts below oldpath (swap with RENAME_EXCHANGE)
+	unhide           bool       // Delete the whiteout at newpath
+	hide             bool       // Create a whiteout at oldpath
+}
+
+// Ensure AgentFS implements Delta
+var _ Delta = (*AgentFS)(nil)
+
+// setBase sets the base layer behind partially copied-up files
+func (a *AgentFS) setBase(base FileSystem) {
+	a.base = base
+}
+
+func (a *AgentFS) listWhiteouts(ctx context.Context) ([]string, error) {
+	return a.store.ListWhiteouts(ctx)
+}
+
+func (a *AgentFS) createWhiteout(ctx context.Context, path string) error {
+	return a.store.CreateWhiteout(ctx, path)
+}
+
+func (a *AgentFS) deleteWhiteout(ctx context.Context, path string) error {
+	return a.store.DeleteWhiteout(ctx, path)
+}
+
+func (a *AgentFS) deleteWhiteoutsUnder(ctx context.Context, path string) error {
+	return a.store.DeleteWhiteoutsUnder(ctx, path)
+}
+
+func (a *AgentFS) origin(ctx context.Context, ino uint64) (uint64, error) {
+	return a.store.GetOrigin(ctx, ino)
+}
+
+func (a *AgentFS) addOrigin(ctx context.Context, ino, baseIno uint64) error {
+	return a.store.AddOrigin(ctx, ino, baseIno)
+}
+
+func (a *AgentFS) deleteOrigin(ctx context.Context, ino uint64) error {
+	return a.store.DeleteOrigin(ctx, ino)
+}
+
+func (a *AgentFS) inoXattr(ctx context.Context, ino uint64, name string) ([]byte, error) {
+	value, err := a.store.GetXattr(ctx, ino, name)
+	if err == db.ErrNotFound {
+		return nil, ErrNoAttr
+	}
+	return value, err
+}
+
+func (a *AgentFS) setInoXattr(ctx context.Context, ino uint64, name string, value []byte) error {
+	return a.store.SetXattr(ctx, ino, name, value, 0)
+}
+
+func (a *AgentFS) removeInoXattr(ctx context.Context, ino uint64, name string) error {
+	err := a.store.RemoveXattr(ctx, ino, name)
+	if err == db.ErrNotFound {
+		return ErrNoAttr
+	}
+	return err
+}
+
+func (a *AgentFS) renameMerged(ctx context.Context, r *mergedRename) error {
+	return a.rename(ctx, r.oldpath, r.newpath, r.flags, func(tx *sql.Tx) error {
+		if r.unhide {
+			if err := a.store.DeleteWhiteoutTx(ctx, tx, r.newpath); err != nil {
+				return err
+			}
+		}
+		for _, d := range r.dirs {
+			if err := a.setDirMetaTx(ctx, tx, d); err != nil {
+				return err
+			}
+		}
+		if r.whiteouts {
+			var err error
+			if r.flags&RENAME_EXCHANGE != 0 {
+				err = a.store.SwapWhiteoutsUnderTx(ctx, tx, r.oldpath, r.newpath)
+			} else {
+				err = a.store.MoveWhiteoutsUnderTx(ctx, tx, r.oldpath, r.newpath)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if r.hide {
+			return a.store.CreateWhiteoutTx(ctx, tx, r.oldpath)
+		}
+		return nil
+	})
+}
+
+// setDirMetaTx writes the merge state of a moved directory as xattrs
+func (a *AgentFS) setDirMetaTx(ctx context.Context, tx *sql.Tx, d movedDir) error {
+	var err error
+	if d.meta.redirect != "" {
+		err = a.store.SetXattrTx(ctx, tx, d.ino, XattrRedirect, []byte(d.meta.redirect), 0)
+	} else {
+		err = a.store.RemoveXattrTx(ctx, tx, d.ino, XattrRedirect)
+	}
+	if err != nil && err != db.ErrNotFound {
+		return err
+	}
+	if d.meta.opaque {
+		err = a.store.SetXattrTx(ctx, tx, d.ino, XattrOpaque, []byte("y"), 0)
+	} else {
+		err = a.store.RemoveXattrTx(ctx, tx, d.ino, XattrOpaque)
+	}
+	if err != nil && err != db.ErrNotFound {
+		return err
+	}
+	return nil
+}
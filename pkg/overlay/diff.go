@@ -0,0 +1,275 @@
+package overlay
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ChangeKind classifies a difference between the overlay and its base layer
+type ChangeKind string
+
+const (
+	ChangeAdded    ChangeKind = "added"    // Only in the overlay
+	ChangeDeleted  ChangeKind = "deleted"  // Only in the base
+	ChangeModified ChangeKind = "modified" // Contents or symlink target differ
+	ChangeMode     ChangeKind = "mode"     // Only permissions differ
+)
+
+// Change describes one changed path in the workspace
+type Change struct {
+	Path    string     `json:"path"` // Relative to the workspace root
+	Kind    ChangeKind `json:"kind"`
+	OldMode uint32     `json:"old_mode,omitempty"` // Mode in the base (0 if added)
+	NewMode uint32     `json:"new_mode,omitempty"` // Mode in the overlay (0 if deleted)
+}
+
+// IsDir returns true if the changed path is (or was) a directory
+func (c *Change) IsDir() bool {
+	return (c.OldMode|c.NewMode)&S_IFMT == S_IFDIR
+}
+
+// Diff compares the workspace as seen through the overlay with the base
+// layer and returns the changed paths, sorted. Modified files keep their
+// path; a path whose file type changed is reported as deleted and added.
+// Only directories that exist in the delta layer, contain whiteouts or were
+// moved are walked, so unchanged parts of the base are not read.
+func (o *OverlayFS) Diff(ctx context.Context) ([]Change, error) {
+	root := "/"
+	if o.workspaceName != "" {
+		root = "/" + o.workspaceName
+	}
+
+	var changes []Change
+	if err := o.diffDir(ctx, root, "", &changes); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Path != changes[j].Path {
+			return changes[i].Path < changes[j].Path
+		}
+		// Deletion before addition when a path changes type
+		return changes[i].Kind == ChangeDeleted
+	})
+	return changes, nil
+}
+
+// diffDir compares one directory; rel is its path relative to the workspace
+func (o *OverlayFS) diffDir(ctx context.Context, path, rel string, changes *[]Change) error {
+	names := make(map[string]bool)
+
+	baseEntries := make(map[string]bool)
+	if basePath := o.toBasePath(path); basePath != "" {
+		if entries, err := o.base.Readdir(ctx, basePath); err == nil {
+			for _, e := range entries {
+				baseEntries[e.Name] = true
+				names[e.Name] = true
+			}
+		}
+	}
+
+	mergedEntries := make(map[string]bool)
+	if entries, err := o.Readdir(ctx, path); err == nil {
+		for _, e := range entries {
+			mergedEntries[e.Name] = true
+			names[e.Name] = true
+		}
+	}
+
+	for name := range names {
+		childPath := path + "/" + name
+		if path == "/" {
+			childPath = "/" + name
+		}
+		childRel := name
+		if rel != "" {
+			childRel = rel + "/" + name
+		}
+
+		var err error
+		switch {
+		case !mergedEntries[name]:
+			err = o.diffTree(ctx, o.base, o.toBasePath(childPath), childRel, ChangeDeleted, changes)
+		case !baseEntries[name]:
+			err = o.diffTree(ctx, o, childPath, childRel, ChangeAdded, changes)
+		default:
+			err = o.diffEntry(ctx, childPath, childRel, changes)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffEntry compares a path present in both the overlay and the base
+func (o *OverlayFS) diffEntry(ctx context.Context, path, rel string, changes *[]Change) error {
+	basePath := o.toBasePath(path)
+	oldStats, err := o.base.Lstat(ctx, basePath)
+	if err != nil {
+		return err
+	}
+	newStats, err := o.Lstat(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	if oldStats.FileType() != newStats.FileType() {
+		if err := o.diffTree(ctx, o.base, basePath, rel, ChangeDeleted, changes); err != nil {
+			return err
+		}
+		return o.diffTree(ctx, o, path, rel, ChangeAdded, changes)
+	}
+
+	change := Change{Path: rel, OldMode: oldStats.Mode, NewMode: newStats.Mode}
+	inDelta := o.existsInDelta(ctx, path)
+	// Below a renamed directory, base entries show up under other names
+	moved := !inDelta && o.basePath(ctx, path) != basePath
+
+	switch {
+	case newStats.IsDir():
+		if oldStats.Perm() != newStats.Perm() {
+			change.Kind = ChangeMode
+			*changes = append(*changes, change)
+		}
+		if inDelta || moved || o.whiteout.HasWhiteoutUnder(path) {
+			return o.diffDir(ctx, path, rel, changes)
+		}
+		return nil
+
+	case !inDelta && !moved:
+		// Served from the base layer, so unchanged
+		return nil
+
+	case newStats.IsRegular():
+		same, err := sameContents(ctx, o.base, basePath, o, path, oldStats.Size, newStats.Size)
+		if err != nil {
+			return err
+		}
+		if !same {
+			change.Kind = ChangeModified
+		}
+
+	case newStats.IsSymlink():
+		oldTarget, err := o.base.Readlink(ctx, basePath)
+		if err != nil {
+			return err
+		}
+		newTarget, err := o.Readlink(ctx, path)
+		if err != nil {
+			return err
+		}
+		if oldTarget != newTarget {
+			change.Kind = ChangeModified
+		}
+	}
+
+	if change.Kind == "" && oldStats.Perm() != newStats.Perm() {
+		change.Kind = ChangeMode
+	}
+	if change.Kind != "" {
+		*changes = append(*changes, change)
+	}
+	return nil
+}
+
+// diffTree reports path and everything below it in fs as added or deleted
+func (o *OverlayFS) diffTree(ctx context.Context, fs FileSystem, path, rel string, kind ChangeKind, changes *[]Change) error {
+	stats, err := fs.Lstat(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	change := Change{Path: rel, Kind: kind}
+	if kind == ChangeAdded {
+		change.NewMode = stats.Mode
+	} else {
+		change.OldMode = stats.Mode
+	}
+	*changes = append(*changes, change)
+
+	if !stats.IsDir() {
+		return nil
+	}
+	entries, err := fs.Readdir(ctx, path)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		childPath := strings.TrimSuffix(path, "/") + "/" + e.Name
+		if err := o.diffTree(ctx, fs, childPath, rel+"/"+e.Name, kind, changes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameContents compares two regular files chunk by chunk
+func sameContents(ctx context.Context, afs FileSystem, apath string, bfs FileSystem, bpath string, asize, bsize int64) (bool, error) {
+	if asize != bsize {
+		return false, nil
+	}
+
+	af, err := afs.Open(ctx, apath, O_RDONLY)
+	if err != nil {
+		return false, err
+	}
+	defer af.Close()
+	bf, err := bfs.Open(ctx, bpath, O_RDONLY)
+	if err != nil {
+		return false, err
+	}
+	defer bf.Close()
+
+	abuf := make([]byte, 64*1024)
+	bbuf := make([]byte, 64*1024)
+	for offset := int64(0); offset < asize; {
+		an, err := af.Read(ctx, abuf, offset)
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+		bn, err := bf.Read(ctx, bbuf, offset)
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+		if an != bn || !bytes.Equal(abuf[:an], bbuf[:bn]) {
+			return false, nil
+		}
+		if an == 0 {
+			break
+		}
+		offset += int64(an)
+	}
+	return true, nil
+}
+
+// ReadFile reads the entire contents of a regular file from fs
+func ReadFile(ctx context.Context, fs FileSystem, path string) ([]byte, error) {
+	stats, err := fs.Lstat(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.Open(ctx, path, O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	chunk := make([]byte, 64*1024)
+	for offset := int64(0); offset < stats.Size; {
+		n, err := f.Read(ctx, chunk, offset)
+		buf.Write(chunk[:n])
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		offset += int64(n)
+	}
+	return buf.Bytes(), nil
+}
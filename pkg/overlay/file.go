@@ -79,6 +79,15 @@ func (f *OSFile) Truncate(ctx context.Context, size int64) error {
 // fileInfoToStats converts os.FileInfo to overlay.Stats
 func fileInfoToStats(info os.FileInfo) *Stats {
 	mode := uint32(info.Mode().Perm())
+	if info.Mode()&os.ModeSetuid != 0 {
+		mode |= 0o4000
+	}
+	if info.Mode()&os.ModeSetgid != 0 {
+		mode |= 0o2000
+	}
+	if info.Mode()&os.ModeSticky != 0 {
+		mode |= S_ISVTX
+	}
 	switch {
 	case info.IsDir():
 		mode |= S_IFDIR
@@ -18,6 +18,13 @@ var (
 	ErrNoAccess  = errors.New("permission denied")
 	ErrReadOnly  = errors.New("read-only filesystem")
 	ErrCrossLink = errors.New("cross-device link")
+	ErrNoAttr    = errors.New("no such attribute")
+	ErrLoop      = errors.New("too many levels of symbolic links")
+	ErrNoPerm    = errors.New("operation not permitted")
+	ErrStale     = errors.New("base file changed since copy-up")
+	ErrNoSpace   = errors.New("no space left on device")
+	ErrPastEnd   = errors.New("offset past end of file")
+	ErrNoSupport = errors.New("operation not supported")
 )
 
 // File type constants (matching Unix)
@@ -43,6 +50,32 @@ const (
 	O_TRUNC  = syscall.O_TRUNC
 )
 
+// Setxattr flags
+const (
+	XATTR_CREATE  = 1 // Fail if the attribute exists
+	XATTR_REPLACE = 2 // Fail if the attribute does not exist
+)
+
+// Rename flags (matching renameat2)
+const (
+	RENAME_NOREPLACE = 1 << 0 // Fail if newpath exists
+	RENAME_EXCHANGE  = 1 << 1 // Atomically swap oldpath and newpath
+	RENAME_WHITEOUT  = 1 << 2 // Leave a whiteout at oldpath
+)
+
+// Seek modes for finding holes (matching lseek)
+const (
+	SEEK_DATA = 3 // Next offset with data
+	SEEK_HOLE = 4 // Next offset in a hole
+)
+
+// Allocation modes (matching fallocate)
+const (
+	FALLOC_FL_KEEP_SIZE  = 0x01 // Don't change the file size
+	FALLOC_FL_PUNCH_HOLE = 0x02 // Deallocate the range, which then reads as zeros
+	FALLOC_FL_ZERO_RANGE = 0x10 // Zero the range
+)
+
 // Stats holds file metadata
 type Stats struct {
 	Ino   uint64 // Inode number
@@ -54,6 +87,7 @@ type Stats struct {
 	Atime int64  // Access time (Unix timestamp)
 	Mtime int64  // Modification time (Unix timestamp)
 	Ctime int64  // Change time (Unix timestamp)
+	Rdev  uint32 // Device number of character and block devices
 }
 
 // IsDir returns true if the stats represent a directory
@@ -71,6 +105,15 @@ func (s *Stats) IsSymlink() bool {
 	return s.Mode&S_IFMT == S_IFLNK
 }
 
+// IsSpecial returns true if the stats represent a FIFO, socket or device
+func (s *Stats) IsSpecial() bool {
+	switch s.Mode & S_IFMT {
+	case S_IFIFO, S_IFSOCK, S_IFCHR, S_IFBLK:
+		return true
+	}
+	return false
+}
+
 // FileType returns just the file type bits
 func (s *Stats) FileType() uint32 {
 	return s.Mode & S_IFMT
@@ -125,7 +168,10 @@ type File interface {
 	Truncate(ctx context.Context, size int64) error
 }
 
-// FileSystem is the abstraction for different storage backends
+// FileSystem is the abstraction for different storage backends.
+// Symlinks in all but the last component of a path are followed; Stat,
+// Open, Readdir and Access also follow a symlink in the last component,
+// while the other methods act on the link itself.
 type FileSystem interface {
 	// Stat returns file metadata, following symlinks
 	Stat(ctx context.Context, path string) (*Stats, error)
@@ -151,14 +197,19 @@ type FileSystem interface {
 	// Create creates a new file and returns a handle
 	Create(ctx context.Context, path string, mode uint32) (File, *Stats, error)
 
+	// Mknod creates a FIFO, socket or device node; rdev is the device
+	// number of character and block devices
+	Mknod(ctx context.Context, path string, mode, rdev uint32) error
+
 	// Open opens an existing file
 	Open(ctx context.Context, path string, flags int) (File, error)
 
 	// Remove removes a file (not a directory)
 	Remove(ctx context.Context, path string) error
 
-	// Rename renames/moves a file or directory
-	Rename(ctx context.Context, oldpath, newpath string) error
+	// Rename renames/moves a file or directory; flags may be
+	// RENAME_NOREPLACE, RENAME_EXCHANGE or RENAME_WHITEOUT
+	Rename(ctx context.Context, oldpath, newpath string, flags uint32) error
 
 	// Chmod changes file permissions
 	Chmod(ctx context.Context, path string, mode uint32) error
@@ -180,6 +231,19 @@ type FileSystem interface {
 
 	// Access checks if the path is accessible with the given mode
 	Access(ctx context.Context, path string, mode uint32) error
+
+	// Getxattr returns the value of an extended attribute. Like the other
+	// xattr methods, it applies to the path itself, not a symlink target.
+	Getxattr(ctx context.Context, path, name string) ([]byte, error)
+
+	// Setxattr sets an extended attribute; flags may be XATTR_CREATE or XATTR_REPLACE
+	Setxattr(ctx context.Context, path, name string, value []byte, flags int) error
+
+	// Listxattr returns the names of all extended attributes
+	Listxattr(ctx context.Context, path string) ([]string, error)
+
+	// Removexattr removes an extended attribute
+	Removexattr(ctx context.Context, path, name string) error
 }
 
 // ToErrno converts filesystem errors to syscall.Errno
@@ -214,6 +278,24 @@ func ToErrno(err error) syscall.Errno {
 	if errors.Is(err, ErrCrossLink) {
 		return syscall.EXDEV
 	}
+	if errors.Is(err, ErrNoAttr) {
+		return syscall.ENODATA
+	}
+	if errors.Is(err, ErrNoPerm) {
+		return syscall.EPERM
+	}
+	if errors.Is(err, ErrLoop) {
+		return syscall.ELOOP
+	}
+	if errors.Is(err, ErrNoSpace) {
+		return syscall.ENOSPC
+	}
+	if errors.Is(err, ErrPastEnd) {
+		return syscall.ENXIO
+	}
+	if errors.Is(err, ErrNoSupport) {
+		return syscall.EOPNOTSUPP
+	}
 	// Check for syscall.Errno
 	var errno syscall.Errno
 	if errors.As(err, &errno) {
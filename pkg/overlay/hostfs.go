@@ -7,6 +7,8 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 // HostFS implements FileSystem by passing through to the host filesystem
@@ -241,6 +243,25 @@ func (h *HostFS) Create(ctx context.Context, path string, mode uint32) (File, *S
 	return NewOSFile(f, path), fileInfoToStats(info), nil
 }
 
+// Mknod implements FileSystem.Mknod
+func (h *HostFS) Mknod(ctx context.Context, path string, mode, rdev uint32) error {
+	realPath, err := h.resolvePath(path)
+	if err != nil {
+		return err
+	}
+
+	switch err := unix.Mknod(realPath, mode, int(rdev)); err {
+	case nil:
+		return nil
+	case unix.EEXIST:
+		return ErrExists
+	case unix.ENOENT:
+		return ErrNotFound
+	default:
+		return err
+	}
+}
+
 // Open implements FileSystem.Open
 func (h *HostFS) Open(ctx context.Context, path string, flags int) (File, error) {
 	realPath, err := h.resolvePath(path)
@@ -309,7 +330,7 @@ func (h *HostFS) Remove(ctx context.Context, path string) error {
 }
 
 // Rename implements FileSystem.Rename
-func (h *HostFS) Rename(ctx context.Context, oldpath, newpath string) error {
+func (h *HostFS) Rename(ctx context.Context, oldpath, newpath string, flags uint32) error {
 	realOld, err := h.resolvePath(oldpath)
 	if err != nil {
 		return err
@@ -319,7 +340,19 @@ func (h *HostFS) Rename(ctx context.Context, oldpath, newpath string) error {
 		return err
 	}
 
-	return os.Rename(realOld, realNew)
+	if flags == 0 {
+		return os.Rename(realOld, realNew)
+	}
+	switch err := unix.Renameat2(unix.AT_FDCWD, realOld, unix.AT_FDCWD, realNew, uint(flags)); err {
+	case nil:
+		return nil
+	case unix.EEXIST:
+		return ErrExists
+	case unix.ENOENT:
+		return ErrNotFound
+	default:
+		return err
+	}
 }
 
 // Chmod implements FileSystem.Chmod
@@ -408,23 +441,103 @@ func (h *HostFS) Link(ctx context.Context, oldpath, newpath string) error {
 
 // Access implements FileSystem.Access
 func (h *HostFS) Access(ctx context.Context, path string, mode uint32) error {
+	stats, err := h.Stat(ctx, path)
+	if err != nil {
+		return err
+	}
+	return CheckAccess(ctx, stats, mode)
+}
+
+// Getxattr implements FileSystem.Getxattr
+func (h *HostFS) Getxattr(ctx context.Context, path, name string) ([]byte, error) {
+	realPath, err := h.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		size, err := unix.Lgetxattr(realPath, name, nil)
+		if err != nil {
+			return nil, hostXattrError(err)
+		}
+		buf := make([]byte, size)
+		n, err := unix.Lgetxattr(realPath, name, buf)
+		if err == unix.ERANGE {
+			continue // Grew since we asked for the size
+		}
+		if err != nil {
+			return nil, hostXattrError(err)
+		}
+		return buf[:n], nil
+	}
+}
+
+// Setxattr implements FileSystem.Setxattr
+func (h *HostFS) Setxattr(ctx context.Context, path, name string, value []byte, flags int) error {
 	realPath, err := h.resolvePath(path)
 	if err != nil {
 		return err
 	}
 
-	// Check existence first
-	_, err = os.Lstat(realPath)
+	return hostXattrError(unix.Lsetxattr(realPath, name, value, flags))
+}
+
+// Listxattr implements FileSystem.Listxattr
+func (h *HostFS) Listxattr(ctx context.Context, path string) ([]string, error) {
+	realPath, err := h.resolvePath(path)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return ErrNotFound
+		return nil, err
+	}
+
+	for {
+		size, err := unix.Llistxattr(realPath, nil)
+		if err == unix.ENOTSUP {
+			return nil, nil // No xattr support means no xattrs
+		}
+		if err != nil {
+			return nil, hostXattrError(err)
+		}
+		buf := make([]byte, size)
+		n, err := unix.Llistxattr(realPath, buf)
+		if err == unix.ERANGE {
+			continue
 		}
+		if err != nil {
+			return nil, hostXattrError(err)
+		}
+
+		// Names are NUL-terminated
+		var names []string
+		for _, name := range strings.Split(string(buf[:n]), "\x00") {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+}
+
+// Removexattr implements FileSystem.Removexattr
+func (h *HostFS) Removexattr(ctx context.Context, path, name string) error {
+	realPath, err := h.resolvePath(path)
+	if err != nil {
 		return err
 	}
 
-	// For now, just check existence (mode 0 = F_OK)
-	// A full implementation would check R_OK, W_OK, X_OK
-	return nil
+	return hostXattrError(unix.Lremovexattr(realPath, name))
+}
+
+// hostXattrError maps xattr syscall errors to FileSystem errors
+func hostXattrError(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case unix.ENODATA:
+		return ErrNoAttr
+	case unix.ENOENT:
+		return ErrNotFound
+	}
+	return err
 }
 
 // Ensure HostFS implements FileSystem
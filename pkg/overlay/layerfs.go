@@ -0,0 +1,333 @@
+package overlay
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+)
+
+// Layer is a read-only lower layer of an overlay: the contents of FS appear
+// at Prefix in the overlay ("/" for its root)
+type Layer struct {
+	FS     FileSystem
+	Prefix string
+}
+
+// LayerFS stacks read-only layers into one FileSystem addressed by overlay
+// paths. Layers listed first take precedence: a path shows the entry of
+// the first layer that has one, and directories merge the entries of every
+// layer down to the first one where the path is not a directory. The
+// directories leading to a layer's prefix appear as empty directories.
+type LayerFS struct {
+	layers []Layer
+}
+
+// NewLayerFS creates a LayerFS from layers in order of precedence
+func NewLayerFS(layers ...Layer) *LayerFS {
+	l := &LayerFS{}
+	for _, layer := range layers {
+		layer.Prefix = filepath.Clean("/" + layer.Prefix)
+		l.layers = append(l.layers, layer)
+	}
+	return l
+}
+
+// Layers returns the layers in order of precedence
+func (l *LayerFS) Layers() []Layer {
+	return l.layers
+}
+
+// layerPath maps an overlay path into a layer. It returns the path in the
+// layer, or the name of the next directory towards the prefix if the path
+// is above it.
+func (layer *Layer) layerPath(path string) (inner, above string, ok bool) {
+	switch {
+	case layer.Prefix == "/":
+		return path, "", true
+	case path == layer.Prefix:
+		return "/", "", true
+	case strings.HasPrefix(path, layer.Prefix+"/"):
+		return path[len(layer.Prefix):], "", true
+	}
+
+	rest := ""
+	if path == "/" {
+		rest = layer.Prefix[1:]
+	} else if strings.HasPrefix(layer.Prefix, path+"/") {
+		rest = layer.Prefix[len(path)+1:]
+	} else {
+		return "", "", false
+	}
+	name, _, _ := strings.Cut(rest, "/")
+	return "", name, true
+}
+
+// covers checks if any layer can have an entry at path
+func (l *LayerFS) covers(path string) bool {
+	for i := range l.layers {
+		if _, _, ok := l.layers[i].layerPath(path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// find returns the layer whose entry shows at path and the path in it. A
+// nil FileSystem means the path is a directory leading to a layer prefix
+// that no layer has.
+func (l *LayerFS) find(ctx context.Context, path string) (FileSystem, string, *Stats, error) {
+	var synthetic *Stats
+	var firstErr error
+	for i := range l.layers {
+		layer := &l.layers[i]
+		inner, above, ok := layer.layerPath(path)
+		if !ok {
+			continue
+		}
+		if above != "" {
+			if synthetic == nil {
+				synthetic = &Stats{Mode: S_IFDIR | 0o755, Nlink: 2}
+				if root, err := layer.FS.Lstat(ctx, "/"); err == nil {
+					synthetic.Uid, synthetic.Gid = root.Uid, root.Gid
+					synthetic.Mtime, synthetic.Atime, synthetic.Ctime = root.Mtime, root.Atime, root.Ctime
+				}
+			}
+			continue
+		}
+		stats, err := layer.FS.Lstat(ctx, inner)
+		if err == nil {
+			// Paths leading to a layer prefix must stay directories
+			if synthetic != nil && !stats.IsDir() {
+				continue
+			}
+			return layer.FS, inner, stats, nil
+		}
+		// A layer without the path (or with a file on the way) doesn't hide
+		// the ones below
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if synthetic != nil {
+		return nil, "", synthetic, nil
+	}
+	if firstErr == nil {
+		firstErr = ErrNotFound
+	}
+	return nil, "", nil, firstErr
+}
+
+// Stat implements FileSystem.Stat
+func (l *LayerFS) Stat(ctx context.Context, path string) (*Stats, error) {
+	fs, inner, stats, err := l.find(ctx, path)
+	if err != nil || fs == nil {
+		return stats, err
+	}
+	return fs.Stat(ctx, inner)
+}
+
+// Lstat implements FileSystem.Lstat
+func (l *LayerFS) Lstat(ctx context.Context, path string) (*Stats, error) {
+	_, _, stats, err := l.find(ctx, path)
+	return stats, err
+}
+
+// Readlink implements FileSystem.Readlink
+func (l *LayerFS) Readlink(ctx context.Context, path string) (string, error) {
+	fs, inner, _, err := l.find(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	if fs == nil {
+		return "", ErrInvalid
+	}
+	return fs.Readlink(ctx, inner)
+}
+
+// Statfs implements FileSystem.Statfs with the first layer's statistics
+func (l *LayerFS) Statfs(ctx context.Context) (*FilesystemStats, error) {
+	if len(l.layers) == 0 {
+		return &FilesystemStats{Bsize: 4096, Namelen: 255}, nil
+	}
+	return l.layers[0].FS.Statfs(ctx)
+}
+
+// Readdir implements FileSystem.Readdir, merging the directories of all
+// layers that aren't hidden by a non-directory in a layer above
+func (l *LayerFS) Readdir(ctx context.Context, path string) ([]DirEntry, error) {
+	seen := make(map[string]bool)
+	var result []DirEntry
+	found, synthetic := false, false
+
+	for i := range l.layers {
+		layer := &l.layers[i]
+		inner, above, ok := layer.layerPath(path)
+		if !ok {
+			continue
+		}
+		if above != "" {
+			found, synthetic = true, true
+			if !seen[above] {
+				seen[above] = true
+				entry := DirEntry{Name: above, Mode: S_IFDIR | 0o755}
+				if filepath.Join(path, above) == layer.Prefix {
+					// The layer root itself
+					if root, err := layer.FS.Lstat(ctx, "/"); err == nil {
+						entry.Ino = root.Ino
+					}
+				}
+				result = append(result, entry)
+			}
+			continue
+		}
+
+		stats, err := layer.FS.Lstat(ctx, inner)
+		if err != nil {
+			continue
+		}
+		if !stats.IsDir() {
+			switch {
+			case synthetic:
+				continue // Paths leading to a layer prefix stay directories
+			case !found:
+				return nil, ErrNotDir
+			}
+			break // Hides the layers below
+		}
+		found = true
+
+		entries, err := layer.FS.Readdir(ctx, inner)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !seen[e.Name] {
+				seen[e.Name] = true
+				result = append(result, e)
+			}
+		}
+	}
+
+	if !found {
+		return nil, ErrNotFound
+	}
+	return result, nil
+}
+
+// Open implements FileSystem.Open; layers are read-only
+func (l *LayerFS) Open(ctx context.Context, path string, flags int) (File, error) {
+	if flags&(O_WRONLY|O_RDWR|O_TRUNC|O_APPEND) != 0 {
+		return nil, ErrReadOnly
+	}
+	fs, inner, _, err := l.find(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if fs == nil {
+		return nil, ErrIsDir
+	}
+	return fs.Open(ctx, inner, flags)
+}
+
+// Access implements FileSystem.Access
+func (l *LayerFS) Access(ctx context.Context, path string, mode uint32) error {
+	fs, inner, _, err := l.find(ctx, path)
+	if err != nil || fs == nil {
+		return err
+	}
+	return fs.Access(ctx, inner, mode)
+}
+
+// Getxattr implements FileSystem.Getxattr
+func (l *LayerFS) Getxattr(ctx context.Context, path, name string) ([]byte, error) {
+	fs, inner, _, err := l.find(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if fs == nil {
+		return nil, ErrNoAttr
+	}
+	return fs.Getxattr(ctx, inner, name)
+}
+
+// Listxattr implements FileSystem.Listxattr
+func (l *LayerFS) Listxattr(ctx context.Context, path string) ([]string, error) {
+	fs, inner, _, err := l.find(ctx, path)
+	if err != nil || fs == nil {
+		return nil, err
+	}
+	return fs.Listxattr(ctx, inner)
+}
+
+// Mkdir implements FileSystem.Mkdir; layers are read-only
+func (l *LayerFS) Mkdir(ctx context.Context, path string, mode uint32) error {
+	return ErrReadOnly
+}
+
+// Rmdir implements FileSystem.Rmdir; layers are read-only
+func (l *LayerFS) Rmdir(ctx context.Context, path string) error {
+	return ErrReadOnly
+}
+
+// Create implements FileSystem.Create; layers are read-only
+func (l *LayerFS) Create(ctx context.Context, path string, mode uint32) (File, *Stats, error) {
+	return nil, nil, ErrReadOnly
+}
+
+// Mknod implements FileSystem.Mknod; layers are read-only
+func (l *LayerFS) Mknod(ctx context.Context, path string, mode, rdev uint32) error {
+	return ErrReadOnly
+}
+
+// Remove implements FileSystem.Remove; layers are read-only
+func (l *LayerFS) Remove(ctx context.Context, path string) error {
+	return ErrReadOnly
+}
+
+// Rename implements FileSystem.Rename; layers are read-only
+func (l *LayerFS) Rename(ctx context.Context, oldpath, newpath string, flags uint32) error {
+	return ErrReadOnly
+}
+
+// Chmod implements FileSystem.Chmod; layers are read-only
+func (l *LayerFS) Chmod(ctx context.Context, path string, mode uint32) error {
+	return ErrReadOnly
+}
+
+// Chown implements FileSystem.Chown; layers are read-only
+func (l *LayerFS) Chown(ctx context.Context, path string, uid, gid uint32) error {
+	return ErrReadOnly
+}
+
+// Truncate implements FileSystem.Truncate; layers are read-only
+func (l *LayerFS) Truncate(ctx context.Context, path string, size int64) error {
+	return ErrReadOnly
+}
+
+// Utimens implements FileSystem.Utimens; layers are read-only
+func (l *LayerFS) Utimens(ctx context.Context, path string, atime, mtime *int64) error {
+	return ErrReadOnly
+}
+
+// Symlink implements FileSystem.Symlink; layers are read-only
+func (l *LayerFS) Symlink(ctx context.Context, target, linkpath string) error {
+	return ErrReadOnly
+}
+
+// Link implements FileSystem.Link; layers are read-only
+func (l *LayerFS) Link(ctx context.Context, oldpath, newpath string) error {
+	return ErrReadOnly
+}
+
+// Setxattr implements FileSystem.Setxattr; layers are read-only
+func (l *LayerFS) Setxattr(ctx context.Context, path, name string, value []byte, flags int) error {
+	return ErrReadOnly
+}
+
+// Removexattr implements FileSystem.Removexattr; layers are read-only
+func (l *LayerFS) Removexattr(ctx context.Context, path, name string) error {
+	return ErrReadOnly
+}
+
+// Ensure LayerFS implements FileSystem
+var _ FileSystem = (*LayerFS)(nil)
@@ -0,0 +1,186 @@
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"art/pkg/db"
+)
+
+// lazyCopyMin is the size from which regular files are copied up chunk by
+// chunk as they are written. Smaller files are copied whole, when written or
+// right away: that is cheap, and keeps them independent of the base layer.
+const lazyCopyMin = 1 << 20
+
+// lowerOf returns the base file behind a partially copied-up file, or nil
+func (f *AgentFile) lowerOf(ctx context.Context) (*db.Lower, error) {
+	if f.base == nil {
+		return nil, nil
+	}
+	lower, err := f.store.GetLower(ctx, f.ino)
+	if err == db.ErrNotFound {
+		return nil, nil
+	}
+	return lower, err
+}
+
+// readLower reads length bytes at offset from the base file, failing with
+// ErrStale if it changed since the copy-up rather than mixing contents
+func (f *AgentFile) readLower(ctx context.Context, lower *db.Lower, offset, length int64) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.lower == nil {
+		file, err := f.base.Open(ctx, lower.Path, O_RDONLY)
+		if err == ErrNotFound {
+			return nil, ErrStale
+		}
+		if err != nil {
+			return nil, err
+		}
+		f.lower = file
+	}
+
+	stats, err := f.lower.Stat(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if (lower.BaseIno != 0 && stats.Ino != lower.BaseIno) ||
+		stats.Size != lower.BaseSize || stats.Mtime != lower.BaseMtime {
+		return nil, ErrStale
+	}
+
+	buf := make([]byte, length)
+	for n := 0; n < len(buf); {
+		m, err := f.lower.Read(ctx, buf[n:], offset+int64(n))
+		n += m
+		if err == io.EOF || (err == nil && m == 0) {
+			return nil, ErrStale
+		}
+		if err != nil && n < len(buf) {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// readMerged reads a partially copied-up file: stored chunks from the
+// database, the others from the base file or as zeros past its end
+func (f *AgentFile) readMerged(ctx context.Context, lower *db.Lower, dest []byte, offset int64) (int, error) {
+	inode, err := f.store.GetInode(ctx, f.ino)
+	if err != nil {
+		return 0, err
+	}
+	size := int64(inode.Size)
+	if offset >= size || len(dest) == 0 {
+		return 0, nil
+	}
+	buf := dest[:min(int64(len(dest)), size-offset)]
+	clear(buf)
+	end := offset + int64(len(buf))
+
+	chunkSize := f.store.ChunkSize()
+	first, last := offset/chunkSize, (end-1)/chunkSize
+	chunks, err := f.store.ReadChunks(ctx, f.ino, first, last)
+	if err != nil {
+		return 0, err
+	}
+
+	for idx := first; idx <= last; idx++ {
+		start := idx * chunkSize
+		data, ok := chunks[idx]
+		if !ok && start < lower.Size {
+			if data, err = f.readLower(ctx, lower, start, min(chunkSize, lower.Size-start)); err != nil {
+				return 0, err
+			}
+		}
+		lo, hi := max(start, offset), min(start+int64(len(data)), end)
+		if hi > lo {
+			copy(buf[lo-offset:hi-offset], data[lo-start:hi-start])
+		}
+	}
+	return len(buf), nil
+}
+
+// fillFromLower stores the chunks a write covers only partly, so that they
+// keep the rest of their base contents
+func (f *AgentFile) fillFromLower(ctx context.Context, lower *db.Lower, offset, length int64) error {
+	if length <= 0 {
+		return nil
+	}
+	chunkSize := f.store.ChunkSize()
+	end := offset + length
+
+	for _, idx := range []int64{offset / chunkSize, (end - 1) / chunkSize} {
+		start := idx * chunkSize
+		if start >= lower.Size || (offset <= start && end >= start+chunkSize) {
+			continue
+		}
+		chunks, err := f.store.ReadChunks(ctx, f.ino, idx, idx)
+		if err != nil {
+			return err
+		}
+		if _, ok := chunks[idx]; ok {
+			continue
+		}
+		data, err := f.readLower(ctx, lower, start, min(chunkSize, lower.Size-start))
+		if err != nil {
+			return err
+		}
+		if err := f.store.WriteData(ctx, f.ino, start, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// completeLower stores every chunk still read from the base file
+func (f *AgentFile) completeLower(ctx context.Context, lower *db.Lower) error {
+	indexes, err := f.store.ListChunkIndexes(ctx, f.ino)
+	if err != nil {
+		return err
+	}
+	stored := make(map[int64]bool, len(indexes))
+	for _, idx := range indexes {
+		stored[idx] = true
+	}
+
+	chunkSize := f.store.ChunkSize()
+	for start := int64(0); start < lower.Size; start += chunkSize {
+		if stored[start/chunkSize] {
+			continue
+		}
+		data, err := f.readLower(ctx, lower, start, min(chunkSize, lower.Size-start))
+		if err != nil {
+			return err
+		}
+		if err := f.store.WriteData(ctx, f.ino, start, data); err != nil {
+			return err
+		}
+	}
+	return f.store.DeleteLower(ctx, f.ino)
+}
+
+// CompleteCopyUps stores the parts of partially copied-up files that are
+// still read from the given layers, so that the store no longer depends on
+// them. Files copied up from other layers are left alone. It fails with
+// ErrStale if a base file changed since its copy-up.
+func CompleteCopyUps(ctx context.Context, store *db.Store, base *LayerFS) error {
+	lowers, err := store.ListLowers(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range lowers {
+		if !base.covers(lowers[i].Path) {
+			continue
+		}
+		f := &AgentFile{store: store, ino: lowers[i].Ino, base: base}
+		err := f.completeLower(ctx, &lowers[i])
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to copy up %s: %w", lowers[i].Path, err)
+		}
+	}
+	return nil
+}
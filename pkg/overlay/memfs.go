@@ -0,0 +1,1285 @@
+package overlay
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"art/pkg/db"
+)
+
+// memInode is a file, directory or special node of a MemFS
+type memInode struct {
+	stats    Stats
+	data     []byte            // Contents of a regular file, up to the last written byte
+	target   string            // Target of a symlink
+	children map[string]uint64 // Entries of a directory
+	xattrs   map[string][]byte
+}
+
+// usage returns the bytes an inode counts against the size cap
+func (n *memInode) usage() int64 {
+	size := int64(len(n.data) + len(n.target))
+	for name, value := range n.xattrs {
+		size += int64(len(name) + len(value))
+	}
+	return size
+}
+
+// MemFS implements FileSystem in memory, for sessions that don't need to
+// outlive the process and for tests. As a delta layer it keeps whiteouts
+// and origins in memory too, and Dump writes all of it to a SQLite store.
+type MemFS struct {
+	inodes    map[uint64]*memInode
+	nextIno   uint64
+	maxSize   int64             // Cap on contents, symlink targets and xattrs (0 = unlimited)
+	used      int64             // Bytes counted against maxSize
+	whiteouts map[string]bool   // Deleted base paths
+	origins   map[uint64]uint64 // Base inodes of copied-up files
+	mu        sync.RWMutex
+}
+
+// MemFSOption configures MemFS behavior
+type MemFSOption func(*MemFS)
+
+// WithMaxSize caps the bytes of file contents, symlink targets and
+// extended attributes a MemFS holds. Writes beyond it fail with ErrNoSpace.
+func WithMaxSize(bytes int64) MemFSOption {
+	return func(m *MemFS) {
+		m.maxSize = bytes
+	}
+}
+
+// NewMemFS creates an empty in-memory filesystem
+func NewMemFS(opts ...MemFSOption) *MemFS {
+	now := time.Now().Unix()
+	m := &MemFS{
+		inodes:    make(map[uint64]*memInode),
+		nextIno:   2,
+		whiteouts: make(map[string]bool),
+		origins:   make(map[uint64]uint64),
+	}
+	m.inodes[1] = &memInode{
+		stats:    Stats{Ino: 1, Mode: S_IFDIR | 0o755, Nlink: 2, Atime: now, Mtime: now, Ctime: now},
+		children: make(map[string]uint64),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Size returns the bytes counted against the size cap
+func (m *MemFS) Size() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.used
+}
+
+// reserveLocked accounts for n more bytes (or fewer if negative)
+func (m *MemFS) reserveLocked(n int64) error {
+	if n > 0 && m.maxSize > 0 && m.used+n > m.maxSize {
+		return ErrNoSpace
+	}
+	m.used += n
+	return nil
+}
+
+// newInodeLocked adds an inode of the given mode, owned by the caller
+func (m *MemFS) newInodeLocked(ctx context.Context, mode uint32) *memInode {
+	now := time.Now().Unix()
+	uid, gid := owner(ctx)
+	n := &memInode{
+		stats: Stats{Ino: m.nextIno, Mode: mode, Nlink: 1, Uid: uid, Gid: gid, Atime: now, Mtime: now, Ctime: now},
+	}
+	if mode&S_IFMT == S_IFDIR {
+		n.stats.Nlink = 2
+		n.children = make(map[string]uint64)
+	}
+	m.inodes[n.stats.Ino] = n
+	m.nextIno++
+	return n
+}
+
+// lookupLocked converts a path without symlinks to an inode
+func (m *MemFS) lookupLocked(path string) (*memInode, error) {
+	n := m.inodes[1]
+	for _, part := range splitPath(path) {
+		if n.children == nil {
+			return nil, ErrNotDir
+		}
+		ino, ok := n.children[part]
+		if !ok {
+			return nil, ErrNotFound
+		}
+		n = m.inodes[ino]
+	}
+	return n, nil
+}
+
+// resolve returns the path that path refers to without symlinks, following
+// one in the last component too if followLast is set
+func (m *MemFS) resolve(ctx context.Context, path string, followLast bool) (string, error) {
+	return walkSymlinks(ctx, m, path, "", followLast)
+}
+
+// resolveParent resolves the directory of path and returns the name
+// component, for operations that create or remove entries
+func (m *MemFS) resolveParent(ctx context.Context, path string) (string, string, error) {
+	parts := splitPath(path)
+	if len(parts) == 0 {
+		return "", "", ErrInvalid // Can't get parent of root
+	}
+	parent, err := m.resolve(ctx, joinPath(parts[:len(parts)-1]), true)
+	if err != nil {
+		return "", "", err
+	}
+	return parent, parts[len(parts)-1], nil
+}
+
+// dirLocked returns the directory inode at a resolved path
+func (m *MemFS) dirLocked(path string) (*memInode, error) {
+	dir, err := m.lookupLocked(path)
+	if err != nil {
+		return nil, err
+	}
+	if dir.children == nil {
+		return nil, ErrNotDir
+	}
+	return dir, nil
+}
+
+// typeOf returns the file type of a path without symlinks before its last
+// component
+func (m *MemFS) typeOf(ctx context.Context, path string) (uint32, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n, err := m.lookupLocked(path)
+	if err != nil {
+		return 0, err
+	}
+	return n.stats.FileType(), nil
+}
+
+// readlink returns the target of a symlink at a path without symlinks
+// before its last component
+func (m *MemFS) readlink(ctx context.Context, path string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n, err := m.lookupLocked(path)
+	if err != nil {
+		return "", err
+	}
+	if !n.stats.IsSymlink() {
+		return "", ErrInvalid
+	}
+	return n.target, nil
+}
+
+// lookupChild returns the inode of an entry in a directory
+func (m *MemFS) lookupChild(ctx context.Context, parentIno uint64, name string) (uint64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	parent, ok := m.inodes[parentIno]
+	if !ok || parent.children == nil {
+		return 0, ErrNotFound
+	}
+	ino, ok := parent.children[name]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return ino, nil
+}
+
+// GetIno returns the inode number for a path
+func (m *MemFS) GetIno(ctx context.Context, path string) (uint64, error) {
+	resolved, err := m.resolve(ctx, path, false)
+	if err != nil {
+		return 0, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n, err := m.lookupLocked(resolved)
+	if err != nil {
+		return 0, err
+	}
+	return n.stats.Ino, nil
+}
+
+// stat returns the stats of a path
+func (m *MemFS) stat(ctx context.Context, path string, followLast bool) (*Stats, error) {
+	resolved, err := m.resolve(ctx, path, followLast)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n, err := m.lookupLocked(resolved)
+	if err != nil {
+		return nil, err
+	}
+	stats := n.stats
+	return &stats, nil
+}
+
+// Stat implements FileSystem.Stat (follows symlinks)
+func (m *MemFS) Stat(ctx context.Context, path string) (*Stats, error) {
+	return m.stat(ctx, path, true)
+}
+
+// Lstat implements FileSystem.Lstat (does not follow symlinks)
+func (m *MemFS) Lstat(ctx context.Context, path string) (*Stats, error) {
+	return m.stat(ctx, path, false)
+}
+
+// Readlink implements FileSystem.Readlink
+func (m *MemFS) Readlink(ctx context.Context, path string) (string, error) {
+	resolved, err := m.resolve(ctx, path, false)
+	if err != nil {
+		return "", err
+	}
+	return m.readlink(ctx, resolved)
+}
+
+// Statfs implements FileSystem.Statfs, reporting the size cap if set
+func (m *MemFS) Statfs(ctx context.Context) (*FilesystemStats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	const bsize = 1024
+	stats := &FilesystemStats{
+		Blocks:  1024 * 1024, // 1GB with 1KB blocks
+		Files:   max(1000000, uint64(len(m.inodes))),
+		Bsize:   bsize,
+		Namelen: 255,
+	}
+	stats.Ffree = stats.Files - uint64(len(m.inodes))
+	if m.maxSize > 0 {
+		stats.Blocks = uint64(m.maxSize / bsize)
+	}
+	used := uint64(m.used / bsize)
+	if used < stats.Blocks {
+		stats.Bfree = stats.Blocks - used
+	}
+	stats.Bavail = stats.Bfree
+	return stats, nil
+}
+
+// Readdir implements FileSystem.Readdir
+func (m *MemFS) Readdir(ctx context.Context, path string) ([]DirEntry, error) {
+	resolved, err := m.resolve(ctx, path, true)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	dir, err := m.dirLocked(resolved)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]DirEntry, 0, len(dir.children))
+	for name, ino := range dir.children {
+		result = append(result, DirEntry{Name: name, Mode: m.inodes[ino].stats.Mode, Ino: ino})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// create adds a new entry at path, letting init fill in the inode
+func (m *MemFS) create(ctx context.Context, path string, mode uint32, init func(n *memInode) error) (*memInode, error) {
+	parentPath, name, err := m.resolveParent(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	parent, err := m.dirLocked(parentPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := parent.children[name]; exists {
+		return nil, ErrExists
+	}
+
+	n := m.newInodeLocked(ctx, mode)
+	if init != nil {
+		if err := init(n); err != nil {
+			delete(m.inodes, n.stats.Ino)
+			return nil, err
+		}
+	}
+	parent.children[name] = n.stats.Ino
+	if n.children != nil {
+		parent.stats.Nlink++ // For ".."
+	}
+	parent.stats.Mtime = n.stats.Ctime
+	parent.stats.Ctime = n.stats.Ctime
+	return n, nil
+}
+
+// Mkdir implements FileSystem.Mkdir
+func (m *MemFS) Mkdir(ctx context.Context, path string, mode uint32) error {
+	_, err := m.create(ctx, path, S_IFDIR|mode&0o7777, nil)
+	return err
+}
+
+// Create implements FileSystem.Create
+func (m *MemFS) Create(ctx context.Context, path string, mode uint32) (File, *Stats, error) {
+	n, err := m.create(ctx, path, S_IFREG|mode&0o7777, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	stats := n.stats
+	return &memFSFile{fs: m, ino: stats.Ino}, &stats, nil
+}
+
+// Mknod implements FileSystem.Mknod
+func (m *MemFS) Mknod(ctx context.Context, path string, mode, rdev uint32) error {
+	switch mode & S_IFMT {
+	case S_IFIFO, S_IFSOCK, S_IFCHR, S_IFBLK:
+	default:
+		return ErrInvalid
+	}
+	_, err := m.create(ctx, path, mode, func(n *memInode) error {
+		n.stats.Rdev = rdev
+		return nil
+	})
+	return err
+}
+
+// Symlink implements FileSystem.Symlink
+func (m *MemFS) Symlink(ctx context.Context, target, linkpath string) error {
+	_, err := m.create(ctx, linkpath, S_IFLNK|0o777, func(n *memInode) error {
+		if err := m.reserveLocked(int64(len(target))); err != nil {
+			return err
+		}
+		n.target = target
+		n.stats.Size = int64(len(target))
+		return nil
+	})
+	return err
+}
+
+// Open implements FileSystem.Open
+func (m *MemFS) Open(ctx context.Context, path string, flags int) (File, error) {
+	resolved, err := m.resolve(ctx, path, true)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.lookupLocked(resolved)
+	if err != nil {
+		return nil, err
+	}
+	if flags&O_TRUNC != 0 && n.stats.IsRegular() {
+		m.truncateLocked(n, 0)
+	}
+	return &memFSFile{fs: m, ino: n.stats.Ino}, nil
+}
+
+// unlinkLocked removes the entry name of parent, freeing its inode when
+// this was the last link
+func (m *MemFS) unlinkLocked(parent *memInode, name string) {
+	n := m.inodes[parent.children[name]]
+	delete(parent.children, name)
+	now := time.Now().Unix()
+	parent.stats.Mtime, parent.stats.Ctime = now, now
+
+	if n.children != nil {
+		parent.stats.Nlink-- // The removed directory's ".."
+		n.stats.Nlink = 0
+	} else {
+		n.stats.Nlink--
+		n.stats.Ctime = now
+	}
+	if n.stats.Nlink == 0 {
+		m.used -= n.usage()
+		delete(m.inodes, n.stats.Ino)
+		delete(m.origins, n.stats.Ino)
+	}
+}
+
+// Remove implements FileSystem.Remove
+func (m *MemFS) Remove(ctx context.Context, path string) error {
+	parentPath, name, err := m.resolveParent(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	parent, err := m.dirLocked(parentPath)
+	if err != nil {
+		return err
+	}
+	ino, ok := parent.children[name]
+	if !ok {
+		return ErrNotFound
+	}
+	if m.inodes[ino].children != nil {
+		return ErrIsDir
+	}
+	m.unlinkLocked(parent, name)
+	return nil
+}
+
+// Rmdir implements FileSystem.Rmdir
+func (m *MemFS) Rmdir(ctx context.Context, path string) error {
+	parentPath, name, err := m.resolveParent(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	parent, err := m.dirLocked(parentPath)
+	if err != nil {
+		return err
+	}
+	ino, ok := parent.children[name]
+	if !ok {
+		return ErrNotFound
+	}
+	dir := m.inodes[ino]
+	if dir.children == nil {
+		return ErrNotDir
+	}
+	if len(dir.children) > 0 {
+		return ErrNotEmpty
+	}
+	m.unlinkLocked(parent, name)
+	return nil
+}
+
+// Rename implements FileSystem.Rename
+func (m *MemFS) Rename(ctx context.Context, oldpath, newpath string, flags uint32) error {
+	if flags&^(RENAME_NOREPLACE|RENAME_EXCHANGE|RENAME_WHITEOUT) != 0 {
+		return ErrInvalid
+	}
+	if flags&RENAME_EXCHANGE != 0 && flags&(RENAME_NOREPLACE|RENAME_WHITEOUT) != 0 {
+		return ErrInvalid
+	}
+
+	oldParentPath, oldName, err := m.resolveParent(ctx, oldpath)
+	if err != nil {
+		return err
+	}
+	newParentPath, newName, err := m.resolveParent(ctx, newpath)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.renameLocked(ctx, oldParentPath, oldName, newParentPath, newName, flags)
+}
+
+// renameLocked renames an entry between resolved parent directories. It
+// fails before changing anything.
+func (m *MemFS) renameLocked(ctx context.Context, oldParentPath, oldName, newParentPath, newName string, flags uint32) error {
+	oldParent, err := m.dirLocked(oldParentPath)
+	if err != nil {
+		return err
+	}
+	newParent, err := m.dirLocked(newParentPath)
+	if err != nil {
+		return err
+	}
+	ino, ok := oldParent.children[oldName]
+	if !ok {
+		return ErrNotFound
+	}
+	source := m.inodes[ino]
+	// A directory can't move below itself
+	if source.children != nil {
+		self := strings.TrimSuffix(oldParentPath, "/") + "/" + oldName
+		if newParentPath == self || strings.HasPrefix(newParentPath, self+"/") {
+			return ErrInvalid
+		}
+	}
+	targetIno, targetExists := newParent.children[newName]
+	now := time.Now().Unix()
+
+	if flags&RENAME_EXCHANGE != 0 {
+		if !targetExists {
+			return ErrNotFound
+		}
+		if targetIno == ino {
+			return nil
+		}
+		target := m.inodes[targetIno]
+		oldParent.children[oldName] = targetIno
+		newParent.children[newName] = ino
+		// Swapping a directory with a non-directory across parents moves a ".."
+		if oldParent != newParent && (source.children != nil) != (target.children != nil) {
+			if source.children != nil {
+				oldParent.stats.Nlink--
+				newParent.stats.Nlink++
+			} else {
+				newParent.stats.Nlink--
+				oldParent.stats.Nlink++
+			}
+		}
+		source.stats.Ctime, target.stats.Ctime = now, now
+		oldParent.stats.Mtime, oldParent.stats.Ctime = now, now
+		newParent.stats.Mtime, newParent.stats.Ctime = now, now
+		return nil
+	}
+
+	if targetExists {
+		if flags&RENAME_NOREPLACE != 0 {
+			return ErrExists
+		}
+		// Renaming a link onto another link of the same inode does nothing
+		if targetIno == ino {
+			return nil
+		}
+		target := m.inodes[targetIno]
+		switch {
+		case source.children != nil && target.children == nil:
+			return ErrNotDir
+		case source.children == nil && target.children != nil:
+			return ErrIsDir
+		case target.children != nil && len(target.children) > 0:
+			return ErrNotEmpty
+		}
+		m.unlinkLocked(newParent, newName)
+	}
+
+	delete(oldParent.children, oldName)
+	newParent.children[newName] = ino
+	// A directory's ".." moves to its new parent
+	if source.children != nil && oldParent != newParent {
+		oldParent.stats.Nlink--
+		newParent.stats.Nlink++
+	}
+	source.stats.Ctime = now
+	oldParent.stats.Mtime, oldParent.stats.Ctime = now, now
+	newParent.stats.Mtime, newParent.stats.Ctime = now, now
+
+	if flags&RENAME_WHITEOUT != 0 {
+		whiteout := m.newInodeLocked(ctx, S_IFCHR)
+		whiteout.stats.Uid, whiteout.stats.Gid = source.stats.Uid, source.stats.Gid
+		oldParent.children[oldName] = whiteout.stats.Ino
+	}
+	return nil
+}
+
+// update applies fn to the inode at path, following symlinks in all but
+// the last component
+func (m *MemFS) update(ctx context.Context, path string, fn func(n *memInode) error) error {
+	resolved, err := m.resolve(ctx, path, false)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.lookupLocked(resolved)
+	if err != nil {
+		return err
+	}
+	return fn(n)
+}
+
+// Chmod implements FileSystem.Chmod
+func (m *MemFS) Chmod(ctx context.Context, path string, mode uint32) error {
+	return m.update(ctx, path, func(n *memInode) error {
+		n.stats.Mode = n.stats.FileType() | mode&0o7777
+		n.stats.Ctime = time.Now().Unix()
+		return nil
+	})
+}
+
+// Chown implements FileSystem.Chown
+func (m *MemFS) Chown(ctx context.Context, path string, uid, gid uint32) error {
+	return m.update(ctx, path, func(n *memInode) error {
+		n.stats.Uid, n.stats.Gid = uid, gid
+		n.stats.Ctime = time.Now().Unix()
+		return nil
+	})
+}
+
+// truncateLocked sets the size of a regular file. Bytes past the written
+// data read as zeros, so extending a file takes no memory.
+func (m *MemFS) truncateLocked(n *memInode, size int64) {
+	if size < int64(len(n.data)) {
+		m.used -= int64(len(n.data)) - size
+		n.data = n.data[:size:size]
+	}
+	now := time.Now().Unix()
+	n.stats.Size = size
+	n.stats.Mtime, n.stats.Ctime = now, now
+}
+
+// Truncate implements FileSystem.Truncate
+func (m *MemFS) Truncate(ctx context.Context, path string, size int64) error {
+	if size < 0 {
+		return ErrInvalid
+	}
+	return m.update(ctx, path, func(n *memInode) error {
+		switch {
+		case n.children != nil:
+			return ErrIsDir
+		case !n.stats.IsRegular():
+			return ErrInvalid
+		}
+		m.truncateLocked(n, size)
+		return nil
+	})
+}
+
+// Utimens implements FileSystem.Utimens
+func (m *MemFS) Utimens(ctx context.Context, path string, atime, mtime *int64) error {
+	return m.update(ctx, path, func(n *memInode) error {
+		now := time.Now().Unix()
+		n.stats.Atime, n.stats.Mtime = now, now
+		if atime != nil {
+			n.stats.Atime = *atime
+		}
+		if mtime != nil {
+			n.stats.Mtime = *mtime
+		}
+		n.stats.Ctime = now
+		return nil
+	})
+}
+
+// Link implements FileSystem.Link
+func (m *MemFS) Link(ctx context.Context, oldpath, newpath string) error {
+	source, err := m.resolve(ctx, oldpath, false)
+	if err != nil {
+		return err
+	}
+	parentPath, name, err := m.resolveParent(ctx, newpath)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.lookupLocked(source)
+	if err != nil {
+		return err
+	}
+	if n.children != nil {
+		return ErrIsDir
+	}
+	parent, err := m.dirLocked(parentPath)
+	if err != nil {
+		return err
+	}
+	if _, exists := parent.children[name]; exists {
+		return ErrExists
+	}
+
+	parent.children[name] = n.stats.Ino
+	now := time.Now().Unix()
+	n.stats.Nlink++
+	n.stats.Ctime = now
+	parent.stats.Mtime, parent.stats.Ctime = now, now
+	return nil
+}
+
+// Access implements FileSystem.Access
+func (m *MemFS) Access(ctx context.Context, path string, mode uint32) error {
+	stats, err := m.Stat(ctx, path)
+	if err != nil {
+		return err
+	}
+	return CheckAccess(ctx, stats, mode)
+}
+
+// Getxattr implements FileSystem.Getxattr
+func (m *MemFS) Getxattr(ctx context.Context, path, name string) ([]byte, error) {
+	var value []byte
+	err := m.update(ctx, path, func(n *memInode) error {
+		v, ok := n.xattrs[name]
+		if !ok {
+			return ErrNoAttr
+		}
+		value = append([]byte(nil), v...)
+		return nil
+	})
+	return value, err
+}
+
+// setXattrLocked sets an extended attribute of an inode
+func (m *MemFS) setXattrLocked(n *memInode, name string, value []byte, flags int) error {
+	old, exists := n.xattrs[name]
+	switch {
+	case flags&XATTR_CREATE != 0 && exists:
+		return ErrExists
+	case flags&XATTR_REPLACE != 0 && !exists:
+		return ErrNoAttr
+	}
+
+	grow := int64(len(value) - len(old))
+	if !exists {
+		grow += int64(len(name))
+	}
+	if err := m.reserveLocked(grow); err != nil {
+		return err
+	}
+	if n.xattrs == nil {
+		n.xattrs = make(map[string][]byte)
+	}
+	n.xattrs[name] = append([]byte(nil), value...)
+	n.stats.Ctime = time.Now().Unix()
+	return nil
+}
+
+// removeXattrLocked removes an extended attribute of an inode
+func (m *MemFS) removeXattrLocked(n *memInode, name string) error {
+	old, exists := n.xattrs[name]
+	if !exists {
+		return ErrNoAttr
+	}
+	m.used -= int64(len(name) + len(old))
+	delete(n.xattrs, name)
+	n.stats.Ctime = time.Now().Unix()
+	return nil
+}
+
+// Setxattr implements FileSystem.Setxattr
+func (m *MemFS) Setxattr(ctx context.Context, path, name string, value []byte, flags int) error {
+	if name == "" {
+		return ErrInvalid
+	}
+	return m.update(ctx, path, func(n *memInode) error {
+		return m.setXattrLocked(n, name, value, flags)
+	})
+}
+
+// Listxattr implements FileSystem.Listxattr
+func (m *MemFS) Listxattr(ctx context.Context, path string) ([]string, error) {
+	var names []string
+	err := m.update(ctx, path, func(n *memInode) error {
+		for name := range n.xattrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil
+	})
+	return names, err
+}
+
+// Removexattr implements FileSystem.Removexattr
+func (m *MemFS) Removexattr(ctx context.Context, path, name string) error {
+	return m.update(ctx, path, func(n *memInode) error {
+		return m.removeXattrLocked(n, name)
+	})
+}
+
+// Ensure MemFS implements Delta
+var _ Delta = (*MemFS)(nil)
+
+// setBase is a no-op: MemFS copies files up whole
+func (m *MemFS) setBase(base FileSystem) {}
+
+// CopyFromBaseWithPath copies a file from the base filesystem to MemFS.
+// deltaPath is where to create it, basePath where to read it from base.
+func (m *MemFS) CopyFromBaseWithPath(ctx context.Context, deltaPath, basePath string, base FileSystem) (uint64, error) {
+	stats, err := base.Lstat(ctx, basePath)
+	if err != nil {
+		return 0, err
+	}
+	xattrs, err := readXattrs(ctx, base, basePath)
+	if err != nil {
+		return 0, err
+	}
+
+	var data []byte
+	var target string
+	switch {
+	case stats.IsRegular():
+		if data, err = ReadFile(ctx, base, basePath); err != nil {
+			return 0, err
+		}
+	case stats.IsSymlink():
+		if target, err = base.Readlink(ctx, basePath); err != nil {
+			return 0, err
+		}
+	}
+
+	// Ensure parent directories exist
+	parts := splitPath(deltaPath)
+	for i := 1; i < len(parts); i++ {
+		if err := m.Mkdir(ctx, joinPath(parts[:i]), 0o755); err != nil && err != ErrExists {
+			return 0, err
+		}
+	}
+
+	n, err := m.create(ctx, deltaPath, stats.Mode, func(n *memInode) error {
+		usage := int64(len(data) + len(target))
+		for name, value := range xattrs {
+			usage += int64(len(name) + len(value))
+		}
+		if err := m.reserveLocked(usage); err != nil {
+			return err
+		}
+		n.data, n.target, n.xattrs = data, target, xattrs
+		n.stats.Uid, n.stats.Gid = stats.Uid, stats.Gid
+		n.stats.Rdev = stats.Rdev
+		n.stats.Size = int64(len(data) + len(target))
+		n.stats.Atime, n.stats.Mtime = stats.Atime, stats.Mtime
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n.stats.Ino, nil
+}
+
+// CopyMetadataFromBase copies a file like CopyFromBaseWithPath. Contents
+// are copied right away, as nothing would read them from base later.
+func (m *MemFS) CopyMetadataFromBase(ctx context.Context, deltaPath, basePath string, base FileSystem) (uint64, error) {
+	return m.CopyFromBaseWithPath(ctx, deltaPath, basePath, base)
+}
+
+// normalizeWhiteout gives whiteout paths the form they have in SQLite
+func normalizeWhiteout(path string) string {
+	return filepath.Clean("/" + path)
+}
+
+func (m *MemFS) listWhiteouts(ctx context.Context) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	paths := make([]string, 0, len(m.whiteouts))
+	for path := range m.whiteouts {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func (m *MemFS) createWhiteout(ctx context.Context, path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.whiteouts[normalizeWhiteout(path)] = true
+	return nil
+}
+
+func (m *MemFS) deleteWhiteout(ctx context.Context, path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.whiteouts, normalizeWhiteout(path))
+	return nil
+}
+
+func (m *MemFS) deleteWhiteoutsUnder(ctx context.Context, path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path = normalizeWhiteout(path)
+	delete(m.whiteouts, path)
+	m.takeWhiteoutsLocked(path)
+	return nil
+}
+
+// takeWhiteoutsLocked removes the whiteouts below path (not path itself)
+// and returns them relative to it
+func (m *MemFS) takeWhiteoutsLocked(path string) []string {
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	var taken []string
+	for w := range m.whiteouts {
+		if strings.HasPrefix(w, prefix) {
+			taken = append(taken, w[len(prefix):])
+			delete(m.whiteouts, w)
+		}
+	}
+	return taken
+}
+
+// moveWhiteoutsLocked moves the whiteouts below oldPath to below newPath,
+// replacing any that were there
+func (m *MemFS) moveWhiteoutsLocked(oldPath, newPath string) {
+	newPath = normalizeWhiteout(newPath)
+	m.takeWhiteoutsLocked(newPath)
+	for _, rel := range m.takeWhiteoutsLocked(normalizeWhiteout(oldPath)) {
+		m.whiteouts[newPath+"/"+rel] = true
+	}
+}
+
+// swapWhiteoutsLocked exchanges the whiteouts below two paths
+func (m *MemFS) swapWhiteoutsLocked(path1, path2 string) {
+	path1, path2 = normalizeWhiteout(path1), normalizeWhiteout(path2)
+	under1 := m.takeWhiteoutsLocked(path1)
+	under2 := m.takeWhiteoutsLocked(path2)
+	for _, rel := range under1 {
+		m.whiteouts[path2+"/"+rel] = true
+	}
+	for _, rel := range under2 {
+		m.whiteouts[path1+"/"+rel] = true
+	}
+}
+
+func (m *MemFS) origin(ctx context.Context, ino uint64) (uint64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.origins[ino], nil
+}
+
+func (m *MemFS) addOrigin(ctx context.Context, ino, baseIno uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.origins[ino] = baseIno
+	return nil
+}
+
+func (m *MemFS) deleteOrigin(ctx context.Context, ino uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.origins, ino)
+	return nil
+}
+
+// inodeLocked returns an inode by number
+func (m *MemFS) inodeLocked(ino uint64) (*memInode, error) {
+	n, ok := m.inodes[ino]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return n, nil
+}
+
+func (m *MemFS) inoXattr(ctx context.Context, ino uint64, name string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n, err := m.inodeLocked(ino)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := n.xattrs[name]
+	if !ok {
+		return nil, ErrNoAttr
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (m *MemFS) setInoXattr(ctx context.Context, ino uint64, name string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.inodeLocked(ino)
+	if err != nil {
+		return err
+	}
+	return m.setXattrLocked(n, name, value, 0)
+}
+
+func (m *MemFS) removeInoXattr(ctx context.Context, ino uint64, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.inodeLocked(ino)
+	if err != nil {
+		return err
+	}
+	return m.removeXattrLocked(n, name)
+}
+
+func (m *MemFS) renameMerged(ctx context.Context, r *mergedRename) error {
+	oldParentPath, oldName, err := m.resolveParent(ctx, r.oldpath)
+	if err != nil {
+		return err
+	}
+	newParentPath, newName, err := m.resolveParent(ctx, r.newpath)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Only the rename and the room for the merge state can fail, so check
+	// both before changing anything
+	var grow int64
+	for _, d := range r.dirs {
+		n, err := m.inodeLocked(d.ino)
+		if err != nil {
+			return err
+		}
+		grow += dirMetaGrowth(n, d.meta)
+	}
+	if m.maxSize > 0 && m.used+grow > m.maxSize {
+		return ErrNoSpace
+	}
+	if err := m.renameLocked(ctx, oldParentPath, oldName, newParentPath, newName, r.flags); err != nil {
+		return err
+	}
+
+	if r.unhide {
+		delete(m.whiteouts, normalizeWhiteout(r.newpath))
+	}
+	for _, d := range r.dirs {
+		if err := m.setDirMetaLocked(m.inodes[d.ino], d.meta); err != nil {
+			return err
+		}
+	}
+	if r.whiteouts {
+		if r.flags&RENAME_EXCHANGE != 0 {
+			m.swapWhiteoutsLocked(r.oldpath, r.newpath)
+		} else {
+			m.moveWhiteoutsLocked(r.oldpath, r.newpath)
+		}
+	}
+	if r.hide {
+		m.whiteouts[normalizeWhiteout(r.oldpath)] = true
+	}
+	return nil
+}
+
+// dirMetaGrowth returns the most bytes setting meta on n can take
+func dirMetaGrowth(n *memInode, meta dirMeta) int64 {
+	var grow int64
+	if meta.redirect != "" {
+		old, exists := n.xattrs[XattrRedirect]
+		grow += int64(len(meta.redirect) - len(old))
+		if !exists {
+			grow += int64(len(XattrRedirect))
+		}
+	}
+	if _, exists := n.xattrs[XattrOpaque]; meta.opaque && !exists {
+		grow += int64(len(XattrOpaque) + 1)
+	}
+	return max(grow, 0)
+}
+
+// setDirMetaLocked writes the merge state of a moved directory as xattrs
+func (m *MemFS) setDirMetaLocked(n *memInode, meta dirMeta) error {
+	var err error
+	if meta.redirect != "" {
+		err = m.setXattrLocked(n, XattrRedirect, []byte(meta.redirect), 0)
+	} else {
+		err = m.removeXattrLocked(n, XattrRedirect)
+	}
+	if err != nil && err != ErrNoAttr {
+		return err
+	}
+	if meta.opaque {
+		err = m.setXattrLocked(n, XattrOpaque, []byte("y"), 0)
+	} else {
+		err = m.removeXattrLocked(n, XattrOpaque)
+	}
+	if err != nil && err != ErrNoAttr {
+		return err
+	}
+	return nil
+}
+
+// memFSFile implements File for MemFS
+type memFSFile struct {
+	fs  *MemFS
+	ino uint64
+}
+
+// Read implements File.Read
+func (f *memFSFile) Read(ctx context.Context, dest []byte, offset int64) (int, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	n, err := f.fs.inodeLocked(f.ino)
+	if err != nil {
+		return 0, err
+	}
+	if offset >= n.stats.Size {
+		return 0, nil
+	}
+	length := min(int64(len(dest)), n.stats.Size-offset)
+	copied := 0
+	if offset < int64(len(n.data)) {
+		copied = copy(dest[:length], n.data[offset:])
+	}
+	clear(dest[copied:length]) // Hole after the written data
+	return int(length), nil
+}
+
+// Write implements File.Write
+func (f *memFSFile) Write(ctx context.Context, data []byte, offset int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	n, err := f.fs.inodeLocked(f.ino)
+	if err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		return 0, ErrInvalid
+	}
+
+	end := offset + int64(len(data))
+	if end > int64(len(n.data)) {
+		if err := f.fs.reserveLocked(end - int64(len(n.data))); err != nil {
+			return 0, err
+		}
+		if end > int64(cap(n.data)) {
+			grown := make([]byte, end, max(end, 2*int64(cap(n.data))))
+			copy(grown, n.data)
+			n.data = grown
+		} else {
+			n.data = n.data[:end]
+		}
+	}
+	copy(n.data[offset:], data)
+
+	now := time.Now().Unix()
+	n.stats.Size = max(n.stats.Size, end)
+	n.stats.Mtime, n.stats.Ctime = now, now
+	return len(data), nil
+}
+
+// Sync implements File.Sync
+func (f *memFSFile) Sync(ctx context.Context) error {
+	return nil
+}
+
+// Close implements File.Close
+func (f *memFSFile) Close() error {
+	return nil
+}
+
+// Stat implements File.Stat
+func (f *memFSFile) Stat(ctx context.Context) (*Stats, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	n, err := f.fs.inodeLocked(f.ino)
+	if err != nil {
+		return nil, err
+	}
+	stats := n.stats
+	return &stats, nil
+}
+
+// Truncate implements File.Truncate
+func (f *memFSFile) Truncate(ctx context.Context, size int64) error {
+	if size < 0 {
+		return ErrInvalid
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	n, err := f.fs.inodeLocked(f.ino)
+	if err != nil {
+		return err
+	}
+	f.fs.truncateLocked(n, size)
+	return nil
+}
+
+// Dump writes the filesystem, with its whiteouts and origins, to an empty
+// store, so that a session kept in memory can be resumed, diffed or pulled
+// like one backed by SQLite
+func (m *MemFS) Dump(ctx context.Context, store *db.Store) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if hasChildren, err := store.HasChildren(ctx, 1); err != nil {
+		return err
+	} else if hasChildren {
+		return fmt.Errorf("database is not empty")
+	}
+
+	return store.WithTx(ctx, func(tx *sql.Tx) error {
+		// Inodes already written, for hard links
+		inos := map[uint64]uint64{1: 1}
+
+		var dumpDir func(dir *memInode) error
+		dumpDir = func(dir *memInode) error {
+			names := make([]string, 0, len(dir.children))
+			for name := range dir.children {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			for _, name := range names {
+				n := m.inodes[dir.children[name]]
+				if ino, ok := inos[n.stats.Ino]; ok {
+					if err := store.CreateDentryTx(ctx, tx, inos[dir.stats.Ino], name, ino); err != nil {
+						return err
+					}
+					continue
+				}
+
+				var ino uint64
+				var err error
+				if n.stats.IsSpecial() {
+					ino, err = store.CreateNodeTx(ctx, tx, n.stats.Mode, n.stats.Uid, n.stats.Gid, n.stats.Rdev)
+				} else {
+					ino, err = store.CreateInodeTx(ctx, tx, n.stats.Mode, n.stats.Uid, n.stats.Gid)
+				}
+				if err != nil {
+					return err
+				}
+				inos[n.stats.Ino] = ino
+				if err := m.dumpInodeTx(ctx, store, tx, n, ino); err != nil {
+					return err
+				}
+				if err := store.CreateDentryTx(ctx, tx, inos[dir.stats.Ino], name, ino); err != nil {
+					return err
+				}
+				if n.children != nil {
+					if err := dumpDir(n); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+
+		root := m.inodes[1]
+		if err := m.dumpInodeTx(ctx, store, tx, root, 1); err != nil {
+			return err
+		}
+		if err := dumpDir(root); err != nil {
+			return err
+		}
+
+		for path := range m.whiteouts {
+			if err := store.CreateWhiteoutTx(ctx, tx, path); err != nil {
+				return err
+			}
+		}
+		for memIno, baseIno := range m.origins {
+			// Inodes only kept alive by open files aren't dumped
+			if ino, ok := inos[memIno]; ok {
+				if err := store.AddOriginTx(ctx, tx, ino, baseIno); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// dumpInodeTx writes the contents and attributes of an inode to the store
+func (m *MemFS) dumpInodeTx(ctx context.Context, store *db.Store, tx *sql.Tx, n *memInode, ino uint64) error {
+	if len(n.data) > 0 {
+		if err := store.WriteDataTx(ctx, tx, ino, 0, n.data); err != nil {
+			return err
+		}
+	}
+	if n.stats.IsSymlink() {
+		if err := store.CreateSymlinkTx(ctx, tx, ino, n.target); err != nil {
+			return err
+		}
+	}
+	for name, value := range n.xattrs {
+		if err := store.SetXattrTx(ctx, tx, ino, name, value, 0); err != nil {
+			return err
+		}
+	}
+	return store.UpdateInodeTx(ctx, tx, &db.Inode{
+		Ino:   ino,
+		Mode:  n.stats.Mode,
+		Nlink: n.stats.Nlink,
+		UID:   n.stats.Uid,
+		GID:   n.stats.Gid,
+		Size:  uint64(n.stats.Size),
+		Atime: n.stats.Atime,
+		Mtime: n.stats.Mtime,
+		Ctime: n.stats.Ctime,
+	})
+}
@@ -0,0 +1,39 @@
+package overlay
+
+import (
+	"context"
+	"path/filepath"
+)
+
+// Notifier is told which paths of an OverlayFS changed, so that a mount
+// can drop what the kernel cached about them. It is told about every
+// change, including ones a mount made itself, and may be told about
+// changes that then failed; invalidating too much is always safe.
+type Notifier interface {
+	// ContentChanged reports that the data or attributes at path changed
+	ContentChanged(ctx context.Context, path string)
+
+	// EntryChanged reports that the entry at path was created, removed
+	// or replaced, which also changes its parent directory
+	EntryChanged(ctx context.Context, path string)
+}
+
+// SetNotifier sets the Notifier told about changes. Set it before the
+// overlay is changed by anything but the mount it belongs to.
+func (o *OverlayFS) SetNotifier(n Notifier) {
+	o.notifier = n
+}
+
+// contentChanged reports a change to the data or attributes at path
+func (o *OverlayFS) contentChanged(ctx context.Context, path string) {
+	if o.notifier != nil {
+		o.notifier.ContentChanged(ctx, filepath.Clean(path))
+	}
+}
+
+// entryChanged reports a change to the entry at path
+func (o *OverlayFS) entryChanged(ctx context.Context, path string) {
+	if o.notifier != nil {
+		o.notifier.EntryChanged(ctx, filepath.Clean(path))
+	}
+}
@@ -2,18 +2,25 @@ package overlay
 
 import (
 	"context"
-	"strings"
+	"path/filepath"
 	"sync"
+
+	lru "github.com/hashicorp/golang-lru/v2"
 )
 
 // OverlayFS implements a copy-on-write overlay filesystem.
-// Reads come from the base layer (HostFS) and writes go to the delta layer (AgentFS).
+// Reads come from the base layers (HostFS) and writes go to the delta layer (AgentFS).
 // Deleted files from the base are tracked as "whiteouts" in the delta.
 type OverlayFS struct {
-	base          FileSystem     // Read-only base layer (HostFS)
-	delta         *AgentFS       // Writable delta layer (SQLite)
-	whiteout      *WhiteoutCache // In-memory cache of deleted paths
-	workspaceName string         // Subdirectory name where base is mounted (empty = root)
+	base          *LayerFS                    // Read-only base layers (HostFS)
+	layers        []Layer                     // Extra layers below the workspace
+	delta         Delta                       // Writable delta layer (SQLite or memory)
+	whiteout      *WhiteoutCache              // In-memory cache of deleted paths
+	meta          *lru.Cache[uint64, dirMeta] // Redirect and opacity of delta directories
+	workspaceName string                      // Subdirectory name where base is mounted (empty = root)
+	mountPoint    string                      // Where processes see the overlay root, for absolute symlinks
+	devices       bool                        // Allow creating character and block devices
+	notifier      Notifier                    // Told about changes, so kernel caches can be dropped
 	mu            sync.RWMutex
 }
 
@@ -29,12 +36,45 @@ func WithWorkspaceName(name string) OverlayOption {
 	}
 }
 
-// NewOverlayFS creates a new overlay filesystem
-func NewOverlayFS(base FileSystem, delta *AgentFS, opts ...OverlayOption) (*OverlayFS, error) {
+// WithLayer adds a read-only layer whose contents appear at prefix in the
+// overlay, below the workspace and any layers added before it. Layers let
+// sandboxes share pre-populated trees, such as a toolchain home directory
+// or an organization-wide template.
+func WithLayer(fs FileSystem, prefix string) OverlayOption {
+	return func(o *OverlayFS) {
+		o.layers = append(o.layers, Layer{FS: fs, Prefix: prefix})
+	}
+}
+
+// WithMountPoint sets the directory where processes see the overlay root.
+// Absolute symlink targets under it are resolved within the overlay, and
+// targets outside of it are treated as missing. Without a mount point,
+// absolute targets are taken relative to the overlay root.
+func WithMountPoint(dir string) OverlayOption {
+	return func(o *OverlayFS) {
+		o.mountPoint = dir
+	}
+}
+
+// WithDevices allows creating character and block device nodes. Without
+// it, Mknod only creates FIFOs and sockets.
+func WithDevices() OverlayOption {
+	return func(o *OverlayFS) {
+		o.devices = true
+	}
+}
+
+// NewOverlayFS creates a new overlay filesystem. The base appears at the
+// workspace directory, unless it is a LayerFS, which is used as is.
+func NewOverlayFS(base FileSystem, delta Delta, opts ...OverlayOption) (*OverlayFS, error) {
+	meta, err := lru.New[uint64, dirMeta](10000)
+	if err != nil {
+		return nil, err
+	}
 	o := &OverlayFS{
-		base:     base,
 		delta:    delta,
 		whiteout: NewWhiteoutCache(),
+		meta:     meta,
 	}
 
 	// Apply options
@@ -42,9 +82,17 @@ func NewOverlayFS(base FileSystem, delta *AgentFS, opts ...OverlayOption) (*Over
 		opt(o)
 	}
 
+	if layers, ok := base.(*LayerFS); ok {
+		o.base = NewLayerFS(append(layers.Layers(), o.layers...)...)
+	} else {
+		o.base = NewLayerFS(append([]Layer{{FS: base, Prefix: "/" + o.workspaceName}}, o.layers...)...)
+	}
+	// Files are copied up from base a chunk at a time
+	delta.setBase(o.base)
+
 	// Load existing whiteouts from database
 	ctx := context.Background()
-	paths, err := delta.Store().ListWhiteouts(ctx)
+	paths, err := delta.listWhiteouts(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -59,29 +107,12 @@ func (o *OverlayFS) WorkspaceName() string {
 }
 
 // toBasePath converts an overlay path to a base path.
-// Returns empty string if the path is not under the workspace.
+// Returns empty string if no base layer covers the path.
 func (o *OverlayFS) toBasePath(overlayPath string) string {
-	if o.workspaceName == "" {
-		return overlayPath
-	}
-
-	// Overlay path must be under /workspaceName/...
-	prefix := "/" + o.workspaceName
-	if overlayPath == prefix {
-		return "/"
+	if !o.base.covers(overlayPath) {
+		return ""
 	}
-	if strings.HasPrefix(overlayPath, prefix+"/") {
-		return overlayPath[len(prefix):]
-	}
-	return "" // Not under workspace
-}
-
-// isWorkspacePath checks if the overlay path is the workspace directory itself
-func (o *OverlayFS) isWorkspacePath(overlayPath string) bool {
-	if o.workspaceName == "" {
-		return overlayPath == "/"
-	}
-	return overlayPath == "/"+o.workspaceName
+	return overlayPath
 }
 
 // Base returns the base filesystem
@@ -90,7 +121,7 @@ func (o *OverlayFS) Base() FileSystem {
 }
 
 // Delta returns the delta filesystem
-func (o *OverlayFS) Delta() *AgentFS {
+func (o *OverlayFS) Delta() Delta {
 	return o.delta
 }
 
@@ -102,7 +133,7 @@ func (o *OverlayFS) existsInDelta(ctx context.Context, path string) bool {
 
 // existsInBase checks if a path exists in the base layer
 func (o *OverlayFS) existsInBase(ctx context.Context, path string) bool {
-	basePath := o.toBasePath(path)
+	basePath := o.basePath(ctx, path)
 	if basePath == "" {
 		return false
 	}
@@ -110,29 +141,53 @@ func (o *OverlayFS) existsInBase(ctx context.Context, path string) bool {
 	return err == nil
 }
 
-// Stat implements FileSystem.Stat (follows symlinks)
-func (o *OverlayFS) Stat(ctx context.Context, path string) (*Stats, error) {
-	// Check if whited out
+// resolvePath follows symlinks in all but the last component of path
+// through the merged view, so a link in one layer can point into the other
+func (o *OverlayFS) resolvePath(ctx context.Context, path string) (string, error) {
+	return walkSymlinks(ctx, o, path, o.mountPoint, false)
+}
+
+// typeOf returns the file type of a path without symlinks before its last
+// component
+func (o *OverlayFS) typeOf(ctx context.Context, path string) (uint32, error) {
 	if o.whiteout.HasWhiteoutAncestor(path) {
-		return nil, ErrNotFound
+		return 0, ErrNotFound
 	}
-
-	// Try delta first
-	if stats, err := o.delta.Stat(ctx, path); err == nil {
-		// Check for origin mapping to return original inode
-		return o.applyOrigin(ctx, stats)
+	if mode, err := o.delta.typeOf(ctx, path); err == nil {
+		return mode, nil
 	}
 
-	// Fall back to base (with path translation)
-	basePath := o.toBasePath(path)
+	basePath := o.basePath(ctx, path)
 	if basePath == "" {
-		return nil, ErrNotFound
+		return 0, ErrNotFound
 	}
-	return o.base.Stat(ctx, basePath)
+	stats, err := o.base.Lstat(ctx, basePath)
+	if err != nil {
+		return 0, err
+	}
+	return stats.FileType(), nil
+}
+
+// Stat implements FileSystem.Stat (follows symlinks)
+func (o *OverlayFS) Stat(ctx context.Context, path string) (*Stats, error) {
+	path, err := walkSymlinks(ctx, o, path, o.mountPoint, true)
+	if err != nil {
+		return nil, err
+	}
+	return o.lstat(ctx, path)
 }
 
 // Lstat implements FileSystem.Lstat (does not follow symlinks)
 func (o *OverlayFS) Lstat(ctx context.Context, path string) (*Stats, error) {
+	path, err := o.resolvePath(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return o.lstat(ctx, path)
+}
+
+// lstat returns the stats of a resolved path
+func (o *OverlayFS) lstat(ctx context.Context, path string) (*Stats, error) {
 	// Check if whited out
 	if o.whiteout.HasWhiteoutAncestor(path) {
 		return nil, ErrNotFound
@@ -144,7 +199,7 @@ func (o *OverlayFS) Lstat(ctx context.Context, path string) (*Stats, error) {
 	}
 
 	// Fall back to base (with path translation)
-	basePath := o.toBasePath(path)
+	basePath := o.basePath(ctx, path)
 	if basePath == "" {
 		return nil, ErrNotFound
 	}
@@ -153,7 +208,7 @@ func (o *OverlayFS) Lstat(ctx context.Context, path string) (*Stats, error) {
 
 // applyOrigin checks for origin mapping and returns the original inode
 func (o *OverlayFS) applyOrigin(ctx context.Context, stats *Stats) (*Stats, error) {
-	baseIno, err := o.delta.Store().GetOrigin(ctx, stats.Ino)
+	baseIno, err := o.delta.origin(ctx, stats.Ino)
 	if err != nil {
 		return nil, err
 	}
@@ -165,17 +220,26 @@ func (o *OverlayFS) applyOrigin(ctx context.Context, stats *Stats) (*Stats, erro
 
 // Readlink implements FileSystem.Readlink
 func (o *OverlayFS) Readlink(ctx context.Context, path string) (string, error) {
+	path, err := o.resolvePath(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	return o.readlink(ctx, path)
+}
+
+// readlink returns the target of a symlink at a resolved path
+func (o *OverlayFS) readlink(ctx context.Context, path string) (string, error) {
 	if o.whiteout.HasWhiteoutAncestor(path) {
 		return "", ErrNotFound
 	}
 
 	// Try delta first
-	if target, err := o.delta.Readlink(ctx, path); err == nil {
+	if target, err := o.delta.readlink(ctx, path); err == nil {
 		return target, nil
 	}
 
 	// Fall back to base (with path translation)
-	basePath := o.toBasePath(path)
+	basePath := o.basePath(ctx, path)
 	if basePath == "" {
 		return "", ErrNotFound
 	}
@@ -190,6 +254,11 @@ func (o *OverlayFS) Statfs(ctx context.Context) (*FilesystemStats, error) {
 
 // Readdir implements FileSystem.Readdir - merges entries from both layers
 func (o *OverlayFS) Readdir(ctx context.Context, path string) ([]DirEntry, error) {
+	path, err := walkSymlinks(ctx, o, path, o.mountPoint, true)
+	if err != nil {
+		return nil, err
+	}
+
 	if o.whiteout.HasWhiteoutAncestor(path) {
 		return nil, ErrNotFound
 	}
@@ -209,24 +278,9 @@ func (o *OverlayFS) Readdir(ctx context.Context, path string) ([]DirEntry, error
 	}
 
 	// Handle base layer based on workspace mapping
-	basePath := o.toBasePath(path)
-
-	if path == "/" && o.workspaceName != "" {
-		// At root level with workspace mapping:
-		// Show workspace directory (from base) as an entry
-		if !whiteouts[o.workspaceName] {
-			if _, exists := deltaEntries[o.workspaceName]; !exists {
-				// Check if base root exists
-				if stats, err := o.base.Lstat(ctx, "/"); err == nil && stats.IsDir() {
-					deltaEntries[o.workspaceName] = DirEntry{
-						Name: o.workspaceName,
-						Mode: S_IFDIR | 0755,
-						Ino:  stats.Ino,
-					}
-				}
-			}
-		}
-	} else if basePath != "" {
+	basePath := o.dirBasePath(ctx, path)
+
+	if basePath != "" {
 		// Collect entries from base (if not whited out or overridden)
 		if entries, err := o.base.Readdir(ctx, basePath); err == nil {
 			for _, e := range entries {
@@ -254,6 +308,12 @@ func (o *OverlayFS) Readdir(ctx context.Context, path string) ([]DirEntry, error
 
 // Mkdir implements FileSystem.Mkdir
 func (o *OverlayFS) Mkdir(ctx context.Context, path string, mode uint32) error {
+	path, err := o.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer o.entryChanged(ctx, path)
+
 	// Check if ancestor is whited out (can't create under deleted dir)
 	parts := splitPath(path)
 	if len(parts) > 1 {
@@ -263,20 +323,37 @@ func (o *OverlayFS) Mkdir(ctx context.Context, path string, mode uint32) error {
 		}
 	}
 
-	// Remove whiteout if this path was deleted
+	// Ensure parent directories exist in delta
+	if err := o.ensureParentDirs(ctx, path); err != nil {
+		return err
+	}
+
+	if err := o.delta.Mkdir(ctx, path, mode); err != nil {
+		return err
+	}
+
+	// A directory recreated where a base one was deleted must not show
+	// its old entries. Making it opaque hides them with one record, so
+	// the whiteouts for the path and below it can go.
 	if o.whiteout.HasExactWhiteout(path) {
-		if err := o.delta.Store().DeleteWhiteout(ctx, path); err != nil {
+		if err := o.setDirMeta(ctx, path, dirMeta{opaque: true}); err != nil {
 			return err
 		}
-		o.whiteout.Remove(path)
+		return o.clearWhiteoutsUnder(ctx, path)
 	}
+	return nil
+}
 
-	// Ensure parent directories exist in delta
-	if err := o.ensureParentDirs(ctx, path); err != nil {
+// clearWhiteoutsUnder removes the whiteouts for a path and below it
+func (o *OverlayFS) clearWhiteoutsUnder(ctx context.Context, path string) error {
+	if !o.whiteout.HasWhiteoutUnder(path) {
+		return nil
+	}
+	if err := o.delta.deleteWhiteoutsUnder(ctx, path); err != nil {
 		return err
 	}
-
-	return o.delta.Mkdir(ctx, path, mode)
+	o.whiteout.RemoveUnder(path)
+	return nil
 }
 
 // ensureParentDirs ensures all parent directories exist in the delta layer
@@ -295,13 +372,19 @@ func (o *OverlayFS) ensureParentDirs(ctx context.Context, path string) error {
 		}
 
 		// Translate to base path (may be empty if outside workspace)
-		basePath := o.toBasePath(parentPath)
+		basePath := o.basePath(ctx, parentPath)
 
 		// Check if parent exists in base
 		if basePath != "" {
 			if baseStats, baseErr := o.base.Lstat(ctx, basePath); baseErr == nil && baseStats.IsDir() {
 				// Create matching directory in delta
-				if err := o.delta.Mkdir(ctx, parentPath, baseStats.Perm()); err != nil && err != ErrExists {
+				if err := o.delta.Mkdir(ctx, parentPath, baseStats.Mode&0o7777); err != nil && err != ErrExists {
+					return err
+				}
+				if err := o.delta.Chown(ctx, parentPath, baseStats.Uid, baseStats.Gid); err != nil {
+					return err
+				}
+				if err := o.copyXattrs(ctx, parentPath, basePath); err != nil {
 					return err
 				}
 				continue
@@ -317,8 +400,28 @@ func (o *OverlayFS) ensureParentDirs(ctx context.Context, path string) error {
 	return nil
 }
 
+// copyXattrs copies the extended attributes of a base path to the delta
+func (o *OverlayFS) copyXattrs(ctx context.Context, path, basePath string) error {
+	xattrs, err := readXattrs(ctx, o.base, basePath)
+	if err != nil {
+		return err
+	}
+	for name, value := range xattrs {
+		if err := o.delta.Setxattr(ctx, path, name, value, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Rmdir implements FileSystem.Rmdir
 func (o *OverlayFS) Rmdir(ctx context.Context, path string) error {
+	path, err := o.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer o.entryChanged(ctx, path)
+
 	if o.whiteout.HasWhiteoutAncestor(path) {
 		return ErrNotFound
 	}
@@ -337,9 +440,15 @@ func (o *OverlayFS) Rmdir(ctx context.Context, path string) error {
 		}
 	}
 
+	// The directory is empty, so whiteouts below it only hid base
+	// entries; a whiteout for the directory itself covers them
+	if err := o.clearWhiteoutsUnder(ctx, path); err != nil {
+		return err
+	}
+
 	// If in base, create whiteout
 	if inBase {
-		if err := o.delta.Store().CreateWhiteout(ctx, path); err != nil {
+		if err := o.delta.createWhiteout(ctx, path); err != nil {
 			return err
 		}
 		o.whiteout.Insert(path)
@@ -350,6 +459,12 @@ func (o *OverlayFS) Rmdir(ctx context.Context, path string) error {
 
 // Create implements FileSystem.Create
 func (o *OverlayFS) Create(ctx context.Context, path string, mode uint32) (File, *Stats, error) {
+	path, err := o.resolvePath(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer o.entryChanged(ctx, path)
+
 	// Check ancestors
 	parts := splitPath(path)
 	if len(parts) > 1 {
@@ -361,7 +476,7 @@ func (o *OverlayFS) Create(ctx context.Context, path string, mode uint32) (File,
 
 	// Remove whiteout if recreating a deleted file
 	if o.whiteout.HasExactWhiteout(path) {
-		if err := o.delta.Store().DeleteWhiteout(ctx, path); err != nil {
+		if err := o.delta.deleteWhiteout(ctx, path); err != nil {
 			return nil, nil, err
 		}
 		o.whiteout.Remove(path)
@@ -384,8 +499,58 @@ func (o *OverlayFS) Create(ctx context.Context, path string, mode uint32) (File,
 	}, stats, nil
 }
 
+// Mknod implements FileSystem.Mknod
+func (o *OverlayFS) Mknod(ctx context.Context, path string, mode, rdev uint32) error {
+	switch mode & S_IFMT {
+	case S_IFIFO, S_IFSOCK:
+	case S_IFCHR, S_IFBLK:
+		if !o.devices {
+			return ErrNoPerm
+		}
+	default:
+		return ErrInvalid
+	}
+
+	path, err := o.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer o.entryChanged(ctx, path)
+
+	// Check ancestors
+	parts := splitPath(path)
+	if len(parts) > 1 {
+		parentPath := joinPath(parts[:len(parts)-1])
+		if o.whiteout.HasWhiteoutAncestor(parentPath) {
+			return ErrNotFound
+		}
+	}
+	if _, err := o.lstat(ctx, path); err == nil {
+		return ErrExists
+	}
+
+	// Remove whiteout if recreating a deleted file
+	if o.whiteout.HasExactWhiteout(path) {
+		if err := o.delta.deleteWhiteout(ctx, path); err != nil {
+			return err
+		}
+		o.whiteout.Remove(path)
+	}
+
+	if err := o.ensureParentDirs(ctx, path); err != nil {
+		return err
+	}
+
+	return o.delta.Mknod(ctx, path, mode, rdev)
+}
+
 // Open implements FileSystem.Open
 func (o *OverlayFS) Open(ctx context.Context, path string, flags int) (File, error) {
+	path, err := walkSymlinks(ctx, o, path, o.mountPoint, true)
+	if err != nil {
+		return nil, err
+	}
+
 	if o.whiteout.HasWhiteoutAncestor(path) {
 		return nil, ErrNotFound
 	}
@@ -397,6 +562,10 @@ func (o *OverlayFS) Open(ctx context.Context, path string, flags int) (File, err
 		return nil, ErrNotFound
 	}
 
+	if flags&O_TRUNC != 0 {
+		defer o.contentChanged(ctx, path)
+	}
+
 	// Determine if write access is needed
 	writeNeeded := flags&(O_WRONLY|O_RDWR|O_TRUNC|O_APPEND) != 0
 
@@ -422,7 +591,7 @@ func (o *OverlayFS) Open(ctx context.Context, path string, flags int) (File, err
 	}
 
 	// Read-only from base (with path translation)
-	basePath := o.toBasePath(path)
+	basePath := o.basePath(ctx, path)
 	if basePath == "" {
 		return nil, ErrNotFound
 	}
@@ -439,16 +608,31 @@ func (o *OverlayFS) Open(ctx context.Context, path string, flags int) (File, err
 
 // copyOnWrite copies a file from base to delta
 func (o *OverlayFS) copyOnWrite(ctx context.Context, path string) error {
+	return o.copyUp(ctx, path, false)
+}
+
+// copyMetadata copies a file from base to delta for a metadata change: the
+// contents of a regular file are only copied once written
+func (o *OverlayFS) copyMetadata(ctx context.Context, path string) error {
+	return o.copyUp(ctx, path, true)
+}
+
+// copyUp copies a file from base to delta, with or without its contents
+func (o *OverlayFS) copyUp(ctx context.Context, path string, metadataOnly bool) error {
 	o.mu.Lock()
 	defer o.mu.Unlock()
+	return o.copyUpLocked(ctx, path, metadataOnly)
+}
 
+// copyUpLocked copies a file from base to delta with o.mu held
+func (o *OverlayFS) copyUpLocked(ctx context.Context, path string, metadataOnly bool) error {
 	// Double-check it's not already copied
 	if o.existsInDelta(ctx, path) {
 		return nil
 	}
 
 	// Translate to base path
-	basePath := o.toBasePath(path)
+	basePath := o.basePath(ctx, path)
 	if basePath == "" {
 		return ErrNotFound
 	}
@@ -459,18 +643,34 @@ func (o *OverlayFS) copyOnWrite(ctx context.Context, path string) error {
 		return err
 	}
 
+	// Mirror base directories first so they keep their mode and xattrs
+	if err := o.ensureParentDirs(ctx, path); err != nil {
+		return err
+	}
+
 	// Copy file to delta using a wrapper that translates paths
-	deltaIno, err := o.delta.CopyFromBaseWithPath(ctx, path, basePath, o.base)
+	var deltaIno uint64
+	if metadataOnly {
+		deltaIno, err = o.delta.CopyMetadataFromBase(ctx, path, basePath, o.base)
+	} else {
+		deltaIno, err = o.delta.CopyFromBaseWithPath(ctx, path, basePath, o.base)
+	}
 	if err != nil {
 		return err
 	}
 
 	// Store origin mapping
-	return o.delta.Store().AddOrigin(ctx, deltaIno, baseStats.Ino)
+	return o.delta.addOrigin(ctx, deltaIno, baseStats.Ino)
 }
 
 // Remove implements FileSystem.Remove
 func (o *OverlayFS) Remove(ctx context.Context, path string) error {
+	path, err := o.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer o.entryChanged(ctx, path)
+
 	if o.whiteout.HasWhiteoutAncestor(path) {
 		return ErrNotFound
 	}
@@ -486,7 +686,7 @@ func (o *OverlayFS) Remove(ctx context.Context, path string) error {
 	if inDelta {
 		// Also delete origin mapping if exists
 		if ino, err := o.delta.GetIno(ctx, path); err == nil {
-			_ = o.delta.Store().DeleteOrigin(ctx, ino)
+			_ = o.delta.deleteOrigin(ctx, ino)
 		}
 		if err := o.delta.Remove(ctx, path); err != nil {
 			return err
@@ -495,7 +695,7 @@ func (o *OverlayFS) Remove(ctx context.Context, path string) error {
 
 	// If in base, create whiteout
 	if inBase {
-		if err := o.delta.Store().CreateWhiteout(ctx, path); err != nil {
+		if err := o.delta.createWhiteout(ctx, path); err != nil {
 			return err
 		}
 		o.whiteout.Insert(path)
@@ -504,8 +704,37 @@ func (o *OverlayFS) Remove(ctx context.Context, path string) error {
 	return nil
 }
 
-// Rename implements FileSystem.Rename
-func (o *OverlayFS) Rename(ctx context.Context, oldpath, newpath string) error {
+// Rename implements FileSystem.Rename. RENAME_WHITEOUT leaves a whiteout
+// device (character device 0/0) at oldpath in the delta, like on any other
+// filesystem; it hides the base entry of that name as well.
+func (o *OverlayFS) Rename(ctx context.Context, oldpath, newpath string, flags uint32) error {
+	if flags&^(RENAME_NOREPLACE|RENAME_EXCHANGE|RENAME_WHITEOUT) != 0 {
+		return ErrInvalid
+	}
+	if flags&RENAME_EXCHANGE != 0 && flags&(RENAME_NOREPLACE|RENAME_WHITEOUT) != 0 {
+		return ErrInvalid
+	}
+
+	oldpath, err := o.resolvePath(ctx, oldpath)
+	if err != nil {
+		return err
+	}
+	newpath, err = o.resolvePath(ctx, newpath)
+	if err != nil {
+		return err
+	}
+	defer o.entryChanged(ctx, oldpath)
+	defer o.entryChanged(ctx, newpath)
+
+	// The merge state of moved directories depends on the delta as it is
+	// before the rename
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if flags&RENAME_EXCHANGE != 0 {
+		return o.exchange(ctx, oldpath, newpath)
+	}
+
 	if o.whiteout.HasWhiteoutAncestor(oldpath) {
 		return ErrNotFound
 	}
@@ -517,9 +746,24 @@ func (o *OverlayFS) Rename(ctx context.Context, oldpath, newpath string) error {
 		return ErrNotFound
 	}
 
+	// Check the destination against the merged view, as the delta alone
+	// doesn't know about base entries being replaced
+	if err := o.checkRenameTarget(ctx, oldpath, newpath, flags); err != nil {
+		return err
+	}
+
+	// A directory keeps showing the base entries it shows now, without
+	// copying them up
+	var meta dirMeta
+	isDir := false
+	if stats, err := o.lstat(ctx, oldpath); err == nil && stats.IsDir() {
+		isDir = true
+		meta = o.movedDirMeta(ctx, oldpath)
+	}
+
 	// If only in base, copy to delta first
 	if !inDelta && inBase {
-		if err := o.copyOnWrite(ctx, oldpath); err != nil {
+		if err := o.copyUpLocked(ctx, oldpath, false); err != nil {
 			return err
 		}
 	}
@@ -529,32 +773,150 @@ func (o *OverlayFS) Rename(ctx context.Context, oldpath, newpath string) error {
 		return err
 	}
 
-	// Remove whiteout at destination if exists
-	if o.whiteout.HasExactWhiteout(newpath) {
-		if err := o.delta.Store().DeleteWhiteout(ctx, newpath); err != nil {
+	// The rename replaces a whiteout at the destination, and leaves one at
+	// the source if it was in base (unless the delta already holds a
+	// whiteout device there)
+	r := &mergedRename{
+		oldpath: oldpath,
+		newpath: newpath,
+		flags:   flags,
+		unhide:  o.whiteout.HasExactWhiteout(newpath),
+		hide:    inBase && flags&RENAME_WHITEOUT == 0,
+	}
+	if isDir {
+		d, err := o.placeDir(ctx, oldpath, newpath, meta)
+		if err != nil {
 			return err
 		}
-		o.whiteout.Remove(newpath)
+		r.dirs = []movedDir{d}
+		r.whiteouts = o.whiteout.HasWhiteoutUnder(oldpath) || o.whiteout.HasWhiteoutUnder(newpath)
 	}
+	return o.renameMerged(ctx, r)
+}
 
-	// Rename in delta
-	if err := o.delta.Rename(ctx, oldpath, newpath); err != nil {
+// renameMerged renames in the delta and brings the caches of whiteouts and
+// directory merge state in line once it is done
+func (o *OverlayFS) renameMerged(ctx context.Context, r *mergedRename) error {
+	if err := o.delta.renameMerged(ctx, r); err != nil {
 		return err
 	}
 
-	// If source was in base, create whiteout
-	if inBase {
-		if err := o.delta.Store().CreateWhiteout(ctx, oldpath); err != nil {
-			return err
+	if r.unhide {
+		o.whiteout.Remove(r.newpath)
+	}
+	for _, d := range r.dirs {
+		o.meta.Add(d.ino, d.meta)
+	}
+	if r.whiteouts {
+		if r.flags&RENAME_EXCHANGE != 0 {
+			o.whiteout.SwapUnder(r.oldpath, r.newpath)
+		} else {
+			o.whiteout.MoveUnder(r.oldpath, r.newpath)
 		}
-		o.whiteout.Insert(oldpath)
 	}
+	if r.hide {
+		o.whiteout.Insert(r.oldpath)
+	}
+	return nil
+}
 
+// checkRenameTarget checks that oldpath may be renamed to newpath in the
+// merged view
+func (o *OverlayFS) checkRenameTarget(ctx context.Context, oldpath, newpath string, flags uint32) error {
+	mode, err := o.typeOf(ctx, filepath.Dir(newpath))
+	if err != nil {
+		return err
+	}
+	if mode != S_IFDIR {
+		return ErrNotDir
+	}
+
+	target, err := o.lstat(ctx, newpath)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if flags&RENAME_NOREPLACE != 0 {
+		return ErrExists
+	}
+
+	source, err := o.lstat(ctx, oldpath)
+	if err != nil {
+		return err
+	}
+	switch {
+	case source.IsDir() && !target.IsDir():
+		return ErrNotDir
+	case !source.IsDir() && target.IsDir():
+		return ErrIsDir
+	case target.IsDir():
+		entries, err := o.Readdir(ctx, newpath)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return ErrNotEmpty
+		}
+	}
 	return nil
 }
 
+// exchange atomically swaps oldpath and newpath. Entries only in the base
+// are copied up first; both names stay occupied in the delta afterwards,
+// so no whiteouts are created. Directories keep showing the base entries
+// they showed before, along with the whiteouts below them. The caller
+// holds o.mu.
+func (o *OverlayFS) exchange(ctx context.Context, oldpath, newpath string) error {
+	paths := [2]string{oldpath, newpath}
+	var metas [2]dirMeta
+	var isDir [2]bool
+	for i, path := range paths {
+		stats, err := o.lstat(ctx, path)
+		if err != nil {
+			return err
+		}
+		if stats.IsDir() {
+			isDir[i] = true
+			metas[i] = o.movedDirMeta(ctx, path)
+		}
+	}
+
+	for _, path := range paths {
+		if !o.existsInDelta(ctx, path) {
+			if err := o.copyUpLocked(ctx, path, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	r := &mergedRename{
+		oldpath: oldpath,
+		newpath: newpath,
+		flags:   RENAME_EXCHANGE,
+	}
+	for i, path := range paths {
+		if isDir[i] {
+			d, err := o.placeDir(ctx, path, paths[1-i], metas[i])
+			if err != nil {
+				return err
+			}
+			r.dirs = append(r.dirs, d)
+		}
+	}
+	r.whiteouts = o.whiteout.HasWhiteoutUnder(oldpath) || o.whiteout.HasWhiteoutUnder(newpath)
+	return o.renameMerged(ctx, r)
+}
+
 // Chmod implements FileSystem.Chmod
 func (o *OverlayFS) Chmod(ctx context.Context, path string, mode uint32) error {
+	path, err := o.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer o.contentChanged(ctx, path)
+
 	if o.whiteout.HasWhiteoutAncestor(path) {
 		return ErrNotFound
 	}
@@ -564,7 +926,7 @@ func (o *OverlayFS) Chmod(ctx context.Context, path string, mode uint32) error {
 		if !o.existsInBase(ctx, path) {
 			return ErrNotFound
 		}
-		if err := o.copyOnWrite(ctx, path); err != nil {
+		if err := o.copyMetadata(ctx, path); err != nil {
 			return err
 		}
 	}
@@ -574,6 +936,12 @@ func (o *OverlayFS) Chmod(ctx context.Context, path string, mode uint32) error {
 
 // Chown implements FileSystem.Chown
 func (o *OverlayFS) Chown(ctx context.Context, path string, uid, gid uint32) error {
+	path, err := o.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer o.contentChanged(ctx, path)
+
 	if o.whiteout.HasWhiteoutAncestor(path) {
 		return ErrNotFound
 	}
@@ -582,7 +950,7 @@ func (o *OverlayFS) Chown(ctx context.Context, path string, uid, gid uint32) err
 		if !o.existsInBase(ctx, path) {
 			return ErrNotFound
 		}
-		if err := o.copyOnWrite(ctx, path); err != nil {
+		if err := o.copyMetadata(ctx, path); err != nil {
 			return err
 		}
 	}
@@ -592,6 +960,12 @@ func (o *OverlayFS) Chown(ctx context.Context, path string, uid, gid uint32) err
 
 // Truncate implements FileSystem.Truncate
 func (o *OverlayFS) Truncate(ctx context.Context, path string, size int64) error {
+	path, err := o.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer o.contentChanged(ctx, path)
+
 	if o.whiteout.HasWhiteoutAncestor(path) {
 		return ErrNotFound
 	}
@@ -610,6 +984,12 @@ func (o *OverlayFS) Truncate(ctx context.Context, path string, size int64) error
 
 // Utimens implements FileSystem.Utimens
 func (o *OverlayFS) Utimens(ctx context.Context, path string, atime, mtime *int64) error {
+	path, err := o.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer o.contentChanged(ctx, path)
+
 	if o.whiteout.HasWhiteoutAncestor(path) {
 		return ErrNotFound
 	}
@@ -618,7 +998,7 @@ func (o *OverlayFS) Utimens(ctx context.Context, path string, atime, mtime *int6
 		if !o.existsInBase(ctx, path) {
 			return ErrNotFound
 		}
-		if err := o.copyOnWrite(ctx, path); err != nil {
+		if err := o.copyMetadata(ctx, path); err != nil {
 			return err
 		}
 	}
@@ -628,6 +1008,12 @@ func (o *OverlayFS) Utimens(ctx context.Context, path string, atime, mtime *int6
 
 // Symlink implements FileSystem.Symlink
 func (o *OverlayFS) Symlink(ctx context.Context, target, linkpath string) error {
+	linkpath, err := o.resolvePath(ctx, linkpath)
+	if err != nil {
+		return err
+	}
+	defer o.entryChanged(ctx, linkpath)
+
 	// Check ancestors
 	parts := splitPath(linkpath)
 	if len(parts) > 1 {
@@ -639,7 +1025,7 @@ func (o *OverlayFS) Symlink(ctx context.Context, target, linkpath string) error
 
 	// Remove whiteout if recreating
 	if o.whiteout.HasExactWhiteout(linkpath) {
-		if err := o.delta.Store().DeleteWhiteout(ctx, linkpath); err != nil {
+		if err := o.delta.deleteWhiteout(ctx, linkpath); err != nil {
 			return err
 		}
 		o.whiteout.Remove(linkpath)
@@ -654,6 +1040,17 @@ func (o *OverlayFS) Symlink(ctx context.Context, target, linkpath string) error
 
 // Link implements FileSystem.Link
 func (o *OverlayFS) Link(ctx context.Context, oldpath, newpath string) error {
+	oldpath, err := o.resolvePath(ctx, oldpath)
+	if err != nil {
+		return err
+	}
+	newpath, err = o.resolvePath(ctx, newpath)
+	if err != nil {
+		return err
+	}
+	defer o.contentChanged(ctx, oldpath)
+	defer o.entryChanged(ctx, newpath)
+
 	if o.whiteout.HasWhiteoutAncestor(oldpath) {
 		return ErrNotFound
 	}
@@ -670,7 +1067,7 @@ func (o *OverlayFS) Link(ctx context.Context, oldpath, newpath string) error {
 
 	// Remove whiteout at destination
 	if o.whiteout.HasExactWhiteout(newpath) {
-		if err := o.delta.Store().DeleteWhiteout(ctx, newpath); err != nil {
+		if err := o.delta.deleteWhiteout(ctx, newpath); err != nil {
 			return err
 		}
 		o.whiteout.Remove(newpath)
@@ -685,19 +1082,131 @@ func (o *OverlayFS) Link(ctx context.Context, oldpath, newpath string) error {
 
 // Access implements FileSystem.Access
 func (o *OverlayFS) Access(ctx context.Context, path string, mode uint32) error {
+	path, err := walkSymlinks(ctx, o, path, o.mountPoint, true)
+	if err != nil {
+		return err
+	}
+
+	stats, err := o.lstat(ctx, path)
+	if err != nil {
+		return err
+	}
+	return CheckAccess(ctx, stats, mode)
+}
+
+// Getxattr implements FileSystem.Getxattr
+func (o *OverlayFS) Getxattr(ctx context.Context, path, name string) ([]byte, error) {
+	path, err := o.resolvePath(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if isPrivateXattr(name) {
+		return nil, ErrNoAttr
+	}
+
 	if o.whiteout.HasWhiteoutAncestor(path) {
-		return ErrNotFound
+		return nil, ErrNotFound
 	}
 
-	if err := o.delta.Access(ctx, path, mode); err == nil {
-		return nil
+	if o.existsInDelta(ctx, path) {
+		return o.delta.Getxattr(ctx, path, name)
 	}
 
-	basePath := o.toBasePath(path)
+	basePath := o.basePath(ctx, path)
 	if basePath == "" {
+		return nil, ErrNotFound
+	}
+	return o.base.Getxattr(ctx, basePath, name)
+}
+
+// Setxattr implements FileSystem.Setxattr
+func (o *OverlayFS) Setxattr(ctx context.Context, path, name string, value []byte, flags int) error {
+	path, err := o.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	if isPrivateXattr(name) {
+		return ErrNoPerm
+	}
+
+	if o.whiteout.HasWhiteoutAncestor(path) {
+		return ErrNotFound
+	}
+
+	if !o.existsInDelta(ctx, path) {
+		if !o.existsInBase(ctx, path) {
+			return ErrNotFound
+		}
+		if err := o.copyMetadata(ctx, path); err != nil {
+			return err
+		}
+	}
+
+	return o.delta.Setxattr(ctx, path, name, value, flags)
+}
+
+// Listxattr implements FileSystem.Listxattr
+func (o *OverlayFS) Listxattr(ctx context.Context, path string) ([]string, error) {
+	path, err := o.resolvePath(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.whiteout.HasWhiteoutAncestor(path) {
+		return nil, ErrNotFound
+	}
+
+	var names []string
+	if o.existsInDelta(ctx, path) {
+		names, err = o.delta.Listxattr(ctx, path)
+	} else {
+		basePath := o.basePath(ctx, path)
+		if basePath == "" {
+			return nil, ErrNotFound
+		}
+		names, err = o.base.Listxattr(ctx, basePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The overlay's own attributes aren't part of the merged view
+	visible := names[:0]
+	for _, name := range names {
+		if !isPrivateXattr(name) {
+			visible = append(visible, name)
+		}
+	}
+	return visible, nil
+}
+
+// Removexattr implements FileSystem.Removexattr
+func (o *OverlayFS) Removexattr(ctx context.Context, path, name string) error {
+	path, err := o.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	if isPrivateXattr(name) {
+		return ErrNoPerm
+	}
+
+	if o.whiteout.HasWhiteoutAncestor(path) {
 		return ErrNotFound
 	}
-	return o.base.Access(ctx, basePath, mode)
+
+	if !o.existsInDelta(ctx, path) {
+		if !o.existsInBase(ctx, path) {
+			return ErrNotFound
+		}
+		if err := o.copyMetadata(ctx, path); err != nil {
+			return err
+		}
+	}
+
+	return o.delta.Removexattr(ctx, path, name)
 }
 
 // Ensure OverlayFS implements FileSystem
@@ -726,6 +1235,8 @@ func (f *OverlayFile) Read(ctx context.Context, dest []byte, offset int64) (int,
 
 // Write implements File.Write with copy-on-write
 func (f *OverlayFile) Write(ctx context.Context, data []byte, offset int64) (int, error) {
+	defer f.overlay.contentChanged(ctx, f.path)
+
 	// Ensure file is in delta
 	if f.delta == nil {
 		if err := f.ensureDelta(ctx); err != nil {
@@ -778,6 +1289,14 @@ func (f *OverlayFile) Sync(ctx context.Context) error {
 	return nil
 }
 
+// Flush implements Flusher, for a delta that buffers writes
+func (f *OverlayFile) Flush(ctx context.Context) error {
+	if flusher, ok := f.delta.(Flusher); ok {
+		return flusher.Flush(ctx)
+	}
+	return nil
+}
+
 // Close implements File.Close
 func (f *OverlayFile) Close() error {
 	var err error
@@ -809,6 +1328,8 @@ func (f *OverlayFile) Stat(ctx context.Context) (*Stats, error) {
 
 // Truncate implements File.Truncate
 func (f *OverlayFile) Truncate(ctx context.Context, size int64) error {
+	defer f.overlay.contentChanged(ctx, f.path)
+
 	// Ensure in delta
 	if f.delta == nil {
 		if err := f.ensureDelta(ctx); err != nil {
@@ -0,0 +1,138 @@
+package overlay
+
+import (
+	"context"
+	"path/filepath"
+)
+
+// Access modes (matching access(2))
+const (
+	F_OK = 0 // Existence only
+	X_OK = 1 // Execute or search
+	W_OK = 2 // Write
+	R_OK = 4 // Read
+)
+
+// S_ISVTX is the sticky bit: in a directory with it set, entries can only
+// be removed or renamed by their owner, the directory's owner or root
+const S_ISVTX = 0o1000
+
+// Caller identifies the user a request is made on behalf of
+type Caller struct {
+	Uid uint32
+	Gid uint32
+}
+
+// callerKey is the context key for the Caller
+type callerKey struct{}
+
+// WithCaller returns a context carrying the caller of a request.
+// Permission checks only apply to requests with a caller, and new files
+// are owned by the caller instead of root.
+func WithCaller(ctx context.Context, c Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, c)
+}
+
+// CallerFromContext returns the caller carried by ctx, if any
+func CallerFromContext(ctx context.Context) (Caller, bool) {
+	c, ok := ctx.Value(callerKey{}).(Caller)
+	return c, ok
+}
+
+// owner returns the uid and gid for inodes created by a request
+func owner(ctx context.Context) (uid, gid uint32) {
+	if c, ok := CallerFromContext(ctx); ok {
+		return c.Uid, c.Gid
+	}
+	return 0, 0
+}
+
+// CheckAccess checks the permission bits in stats against the caller of
+// a request, for a mask of R_OK, W_OK and X_OK. Supplementary groups are
+// not taken into account. Root may do anything except execute files that
+// have no execute bit set. Requests without a caller are always allowed.
+func CheckAccess(ctx context.Context, stats *Stats, mask uint32) error {
+	c, ok := CallerFromContext(ctx)
+	if !ok || mask == F_OK {
+		return nil
+	}
+
+	if c.Uid == 0 {
+		if mask&X_OK != 0 && !stats.IsDir() && stats.Mode&0o111 == 0 {
+			return ErrNoAccess
+		}
+		return nil
+	}
+
+	perm := stats.Mode & 0o7
+	switch {
+	case c.Uid == stats.Uid:
+		perm = stats.Mode >> 6 & 0o7
+	case c.Gid == stats.Gid:
+		perm = stats.Mode >> 3 & 0o7
+	}
+	if perm&mask != mask {
+		return ErrNoAccess
+	}
+	return nil
+}
+
+// CheckPath checks that the caller of a request has the access in mask
+// to path in fsys, following a symlink in the last component
+func CheckPath(ctx context.Context, fsys FileSystem, path string, mask uint32) error {
+	if _, ok := CallerFromContext(ctx); !ok {
+		return nil
+	}
+	stats, err := fsys.Stat(ctx, path)
+	if err != nil {
+		return err
+	}
+	return CheckAccess(ctx, stats, mask)
+}
+
+// CheckRemove checks that the caller of a request may remove or rename
+// away path in fsys: it needs write and search permission on the parent
+// directory and, if that is sticky, must own the parent or the entry
+func CheckRemove(ctx context.Context, fsys FileSystem, path string) error {
+	c, ok := CallerFromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	dir, err := fsys.Stat(ctx, filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if err := CheckAccess(ctx, dir, W_OK|X_OK); err != nil {
+		return err
+	}
+	if dir.Mode&S_ISVTX == 0 || c.Uid == 0 || c.Uid == dir.Uid {
+		return nil
+	}
+
+	stats, err := fsys.Lstat(ctx, path)
+	if err != nil {
+		return err
+	}
+	if c.Uid != stats.Uid {
+		return ErrNoAccess
+	}
+	return nil
+}
+
+// OpenMask returns the access mode needed to open a file with flags
+func OpenMask(flags int) uint32 {
+	var mask uint32
+	switch flags & (O_RDONLY | O_WRONLY | O_RDWR) {
+	case O_RDONLY:
+		mask = R_OK
+	case O_WRONLY:
+		mask = W_OK
+	case O_RDWR:
+		mask = R_OK | W_OK
+	}
+	if flags&O_TRUNC != 0 {
+		mask |= W_OK
+	}
+	return mask
+}
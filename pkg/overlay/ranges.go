@@ -0,0 +1,308 @@
+package overlay
+
+import (
+	"context"
+	"io"
+)
+
+// Allocator is implemented by files that support fallocate
+type Allocator interface {
+	// Allocate allocates, zeroes or punches out size bytes at off, as
+	// fallocate does for mode
+	Allocate(ctx context.Context, off, size int64, mode uint32) error
+}
+
+// HoleSeeker is implemented by files that know where their holes are
+type HoleSeeker interface {
+	// SeekHole returns the first offset from off on that holds data
+	// (SEEK_DATA) or lies in a hole (SEEK_HOLE). The end of the file
+	// counts as a hole; with no data after off, it fails with ErrPastEnd.
+	SeekHole(ctx context.Context, off int64, whence int) (int64, error)
+}
+
+// RangeCopier is implemented by files that can copy from another file
+// without the data passing through the caller
+type RangeCopier interface {
+	// CopyRange copies length bytes at srcOff in src to dstOff, up to the
+	// end of src, and returns how many were copied. It fails with
+	// ErrNoSupport if it can't copy from src.
+	CopyRange(ctx context.Context, src File, srcOff, dstOff, length int64) (int64, error)
+}
+
+// copyBufSize is the block size of copies through Read and Write
+const copyBufSize = 128 << 10
+
+// Allocate runs fallocate on a file. For files that don't implement
+// Allocator or the mode, it grows the file with Truncate and zeroes
+// ranges with Write.
+func Allocate(ctx context.Context, f File, off, size int64, mode uint32) error {
+	if off < 0 || size <= 0 {
+		return ErrInvalid
+	}
+	if a, ok := f.(Allocator); ok {
+		if err := a.Allocate(ctx, off, size, mode); err != ErrNoSupport {
+			return err
+		}
+	}
+
+	stats, err := f.Stat(ctx)
+	if err != nil {
+		return err
+	}
+	end := off + size
+	switch mode &^ FALLOC_FL_KEEP_SIZE {
+	case 0:
+		// There is nothing to reserve space in ahead of writes
+		if mode&FALLOC_FL_KEEP_SIZE == 0 && end > stats.Size {
+			return f.Truncate(ctx, end)
+		}
+		return nil
+	case FALLOC_FL_PUNCH_HOLE:
+		if mode&FALLOC_FL_KEEP_SIZE == 0 {
+			return ErrInvalid
+		}
+		return writeZeros(ctx, f, off, min(end, stats.Size))
+	case FALLOC_FL_ZERO_RANGE:
+		if mode&FALLOC_FL_KEEP_SIZE != 0 {
+			end = min(end, stats.Size)
+		}
+		return writeZeros(ctx, f, off, end)
+	default:
+		return ErrNoSupport
+	}
+}
+
+// writeZeros writes zeros from off up to end
+func writeZeros(ctx context.Context, f File, off, end int64) error {
+	zeros := make([]byte, min(max(end-off, 0), copyBufSize))
+	for off < end {
+		n, err := f.Write(ctx, zeros[:min(int64(len(zeros)), end-off)], off)
+		if err != nil {
+			return err
+		}
+		off += int64(n)
+	}
+	return nil
+}
+
+// SeekHole finds data or holes in a file. Files that don't implement
+// HoleSeeker are taken to have data up to their end.
+func SeekHole(ctx context.Context, f File, off int64, whence int) (int64, error) {
+	if whence != SEEK_DATA && whence != SEEK_HOLE {
+		return 0, ErrInvalid
+	}
+	if s, ok := f.(HoleSeeker); ok {
+		if pos, err := s.SeekHole(ctx, off, whence); err != ErrNoSupport {
+			return pos, err
+		}
+	}
+
+	stats, err := f.Stat(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if off < 0 || off >= stats.Size {
+		return 0, ErrPastEnd
+	}
+	if whence == SEEK_DATA {
+		return off, nil
+	}
+	return stats.Size, nil
+}
+
+// CopyRange copies length bytes at srcOff in src to dstOff in dst, up to
+// the end of src, and returns how many were copied. Unless dst implements
+// RangeCopier for src, the data is read and written in blocks.
+func CopyRange(ctx context.Context, dst, src File, srcOff, dstOff, length int64) (int64, error) {
+	if c, ok := dst.(RangeCopier); ok {
+		if n, err := c.CopyRange(ctx, src, srcOff, dstOff, length); err != ErrNoSupport {
+			return n, err
+		}
+	}
+
+	buf := make([]byte, min(max(length, 0), copyBufSize))
+	var copied int64
+	for copied < length {
+		n, err := src.Read(ctx, buf[:min(int64(len(buf)), length-copied)], srcOff+copied)
+		if n > 0 {
+			w, werr := dst.Write(ctx, buf[:n], dstOff+copied)
+			copied += int64(w)
+			if werr != nil {
+				return copied, werr
+			}
+		}
+		if err == io.EOF || n == 0 {
+			break
+		}
+		if err != nil {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
+
+// SeekHole implements HoleSeeker with the holes of the host file
+func (f *OSFile) SeekHole(ctx context.Context, off int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Reads and writes take offsets, so moving the position is harmless
+	return f.f.Seek(off, whence)
+}
+
+// Allocate implements Allocator, growing the file or punching holes
+func (f *AgentFile) Allocate(ctx context.Context, off, size int64, mode uint32) error {
+	if err := f.Flush(ctx); err != nil {
+		return err
+	}
+	lower, err := f.lowerOf(ctx)
+	if err != nil {
+		return err
+	}
+	if lower != nil {
+		// Missing chunks of partially copied-up files are read from the
+		// base, so they can't stand for holes
+		return ErrNoSupport
+	}
+
+	inode, err := f.store.GetInode(ctx, f.ino)
+	if err != nil {
+		return err
+	}
+	end := uint64(off + size)
+	switch mode &^ FALLOC_FL_KEEP_SIZE {
+	case 0:
+	case FALLOC_FL_PUNCH_HOLE:
+		if mode&FALLOC_FL_KEEP_SIZE == 0 {
+			return ErrInvalid
+		}
+		return f.store.PunchHole(ctx, f.ino, off, size)
+	case FALLOC_FL_ZERO_RANGE:
+		if err := f.store.PunchHole(ctx, f.ino, off, size); err != nil {
+			return err
+		}
+	default:
+		return ErrNoSupport
+	}
+	if mode&FALLOC_FL_KEEP_SIZE != 0 || end <= inode.Size {
+		return nil
+	}
+	// Growing the file leaves a hole, which reads as zeros
+	return f.store.UpdateSize(ctx, f.ino, end)
+}
+
+// SeekHole implements HoleSeeker, with chunks that were never written as
+// holes
+func (f *AgentFile) SeekHole(ctx context.Context, off int64, whence int) (int64, error) {
+	if err := f.Flush(ctx); err != nil {
+		return 0, err
+	}
+	lower, err := f.lowerOf(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if lower != nil {
+		return 0, ErrNoSupport
+	}
+
+	inode, err := f.store.GetInode(ctx, f.ino)
+	if err != nil {
+		return 0, err
+	}
+	size := int64(inode.Size)
+	if off < 0 || off >= size {
+		return 0, ErrPastEnd
+	}
+	indexes, err := f.store.ListChunkIndexes(ctx, f.ino)
+	if err != nil {
+		return 0, err
+	}
+	stored := make(map[int64]bool, len(indexes))
+	for _, idx := range indexes {
+		stored[idx] = true
+	}
+
+	chunkSize := f.store.ChunkSize()
+	idx := off / chunkSize
+	if whence == SEEK_DATA {
+		for ; idx*chunkSize < size; idx++ {
+			if stored[idx] {
+				return max(off, idx*chunkSize), nil
+			}
+		}
+		return 0, ErrPastEnd
+	}
+	for ; idx*chunkSize < size; idx++ {
+		if !stored[idx] {
+			return max(off, idx*chunkSize), nil
+		}
+	}
+	return size, nil
+}
+
+// CopyRange implements RangeCopier for files of the same store, sharing
+// whole chunks between them
+func (f *AgentFile) CopyRange(ctx context.Context, src File, srcOff, dstOff, length int64) (int64, error) {
+	srcFile, ok := src.(*AgentFile)
+	chunkSize := f.store.ChunkSize()
+	if !ok || srcFile.store != f.store || srcOff%chunkSize != dstOff%chunkSize {
+		return 0, ErrNoSupport
+	}
+	for _, file := range []*AgentFile{srcFile, f} {
+		if err := file.Flush(ctx); err != nil {
+			return 0, err
+		}
+		lower, err := file.lowerOf(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if lower != nil {
+			return 0, ErrNoSupport
+		}
+	}
+	return f.store.CopyRange(ctx, srcFile.ino, srcOff, f.ino, dstOff, length)
+}
+
+// Allocate implements Allocator, copying the file up unless only space is
+// reserved
+func (f *OverlayFile) Allocate(ctx context.Context, off, size int64, mode uint32) error {
+	if f.delta == nil {
+		if mode == FALLOC_FL_KEEP_SIZE {
+			return nil
+		}
+		if err := f.ensureDelta(ctx); err != nil {
+			return err
+		}
+	}
+	defer f.overlay.contentChanged(ctx, f.path)
+	return Allocate(ctx, f.delta, off, size, mode)
+}
+
+// SeekHole implements HoleSeeker with the holes of the layer the file is in
+func (f *OverlayFile) SeekHole(ctx context.Context, off int64, whence int) (int64, error) {
+	if f.delta != nil {
+		return SeekHole(ctx, f.delta, off, whence)
+	}
+	if f.base != nil {
+		return SeekHole(ctx, f.base, off, whence)
+	}
+	return 0, ErrNotFound
+}
+
+// CopyRange implements RangeCopier, copying the file up first. Copies
+// between files of the delta share their chunks.
+func (f *OverlayFile) CopyRange(ctx context.Context, src File, srcOff, dstOff, length int64) (int64, error) {
+	if f.delta == nil {
+		if err := f.ensureDelta(ctx); err != nil {
+			return 0, err
+		}
+	}
+	if of, ok := src.(*OverlayFile); ok {
+		if of.delta != nil {
+			src = of.delta
+		} else {
+			src = of.base
+		}
+	}
+	defer f.overlay.contentChanged(ctx, f.path)
+	return CopyRange(ctx, f.delta, src, srcOff, dstOff, length)
+}
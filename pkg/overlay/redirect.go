@@ -0,0 +1,192 @@
+package overlay
+
+import (
+	"context"
+	"strings"
+)
+
+// Extended attributes the overlay keeps on delta directories, in the
+// namespace Linux overlayfs uses for the same purpose. They are hidden from
+// the merged view and never copied up from the base.
+const (
+	XattrOpaque   = "trusted.overlay.opaque"   // "y": the base has no entries below this directory
+	XattrRedirect = "trusted.overlay.redirect" // Overlay path whose base entries this directory shows
+)
+
+// xattrPrivatePrefix is the namespace of the overlay's own xattrs
+const xattrPrivatePrefix = "trusted.overlay."
+
+// isPrivateXattr checks if an xattr name belongs to the overlay itself
+func isPrivateXattr(name string) bool {
+	return strings.HasPrefix(name, xattrPrivatePrefix)
+}
+
+// dirMeta is how a delta directory merges with the base. A directory that
+// was renamed shows the base entries of its old path (redirect), so moving
+// it doesn't copy up its contents; one that was created where the base has
+// a deleted directory, or moved without base contents, hides the base
+// entries of its path (opaque).
+type dirMeta struct {
+	redirect string
+	opaque   bool
+}
+
+// dirMetaOf returns the merge state of a delta inode
+func (o *OverlayFS) dirMetaOf(ctx context.Context, ino uint64) (dirMeta, error) {
+	if meta, ok := o.meta.Get(ino); ok {
+		return meta, nil
+	}
+
+	var meta dirMeta
+	value, err := o.delta.inoXattr(ctx, ino, XattrRedirect)
+	switch err {
+	case nil:
+		meta.redirect = string(value)
+	case ErrNoAttr:
+	default:
+		return meta, err
+	}
+	value, err = o.delta.inoXattr(ctx, ino, XattrOpaque)
+	switch err {
+	case nil:
+		meta.opaque = string(value) == "y"
+	case ErrNoAttr:
+	default:
+		return meta, err
+	}
+
+	// Inode numbers are never reused, and only setDirMeta and renames change
+	// these
+	o.meta.Add(ino, meta)
+	return meta, nil
+}
+
+// setDirMeta records the merge state of the delta directory at path
+func (o *OverlayFS) setDirMeta(ctx context.Context, path string, meta dirMeta) error {
+	ino, err := o.delta.GetIno(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	if meta.redirect != "" {
+		err = o.delta.setInoXattr(ctx, ino, XattrRedirect, []byte(meta.redirect))
+	} else {
+		err = o.delta.removeInoXattr(ctx, ino, XattrRedirect)
+	}
+	if err != nil && err != ErrNoAttr {
+		return err
+	}
+	if meta.opaque {
+		err = o.delta.setInoXattr(ctx, ino, XattrOpaque, []byte("y"))
+	} else {
+		err = o.delta.removeInoXattr(ctx, ino, XattrOpaque)
+	}
+	if err != nil && err != ErrNoAttr {
+		return err
+	}
+
+	o.meta.Add(ino, meta)
+	return nil
+}
+
+// lowerPath returns the overlay path whose base entry shows at path, once
+// redirects of delta directories on the way are followed. It returns false
+// if an opaque directory hides the base there. With self set, the path's
+// own redirect and opacity apply too, as for the entries of a directory.
+func (o *OverlayFS) lowerPath(ctx context.Context, path string, self bool) (string, bool) {
+	parts := splitPath(path)
+	lower := make([]string, 0, len(parts))
+	hidden := false
+
+	ino := uint64(1)
+	inDelta := true
+	for i, part := range parts {
+		if !hidden {
+			lower = append(lower, part)
+		}
+		if !inDelta || (i == len(parts)-1 && !self) {
+			continue
+		}
+
+		child, err := o.delta.lookupChild(ctx, ino, part)
+		if err != nil {
+			// Nothing below is in the delta, so nothing is redirected
+			inDelta = false
+			continue
+		}
+		ino = child
+
+		meta, err := o.dirMetaOf(ctx, ino)
+		if err != nil {
+			return "", false
+		}
+		if meta.redirect != "" {
+			lower = append(lower[:0], splitPath(meta.redirect)...)
+			hidden = false
+		}
+		if meta.opaque {
+			hidden = true
+		}
+	}
+
+	if hidden {
+		return "", false
+	}
+	return joinPath(lower), true
+}
+
+// basePath returns the base path whose entry shows at an overlay path, or
+// "" if none can
+func (o *OverlayFS) basePath(ctx context.Context, path string) string {
+	lower, ok := o.lowerPath(ctx, path, false)
+	if !ok {
+		return ""
+	}
+	return o.toBasePath(lower)
+}
+
+// dirBasePath returns the base path whose entries show in the directory at
+// an overlay path, or "" if none can
+func (o *OverlayFS) dirBasePath(ctx context.Context, path string) string {
+	lower, ok := o.lowerPath(ctx, path, true)
+	if !ok {
+		return ""
+	}
+	return o.toBasePath(lower)
+}
+
+// movedDirMeta returns the merge state for a directory moving away from
+// path: it keeps showing the base entries it shows there, or none at all
+func (o *OverlayFS) movedDirMeta(ctx context.Context, path string) dirMeta {
+	lower, ok := o.lowerPath(ctx, path, true)
+	if !ok {
+		return dirMeta{opaque: true}
+	}
+	if basePath := o.toBasePath(lower); basePath != "" {
+		if stats, err := o.base.Lstat(ctx, basePath); err == nil && stats.IsDir() {
+			return dirMeta{redirect: lower}
+		}
+	}
+	return dirMeta{opaque: true}
+}
+
+// movedDir is the merge state a delta directory takes on when it is renamed
+type movedDir struct {
+	ino  uint64
+	meta dirMeta
+}
+
+// placeDir returns the merge state for the directory at from once it is
+// moved to path. A redirect to the path's own lower path is dropped.
+func (o *OverlayFS) placeDir(ctx context.Context, from, path string, meta dirMeta) (movedDir, error) {
+	ino, err := o.delta.GetIno(ctx, from)
+	if err != nil {
+		return movedDir{}, err
+	}
+	if meta.redirect != "" {
+		if lower, ok := o.lowerPath(ctx, path, false); ok && lower == meta.redirect {
+			meta.redirect = ""
+		}
+	}
+	return movedDir{ino: ino, meta: meta}, nil
+}
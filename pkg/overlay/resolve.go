@@ -0,0 +1,104 @@
+package overlay
+
+import (
+	"context"
+	"strings"
+)
+
+// maxSymlinks is the number of symlinks a single path resolution may
+// follow before failing with ErrLoop (Linux uses the same limit)
+const maxSymlinks = 40
+
+// linkResolver is a layer that walkSymlinks can walk. Both methods are
+// only called with paths that contain no symlinks before the last
+// component.
+type linkResolver interface {
+	typeOf(ctx context.Context, path string) (uint32, error)
+	readlink(ctx context.Context, path string) (string, error)
+}
+
+// walkSymlinks returns the path that path refers to once symlinks in its
+// components are followed, the last one only if followLast is set.
+// Relative targets are resolved against the link's directory, with ".."
+// taken physically. Absolute targets are interpreted as seen by processes
+// that have the filesystem mounted at mountPoint ("" or "/" for the
+// root); targets outside the mount point don't exist.
+func walkSymlinks(ctx context.Context, r linkResolver, path, mountPoint string, followLast bool) (string, error) {
+	pending := splitPath(path)
+	resolved := make([]string, 0, len(pending))
+	links := 0
+
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+
+		resolved = append(resolved, part)
+		if len(pending) == 0 && !followLast {
+			break
+		}
+
+		current := joinPath(resolved)
+		mode, err := r.typeOf(ctx, current)
+		if err != nil {
+			return "", err
+		}
+
+		if mode != S_IFLNK {
+			if len(pending) > 0 && mode != S_IFDIR {
+				return "", ErrNotDir
+			}
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", ErrLoop
+		}
+		target, err := r.readlink(ctx, current)
+		if err != nil {
+			return "", err
+		}
+		if target == "" {
+			return "", ErrNotFound
+		}
+
+		resolved = resolved[:len(resolved)-1]
+		if strings.HasPrefix(target, "/") {
+			rel, ok := underMountPoint(target, mountPoint)
+			if !ok {
+				return "", ErrNotFound
+			}
+			resolved = resolved[:0]
+			target = rel
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+
+	return joinPath(resolved), nil
+}
+
+// underMountPoint returns the part of an absolute symlink target below
+// mountPoint, or false if the target points outside of it
+func underMountPoint(target, mountPoint string) (string, bool) {
+	mountPoint = strings.TrimSuffix(mountPoint, "/")
+	if mountPoint == "" {
+		return target, true
+	}
+	if target == mountPoint {
+		return "/", true
+	}
+	if rel, ok := strings.CutPrefix(target, mountPoint+"/"); ok {
+		return "/" + rel, true
+	}
+	return "", false
+}
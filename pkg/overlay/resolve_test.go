@@ -0,0 +1,98 @@
+package overlay
+
+import (
+	"context"
+	"testing"
+)
+
+// fakeLinks is a linkResolver over a fixed tree: paths map to symlink
+// targets, or to "" for directories and "-" for regular files
+type fakeLinks map[string]string
+
+func (f fakeLinks) typeOf(ctx context.Context, path string) (uint32, error) {
+	entry, ok := f[path]
+	switch {
+	case path == "/":
+		return S_IFDIR, nil
+	case !ok:
+		return 0, ErrNotFound
+	case entry == "":
+		return S_IFDIR, nil
+	case entry == "-":
+		return S_IFREG, nil
+	}
+	return S_IFLNK, nil
+}
+
+func (f fakeLinks) readlink(ctx context.Context, path string) (string, error) {
+	entry, ok := f[path]
+	if !ok || entry == "" || entry == "-" {
+		return "", ErrInvalid
+	}
+	if entry == "<empty>" {
+		return "", nil
+	}
+	return entry, nil
+}
+
+func TestWalkSymlinks(t *testing.T) {
+	tree := fakeLinks{
+		"/dir":        "",
+		"/dir/file":   "-",
+		"/dir/rel":    "file",
+		"/dir/chain":  "rel",
+		"/dir/up":     "../other",
+		"/dir/toroot": "../../../other",
+		"/other":      "",
+		"/other/f":    "-",
+		"/abs":        "/home/agent/dir",
+		"/top":        "/home/agent",
+		"/outside":    "/etc",
+		"/filelink":   "dir/file",
+		"/loop1":      "loop2",
+		"/loop2":      "loop1",
+		"/dangling":   "missing",
+		"/empty":      "<empty>",
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		mountPoint string
+		followLast bool
+		want       string
+		wantErr    error
+	}{
+		{"plain file", "/dir/file", "", true, "/dir/file", nil},
+		{"root", "/", "", true, "/", nil},
+		{"relative link", "/dir/rel", "", true, "/dir/file", nil},
+		{"last link not followed", "/dir/rel", "", false, "/dir/rel", nil},
+		{"link to link", "/dir/chain", "", true, "/dir/file", nil},
+		{"dotdot in target", "/dir/up/f", "", true, "/other/f", nil},
+		{"dotdot stops at root", "/dir/toroot/f", "", true, "/other/f", nil},
+		{"absolute under mount point", "/abs/file", "/home/agent", true, "/dir/file", nil},
+		{"mount point with trailing slash", "/abs/file", "/home/agent/", true, "/dir/file", nil},
+		{"absolute to mount point itself", "/top", "/home/agent", true, "/", nil},
+		{"absolute without mount point", "/abs/file", "", true, "", ErrNotFound},
+		{"absolute outside mount point", "/outside", "/home/agent", true, "", ErrNotFound},
+		{"outside not followed last", "/outside", "/home/agent", false, "/outside", nil},
+		{"file as directory", "/dir/file/x", "", true, "", ErrNotDir},
+		{"link to file as directory", "/filelink/x", "", true, "", ErrNotDir},
+		{"loop", "/loop1", "", true, "", ErrLoop},
+		{"loop not followed last", "/loop1", "", false, "/loop1", nil},
+		{"loop in the middle", "/loop1/x", "", false, "", ErrLoop},
+		{"dangling", "/dangling", "", true, "", ErrNotFound},
+		{"dangling not followed last", "/dangling", "", false, "/dangling", nil},
+		{"empty target", "/empty", "", true, "", ErrNotFound},
+		{"missing component", "/nope/x", "", true, "", ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := walkSymlinks(context.Background(), tree, tt.path, tt.mountPoint, tt.followLast)
+			if err != tt.wantErr || got != tt.want {
+				t.Errorf("walkSymlinks(%q, %q, %v) = %q, %v; want %q, %v",
+					tt.path, tt.mountPoint, tt.followLast, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
@@ -11,6 +11,7 @@ func fillUnixStats(stats *Stats, sys interface{}) {
 		stats.Nlink = uint32(stat.Nlink)
 		stats.Uid = stat.Uid
 		stats.Gid = stat.Gid
+		stats.Rdev = uint32(stat.Rdev)
 		stats.Atime = stat.Atim.Sec
 		stats.Mtime = stat.Mtim.Sec
 		stats.Ctime = stat.Ctim.Sec
@@ -82,11 +82,7 @@ func (w *WhiteoutCache) Remove(path string) {
 		return
 	}
 
-	// Find the node and its parent
-	var parents []*whiteoutNode
-	var partNames []string
 	node := w.root
-
 	for _, part := range parts {
 		if node.children == nil {
 			return // Path doesn't exist in trie
@@ -95,18 +91,31 @@ func (w *WhiteoutCache) Remove(path string) {
 		if !ok {
 			return // Path doesn't exist in trie
 		}
-		parents = append(parents, node)
-		partNames = append(partNames, part)
 		node = child
 	}
 
 	// Clear the whiteout flag
 	node.isWhiteout = false
+	w.pruneLocked(parts)
+}
+
+// pruneLocked removes the nodes on the way to a path that no longer lead
+// to a whiteout, from the bottom up
+func (w *WhiteoutCache) pruneLocked(parts []string) {
+	var parents []*whiteoutNode
+	node := w.root
+	for _, part := range parts {
+		child, ok := node.children[part]
+		if !ok {
+			break
+		}
+		parents = append(parents, node)
+		node = child
+	}
 
-	// Clean up empty nodes from bottom to top
 	for i := len(parents) - 1; i >= 0; i-- {
 		parent := parents[i]
-		name := partNames[i]
+		name := parts[i]
 		child := parent.children[name]
 
 		// If the child has no children and is not a whiteout, remove it
@@ -167,6 +176,103 @@ func (w *WhiteoutCache) HasWhiteoutAncestor(path string) bool {
 	return false
 }
 
+// HasWhiteoutUnder checks if the path itself or anything below it is whited out
+func (w *WhiteoutCache) HasWhiteoutUnder(path string) bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	node := w.root
+	for _, part := range splitPath(path) {
+		child, ok := node.children[part]
+		if !ok {
+			return false
+		}
+		node = child
+	}
+
+	// Nodes are only created on the way to a whiteout
+	return node.isWhiteout || len(node.children) > 0
+}
+
+// MoveUnder moves the whiteouts below oldPath (not oldPath itself) to
+// newPath, replacing any that were below newPath
+func (w *WhiteoutCache) MoveUnder(oldPath, newPath string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	children := w.takeChildrenLocked(oldPath)
+	w.takeChildrenLocked(newPath)
+	w.putChildrenLocked(newPath, children)
+	w.pruneLocked(splitPath(oldPath))
+	w.pruneLocked(splitPath(newPath))
+}
+
+// RemoveUnder removes the whiteout for a path and all whiteouts below it
+func (w *WhiteoutCache) RemoveUnder(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	parts := splitPath(path)
+	node := w.root
+	for _, part := range parts {
+		child, ok := node.children[part]
+		if !ok {
+			return
+		}
+		node = child
+	}
+	node.isWhiteout = false
+	node.children = make(map[string]*whiteoutNode)
+	w.pruneLocked(parts)
+}
+
+// SwapUnder exchanges the whiteouts below two paths
+func (w *WhiteoutCache) SwapUnder(path1, path2 string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	children1 := w.takeChildrenLocked(path1)
+	children2 := w.takeChildrenLocked(path2)
+	w.putChildrenLocked(path1, children2)
+	w.putChildrenLocked(path2, children1)
+	w.pruneLocked(splitPath(path1))
+	w.pruneLocked(splitPath(path2))
+}
+
+// takeChildrenLocked detaches and returns the subtrees below path
+func (w *WhiteoutCache) takeChildrenLocked(path string) map[string]*whiteoutNode {
+	node := w.root
+	for _, part := range splitPath(path) {
+		child, ok := node.children[part]
+		if !ok {
+			return nil
+		}
+		node = child
+	}
+	children := node.children
+	node.children = make(map[string]*whiteoutNode)
+	return children
+}
+
+// putChildrenLocked attaches subtrees below path
+func (w *WhiteoutCache) putChildrenLocked(path string, children map[string]*whiteoutNode) {
+	if len(children) == 0 {
+		return
+	}
+	node := w.root
+	for _, part := range splitPath(path) {
+		child, ok := node.children[part]
+		if !ok {
+			child = &whiteoutNode{
+				children: make(map[string]*whiteoutNode),
+			}
+			node.children[part] = child
+		}
+		node = child
+	}
+	node.children = children
+}
+
 // GetChildWhiteouts returns the names of direct children that are whited out
 // for the given directory path
 func (w *WhiteoutCache) GetChildWhiteouts(dirPath string) []string {
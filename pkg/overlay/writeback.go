@@ -0,0 +1,264 @@
+package overlay
+
+import (
+	"context"
+	"database/sql"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"art/pkg/db"
+)
+
+// Flusher is implemented by files that buffer writes. Flush stores what is
+// buffered, as Sync does, and is called when a descriptor is closed.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// writeBuffer holds the writes to one inode that are not stored yet
+type writeBuffer struct {
+	chunks map[int64][]byte // Chunks written to, by index, with their whole current contents
+	size   uint64           // File size with the buffered writes
+	end    uint64           // End of the furthest buffered write
+	mtime  int64            // Time of the last buffered write
+	bytes  int64            // Memory held by chunks
+	timer  *time.Timer      // Flushes the buffer once it is too old
+}
+
+// writeBack coalesces the writes to AgentFS files, storing those to one
+// inode in a single transaction. Reads and stats see buffered writes. A
+// crash loses what wasn't flushed, but never leaves part of a flush.
+type writeBack struct {
+	store   *db.Store
+	maxSize int64         // Memory budget for all buffers
+	maxAge  time.Duration // How long a write may stay buffered
+	buffers map[uint64]*writeBuffer
+	used    int64
+	mu      sync.Mutex
+}
+
+// newWriteBack creates an empty write-back buffer
+func newWriteBack(store *db.Store, maxSize int64, maxAge time.Duration) *writeBack {
+	return &writeBack{
+		store:   store,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		buffers: make(map[uint64]*writeBuffer),
+	}
+}
+
+// write buffers data written at offset. Writes larger than the budget are
+// stored right away, after what is buffered for the inode.
+func (w *writeBack) write(ctx context.Context, ino uint64, data []byte, offset int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if int64(len(data)) > w.maxSize {
+		if err := w.flushLocked(ctx, ino); err != nil {
+			return err
+		}
+		return w.writeThrough(ctx, ino, data, offset)
+	}
+	if w.used+int64(len(data))+w.store.ChunkSize() > w.maxSize {
+		if err := w.flushAllLocked(ctx); err != nil {
+			return err
+		}
+	}
+
+	buf, err := w.bufferLocked(ctx, ino)
+	if err != nil {
+		return err
+	}
+
+	chunkSize := w.store.ChunkSize()
+	end := offset + int64(len(data))
+	for idx := offset / chunkSize; idx*chunkSize < end; idx++ {
+		chunk, ok := buf.chunks[idx]
+		if !ok {
+			stored, err := w.store.ReadChunks(ctx, ino, idx, idx)
+			if err != nil {
+				return err
+			}
+			chunk = stored[idx]
+		}
+
+		chunkStart := idx * chunkSize
+		lo, hi := max(chunkStart, offset), min(chunkStart+chunkSize, end)
+		if need := hi - chunkStart; int64(len(chunk)) < need {
+			grown := make([]byte, need)
+			copy(grown, chunk)
+			chunk = grown
+		}
+		copy(chunk[lo-chunkStart:hi-chunkStart], data[lo-offset:hi-offset])
+
+		w.used += int64(len(chunk)) - int64(len(buf.chunks[idx]))
+		buf.bytes += int64(len(chunk)) - int64(len(buf.chunks[idx]))
+		buf.chunks[idx] = chunk
+	}
+
+	buf.size = max(buf.size, uint64(end))
+	buf.end = max(buf.end, uint64(end))
+	buf.mtime = time.Now().Unix()
+	return nil
+}
+
+// writeThrough stores a write in its own transaction
+func (w *writeBack) writeThrough(ctx context.Context, ino uint64, data []byte, offset int64) error {
+	return w.store.WithTx(ctx, func(tx *sql.Tx) error {
+		inode, err := w.store.GetInodeTx(ctx, tx, ino)
+		if err != nil {
+			return err
+		}
+		if err := w.store.WriteDataTx(ctx, tx, ino, offset, data); err != nil {
+			return err
+		}
+		inode.Size = max(inode.Size, uint64(offset)+uint64(len(data)))
+		inode.Mtime = time.Now().Unix()
+		inode.Ctime = inode.Mtime
+		return w.store.UpdateInodeTx(ctx, tx, inode)
+	})
+}
+
+// bufferLocked returns the buffer of an inode, creating it if needed
+func (w *writeBack) bufferLocked(ctx context.Context, ino uint64) (*writeBuffer, error) {
+	if buf, ok := w.buffers[ino]; ok {
+		return buf, nil
+	}
+
+	inode, err := w.store.GetInode(ctx, ino)
+	if err != nil {
+		return nil, err
+	}
+	buf := &writeBuffer{
+		chunks: make(map[int64][]byte),
+		size:   inode.Size,
+	}
+	buf.timer = time.AfterFunc(w.maxAge, func() {
+		// A failed flush keeps the writes, so try again later
+		if err := w.flush(context.Background(), ino); err != nil {
+			buf.timer.Reset(w.maxAge)
+		}
+	})
+	w.buffers[ino] = buf
+	return buf, nil
+}
+
+// read reads from an inode with buffered writes. It returns false if
+// nothing is buffered for the inode.
+func (w *writeBack) read(ctx context.Context, ino uint64, dest []byte, offset int64) (int, bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	buf, ok := w.buffers[ino]
+	if !ok {
+		return 0, false, nil
+	}
+	if offset >= int64(buf.size) {
+		return 0, true, nil
+	}
+	n := min(int64(len(dest)), int64(buf.size)-offset)
+
+	// The stored contents end at the stored size; buffered chunks and
+	// zeros make up the rest
+	data, err := w.store.ReadData(ctx, ino, offset, n)
+	if err != nil {
+		return 0, true, err
+	}
+	copy(dest, data)
+	clear(dest[len(data):n])
+
+	chunkSize := w.store.ChunkSize()
+	end := offset + n
+	for idx := offset / chunkSize; idx*chunkSize < end; idx++ {
+		chunk, ok := buf.chunks[idx]
+		if !ok {
+			continue
+		}
+		chunkStart := idx * chunkSize
+		lo, hi := max(chunkStart, offset), min(chunkStart+int64(len(chunk)), end)
+		if hi > lo {
+			copy(dest[lo-offset:hi-offset], chunk[lo-chunkStart:hi-chunkStart])
+		}
+	}
+	return int(n), true, nil
+}
+
+// apply updates the stats of an inode with its buffered writes
+func (w *writeBack) apply(stats *Stats) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if buf, ok := w.buffers[stats.Ino]; ok {
+		stats.Size = max(stats.Size, int64(buf.size))
+		stats.Mtime = buf.mtime
+		stats.Ctime = buf.mtime
+	}
+}
+
+// flush stores the buffered writes to an inode
+func (w *writeBack) flush(ctx context.Context, ino uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flushLocked(ctx, ino)
+}
+
+// flushAll stores all buffered writes
+func (w *writeBack) flushAll(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flushAllLocked(ctx)
+}
+
+func (w *writeBack) flushAllLocked(ctx context.Context) error {
+	for ino := range w.buffers {
+		if err := w.flushLocked(ctx, ino); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushLocked stores the buffered writes to an inode in one transaction,
+// along with the size and mtime they give it. Writes to an inode that was
+// deleted in the meantime are dropped.
+func (w *writeBack) flushLocked(ctx context.Context, ino uint64) error {
+	buf, ok := w.buffers[ino]
+	if !ok {
+		return nil
+	}
+
+	chunkSize := w.store.ChunkSize()
+	err := w.store.WithTx(ctx, func(tx *sql.Tx) error {
+		inode, err := w.store.GetInodeTx(ctx, tx, ino)
+		if err == db.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, idx := range slices.Sorted(maps.Keys(buf.chunks)) {
+			if err := w.store.WriteDataTx(ctx, tx, ino, idx*chunkSize, buf.chunks[idx]); err != nil {
+				return err
+			}
+		}
+		// The size may have grown since the buffer was created; only a
+		// truncate, which flushes first, shrinks it
+		inode.Size = max(inode.Size, buf.end)
+		if buf.mtime != 0 {
+			inode.Mtime = buf.mtime
+			inode.Ctime = buf.mtime
+		}
+		return w.store.UpdateInodeTx(ctx, tx, inode)
+	})
+	if err != nil {
+		return err
+	}
+
+	buf.timer.Stop()
+	w.used -= buf.bytes
+	delete(w.buffers, ino)
+	return nil
+}
@@ -0,0 +1,51 @@
+package supervisor
+
+import (
+	"fmt"
+	"time"
+
+	artfs "art/pkg/fs"
+)
+
+// CacheMode controls how much the kernel caches of the overlay mount
+type CacheMode string
+
+const (
+	CacheDefault CacheMode = "default" // Attributes and lookups cached for a second
+	CacheNone    CacheMode = "none"    // Nothing cached, every access reaches the overlay
+	CacheFull    CacheMode = "full"    // Cached for a minute, contents kept across opens, 1 MiB requests
+)
+
+// ParseCacheMode validates a cache mode string.
+// An empty string selects the default mode.
+func ParseCacheMode(s string) (CacheMode, error) {
+	switch CacheMode(s) {
+	case "":
+		return CacheDefault, nil
+	case CacheDefault, CacheNone, CacheFull:
+		return CacheMode(s), nil
+	default:
+		return "", fmt.Errorf("invalid cache mode %q (want default, none or full)", s)
+	}
+}
+
+// cacheOptions returns the mount caching for a cache mode. Changes made in
+// the sandbox and by the supervisor are invalidated as they happen, but
+// edits to the host workspace during the session only show once the
+// kernel's timeouts expire.
+func cacheOptions(mode CacheMode) artfs.CacheOptions {
+	switch mode {
+	case CacheNone:
+		return artfs.CacheOptions{}
+	case CacheFull:
+		return artfs.CacheOptions{
+			AttrTimeout:  time.Minute,
+			EntryTimeout: time.Minute,
+			KeepCache:    true,
+			ReadDirPlus:  true,
+			MaxWrite:     1 << 20,
+		}
+	default:
+		return artfs.DefaultCacheOptions()
+	}
+}
@@ -0,0 +1,407 @@
+package supervisor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// cgroupRoot is where the unified (v2) cgroup hierarchy is mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cpuPeriodUsec is the cpu.max period used for CPU quotas
+const cpuPeriodUsec = 100000
+
+// cgroupDrainTimeout bounds how long Close waits for killed processes to
+// leave the session cgroup
+const cgroupDrainTimeout = 5 * time.Second
+
+// ResourceLimits holds cgroup v2 ceilings for a sandbox session.
+// Zero values mean "no limit".
+type ResourceLimits struct {
+	MemoryMax int64   // memory.max in bytes
+	CPUQuota  float64 // Number of CPUs worth of time (e.g. 1.5)
+	PidsMax   int64   // pids.max
+	IOWeight  uint64  // io.weight (1-10000)
+}
+
+// IsZero returns true if no limits are set
+func (l ResourceLimits) IsZero() bool {
+	return l == ResourceLimits{}
+}
+
+// controllers returns the cgroup controllers needed to enforce the limits
+func (l ResourceLimits) controllers() []string {
+	var ctrls []string
+	if l.MemoryMax > 0 {
+		ctrls = append(ctrls, "memory")
+	}
+	if l.CPUQuota > 0 {
+		ctrls = append(ctrls, "cpu")
+	}
+	if l.PidsMax > 0 {
+		ctrls = append(ctrls, "pids")
+	}
+	if l.IOWeight > 0 {
+		ctrls = append(ctrls, "io")
+	}
+	return ctrls
+}
+
+// ResourceUsage holds peak usage read back from a session cgroup
+type ResourceUsage struct {
+	MemoryPeak int64 // Peak memory in bytes (-1 if unavailable)
+	PidsPeak   int64 // Peak number of tasks (-1 if unavailable)
+	CPUUsec    int64 // Total CPU time in microseconds (-1 if unavailable)
+}
+
+// String formats usage for the end-of-session report
+func (u ResourceUsage) String() string {
+	format := func(v int64, f func(int64) string) string {
+		if v < 0 {
+			return "n/a"
+		}
+		return f(v)
+	}
+	return fmt.Sprintf("peak memory %s, peak pids %s, cpu time %s",
+		format(u.MemoryPeak, FormatSize),
+		format(u.PidsPeak, func(v int64) string { return strconv.FormatInt(v, 10) }),
+		format(u.CPUUsec, func(v int64) string { return fmt.Sprintf("%.2fs", float64(v)/1e6) }),
+	)
+}
+
+// sessionCgroup is a delegated cgroup v2 subtree for one sandbox session
+type sessionCgroup struct {
+	path string
+	dir  *os.File // Open directory, used for CLONE_INTO_CGROUP
+	home string   // Cgroup the supervisor was moved out of, if it was
+	leaf string   // Leaf cgroup the supervisor was moved into
+	ctrl []string // Controllers enabled in home for the move
+}
+
+// newSessionCgroup creates a child cgroup of the supervisor's own cgroup
+// and applies the given limits to it.
+func newSessionCgroup(limits ResourceLimits) (*sessionCgroup, error) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("cgroup v2 is not mounted at %s", cgroupRoot)
+	}
+
+	self, err := selfCgroup()
+	if err != nil {
+		return nil, err
+	}
+	parent := filepath.Join(cgroupRoot, self)
+
+	cg := &sessionCgroup{path: filepath.Join(parent, fmt.Sprintf("art-%d", os.Getpid()))}
+
+	// Controllers can only be enabled for children of a cgroup that has no
+	// processes of its own, so move the supervisor into a leaf first if needed
+	if err := enableControllers(parent, limits.controllers()); err != nil {
+		if !errors.Is(err, syscall.EBUSY) {
+			return nil, err
+		}
+		if err := cg.moveToLeaf(parent, limits.controllers()); err != nil {
+			cg.restore()
+			return nil, err
+		}
+	}
+
+	if err := os.Mkdir(cg.path, 0o755); err != nil {
+		cg.restore()
+		return nil, fmt.Errorf("failed to create session cgroup: %w", err)
+	}
+	if err := cg.apply(limits); err != nil {
+		os.Remove(cg.path)
+		cg.restore()
+		return nil, err
+	}
+
+	cg.dir, err = os.Open(cg.path)
+	if err != nil {
+		os.Remove(cg.path)
+		cg.restore()
+		return nil, err
+	}
+	return cg, nil
+}
+
+// moveToLeaf moves the supervisor from parent into a leaf cgroup and
+// enables the controllers for parent's children, recording what to undo
+func (cg *sessionCgroup) moveToLeaf(parent string, ctrls []string) error {
+	enabled, err := os.ReadFile(filepath.Join(parent, "cgroup.subtree_control"))
+	if err != nil {
+		return err
+	}
+	before := strings.Fields(string(enabled))
+
+	leaf := filepath.Join(parent, "art-supervisor")
+	if err := os.Mkdir(leaf, 0o755); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to create supervisor cgroup: %w", err)
+	}
+	cg.leaf = leaf
+	if err := writeCgroupFile(leaf, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+		return err
+	}
+	cg.home = parent
+
+	for _, c := range ctrls {
+		if !slices.Contains(before, c) {
+			cg.ctrl = append(cg.ctrl, c)
+		}
+	}
+	return enableControllers(parent, ctrls)
+}
+
+// apply writes the limit files for the session cgroup
+func (cg *sessionCgroup) apply(limits ResourceLimits) error {
+	if limits.MemoryMax > 0 {
+		if err := writeCgroupFile(cg.path, "memory.max", strconv.FormatInt(limits.MemoryMax, 10)); err != nil {
+			return err
+		}
+	}
+	if limits.CPUQuota > 0 {
+		quota := int64(limits.CPUQuota * cpuPeriodUsec)
+		if err := writeCgroupFile(cg.path, "cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriodUsec)); err != nil {
+			return err
+		}
+	}
+	if limits.PidsMax > 0 {
+		if err := writeCgroupFile(cg.path, "pids.max", strconv.FormatInt(limits.PidsMax, 10)); err != nil {
+			return err
+		}
+	}
+	if limits.IOWeight > 0 {
+		if err := writeCgroupFile(cg.path, "io.weight", fmt.Sprintf("default %d", limits.IOWeight)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attach makes the command start inside the session cgroup
+func (cg *sessionCgroup) attach(attr *syscall.SysProcAttr) {
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(cg.dir.Fd())
+}
+
+// Usage reads peak usage counters from the session cgroup
+func (cg *sessionCgroup) Usage() ResourceUsage {
+	usage := ResourceUsage{MemoryPeak: -1, PidsPeak: -1, CPUUsec: -1}
+	if v, err := readCgroupInt(cg.path, "memory.peak"); err == nil {
+		usage.MemoryPeak = v
+	}
+	if v, err := readCgroupInt(cg.path, "pids.peak"); err == nil {
+		usage.PidsPeak = v
+	}
+	if stat, err := readCgroupKeyed(cg.path, "cpu.stat"); err == nil {
+		if v, ok := stat["usage_usec"]; ok {
+			usage.CPUUsec = v
+		}
+	}
+	return usage
+}
+
+// Close kills anything left in the session cgroup, removes it once the
+// killed processes are gone and moves the supervisor back where it was
+func (cg *sessionCgroup) Close() error {
+	if cg.dir != nil {
+		cg.dir.Close()
+	}
+	// cgroup.kill is only available on Linux 5.14+; ignore failures
+	_ = writeCgroupFile(cg.path, "cgroup.kill", "1")
+	waitCgroupEmpty(cg.path, cgroupDrainTimeout)
+	err := os.Remove(cg.path)
+	if rerr := cg.restore(); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// restore moves the supervisor back out of its leaf cgroup and removes the
+// leaf. While other sessions run from the same cgroup, they still need the
+// controllers and the leaf, so both are left as they are.
+func (cg *sessionCgroup) restore() error {
+	if cg.leaf == "" {
+		return nil
+	}
+	if cg.home == "" {
+		// The move itself failed
+		os.Remove(cg.leaf)
+		return nil
+	}
+
+	entries, err := os.ReadDir(cg.home)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() && filepath.Join(cg.home, e.Name()) != cg.leaf {
+			return nil
+		}
+	}
+	procs, err := os.ReadFile(filepath.Join(cg.leaf, "cgroup.procs"))
+	if err != nil {
+		return err
+	}
+	if pids := strings.Fields(string(procs)); len(pids) != 1 || pids[0] != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+
+	// Processes can't be moved into a cgroup with controllers enabled for
+	// its children
+	if len(cg.ctrl) > 0 {
+		parts := make([]string, len(cg.ctrl))
+		for i, c := range cg.ctrl {
+			parts[i] = "-" + c
+		}
+		if err := writeCgroupFile(cg.home, "cgroup.subtree_control", strings.Join(parts, " ")); err != nil {
+			return err
+		}
+	}
+	if err := writeCgroupFile(cg.home, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+		return err
+	}
+	if err := os.Remove(cg.leaf); err != nil {
+		return fmt.Errorf("failed to remove supervisor cgroup: %w", err)
+	}
+	cg.leaf = ""
+	return nil
+}
+
+// waitCgroupEmpty waits until no process is left in a cgroup, or the
+// timeout passes. Killing is asynchronous, and a populated cgroup can't be
+// removed.
+func waitCgroupEmpty(dir string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		events, err := readCgroupKeyed(dir, "cgroup.events")
+		if err != nil || events["populated"] == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// selfCgroup returns the supervisor's cgroup v2 path relative to cgroupRoot
+func selfCgroup() (string, error) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The unified hierarchy entry looks like "0::/user.slice/..."
+		if path, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			return path, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no cgroup v2 entry in /proc/self/cgroup")
+}
+
+// enableControllers enables the given controllers for children of dir
+func enableControllers(dir string, ctrls []string) error {
+	if len(ctrls) == 0 {
+		return nil
+	}
+	parts := make([]string, len(ctrls))
+	for i, c := range ctrls {
+		parts[i] = "+" + c
+	}
+	return writeCgroupFile(dir, "cgroup.subtree_control", strings.Join(parts, " "))
+}
+
+// writeCgroupFile writes a value to a cgroup interface file
+func writeCgroupFile(dir, name, value string) error {
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+// readCgroupInt reads a single-value cgroup interface file
+func readCgroupInt(dir, name string) (int64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// readCgroupKeyed reads a flat keyed cgroup file such as cpu.stat
+func readCgroupKeyed(dir, name string) (map[string]int64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]int64)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			values[fields[0]] = v
+		}
+	}
+	return values, nil
+}
+
+// ParseSize parses a human-readable byte size such as "512M" or "2G".
+// Suffixes are binary (K = 1024). An empty string or "max" means no limit.
+func ParseSize(size string) (int64, error) {
+	s := strings.TrimSpace(size)
+	if s == "" || s == "max" {
+		return 0, nil
+	}
+
+	mult := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	case "T":
+		mult = 1 << 40
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	if n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("size %q is too large", size)
+	}
+	return n * mult, nil
+}
+
+// FormatSize formats a byte count using binary suffixes
+func FormatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
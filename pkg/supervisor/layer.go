@@ -0,0 +1,37 @@
+package supervisor
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Layer is a read-only host directory stacked below the workspace in the
+// overlay, shown at GuestPath inside the sandbox
+type Layer struct {
+	HostDir   string // Host directory with the layer's contents
+	GuestPath string // Where the contents appear, under the guest home
+}
+
+// ParseLayer parses a layer given as DIR[:PATH]. PATH defaults to the guest
+// home and must lie under it.
+func ParseLayer(s string) (Layer, error) {
+	dir, guest, hasPath := strings.Cut(s, ":")
+	if dir == "" {
+		return Layer{}, fmt.Errorf("invalid layer %q (want DIR[:PATH])", s)
+	}
+	if !hasPath || guest == "" {
+		guest = guestHomePath
+	}
+	guest = filepath.Clean(guest)
+	if guest != guestHomePath && !strings.HasPrefix(guest, guestHomePath+"/") {
+		return Layer{}, fmt.Errorf("invalid layer %q: path must be under %s", s, guestHomePath)
+	}
+	return Layer{HostDir: dir, GuestPath: guest}, nil
+}
+
+// overlayPath returns where the layer appears in the overlay, which backs
+// the guest home
+func (l Layer) overlayPath() string {
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(l.GuestPath, guestHomePath), "/")
+}
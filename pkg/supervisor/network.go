@@ -0,0 +1,52 @@
+package supervisor
+
+import (
+	"fmt"
+	"os"
+)
+
+// NetworkMode controls what network access the sandbox gets
+type NetworkMode string
+
+const (
+	NetworkHost         NetworkMode = "host"          // Share the host network namespace
+	NetworkNone         NetworkMode = "none"          // Private namespace, IP sockets refused
+	NetworkLoopbackOnly NetworkMode = "loopback-only" // Private namespace with only lo up
+)
+
+// ParseNetworkMode validates a network mode string.
+// An empty string selects the default (host) mode.
+func ParseNetworkMode(s string) (NetworkMode, error) {
+	switch NetworkMode(s) {
+	case "":
+		return NetworkHost, nil
+	case NetworkHost, NetworkNone, NetworkLoopbackOnly:
+		return NetworkMode(s), nil
+	default:
+		return "", fmt.Errorf("invalid network mode %q (want host, none or loopback-only)", s)
+	}
+}
+
+// networkArgs returns the bwrap arguments for the given network mode.
+// For NetworkNone it also returns a pipe carrying a seccomp filter that must
+// be passed to bwrap as its first extra file (fd 3); the caller closes it
+// once bwrap has started.
+func networkArgs(mode NetworkMode) ([]string, *os.File, error) {
+	switch mode {
+	case NetworkHost:
+		return nil, nil, nil
+	case NetworkLoopbackOnly:
+		// bwrap brings up lo inside the new namespace on its own
+		return []string{"--unshare-net"}, nil, nil
+	case NetworkNone:
+		// Same private namespace, but refuse AF_INET/AF_INET6 sockets so
+		// even loopback servers can't be reached
+		filter, err := seccompNoInetFilter()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to build seccomp filter: %w", err)
+		}
+		return []string{"--unshare-net", "--seccomp", "3"}, filter, nil
+	default:
+		return nil, nil, fmt.Errorf("invalid network mode %q", mode)
+	}
+}
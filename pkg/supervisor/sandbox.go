@@ -0,0 +1,401 @@
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"art/pkg/db"
+	artfs "art/pkg/fs"
+	"art/pkg/overlay"
+	"art/pkg/tracer"
+)
+
+// Writes to a SQLite delta layer are buffered up to writeBufferSize bytes
+// and writeBufferAge, so a file written in many small pieces is stored in
+// one transaction
+const (
+	writeBufferSize = 64 << 20
+	writeBufferAge  = 5 * time.Second
+)
+
+// sandbox holds the host-side state for one bwrap session: the FUSE
+// overlay, the bwrap arguments and anything that must be torn down after
+// the sandboxed command exits.
+type sandbox struct {
+	args       []string       // bwrap arguments, without /dev setup or the command
+	extraFiles []*os.File     // Extra fds passed to bwrap (seccomp filter)
+	cgroup     *sessionCgroup // Per-session cgroup (nil without resource limits)
+	tracer     *tracer.Tracer // Syscall tracer (nil if disabled)
+	cleanups   []func()       // Run in reverse order by Close
+}
+
+// newSandbox mounts the overlay (if cfg.DBPath is set) and builds the bwrap
+// arguments for cfg. Supervisor messages are written to log. The caller must
+// call Close once the sandbox is no longer needed.
+func newSandbox(cfg Config, log io.Writer) (_ *sandbox, err error) {
+	sb := &sandbox{}
+	succeeded := false
+	defer func() {
+		if err != nil {
+			sb.Close()
+		}
+	}()
+
+	// Resolve MountDir
+	absMountDir, err := filepath.Abs(cfg.MountDir)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving mount path: %w", err)
+	}
+
+	// Extract workspace name from mount directory
+	workspaceName := filepath.Base(absMountDir)
+	guestWorkspacePath := filepath.Join(guestHomePath, workspaceName)
+
+	var fuseMountPoint string
+
+	// Setup FUSE filesystem if database path provided
+	if cfg.DBPath != "" {
+		// Overlay mode: FUSE backs /home/agent entirely
+		// Workspace files from host are accessible at /home/agent/<workspace>
+		var delta overlay.Delta
+		if cfg.DBPath == MemoryDB {
+			// Ephemeral session: the delta layer lives in memory
+			memfs := overlay.NewMemFS(overlay.WithMaxSize(cfg.DeltaMaxSize))
+			delta = memfs
+			if cfg.DumpPath != "" {
+				// Open the dump database now, so that a session that can't
+				// be kept isn't found out only once it ends
+				dump, err := openDump(cfg.DumpPath)
+				if err != nil {
+					return nil, err
+				}
+				start := time.Now().Unix()
+				// Registered before the mount, so it runs after the unmount
+				sb.onClose(func() {
+					if succeeded {
+						dumpSession(memfs, dump, cfg.DumpPath, start, log)
+					}
+					dump.Close()
+				})
+			}
+		} else {
+			store, err := db.Open(db.DefaultConfig(cfg.DBPath))
+			if err != nil {
+				return nil, fmt.Errorf("failed to open database: %w", err)
+			}
+			sb.onClose(func() { store.Close() })
+
+			// Lets `art pull` tell host edits made during the session apart
+			if err := store.BeginSession(context.Background()); err != nil {
+				return nil, fmt.Errorf("failed to record session start: %w", err)
+			}
+
+			// Create AgentFS for delta layer (entire /home/agent)
+			agentfs, err := overlay.NewAgentFS(store, overlay.WithWriteBuffer(writeBufferSize, writeBufferAge))
+			if err != nil {
+				return nil, fmt.Errorf("failed to create agent filesystem: %w", err)
+			}
+			delta = agentfs
+			// Registered before the mount, so it runs after the unmount
+			sb.onClose(func() {
+				if err := agentfs.Flush(context.Background()); err != nil {
+					fmt.Fprintf(log, "Failed to store buffered writes: %v\n", err)
+				}
+			})
+		}
+
+		// Create HostFS from mount directory, mapped to workspace subpath
+		hostfs, err := overlay.NewHostFS(absMountDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create host filesystem: %w", err)
+		}
+
+		// Create OverlayFS with workspace name for host mapping and the guest
+		// home so absolute symlinks created in the sandbox resolve
+		overlayOpts := []overlay.OverlayOption{
+			overlay.WithWorkspaceName(workspaceName),
+			overlay.WithMountPoint(guestHomePath),
+		}
+		if cfg.Devices {
+			overlayOpts = append(overlayOpts, overlay.WithDevices())
+		}
+		for _, layer := range cfg.Layers {
+			absLayerDir, err := filepath.Abs(layer.HostDir)
+			if err != nil {
+				return nil, fmt.Errorf("error resolving layer path: %w", err)
+			}
+			layerfs, err := overlay.NewHostFS(absLayerDir)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create layer filesystem for %s: %w", absLayerDir, err)
+			}
+			overlayOpts = append(overlayOpts, overlay.WithLayer(layerfs, layer.overlayPath()))
+		}
+		overlayfs, err := overlay.NewOverlayFS(hostfs, delta, overlayOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create overlay filesystem: %w", err)
+		}
+
+		// Create temporary mount point
+		fuseMountPoint, err = os.MkdirTemp("", "art-overlay-*")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temp mount point: %w", err)
+		}
+		sb.onClose(func() { os.RemoveAll(fuseMountPoint) })
+
+		// Mount overlay FUSE filesystem
+		mountOpts := []artfs.OverlayMountOption{artfs.WithCache(cacheOptions(cfg.Cache))}
+		if cfg.Permissions {
+			mountOpts = append(mountOpts, artfs.WithPermissions())
+		}
+		overlayMounter, err := artfs.MountOverlay(fuseMountPoint, overlayfs, mountOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to mount overlay FUSE: %w", err)
+		}
+		sb.onClose(func() { overlayMounter.Unmount() })
+
+		fmt.Fprintf(log, "Overlay FUSE mounted at: %s\n", fuseMountPoint)
+		fmt.Fprintf(log, "Host workspace: %s -> %s\n", absMountDir, guestWorkspacePath)
+		for _, layer := range cfg.Layers {
+			fmt.Fprintf(log, "Layer (read-only): %s -> %s\n", layer.HostDir, layer.GuestPath)
+		}
+		fmt.Fprintf(log, "Delta (write): %s\n", cfg.DBPath)
+
+	} else {
+		// Direct mount mode - still use the new layout
+		fmt.Fprintf(log, "Direct mount: %s -> %s\n", absMountDir, guestWorkspacePath)
+	}
+
+	fmt.Fprintf(log, "--- Starting Sandbox ---\n")
+	fmt.Fprintf(log, "Guest home: %s\n", guestHomePath)
+	fmt.Fprintf(log, "Guest workspace: %s\n", guestWorkspacePath)
+	fmt.Fprintf(log, "Interactive: %v\n", cfg.Interactive)
+
+	// Build Bubblewrap arguments
+	// Mount entire host filesystem read-only for access to packages, tools, etc.
+	bwrapArgs := []string{
+		// Mount root filesystem read-only
+		"--ro-bind", "/", "/",
+
+		// Process information
+		"--proc", "/proc",
+
+		// Writable /tmp
+		"--tmpfs", "/tmp",
+
+		// Writable /home (overlay on read-only root)
+		"--tmpfs", "/home",
+
+		// Devices
+		"--dev-bind", "/dev/null", "/dev/null",
+		"--dev-bind", "/dev/zero", "/dev/zero",
+		"--dev-bind", "/dev/random", "/dev/random",
+		"--dev-bind", "/dev/urandom", "/dev/urandom",
+
+		// Isolation (network namespace is configured below)
+		"--unshare-pid",
+		"--die-with-parent",
+		"--new-session",
+	}
+
+	// Mount home directory (FUSE or direct)
+	if cfg.DBPath != "" {
+		// FUSE overlay mode: bind FUSE mount as /home/agent
+		bwrapArgs = append(bwrapArgs,
+			"--dir", guestHomePath,
+			"--bind", fuseMountPoint, guestHomePath,
+		)
+	} else {
+		// Direct mode: bind workspace directly at /home/agent/<workspace>
+		bwrapArgs = append(bwrapArgs,
+			"--dir", guestHomePath,
+			"--dir", guestWorkspacePath,
+			"--bind", absMountDir, guestWorkspacePath,
+		)
+	}
+
+	// Environment
+	bwrapArgs = append(bwrapArgs,
+		"--chdir", guestWorkspacePath,
+		"--setenv", "HOME", guestHomePath,
+		"--setenv", "PATH", "/usr/local/bin:/usr/bin:/bin",
+	)
+
+	// Load user config from .art/config/binds.json
+	var userCfg *UserConfig
+	userCfgPath := filepath.Join(absMountDir, ".art", "config", "binds.json")
+	if _, err := os.Stat(userCfgPath); err == nil {
+		userCfg, err = loadUserConfig(userCfgPath)
+		if err != nil {
+			fmt.Fprintf(log, "Warning: failed to load user config: %v\n", err)
+		}
+	}
+
+	if userCfg != nil {
+		for _, bind := range userCfg.Binds {
+			if bind.HostPath == "" || bind.GuestPath == "" {
+				continue
+			}
+
+			// Resolve relative host paths against project root
+			hostPath := bind.HostPath
+			if !filepath.IsAbs(hostPath) {
+				hostPath = filepath.Join(absMountDir, hostPath)
+			}
+
+			if bind.ReadOnly {
+				bwrapArgs = append(bwrapArgs, "--ro-bind", hostPath, bind.GuestPath)
+			} else {
+				bwrapArgs = append(bwrapArgs, "--bind", hostPath, bind.GuestPath)
+			}
+			fmt.Fprintf(log, "Binding %s -> %s (ro=%v)\n", hostPath, bind.GuestPath, bind.ReadOnly)
+		}
+	}
+
+	// Network isolation: the command line takes precedence over binds.json
+	network := cfg.Network
+	if network == "" && userCfg != nil {
+		network = NetworkMode(userCfg.Network)
+	}
+	network, err = ParseNetworkMode(string(network))
+	if err != nil {
+		return nil, err
+	}
+	netArgs, seccompFilter, err := networkArgs(network)
+	if err != nil {
+		return nil, err
+	}
+	if seccompFilter != nil {
+		sb.onClose(func() { seccompFilter.Close() })
+		sb.extraFiles = append(sb.extraFiles, seccompFilter)
+	}
+	bwrapArgs = append(bwrapArgs, netArgs...)
+	fmt.Fprintf(log, "Network: %s\n", network)
+
+	sb.args = bwrapArgs
+
+	if cfg.EnableTracer {
+		traceCfg := tracer.Config{
+			TraceSyscalls: cfg.TraceSyscalls,
+		}
+		if cfg.TraceLogPath != "" {
+			l, err := tracer.NewFileLogger(cfg.TraceLogPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create trace logger: %w", err)
+			}
+			sb.onClose(func() { l.Close() })
+			traceCfg.Logger = l
+		} else {
+			traceCfg.Logger = tracer.NewStreamLogger(os.Stderr)
+		}
+		sb.tracer = tracer.New(traceCfg)
+	}
+
+	// Resource limits: bwrap is started directly inside a per-session cgroup
+	if !cfg.Resources.IsZero() {
+		cg, err := newSessionCgroup(cfg.Resources)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up resource limits: %w", err)
+		}
+		sb.cgroup = cg
+		sb.onClose(func() { cg.Close() })
+	}
+
+	succeeded = true
+	return sb, nil
+}
+
+// openDump opens the database an in-memory session is dumped to, which
+// must be new or empty
+func openDump(path string) (*db.Store, error) {
+	store, err := db.Open(db.DefaultConfig(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dump database: %w", err)
+	}
+	if hasChildren, err := store.HasChildren(context.Background(), 1); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to open dump database: %w", err)
+	} else if hasChildren {
+		store.Close()
+		return nil, fmt.Errorf("dump database %s is not empty", path)
+	}
+	return store, nil
+}
+
+// dumpSession keeps an in-memory session by writing it to the dump
+// database. Failures are reported on stderr even in quiet mode, since the
+// session is lost with them.
+func dumpSession(memfs *overlay.MemFS, store *db.Store, path string, start int64, log io.Writer) {
+	ctx := context.Background()
+	err := memfs.Dump(ctx, store)
+	if err == nil {
+		// Lets `art pull` tell host edits made during the session apart
+		err = store.BeginSessionAt(ctx, start)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to dump session to %s: %v\n", path, err)
+		return
+	}
+	fmt.Fprintf(log, "Session dumped to: %s\n", path)
+}
+
+// onClose registers a cleanup function to run when the sandbox is closed
+func (sb *sandbox) onClose(fn func()) {
+	sb.cleanups = append(sb.cleanups, fn)
+}
+
+// Close tears down everything set up by newSandbox, in reverse order
+func (sb *sandbox) Close() {
+	for i := len(sb.cleanups) - 1; i >= 0; i-- {
+		sb.cleanups[i]()
+	}
+	sb.cleanups = nil
+}
+
+// command builds the bwrap command that runs argv inside the sandbox.
+// Interactive commands get a full /dev for the PTY and keep the session.
+func (sb *sandbox) command(ctx context.Context, argv []string, interactive bool) *exec.Cmd {
+	args := append([]string(nil), sb.args...)
+	if interactive {
+		// Add PTY device for interactive mode
+		// Remove --new-session for interactive mode as PTY handles session creation
+		args = removeArg(args, "--new-session")
+		args = append(args, "--dev", "/dev")
+	} else {
+		args = append(args, "--dev-bind", "/dev/tty", "/dev/tty")
+	}
+	args = append(args, argv...)
+
+	cmd := exec.CommandContext(ctx, "bwrap", args...)
+	cmd.ExtraFiles = sb.extraFiles
+	if sb.cgroup != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+		sb.cgroup.attach(cmd.SysProcAttr)
+	}
+	return cmd
+}
+
+// usage returns peak resource usage, or nil if no cgroup was set up
+func (sb *sandbox) usage() *ResourceUsage {
+	if sb.cgroup == nil {
+		return nil
+	}
+	u := sb.cgroup.Usage()
+	return &u
+}
+
+// removeArg removes an argument from the slice
+func removeArg(args []string, arg string) []string {
+	result := make([]string, 0, len(args))
+	for _, a := range args {
+		if a != arg {
+			result = append(result, a)
+		}
+	}
+	return result
+}
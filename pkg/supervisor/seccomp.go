@@ -0,0 +1,74 @@
+package supervisor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"syscall"
+)
+
+// Offsets into struct seccomp_data
+const (
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArg0 = 16
+)
+
+// Seccomp return actions
+const (
+	seccompRetAllow = 0x7fff0000
+	seccompRetErrno = 0x00050000
+)
+
+// seccompNoInetFilter compiles a classic BPF program that makes socket(2)
+// fail with EACCES for AF_INET and AF_INET6, and writes it into a pipe in
+// the format bwrap --seccomp expects. Other socket families (notably
+// AF_UNIX) keep working.
+func seccompNoInetFilter() (*os.File, error) {
+	stmt := func(code uint16, k uint32) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+
+	prog := []syscall.SockFilter{
+		// Only filter the native architecture
+		stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataArch),
+		jump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, auditArch, 0, 6),
+
+		// Refuse the x32 ABI, which shares the architecture but would get
+		// socket(2) past the check below under another number
+		stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataNr),
+		jump(syscall.BPF_JMP|syscall.BPF_JSET|syscall.BPF_K, x32SyscallBit, 5, 0),
+
+		// Only filter socket(2)
+		jump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, sysSocket, 0, 3),
+
+		// Refuse IP address families
+		stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataArg0),
+		jump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, syscall.AF_INET, 2, 0),
+		jump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, syscall.AF_INET6, 1, 0),
+
+		stmt(syscall.BPF_RET|syscall.BPF_K, seccompRetAllow),
+		stmt(syscall.BPF_RET|syscall.BPF_K, seccompRetErrno|uint32(syscall.EACCES)),
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, prog); err != nil {
+		return nil, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+
+	// The program is a few dozen bytes, well under the pipe buffer size
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
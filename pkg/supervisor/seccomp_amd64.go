@@ -0,0 +1,9 @@
+//go:build amd64
+
+package supervisor
+
+const (
+	auditArch     = 0xc000003e // AUDIT_ARCH_X86_64
+	sysSocket     = 41
+	x32SyscallBit = 0x40000000 // __X32_SYSCALL_BIT
+)
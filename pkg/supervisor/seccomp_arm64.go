@@ -0,0 +1,9 @@
+//go:build arm64
+
+package supervisor
+
+const (
+	auditArch     = 0xc00000b7 // AUDIT_ARCH_AARCH64
+	sysSocket     = 198
+	x32SyscallBit = 0 // No x32-like ABI
+)
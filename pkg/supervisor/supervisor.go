@@ -1,22 +1,21 @@
 package supervisor
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"os/signal"
-	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/creack/pty"
 	"golang.org/x/term"
 
-	"art/pkg/db"
-	artfs "art/pkg/fs"
-	"art/pkg/overlay"
 	"art/pkg/tracer"
 )
 
@@ -24,222 +23,101 @@ import (
 type Config struct {
 	MountDir      string // Host directory to mount (workspace source)
 	Interactive   bool
-	DBPath        string
-	EnableTracer  bool     // Enable ptrace tracer
-	TraceLogPath  string   // Path to log syscalls
-	TraceSyscalls []string // List of syscalls to log (empty = all)
-	Command       []string // Command to run (overrides shell)
+	DBPath        string         // SQLite database of the delta layer, or MemoryDB
+	DeltaMaxSize  int64          // Size cap of an in-memory delta layer in bytes (0 = unlimited)
+	DumpPath      string         // Database to keep an in-memory session in when it ends
+	Layers        []Layer        // Read-only layers below the workspace, in order of precedence (overlay mode)
+	EnableTracer  bool           // Enable ptrace tracer
+	TraceLogPath  string         // Path to log syscalls
+	TraceSyscalls []string       // List of syscalls to log (empty = all)
+	Network       NetworkMode    // Network isolation mode (empty = binds.json or host)
+	Resources     ResourceLimits // cgroup v2 limits for the session (zero = unlimited)
+	Command       []string       // Command to run (overrides shell)
+	Quiet         bool           // Suppress supervisor messages (otherwise written to stderr)
+	Permissions   bool           // Enforce permission bits in the overlay against the caller
+	Devices       bool           // Allow creating device nodes in the overlay
+	Cache         CacheMode      // Kernel caching of the overlay mount (empty = default)
+	Stdin         io.Reader      // Standard input for RunCommand (nil = empty)
 }
 
+// MemoryDB as the database path keeps the delta layer in memory, for
+// sessions that don't need to outlive the sandbox
+const MemoryDB = ":memory:"
+
 // guestHomePath is the home directory path inside the sandbox
 const guestHomePath = "/home/agent"
 
-// Run starts the bubblewrap sandbox with the given configuration
-func Run(cfg Config) error {
-	var overlayMounter *artfs.OverlayMounter
-	var store *db.Store
-	var cleanupFuse func()
-	var fuseMountPoint string
-
-	// Resolve MountDir
-	absMountDir, err := filepath.Abs(cfg.MountDir)
-	if err != nil {
-		return fmt.Errorf("error resolving mount path: %w", err)
-	}
-
-	// Extract workspace name from mount directory
-	workspaceName := filepath.Base(absMountDir)
-	guestWorkspacePath := filepath.Join(guestHomePath, workspaceName)
+// GuestHome is where the overlay is mounted inside the sandbox, which
+// absolute symlinks created by the agent point into
+const GuestHome = guestHomePath
 
-	// Setup FUSE filesystem if database path provided
-	if cfg.DBPath != "" {
-		// Overlay mode: FUSE backs /home/agent entirely
-		// Workspace files from host are accessible at /home/agent/<workspace>
-		var err error
-		store, err = db.Open(db.DefaultConfig(cfg.DBPath))
-		if err != nil {
-			return fmt.Errorf("failed to open database: %w", err)
-		}
-		defer store.Close()
-
-		// Create HostFS from mount directory, mapped to workspace subpath
-		hostfs, err := overlay.NewHostFS(absMountDir)
-		if err != nil {
-			return fmt.Errorf("failed to create host filesystem: %w", err)
-		}
-
-		// Create AgentFS for delta layer (entire /home/agent)
-		agentfs, err := overlay.NewAgentFS(store)
-		if err != nil {
-			return fmt.Errorf("failed to create agent filesystem: %w", err)
-		}
-
-		// Create OverlayFS with workspace name for host mapping
-		overlayfs, err := overlay.NewOverlayFS(hostfs, agentfs, overlay.WithWorkspaceName(workspaceName))
-		if err != nil {
-			return fmt.Errorf("failed to create overlay filesystem: %w", err)
-		}
-
-		// Create temporary mount point
-		fuseMountPoint, err = os.MkdirTemp("", "art-overlay-*")
-		if err != nil {
-			return fmt.Errorf("failed to create temp mount point: %w", err)
-		}
-
-		cleanupFuse = func() {
-			if overlayMounter != nil {
-				overlayMounter.Unmount()
-			}
-			os.RemoveAll(fuseMountPoint)
-		}
-		defer cleanupFuse()
-
-		// Mount overlay FUSE filesystem
-		overlayMounter, err = artfs.MountOverlay(fuseMountPoint, overlayfs)
-		if err != nil {
-			os.RemoveAll(fuseMountPoint)
-			return fmt.Errorf("failed to mount overlay FUSE: %w", err)
-		}
+// ExitError is returned by Run when the sandboxed command exits with a
+// non-zero status or is killed by a signal
+type ExitError struct {
+	Status syscall.WaitStatus
+}
 
-		fmt.Printf("Overlay FUSE mounted at: %s\n", fuseMountPoint)
-		fmt.Printf("Host workspace: %s -> %s\n", absMountDir, guestWorkspacePath)
-		fmt.Printf("Delta (write): %s\n", cfg.DBPath)
+func (e *ExitError) Error() string {
+	if e.Status.Signaled() {
+		return fmt.Sprintf("sandboxed command killed by signal: %v", e.Status.Signal())
+	}
+	return fmt.Sprintf("sandboxed command exited with status %d", e.Status.ExitStatus())
+}
 
-	} else {
-		// Direct mount mode - still use the new layout
-		fmt.Printf("Direct mount: %s -> %s\n", absMountDir, guestWorkspacePath)
+// ExitCode returns the command's exit code, or 128+signal if it was killed
+func (e *ExitError) ExitCode() int {
+	if e.Status.Signaled() {
+		return 128 + int(e.Status.Signal())
 	}
+	return e.Status.ExitStatus()
+}
 
-	fmt.Printf("--- Starting Sandbox ---\n")
-	fmt.Printf("Guest home: %s\n", guestHomePath)
-	fmt.Printf("Guest workspace: %s\n", guestWorkspacePath)
-	fmt.Printf("Interactive: %v\n", cfg.Interactive)
-
-	// Build Bubblewrap arguments
-	// Mount entire host filesystem read-only for access to packages, tools, etc.
-	bwrapArgs := []string{
-		// Mount root filesystem read-only
-		"--ro-bind", "/", "/",
-
-		// Process information
-		"--proc", "/proc",
-
-		// Writable /tmp
-		"--tmpfs", "/tmp",
-
-		// Writable /home (overlay on read-only root)
-		"--tmpfs", "/home",
-
-		// Devices
-		"--dev-bind", "/dev/null", "/dev/null",
-		"--dev-bind", "/dev/zero", "/dev/zero",
-		"--dev-bind", "/dev/random", "/dev/random",
-		"--dev-bind", "/dev/urandom", "/dev/urandom",
-
-		// Isolation
-		// "--unshare-net",
-		"--unshare-pid",
-		"--die-with-parent",
-		"--new-session",
+// exitStatusError returns an *ExitError for an unsuccessful wait status
+func exitStatusError(status syscall.WaitStatus) error {
+	if status.Exited() && status.ExitStatus() == 0 {
+		return nil
 	}
+	return &ExitError{Status: status}
+}
 
-	// Mount home directory (FUSE or direct)
-	if cfg.DBPath != "" {
-		// FUSE overlay mode: bind FUSE mount as /home/agent
-		bwrapArgs = append(bwrapArgs,
-			"--dir", guestHomePath,
-			"--bind", fuseMountPoint, guestHomePath,
-		)
-	} else {
-		// Direct mode: bind workspace directly at /home/agent/<workspace>
-		bwrapArgs = append(bwrapArgs,
-			"--dir", guestHomePath,
-			"--dir", guestWorkspacePath,
-			"--bind", absMountDir, guestWorkspacePath,
-		)
+// Run starts the bubblewrap sandbox with the given configuration.
+// If the sandboxed command fails, the returned error is an *ExitError.
+func Run(cfg Config) error {
+	var log io.Writer = os.Stderr
+	if cfg.Quiet {
+		log = io.Discard
 	}
 
-	// Environment
-	bwrapArgs = append(bwrapArgs,
-		"--chdir", guestWorkspacePath,
-		"--setenv", "HOME", guestHomePath,
-		"--setenv", "PATH", "/usr/local/bin:/usr/bin:/bin",
-	)
-
-	// Load user config from .art/config/binds.json
-	userCfgPath := filepath.Join(absMountDir, ".art", "config", "binds.json")
-	if _, err := os.Stat(userCfgPath); err == nil {
-		userCfg, err := loadUserConfig(userCfgPath)
-		if err != nil {
-			fmt.Printf("Warning: failed to load user config: %v\n", err)
-		} else {
-			for _, bind := range userCfg.Binds {
-				if bind.HostPath == "" || bind.GuestPath == "" {
-					continue
-				}
-
-				// Resolve relative host paths against project root
-				hostPath := bind.HostPath
-				if !filepath.IsAbs(hostPath) {
-					hostPath = filepath.Join(absMountDir, hostPath)
-				}
-
-				if bind.ReadOnly {
-					bwrapArgs = append(bwrapArgs, "--ro-bind", hostPath, bind.GuestPath)
-				} else {
-					bwrapArgs = append(bwrapArgs, "--bind", hostPath, bind.GuestPath)
-				}
-				fmt.Printf("Binding %s -> %s (ro=%v)\n", hostPath, bind.GuestPath, bind.ReadOnly)
-			}
-		}
+	sb, err := newSandbox(cfg, log)
+	if err != nil {
+		return err
 	}
+	defer sb.Close()
 
-	var t *tracer.Tracer
-	if cfg.EnableTracer {
-		traceCfg := tracer.Config{
-			TraceSyscalls: cfg.TraceSyscalls,
-		}
-		if cfg.TraceLogPath != "" {
-			l, err := tracer.NewFileLogger(cfg.TraceLogPath)
-			if err != nil {
-				return fmt.Errorf("failed to create trace logger: %w", err)
-			}
-			defer l.Close()
-			traceCfg.Logger = l
+	argv := cfg.Command
+	if len(argv) == 0 {
+		if cfg.Interactive {
+			argv = []string{"/bin/bash"}
 		} else {
-			traceCfg.Logger = tracer.NewStreamLogger(os.Stderr)
+			argv = []string{"/bin/sh"}
 		}
-		t = tracer.New(traceCfg)
 	}
+	cmd := sb.command(context.Background(), argv, cfg.Interactive)
 
 	if cfg.Interactive {
-		// Add PTY device for interactive mode
-		// Remove --new-session for interactive mode as PTY handles session creation
-		bwrapArgs = removeArg(bwrapArgs, "--new-session")
-		bwrapArgs = append(bwrapArgs, "--dev", "/dev")
-
-		if len(cfg.Command) > 0 {
-			bwrapArgs = append(bwrapArgs, cfg.Command...)
-		} else {
-			bwrapArgs = append(bwrapArgs, "/bin/bash")
-		}
-		return runInteractive(bwrapArgs, cleanupFuse, t)
+		err = runInteractive(cmd, sb.tracer, log)
+	} else {
+		err = runNonInteractive(cmd, sb.tracer, log)
 	}
 
-	// Non-interactive mode
-	bwrapArgs = append(bwrapArgs, "--dev-bind", "/dev/tty", "/dev/tty")
-	if len(cfg.Command) > 0 {
-		bwrapArgs = append(bwrapArgs, cfg.Command...)
-	} else {
-		bwrapArgs = append(bwrapArgs, "/bin/sh")
+	if usage := sb.usage(); usage != nil {
+		fmt.Fprintf(log, "Resource usage: %s\n", usage)
 	}
-	return runNonInteractive(bwrapArgs, t)
+	return err
 }
 
 // runInteractive runs the sandbox with a proper PTY for full terminal support
-func runInteractive(bwrapArgs []string, cleanup func(), t *tracer.Tracer) error {
-	cmd := exec.Command("bwrap", bwrapArgs...)
-
+func runInteractive(cmd *exec.Cmd, t *tracer.Tracer, log io.Writer) error {
 	var ptmx *os.File
 	var err error
 
@@ -319,7 +197,7 @@ func runInteractive(bwrapArgs []string, cleanup func(), t *tracer.Tracer) error
 
 	if err != nil {
 		if t == nil {
-			// Exit errors are expected when shell exits
+			// Exit errors are expected when shell exits; the status is checked below
 			if _, ok := err.(*exec.ExitError); !ok {
 				return fmt.Errorf("sandbox exited with error: %w", err)
 			}
@@ -328,13 +206,16 @@ func runInteractive(bwrapArgs []string, cleanup func(), t *tracer.Tracer) error
 		}
 	}
 
-	fmt.Println("\n--- Sandbox Exited Cleanly ---")
+	if err := exitStatusError(commandStatus(cmd, t)); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(log, "\n--- Sandbox Exited Cleanly ---")
 	return nil
 }
 
 // runNonInteractive runs the sandbox without PTY (for scripted/automated use)
-func runNonInteractive(bwrapArgs []string, t *tracer.Tracer) error {
-	cmd := exec.Command("bwrap", bwrapArgs...)
+func runNonInteractive(cmd *exec.Cmd, t *tracer.Tracer, log io.Writer) error {
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -349,30 +230,96 @@ func runNonInteractive(bwrapArgs []string, t *tracer.Tracer) error {
 		}
 	} else {
 		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("sandbox exited with error: %w", err)
+			if _, ok := err.(*exec.ExitError); !ok {
+				return fmt.Errorf("sandbox exited with error: %w", err)
+			}
 		}
 	}
 
-	fmt.Printf("--- Sandbox Exited Cleanly ---\n")
+	if err := exitStatusError(commandStatus(cmd, t)); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(log, "--- Sandbox Exited Cleanly ---\n")
 	return nil
 }
 
-// removeArg removes an argument from the slice
-func removeArg(args []string, arg string) []string {
-	result := make([]string, 0, len(args))
-	for _, a := range args {
-		if a != arg {
-			result = append(result, a)
-		}
+// commandStatus returns the wait status of a finished command. When traced,
+// the tracer reaps the process itself and cmd.ProcessState is never set.
+func commandStatus(cmd *exec.Cmd, t *tracer.Tracer) syscall.WaitStatus {
+	if t != nil {
+		return t.ExitStatus()
 	}
-	return result
+	if cmd.ProcessState == nil {
+		return 0
+	}
+	return cmd.ProcessState.Sys().(syscall.WaitStatus)
+}
+
+// Result holds the outcome of a command run by RunCommand
+type Result struct {
+	ExitCode int            // Exit code, or -1 if the command was killed by a signal
+	Signal   syscall.Signal // Signal that terminated the command (0 if it exited)
+	Duration time.Duration  // Wall-clock run time of the sandbox
+	Stdout   []byte         // Captured standard output
+	Stderr   []byte         // Captured standard error
+	Usage    *ResourceUsage // Peak resource usage (nil without resource limits)
 }
 
-// RunCommand executes a single command in the sandbox and returns output
-func RunCommand(cfg Config) ([]byte, error) {
-	// reuse Run() logic but capture stdout?
-	// For now, this is a placeholder or you might want to implement it properly.
-	return nil, fmt.Errorf("not implemented")
+// RunCommand runs cfg.Command non-interactively in the sandbox, with the same
+// filesystem setup as Run, and captures its output. Nothing is written to the
+// supervisor's own stdout. A non-zero exit status is reported in the Result
+// rather than as an error; if ctx expires the sandbox is killed and the
+// partial Result is returned together with the context error.
+func RunCommand(ctx context.Context, cfg Config) (*Result, error) {
+	if len(cfg.Command) == 0 {
+		return nil, fmt.Errorf("no command to run")
+	}
+
+	sb, err := newSandbox(cfg, io.Discard)
+	if err != nil {
+		return nil, err
+	}
+	defer sb.Close()
+
+	var stdout, stderr bytes.Buffer
+	cmd := sb.command(ctx, cfg.Command, false)
+	cmd.Stdin = cfg.Stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	start := time.Now()
+	if sb.tracer != nil {
+		err = sb.tracer.TraceCmd(ctx, cmd, nil)
+		// The tracer reaps the process itself; Wait only drains the output pipes
+		cmd.Wait()
+	} else {
+		err = cmd.Run()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			err = nil
+		}
+	}
+
+	status := commandStatus(cmd, sb.tracer)
+	result := &Result{
+		ExitCode: status.ExitStatus(),
+		Duration: time.Since(start),
+		Stdout:   stdout.Bytes(),
+		Stderr:   stderr.Bytes(),
+		Usage:    sb.usage(),
+	}
+	if status.Signaled() {
+		result.Signal = status.Signal()
+	}
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return result, ctxErr
+	}
+	if err != nil {
+		return result, fmt.Errorf("sandbox failed: %w", err)
+	}
+	return result, nil
 }
 
 // UserBind defines a single bind mount configuration
@@ -384,7 +331,8 @@ type UserBind struct {
 
 // UserConfig defines the structure of the user configuration file
 type UserConfig struct {
-	Binds []UserBind `json:"binds"`
+	Binds   []UserBind `json:"binds"`
+	Network string     `json:"network,omitempty"` // host, none or loopback-only
 }
 
 // loadUserConfig reads and parses the user configuration file
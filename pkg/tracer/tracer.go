@@ -17,7 +17,9 @@ type Tracer struct {
 	logger        Logger
 	tracees       map[int]*Tracee // pid -> tracee state
 	stopping      bool
-	traceSyscalls map[string]bool // whitelist of syscalls to log (empty = all)
+	traceSyscalls map[string]bool    // whitelist of syscalls to log (empty = all)
+	rootPid       int                // pid of the command started by TraceCmd
+	rootStatus    syscall.WaitStatus // wait status of rootPid once it terminates
 }
 
 // Tracee represents a traced process
@@ -83,6 +85,7 @@ func (t *Tracer) TraceCmd(ctx context.Context, cmd *exec.Cmd, onStart func()) er
 
 	pid := cmd.Process.Pid
 	t.tracees[pid] = &Tracee{pid: pid}
+	t.rootPid = pid
 
 	// Wait for initial stop (SIGTRAP from PTRACE_TRACEME)
 	var ws syscall.WaitStatus
@@ -180,6 +183,9 @@ func (t *Tracer) traceLoop(ctx context.Context) error {
 
 		if ws.Exited() || ws.Signaled() {
 			// Process terminated
+			if pid == t.rootPid {
+				t.rootStatus = ws
+			}
 			delete(t.tracees, pid)
 			continue
 		}
@@ -297,6 +303,13 @@ func (t *Tracer) handleSyscall(tracee *Tracee) error {
 	return nil
 }
 
+// ExitStatus returns the wait status of the command started by TraceCmd.
+// It is only meaningful after TraceCmd has returned; since the tracer reaps
+// the process itself, cmd.ProcessState is never set.
+func (t *Tracer) ExitStatus() syscall.WaitStatus {
+	return t.rootStatus
+}
+
 // Stop stops the tracer
 func (t *Tracer) Stop() {
 	t.stopping = true